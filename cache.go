@@ -75,3 +75,10 @@ type CacheMarshaler interface {
 	MarshalCache() ([]byte, error)
 	UnmarshalCache([]byte) error
 }
+
+// CacheKeyLister is implemented by caches that can enumerate stored keys.
+type CacheKeyLister interface {
+	// Keys returns sorted keys of all values that are not expired and
+	// start with given prefix.
+	Keys(ctx context.Context, prefix string) ([]string, error)
+}
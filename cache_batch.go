@@ -0,0 +1,91 @@
+package surf
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-surf/surf/errors"
+)
+
+// BatchCacheService is implemented by caches that can process many keys in a
+// single operation, for example using a single network round trip.
+type BatchCacheService interface {
+	CacheService
+
+	// GetMulti loads values stored under given keys into destinations
+	// with the same index. Returned slice contains the result of each
+	// lookup, which is nil, ErrMiss or a deserialization error. Error is
+	// returned only if the whole operation failed.
+	GetMulti(ctx context.Context, keys []string, dests []interface{}) ([]error, error)
+
+	// SetMulti sets all given items, overwriting values of keys that are
+	// already in use.
+	SetMulti(ctx context.Context, items []CacheItem) error
+
+	// DelMulti deletes values under given keys. Keys that are not used
+	// are ignored.
+	DelMulti(ctx context.Context, keys []string) error
+}
+
+// CacheItem represents a single value with its key and expiration time.
+type CacheItem struct {
+	Key   string
+	Value interface{}
+	Exp   time.Duration
+}
+
+// AsBatchCache returns BatchCacheService for given cache. If cache does not
+// support batch operations natively, each batch is executed as a sequence of
+// single key operations.
+func AsBatchCache(cache CacheService) BatchCacheService {
+	if bc, ok := cache.(BatchCacheService); ok {
+		return bc
+	}
+	return &sequentialBatchCache{CacheService: cache}
+}
+
+type sequentialBatchCache struct {
+	CacheService
+}
+
+func (c *sequentialBatchCache) GetMulti(ctx context.Context, keys []string, dests []interface{}) ([]error, error) {
+	if err := validateBatch(keys, dests); err != nil {
+		return nil, err
+	}
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		switch err := c.Get(ctx, key, dests[i]); {
+		case err == nil, ErrMiss.Is(err), ErrCacheMalformed.Is(err):
+			errs[i] = err
+		default:
+			return nil, err
+		}
+	}
+	return errs, nil
+}
+
+func (c *sequentialBatchCache) SetMulti(ctx context.Context, items []CacheItem) error {
+	for _, it := range items {
+		if err := c.Set(ctx, it.Key, it.Value, it.Exp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *sequentialBatchCache) DelMulti(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		if err := c.Del(ctx, key); err != nil && !ErrMiss.Is(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateBatch returns an error if keys and destinations do not match.
+func validateBatch(keys []string, dests []interface{}) error {
+	if len(keys) != len(dests) {
+		return errors.Wrap(ErrValidation, "%d keys and %d destinations", len(keys), len(dests))
+	}
+	return nil
+}
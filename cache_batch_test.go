@@ -0,0 +1,58 @@
+package surf
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSequentialBatchCache(t *testing.T) {
+	RunBatchCacheImplementationTest(t, AsBatchCache(NewLocalMemCache()))
+}
+
+func TestPrefixBatchCache(t *testing.T) {
+	ctx := context.Background()
+	mem := NewLocalMemCache()
+	cache := AsBatchCache(PrefixCache(mem, "prefix:"))
+	RunBatchCacheImplementationTest(t, cache)
+
+	var val string
+	if err := mem.Get(ctx, "prefix:batch-2", &val); err == ErrMiss {
+		t.Fatal("batch operation does not use prefix")
+	}
+}
+
+func TestTraceBatchCache(t *testing.T) {
+	RunBatchCacheImplementationTest(t, AsBatchCache(TraceCache(NewLocalMemCache(), "test")))
+}
+
+func TestPrefixCache(t *testing.T) {
+	RunCacheConformanceTest(t, PrefixCache(NewLocalMemCache(), "prefix:"), &CacheCapabilities{Batch: true})
+}
+
+func TestTraceCache(t *testing.T) {
+	RunCacheConformanceTest(t, TraceCache(NewLocalMemCache(), "test"), &CacheCapabilities{Batch: true})
+}
+
+func TestStampedeBatchCache(t *testing.T) {
+	ctx := context.Background()
+	cache := AsBatchCache(StampedeProtect(NewLocalMemCache()))
+	RunBatchCacheImplementationTest(t, cache)
+
+	// value written by batch operation is readable by a single key
+	// lookup and the other way
+	if err := cache.SetMulti(ctx, []CacheItem{{Key: "a", Value: "A", Exp: time.Minute}}); err != nil {
+		t.Fatalf("cannot set multi: %s", err)
+	}
+	var val string
+	if err := cache.Get(ctx, "a", &val); err != nil || val != "A" {
+		t.Fatalf("want A, got %+v, %q", err, val)
+	}
+	if err := cache.Set(ctx, "b", "B", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	errs, err := cache.GetMulti(ctx, []string{"b"}, []interface{}{&val})
+	if err != nil || errs[0] != nil || val != "B" {
+		t.Fatalf("want B, got %+v, %+v, %q", err, errs, val)
+	}
+}
@@ -0,0 +1,291 @@
+package surf
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/go-surf/surf/errors"
+)
+
+// Codec serializes cache values. Use one of JSONCodec, GobCodec or
+// BinaryCodec, or provide your own implementation.
+type Codec interface {
+	Marshal(value interface{}) ([]byte, error)
+	Unmarshal(raw []byte, dest interface{}) error
+
+	// ID is stored in the value header to select the codec when reading.
+	// IDs lower than MinCustomCodecID are reserved for codecs provided by
+	// this package.
+	ID() byte
+}
+
+// MinCustomCodecID is the lowest ID that can be used by a Codec
+// implemented outside of this package.
+const MinCustomCodecID byte = 16
+
+var (
+	// JSONCodec serializes values using JSON. It is the format used by
+	// CacheMarshal.
+	JSONCodec Codec = jsonCodec{}
+
+	// GobCodec serializes values using gob. It preserves Go types, but
+	// each value carries its type description, which makes it bigger
+	// than BinaryCodec for small values.
+	GobCodec Codec = gobCodec{}
+
+	// BinaryCodec serializes values using a compact binary format.
+	BinaryCodec Codec = binaryCodec{}
+)
+
+// CodecCache returns cache wrapper that serializes values using configured
+// codec.
+//
+// Each value is prefixed with a header describing the codec and the
+// compression used, so that values written with a different configuration
+// can still be read. Codec can be changed without flushing the cache. Values
+// without a header, for example written before using CodecCache, are read
+// using CacheUnmarshal.
+//
+// Values implementing CacheMarshaler are always serialized using their own
+// implementation.
+//
+// This function panics if a codec uses an ID reserved for codecs provided
+// by this package, or if two codecs use the same ID.
+func CodecCache(cache CacheService, o *CodecCacheOpts) CacheService {
+	if o == nil {
+		o = &CodecCacheOpts{}
+	}
+	codec := o.Codec
+	if codec == nil {
+		codec = JSONCodec
+	}
+
+	codecs := make(map[byte]Codec)
+	for _, c := range []Codec{JSONCodec, GobCodec, BinaryCodec} {
+		codecs[c.ID()] = c
+	}
+	for _, c := range append([]Codec{codec}, o.Codecs...) {
+		registered, ok := codecs[c.ID()]
+		switch {
+		case c.ID() < MinCustomCodecID:
+			if registered != c {
+				panic(fmt.Sprintf("codec ID %d is reserved", c.ID()))
+			}
+		case ok:
+			if reflect.TypeOf(registered) != reflect.TypeOf(c) {
+				panic(fmt.Sprintf("codec ID %d is used by more than one codec", c.ID()))
+			}
+		default:
+			codecs[c.ID()] = c
+		}
+	}
+
+	return &codecCache{
+		cache:         cache,
+		codec:         codec,
+		codecs:        codecs,
+		compressAbove: o.CompressAbove,
+	}
+}
+
+type CodecCacheOpts struct {
+	// Codec used to serialize values. Defaults to JSONCodec.
+	Codec Codec
+
+	// Codecs are additional codecs used to read values written with
+	// them, for example when switching from one custom codec to another.
+	// Codecs provided by this package are always available.
+	Codecs []Codec
+
+	// CompressAbove is the size in bytes above which serialized values
+	// are compressed. Values are not compressed if zero. Compressed value
+	// is stored only if it is smaller.
+	CompressAbove int
+}
+
+type codecCache struct {
+	cache         CacheService
+	codec         Codec
+	codecs        map[byte]Codec
+	compressAbove int
+}
+
+// Header is the codecHeaderMagic, followed by a flags byte and the codec ID
+// byte. Magic starts with bytes that are never valid UTF-8, so it does not
+// collide with JSON or text values written without a header, and ends with
+// the format version. Values written without a header that start with the
+// magic cannot be read.
+const (
+	codecHeaderMagic = "\xff\xfeSC\x01"
+	codecHeaderSize  = len(codecHeaderMagic) + 2
+
+	codecFlagCompressed byte = 0x01
+
+	// codecIDMarshaler is used for values implementing CacheMarshaler.
+	codecIDMarshaler byte = 0
+)
+
+func (c *codecCache) encode(value interface{}) (*rawCacheValue, error) {
+	var (
+		id      byte
+		payload []byte
+		err     error
+	)
+	if m, ok := value.(CacheMarshaler); ok {
+		id = codecIDMarshaler
+		payload, err = m.MarshalCache()
+	} else {
+		id = c.codec.ID()
+		payload, err = c.codec.Marshal(value)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var flags byte
+	if c.compressAbove > 0 && len(payload) > c.compressAbove {
+		if compressed, ok := compressPayload(payload); ok {
+			flags |= codecFlagCompressed
+			payload = compressed
+		}
+	}
+
+	raw := make(rawCacheValue, 0, len(payload)+codecHeaderSize)
+	raw = append(raw, codecHeaderMagic...)
+	raw = append(raw, flags, id)
+	raw = append(raw, payload...)
+	return &raw, nil
+}
+
+func (c *codecCache) decode(raw []byte, dest interface{}) error {
+	if len(raw) < codecHeaderSize || !bytes.HasPrefix(raw, []byte(codecHeaderMagic)) {
+		return CacheUnmarshal(raw, dest)
+	}
+
+	flags, id := raw[len(codecHeaderMagic)], raw[len(codecHeaderMagic)+1]
+	payload := raw[codecHeaderSize:]
+	if flags&codecFlagCompressed != 0 {
+		var err error
+		if payload, err = decompressPayload(payload); err != nil {
+			return errors.Wrap(ErrCacheMalformed, "%s", err)
+		}
+	}
+
+	if id == codecIDMarshaler {
+		return CacheUnmarshal(payload, dest)
+	}
+	codec, ok := c.codecs[id]
+	if !ok {
+		return errors.Wrap(ErrCacheMalformed, "unknown codec %d", id)
+	}
+	return codec.Unmarshal(payload, dest)
+}
+
+func (c *codecCache) Get(ctx context.Context, key string, dest interface{}) error {
+	var raw rawCacheValue
+	if err := c.cache.Get(ctx, key, &raw); err != nil {
+		return err
+	}
+	return c.decode(raw, dest)
+}
+
+func (c *codecCache) Set(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	raw, err := c.encode(value)
+	if err != nil {
+		return err
+	}
+	return c.cache.Set(ctx, key, raw, exp)
+}
+
+func (c *codecCache) SetNx(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	raw, err := c.encode(value)
+	if err != nil {
+		return err
+	}
+	return c.cache.SetNx(ctx, key, raw, exp)
+}
+
+func (c *codecCache) Del(ctx context.Context, key string) error {
+	return c.cache.Del(ctx, key)
+}
+
+func (c *codecCache) GetMulti(ctx context.Context, keys []string, dests []interface{}) ([]error, error) {
+	if err := validateBatch(keys, dests); err != nil {
+		return nil, err
+	}
+	raws := make([]rawCacheValue, len(keys))
+	rawDests := make([]interface{}, len(keys))
+	for i := range raws {
+		rawDests[i] = &raws[i]
+	}
+	errs, err := AsBatchCache(c.cache).GetMulti(ctx, keys, rawDests)
+	if err != nil {
+		return nil, err
+	}
+	for i, raw := range raws {
+		if errs[i] == nil {
+			errs[i] = c.decode(raw, dests[i])
+		}
+	}
+	return errs, nil
+}
+
+func (c *codecCache) SetMulti(ctx context.Context, items []CacheItem) error {
+	encoded := make([]CacheItem, len(items))
+	for i, it := range items {
+		raw, err := c.encode(it.Value)
+		if err != nil {
+			return err
+		}
+		it.Value = raw
+		encoded[i] = it
+	}
+	return AsBatchCache(c.cache).SetMulti(ctx, encoded)
+}
+
+func (c *codecCache) DelMulti(ctx context.Context, keys []string) error {
+	return AsBatchCache(c.cache).DelMulti(ctx, keys)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ID() byte { return 1 }
+
+func (jsonCodec) Marshal(value interface{}) ([]byte, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, errors.WrapErr(ErrCacheMalformed, err)
+	}
+	return raw, nil
+}
+
+func (jsonCodec) Unmarshal(raw []byte, dest interface{}) error {
+	if err := json.Unmarshal(raw, dest); err != nil {
+		return errors.WrapErr(ErrCacheMalformed, err)
+	}
+	return nil
+}
+
+type gobCodec struct{}
+
+func (gobCodec) ID() byte { return 2 }
+
+func (gobCodec) Marshal(value interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(value); err != nil {
+		return nil, errors.WrapErr(ErrCacheMalformed, err)
+	}
+	return b.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(raw []byte, dest interface{}) error {
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(dest); err != nil {
+		return errors.WrapErr(ErrCacheMalformed, err)
+	}
+	return nil
+}
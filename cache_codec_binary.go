@@ -0,0 +1,518 @@
+package surf
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/go-surf/surf/errors"
+)
+
+// binaryCodec serializes values using a compact, self describing binary
+// format, similar to msgpack. Each value starts with a type tag:
+//
+//	nil, false, true            tag only
+//	int                         zigzag varint
+//	uint                        uvarint
+//	float                       8 bytes, IEEE 754 big endian
+//	string, bytes, time         uvarint length and data
+//	array                       uvarint length and elements
+//	map                         uvarint length and key, value pairs
+//
+// Structs are serialized as maps of exported field names. Pointers are
+// serialized as the value they point to. Time is serialized using its binary
+// marshaler, which preserves nanoseconds and zone offset.
+//
+// When deserializing into an empty interface, integers are int64 or uint64,
+// floats are float64, arrays are []interface{} and maps are
+// map[string]interface{} if all keys are strings, otherwise
+// map[interface{}]interface{}.
+type binaryCodec struct{}
+
+func (binaryCodec) ID() byte { return 3 }
+
+const (
+	binNil byte = iota
+	binFalse
+	binTrue
+	binInt
+	binUint
+	binFloat
+	binString
+	binBytes
+	binTime
+	binArray
+	binMap
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (binaryCodec) Marshal(value interface{}) ([]byte, error) {
+	return appendBinary(nil, reflect.ValueOf(value))
+}
+
+func appendBinary(b []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return append(b, binNil), nil
+	}
+	if v.Type() == timeType {
+		raw, err := v.Interface().(time.Time).MarshalBinary()
+		if err != nil {
+			return nil, errors.Wrap(ErrCacheMalformed, "cannot marshal time: %s", err)
+		}
+		b = append(b, binTime)
+		b = binary.AppendUvarint(b, uint64(len(raw)))
+		return append(b, raw...), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return append(b, binNil), nil
+		}
+		return appendBinary(b, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, binTrue), nil
+		}
+		return append(b, binFalse), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		b = append(b, binInt)
+		return binary.AppendVarint(b, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		b = append(b, binUint)
+		return binary.AppendUvarint(b, v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		b = append(b, binFloat)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(v.Float())), nil
+	case reflect.String:
+		b = append(b, binString)
+		b = binary.AppendUvarint(b, uint64(v.Len()))
+		return append(b, v.String()...), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return append(b, binNil), nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b = append(b, binBytes)
+			b = binary.AppendUvarint(b, uint64(v.Len()))
+			return append(b, v.Bytes()...), nil
+		}
+		return appendBinaryArray(b, v)
+	case reflect.Array:
+		return appendBinaryArray(b, v)
+	case reflect.Map:
+		if v.IsNil() {
+			return append(b, binNil), nil
+		}
+		b = append(b, binMap)
+		b = binary.AppendUvarint(b, uint64(v.Len()))
+		var err error
+		for it := v.MapRange(); it.Next(); {
+			if b, err = appendBinary(b, it.Key()); err != nil {
+				return nil, err
+			}
+			if b, err = appendBinary(b, it.Value()); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Struct:
+		fields := binaryStructFields(v.Type())
+		b = append(b, binMap)
+		b = binary.AppendUvarint(b, uint64(len(fields)))
+		var err error
+		for _, f := range fields {
+			b = append(b, binString)
+			b = binary.AppendUvarint(b, uint64(len(f.Name)))
+			b = append(b, f.Name...)
+			if b, err = appendBinary(b, v.FieldByIndex(f.Index)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	default:
+		return nil, errors.Wrap(ErrCacheMalformed, "unsupported type %s", v.Type())
+	}
+}
+
+func appendBinaryArray(b []byte, v reflect.Value) ([]byte, error) {
+	b = append(b, binArray)
+	b = binary.AppendUvarint(b, uint64(v.Len()))
+	var err error
+	for i := 0; i < v.Len(); i++ {
+		if b, err = appendBinary(b, v.Index(i)); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// binaryStructFields returns exported fields of given struct type.
+func binaryStructFields(t reflect.Type) []reflect.StructField {
+	fields := make([]reflect.StructField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.PkgPath == "" {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+func (binaryCodec) Unmarshal(raw []byte, dest interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return errors.Wrap(ErrCacheMalformed, "destination must be a non nil pointer")
+	}
+	d := binaryDecoder{raw: raw}
+	if err := d.decode(v.Elem()); err != nil {
+		return err
+	}
+	if len(d.raw) != 0 {
+		return errors.Wrap(ErrCacheMalformed, "%d trailing bytes", len(d.raw))
+	}
+	return nil
+}
+
+type binaryDecoder struct {
+	raw []byte
+}
+
+func (d *binaryDecoder) malformed(format string, args ...interface{}) error {
+	return errors.Wrap(ErrCacheMalformed, format, args...)
+}
+
+func (d *binaryDecoder) readByte() (byte, error) {
+	if len(d.raw) == 0 {
+		return 0, d.malformed("unexpected end of data")
+	}
+	c := d.raw[0]
+	d.raw = d.raw[1:]
+	return c, nil
+}
+
+func (d *binaryDecoder) uvarint() (uint64, error) {
+	n, size := binary.Uvarint(d.raw)
+	if size <= 0 {
+		return 0, d.malformed("invalid uvarint")
+	}
+	d.raw = d.raw[size:]
+	return n, nil
+}
+
+func (d *binaryDecoder) varint() (int64, error) {
+	n, size := binary.Varint(d.raw)
+	if size <= 0 {
+		return 0, d.malformed("invalid varint")
+	}
+	d.raw = d.raw[size:]
+	return n, nil
+}
+
+func (d *binaryDecoder) bytes() ([]byte, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(d.raw)) {
+		return nil, d.malformed("unexpected end of data")
+	}
+	b := d.raw[:n]
+	d.raw = d.raw[n:]
+	return b, nil
+}
+
+// length returns the number of elements of an array or a map. Each element
+// takes at least one byte, which limits allocation for malformed data.
+func (d *binaryDecoder) length() (int, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(d.raw)) {
+		return 0, d.malformed("invalid length %d", n)
+	}
+	return int(n), nil
+}
+
+// decode reads a single value into given destination.
+func (d *binaryDecoder) decode(v reflect.Value) error {
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		value, err := d.decodeAny()
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(value))
+		}
+		return nil
+	}
+
+	if len(d.raw) == 0 {
+		return d.malformed("unexpected end of data")
+	}
+	if d.raw[0] == binNil {
+		d.raw = d.raw[1:]
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(v.Elem())
+	}
+
+	tag, err := d.readByte()
+	if err != nil {
+		return err
+	}
+
+	switch tag {
+	case binFalse, binTrue:
+		if v.Kind() != reflect.Bool {
+			return d.malformed("cannot decode bool into %s", v.Type())
+		}
+		v.SetBool(tag == binTrue)
+	case binInt, binUint:
+		var (
+			n   int64
+			u   uint64
+			neg bool
+		)
+		if tag == binInt {
+			if n, err = d.varint(); err != nil {
+				return err
+			}
+			u, neg = uint64(n), n < 0
+		} else {
+			if u, err = d.uvarint(); err != nil {
+				return err
+			}
+			n = int64(u)
+		}
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if (tag == binUint && u > math.MaxInt64) || v.OverflowInt(n) {
+				return d.malformed("%d overflows %s", n, v.Type())
+			}
+			v.SetInt(n)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if neg || v.OverflowUint(u) {
+				return d.malformed("%d overflows %s", n, v.Type())
+			}
+			v.SetUint(u)
+		case reflect.Float32, reflect.Float64:
+			if tag == binInt {
+				v.SetFloat(float64(n))
+			} else {
+				v.SetFloat(float64(u))
+			}
+		default:
+			return d.malformed("cannot decode integer into %s", v.Type())
+		}
+	case binFloat:
+		if len(d.raw) < 8 {
+			return d.malformed("unexpected end of data")
+		}
+		f := math.Float64frombits(binary.BigEndian.Uint64(d.raw))
+		d.raw = d.raw[8:]
+		if v.Kind() != reflect.Float32 && v.Kind() != reflect.Float64 {
+			return d.malformed("cannot decode float into %s", v.Type())
+		}
+		v.SetFloat(f)
+	case binString:
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		if v.Kind() != reflect.String {
+			return d.malformed("cannot decode string into %s", v.Type())
+		}
+		v.SetString(string(b))
+	case binBytes:
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		if v.Kind() != reflect.Slice || v.Type().Elem().Kind() != reflect.Uint8 {
+			return d.malformed("cannot decode bytes into %s", v.Type())
+		}
+		v.SetBytes(append([]byte(nil), b...))
+	case binTime:
+		b, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		if v.Type() != timeType {
+			return d.malformed("cannot decode time into %s", v.Type())
+		}
+		var t time.Time
+		if err := t.UnmarshalBinary(b); err != nil {
+			return d.malformed("invalid time: %s", err)
+		}
+		v.Set(reflect.ValueOf(t))
+	case binArray:
+		return d.decodeArray(v)
+	case binMap:
+		return d.decodeMap(v)
+	default:
+		return d.malformed("unknown tag %d", tag)
+	}
+	return nil
+}
+
+func (d *binaryDecoder) decodeArray(v reflect.Value) error {
+	n, err := d.length()
+	if err != nil {
+		return err
+	}
+	switch v.Kind() {
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+	case reflect.Array:
+		if v.Len() != n {
+			return d.malformed("cannot decode %d elements into %s", n, v.Type())
+		}
+	default:
+		return d.malformed("cannot decode array into %s", v.Type())
+	}
+	for i := 0; i < n; i++ {
+		if err := d.decode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *binaryDecoder) decodeMap(v reflect.Value) error {
+	n, err := d.length()
+	if err != nil {
+		return err
+	}
+	switch v.Kind() {
+	case reflect.Map:
+		m := reflect.MakeMapWithSize(v.Type(), n)
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := d.decode(key); err != nil {
+				return err
+			}
+			if key.Kind() == reflect.Interface && !key.IsNil() && !key.Elem().Type().Comparable() {
+				return d.malformed("invalid map key type %s", key.Elem().Type())
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(value); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, value)
+		}
+		v.Set(m)
+	case reflect.Struct:
+		for i := 0; i < n; i++ {
+			var name string
+			if err := d.decode(reflect.ValueOf(&name).Elem()); err != nil {
+				return err
+			}
+			f, ok := v.Type().FieldByName(name)
+			if !ok || f.PkgPath != "" {
+				// unknown field
+				if _, err := d.decodeAny(); err != nil {
+					return err
+				}
+				continue
+			}
+			field, err := d.promotedField(v, f.Index)
+			if err != nil {
+				return err
+			}
+			if err := d.decode(field); err != nil {
+				return err
+			}
+		}
+	default:
+		return d.malformed("cannot decode map into %s", v.Type())
+	}
+	return nil
+}
+
+// promotedField returns field of given struct value, allocating nil
+// embedded pointers on the way to a promoted field.
+func (d *binaryDecoder) promotedField(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, d.malformed("cannot set embedded pointer %s", v.Type())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
+
+// decodeAny reads a single value into a generic representation.
+func (d *binaryDecoder) decodeAny() (interface{}, error) {
+	if len(d.raw) == 0 {
+		return nil, d.malformed("unexpected end of data")
+	}
+	switch d.raw[0] {
+	case binNil:
+		d.raw = d.raw[1:]
+		return nil, nil
+	case binFalse, binTrue:
+		var b bool
+		err := d.decode(reflect.ValueOf(&b).Elem())
+		return b, err
+	case binInt:
+		var n int64
+		err := d.decode(reflect.ValueOf(&n).Elem())
+		return n, err
+	case binUint:
+		var n uint64
+		err := d.decode(reflect.ValueOf(&n).Elem())
+		return n, err
+	case binFloat:
+		var f float64
+		err := d.decode(reflect.ValueOf(&f).Elem())
+		return f, err
+	case binString:
+		var s string
+		err := d.decode(reflect.ValueOf(&s).Elem())
+		return s, err
+	case binBytes:
+		var b []byte
+		err := d.decode(reflect.ValueOf(&b).Elem())
+		return b, err
+	case binTime:
+		var t time.Time
+		err := d.decode(reflect.ValueOf(&t).Elem())
+		return t, err
+	case binArray:
+		var a []interface{}
+		err := d.decode(reflect.ValueOf(&a).Elem())
+		return a, err
+	case binMap:
+		var m map[interface{}]interface{}
+		if err := d.decode(reflect.ValueOf(&m).Elem()); err != nil {
+			return nil, err
+		}
+		sm := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			s, ok := k.(string)
+			if !ok {
+				return m, nil
+			}
+			sm[s] = v
+		}
+		return sm, nil
+	default:
+		return nil, d.malformed("unknown tag %d", d.raw[0])
+	}
+}
@@ -0,0 +1,262 @@
+package surf
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCodecCache(t *testing.T) {
+	for name, codec := range map[string]Codec{
+		"json":   JSONCodec,
+		"gob":    GobCodec,
+		"binary": BinaryCodec,
+	} {
+		t.Run(name, func(t *testing.T) {
+			RunCacheImplementationTest(t, CodecCache(NewLocalMemCache(), &CodecCacheOpts{Codec: codec}))
+		})
+		t.Run(name+" compressed", func(t *testing.T) {
+			RunCacheImplementationTest(t, CodecCache(NewLocalMemCache(), &CodecCacheOpts{
+				Codec:         codec,
+				CompressAbove: 1,
+			}))
+		})
+		t.Run(name+" batch", func(t *testing.T) {
+			cache := CodecCache(NewLocalMemCache(), &CodecCacheOpts{Codec: codec})
+			RunBatchCacheImplementationTest(t, cache.(BatchCacheService))
+		})
+	}
+}
+
+func TestCodecCacheChangingCodec(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalMemCache()
+
+	// value written before using codecs
+	if err := storage.Set(ctx, "legacy", "plain json", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	if err := CodecCache(storage, &CodecCacheOpts{Codec: GobCodec}).Set(ctx, "gob", "gob value", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	long := strings.Repeat("compressible ", 100)
+	if err := CodecCache(storage, &CodecCacheOpts{CompressAbove: 100}).Set(ctx, "compressed", long, time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+
+	cache := CodecCache(storage, &CodecCacheOpts{Codec: BinaryCodec})
+	for key, want := range map[string]string{
+		"legacy":     "plain json",
+		"gob":        "gob value",
+		"compressed": long,
+	} {
+		var got string
+		if err := cache.Get(ctx, key, &got); err != nil {
+			t.Fatalf("%s: cannot get: %s", key, err)
+		}
+		if got != want {
+			t.Fatalf("%s: want %q, got %q", key, want, got)
+		}
+	}
+
+	var raw rawCacheValue
+	if err := storage.Get(ctx, "compressed", &raw); err != nil {
+		t.Fatalf("cannot get raw value: %s", err)
+	}
+	if len(raw) >= len(long) {
+		t.Fatalf("value is not compressed: %d bytes", len(raw))
+	}
+}
+
+func TestBinaryCodec(t *testing.T) {
+	type inner struct {
+		Name string
+		Tags []string
+	}
+	type item struct {
+		ID        int64
+		Count     uint16
+		Ratio     float64
+		Active    bool
+		Created   time.Time
+		Raw       []byte
+		Inner     inner
+		InnerPtr  *inner
+		NilPtr    *inner
+		Scores    map[string]int
+		Any       interface{}
+		Fixed     [2]int8
+		unexposed string
+	}
+
+	in := item{
+		ID:       1<<62 + 1,
+		Count:    65535,
+		Ratio:    -0.125,
+		Active:   true,
+		Created:  time.Date(2018, 3, 4, 5, 6, 7, 123456789, time.FixedZone("X", 3600)),
+		Raw:      []byte{0, 1, 2},
+		Inner:    inner{Name: "a", Tags: []string{"x", "y"}},
+		InnerPtr: &inner{Name: "b"},
+		Scores:   map[string]int{"a": 1, "b": -2},
+		Any:      map[string]interface{}{"n": int64(1 << 60), "list": []interface{}{"s", true, nil}},
+		Fixed:    [2]int8{-128, 127},
+	}
+
+	raw, err := BinaryCodec.Marshal(&in)
+	if err != nil {
+		t.Fatalf("cannot marshal: %s", err)
+	}
+	var out item
+	if err := BinaryCodec.Unmarshal(raw, &out); err != nil {
+		t.Fatalf("cannot unmarshal: %s", err)
+	}
+	if !out.Created.Equal(in.Created) {
+		t.Fatalf("want %s, got %s", in.Created, out.Created)
+	}
+	out.Created = in.Created
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("want %+v, got %+v", in, out)
+	}
+
+	var small int8
+	if err := BinaryCodec.Unmarshal(raw, &small); !ErrCacheMalformed.Is(err) {
+		t.Fatalf("want ErrCacheMalformed, got %+v", err)
+	}
+	big, _ := BinaryCodec.Marshal(1000)
+	if err := BinaryCodec.Unmarshal(big, &small); !ErrCacheMalformed.Is(err) {
+		t.Fatalf("want overflow error, got %+v", err)
+	}
+	for i := 0; i < len(raw); i++ {
+		if err := BinaryCodec.Unmarshal(raw[:i], &out); !ErrCacheMalformed.Is(err) {
+			t.Fatalf("%d bytes: want ErrCacheMalformed, got %+v", i, err)
+		}
+	}
+}
+
+func TestBinaryCodecPromotedFieldThroughNilPointer(t *testing.T) {
+	type Inner struct{ X int }
+	type inner struct{ X int }
+
+	raw, err := BinaryCodec.Marshal(struct{ X int }{X: 42})
+	if err != nil {
+		t.Fatalf("cannot marshal: %s", err)
+	}
+
+	// Embedded pointer is allocated to set the promoted field.
+	var exported struct{ *Inner }
+	if err := BinaryCodec.Unmarshal(raw, &exported); err != nil {
+		t.Fatalf("cannot unmarshal: %s", err)
+	}
+	if exported.Inner == nil || exported.X != 42 {
+		t.Fatalf("want 42, got %+v", exported.Inner)
+	}
+
+	// Pointer to an unexported type cannot be allocated.
+	var unexported struct{ *inner }
+	if err := BinaryCodec.Unmarshal(raw, &unexported); !ErrCacheMalformed.Is(err) {
+		t.Fatalf("want ErrCacheMalformed, got %+v", err)
+	}
+}
+
+func TestBinaryCodecIsCompact(t *testing.T) {
+	value := map[string]interface{}{"id": 123456, "name": "surf", "ok": true}
+	bin, err := BinaryCodec.Marshal(value)
+	if err != nil {
+		t.Fatalf("cannot marshal: %s", err)
+	}
+	js, err := JSONCodec.Marshal(value)
+	if err != nil {
+		t.Fatalf("cannot marshal: %s", err)
+	}
+	if len(bin) >= len(js) {
+		t.Fatalf("binary %d bytes, json %d bytes", len(bin), len(js))
+	}
+}
+
+// upperCodec is a codec implemented outside of the package.
+type upperCodec struct{}
+
+func (upperCodec) ID() byte { return MinCustomCodecID }
+
+func (upperCodec) Marshal(value interface{}) ([]byte, error) {
+	s, ok := value.(string)
+	if !ok {
+		return nil, ErrCacheMalformed
+	}
+	return []byte(strings.ToUpper(s)), nil
+}
+
+func (upperCodec) Unmarshal(raw []byte, dest interface{}) error {
+	s, ok := dest.(*string)
+	if !ok {
+		return ErrCacheMalformed
+	}
+	*s = string(raw)
+	return nil
+}
+
+func TestCodecCacheCustomCodec(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalMemCache()
+
+	if err := CodecCache(storage, &CodecCacheOpts{Codec: upperCodec{}}).Set(ctx, "key", "value", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+
+	var got string
+	cache := CodecCache(storage, &CodecCacheOpts{Codecs: []Codec{upperCodec{}}})
+	if err := cache.Get(ctx, "key", &got); err != nil || got != "VALUE" {
+		t.Fatalf("want VALUE, got %q, %+v", got, err)
+	}
+	if err := CodecCache(storage, nil).Get(ctx, "key", &got); !ErrCacheMalformed.Is(err) {
+		t.Fatalf("want ErrCacheMalformed for unknown codec, got %+v", err)
+	}
+}
+
+func TestCodecCacheReservedCodecID(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("want panic")
+		}
+	}()
+	CodecCache(NewLocalMemCache(), &CodecCacheOpts{Codec: reservedCodec{}})
+}
+
+type reservedCodec struct{ upperCodec }
+
+func (reservedCodec) ID() byte { return 1 }
+
+// legacyMarshaler serializes to bytes that a single byte codec header
+// could be confused with.
+type legacyMarshaler struct{ raw []byte }
+
+func (m legacyMarshaler) MarshalCache() ([]byte, error) { return m.raw, nil }
+
+func (m *legacyMarshaler) UnmarshalCache(raw []byte) error {
+	m.raw = append([]byte(nil), raw...)
+	return nil
+}
+
+func TestCodecCacheLegacyMarshalerPayload(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalMemCache()
+	cache := CodecCache(storage, nil)
+
+	for _, first := range []byte{0xf8, 0xf9, 0xfc, 0xfe, 0xff} {
+		want := []byte{first, 'x', 'y'}
+		// written before using CodecCache
+		if err := storage.Set(ctx, "legacy", &legacyMarshaler{raw: want}, time.Minute); err != nil {
+			t.Fatalf("cannot set: %s", err)
+		}
+		var got legacyMarshaler
+		if err := cache.Get(ctx, "legacy", &got); err != nil {
+			t.Fatalf("%#x: cannot get: %s", first, err)
+		}
+		if string(got.raw) != string(want) {
+			t.Fatalf("%#x: want %q, got %q", first, want, got.raw)
+		}
+	}
+}
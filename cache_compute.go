@@ -0,0 +1,259 @@
+package surf
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-surf/surf/errors"
+)
+
+// NewComputeCache returns cache wrapper that provides GetOrCompute method.
+func NewComputeCache(cache CacheService, o *ComputeCacheOpts) *ComputeCache {
+	if o == nil {
+		o = &ComputeCacheOpts{}
+	}
+	lockTTL := o.LockTTL
+	if lockTTL <= 0 {
+		lockTTL = 5 * time.Second
+	}
+	locker := o.Locker
+	if locker == nil {
+		if cc, ok := cache.(CounterCache); ok {
+			locker = NewCacheLocker(cc)
+		}
+	}
+	return &ComputeCache{
+		CacheService: cache,
+		locker:       locker,
+		lockTTL:      lockTTL,
+		errorTTL:     o.ErrorTTL,
+		calls:        make(map[string]*computeCall),
+	}
+}
+
+type ComputeCacheOpts struct {
+	// LockTTL is how long a process can compute a value before other
+	// processes are allowed to compute it as well. Defaults to 5 seconds.
+	LockTTL time.Duration
+
+	// ErrorTTL is how long an error returned by the compute function is
+	// cached. Until it expires, GetOrCompute returns ErrComputeFailed
+	// instead of computing the value again. Errors are not cached if
+	// zero.
+	ErrorTTL time.Duration
+
+	// Locker guards computation between processes. Defaults to
+	// NewCacheLocker using the wrapped cache if it is a CounterCache.
+	// Otherwise the lock is set using SetNx and released only if it
+	// still contains the token of its owner, which is not atomic.
+	Locker Locker
+}
+
+// ComputeCache is a CacheService that can compute missing values.
+type ComputeCache struct {
+	CacheService
+
+	locker   Locker
+	lockTTL  time.Duration
+	errorTTL time.Duration
+
+	mu    sync.Mutex
+	calls map[string]*computeCall
+}
+
+// computeCall is an in progress computation of a single key value.
+type computeCall struct {
+	done chan struct{}
+	raw  []byte
+	err  error
+}
+
+// ErrComputeFailed is returned by GetOrCompute if compute function has
+// recently failed and its error is cached.
+var ErrComputeFailed = errors.Wrap(ErrInternal, "cache compute failed")
+
+// GetOrCompute loads value stored under given key into dest. If key is not
+// in use, value is computed using given function and stored for ttl.
+//
+// Concurrent calls for the same key within a process share a single
+// computation. Between processes, computation is guarded by a lock stored in
+// the cache, and processes that did not acquire it wait for the value
+// computed by the lock owner. Waiting is interrupted when the context is
+// done, which does not stop the computation shared with other calls. Calls
+// sharing a computation also share its error. A panic of compute function
+// is returned as ErrInternal.
+func (c *ComputeCache) GetOrCompute(
+	ctx context.Context,
+	key string,
+	dest interface{},
+	ttl time.Duration,
+	compute func() (interface{}, error),
+) error {
+	var raw rawCacheValue
+	switch err := c.CacheService.Get(ctx, key, &raw); {
+	case err == nil:
+		return CacheUnmarshal(raw, dest)
+	case ErrMiss.Is(err):
+		// compute
+	default:
+		return err
+	}
+
+	c.mu.Lock()
+	call, ok := c.calls[key]
+	if !ok {
+		call = &computeCall{done: make(chan struct{})}
+		c.calls[key] = call
+		// Computation is shared, so it must not be cancelled together
+		// with the context of the call that started it.
+		go c.run(context.WithoutCancel(ctx), key, call, ttl, compute)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if call.err != nil {
+		return call.err
+	}
+	return CacheUnmarshal(call.raw, dest)
+}
+
+// run loads value of given call and notifies all waiting calls once done.
+func (c *ComputeCache) run(
+	ctx context.Context,
+	key string,
+	call *computeCall,
+	ttl time.Duration,
+	compute func() (interface{}, error),
+) {
+	defer func() {
+		if r := recover(); r != nil {
+			call.raw = nil
+			call.err = errors.Wrap(ErrInternal, "compute panic: %v", r)
+		}
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	call.raw, call.err = c.load(ctx, key, ttl, compute)
+}
+
+// load returns serialized value, computing it if no other process is
+// computing it already.
+func (c *ComputeCache) load(
+	ctx context.Context,
+	key string,
+	ttl time.Duration,
+	compute func() (interface{}, error),
+) ([]byte, error) {
+	lockKey := key + ":computelock"
+	errKey := key + ":computeerror"
+
+	backoff := 5 * time.Millisecond
+	for {
+		if c.errorTTL > 0 {
+			var msg string
+			switch err := c.CacheService.Get(ctx, errKey, &msg); {
+			case err == nil:
+				return nil, errors.Wrap(ErrComputeFailed, "%s", msg)
+			case ErrMiss.Is(err):
+				// no recent failure
+			default:
+				return nil, err
+			}
+		}
+
+		switch release, err := c.lock(ctx, lockKey); {
+		case err == nil:
+			defer release()
+			return c.compute(ctx, key, errKey, ttl, compute)
+		case ErrConflict.Is(err):
+			// another process is computing the value
+		default:
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff < 250*time.Millisecond {
+			backoff *= 2
+		}
+
+		var raw rawCacheValue
+		switch err := c.CacheService.Get(ctx, key, &raw); {
+		case err == nil:
+			return raw, nil
+		case ErrMiss.Is(err):
+			// still computing
+		default:
+			return nil, err
+		}
+	}
+}
+
+func (c *ComputeCache) compute(
+	ctx context.Context,
+	key, errKey string,
+	ttl time.Duration,
+	compute func() (interface{}, error),
+) ([]byte, error) {
+	value, err := compute()
+	if err != nil {
+		if c.errorTTL > 0 {
+			if serr := c.CacheService.Set(ctx, errKey, err.Error(), c.errorTTL); serr != nil {
+				LogError(ctx, serr, "cannot cache compute error",
+					"key", key)
+			}
+		}
+		return nil, err
+	}
+	raw, err := CacheMarshal(value)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.CacheService.Set(ctx, key, (*rawCacheValue)(&raw), ttl); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// lock acquires lock of given name. Returned function releases the lock if
+// it is still owned by the caller.
+func (c *ComputeCache) lock(ctx context.Context, name string) (func(), error) {
+	if c.locker != nil {
+		lock, err := c.locker.Acquire(ctx, name, c.lockTTL)
+		if err != nil {
+			return nil, err
+		}
+		return func() {
+			if err := c.locker.Release(ctx, lock); err != nil && !ErrLockLost.Is(err) {
+				LogError(ctx, err, "cannot release compute lock",
+					"lock", name)
+			}
+		}, nil
+	}
+
+	token := generateID()
+	if err := c.CacheService.SetNx(ctx, name, token, c.lockTTL); err != nil {
+		return nil, err
+	}
+	return func() {
+		var owner string
+		if err := c.CacheService.Get(ctx, name, &owner); err != nil || owner != token {
+			// Lock expired and might be held by another process.
+			return
+		}
+		if err := c.CacheService.Del(ctx, name); err != nil && !ErrMiss.Is(err) {
+			LogError(ctx, err, "cannot release compute lock",
+				"lock", name)
+		}
+	}, nil
+}
@@ -0,0 +1,222 @@
+package surf
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestComputeCacheSingleflight(t *testing.T) {
+	ctx := context.Background()
+	cache := NewComputeCache(NewLocalMemCache(), nil)
+
+	var computeCnt uint64
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+
+			var value string
+			err := cache.GetOrCompute(ctx, "key", &value, time.Minute, func() (interface{}, error) {
+				atomic.AddUint64(&computeCnt, 1)
+				time.Sleep(20 * time.Millisecond)
+				return "computed", nil
+			})
+			if err != nil {
+				t.Errorf("cannot get or compute: %s", err)
+			} else if value != "computed" {
+				t.Errorf("want computed, got %q", value)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if computeCnt != 1 {
+		t.Fatalf("want one computation, got %d", computeCnt)
+	}
+
+	var value string
+	if err := cache.Get(ctx, "key", &value); err != nil || value != "computed" {
+		t.Fatalf("want value stored, got %q, %+v", value, err)
+	}
+}
+
+func TestComputeCacheAcrossProcesses(t *testing.T) {
+	ctx := context.Background()
+
+	// Two instances sharing the same storage behave like two processes.
+	storage := NewLocalMemCache()
+	a := NewComputeCache(storage, nil)
+	b := NewComputeCache(storage, nil)
+
+	var computeCnt uint64
+	compute := func() (interface{}, error) {
+		atomic.AddUint64(&computeCnt, 1)
+		time.Sleep(50 * time.Millisecond)
+		return 42, nil
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range []*ComputeCache{a, b, a, b} {
+		wg.Add(1)
+		go func(c *ComputeCache) {
+			defer wg.Done()
+			var value int
+			if err := c.GetOrCompute(ctx, "shared", &value, time.Minute, compute); err != nil {
+				t.Errorf("cannot get or compute: %s", err)
+			} else if value != 42 {
+				t.Errorf("want 42, got %d", value)
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	if computeCnt != 1 {
+		t.Fatalf("want one computation, got %d", computeCnt)
+	}
+}
+
+func TestComputeCacheWaitingIsCancelled(t *testing.T) {
+	storage := NewLocalMemCache()
+	if _, err := NewCacheLocker(storage).Acquire(context.Background(), "key:computelock", time.Minute); err != nil {
+		t.Fatalf("cannot acquire lock: %s", err)
+	}
+	cache := NewComputeCache(storage, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+
+	var computeCnt uint64
+	var value string
+	err := cache.GetOrCompute(ctx, "key", &value, time.Minute, func() (interface{}, error) {
+		atomic.AddUint64(&computeCnt, 1)
+		return "computed", nil
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("want deadline exceeded, got %+v", err)
+	}
+	if n := atomic.LoadUint64(&computeCnt); n != 0 {
+		t.Fatalf("value must not be computed while locked, got %d computations", n)
+	}
+}
+
+func TestComputeCacheCancelledCallerDoesNotFailOthers(t *testing.T) {
+	cache := NewComputeCache(NewLocalMemCache(), nil)
+
+	started := make(chan struct{})
+	compute := func() (interface{}, error) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		return "computed", nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		var value string
+		leaderErr <- cache.GetOrCompute(ctx, "key", &value, time.Minute, compute)
+	}()
+	<-started
+
+	followerErr := make(chan error, 1)
+	var value string
+	go func() {
+		followerErr <- cache.GetOrCompute(context.Background(), "key", &value, time.Minute, compute)
+	}()
+	cancel()
+
+	if err := <-leaderErr; err != context.Canceled {
+		t.Fatalf("want cancelled, got %+v", err)
+	}
+	if err := <-followerErr; err != nil || value != "computed" {
+		t.Fatalf("want computed, got %q, %+v", value, err)
+	}
+}
+
+func TestComputeCachePanic(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalMemCache()
+	cache := NewComputeCache(storage, nil)
+
+	var value string
+	err := cache.GetOrCompute(ctx, "key", &value, time.Minute, func() (interface{}, error) {
+		panic("boom")
+	})
+	if !ErrInternal.Is(err) {
+		t.Fatalf("want ErrInternal, got %+v", err)
+	}
+
+	// Lock is released and computation is not shared anymore.
+	err = cache.GetOrCompute(ctx, "key", &value, time.Minute, func() (interface{}, error) {
+		return "computed", nil
+	})
+	if err != nil || value != "computed" {
+		t.Fatalf("want computed, got %q, %+v", value, err)
+	}
+}
+
+func TestComputeCacheLockReleasedByOwnerOnly(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalMemCache()
+	cache := NewComputeCache(storage, nil)
+	// Use the lock set with SetNx, as for caches that do not implement
+	// CounterCache.
+	cache.locker = nil
+
+	var value string
+	err := cache.GetOrCompute(ctx, "key", &value, time.Minute, func() (interface{}, error) {
+		// Lock expired and was acquired by another process.
+		if err := storage.Set(ctx, "key:computelock", "another-owner", time.Minute); err != nil {
+			t.Errorf("cannot set: %s", err)
+		}
+		return "computed", nil
+	})
+	if err != nil {
+		t.Fatalf("cannot get or compute: %s", err)
+	}
+	var owner string
+	if err := storage.Get(ctx, "key:computelock", &owner); err != nil || owner != "another-owner" {
+		t.Fatalf("lock of another owner must not be released, got %q, %+v", owner, err)
+	}
+}
+
+func TestComputeCacheNegativeCaching(t *testing.T) {
+	ctx := context.Background()
+	cache := NewComputeCache(NewLocalMemCache(), &ComputeCacheOpts{
+		ErrorTTL: time.Second,
+	})
+
+	failure := errors.New("backend down")
+	var computeCnt uint64
+	compute := func() (interface{}, error) {
+		atomic.AddUint64(&computeCnt, 1)
+		return nil, failure
+	}
+
+	var value string
+	if err := cache.GetOrCompute(ctx, "key", &value, time.Minute, compute); err != failure {
+		t.Fatalf("want compute error, got %+v", err)
+	}
+	if err := cache.GetOrCompute(ctx, "key", &value, time.Minute, compute); !ErrComputeFailed.Is(err) {
+		t.Fatalf("want ErrComputeFailed, got %+v", err)
+	}
+	if computeCnt != 1 {
+		t.Fatalf("want one computation, got %d", computeCnt)
+	}
+
+	time.Sleep(time.Second + 20*time.Millisecond)
+
+	if err := cache.GetOrCompute(ctx, "key", &value, time.Minute, compute); err != failure {
+		t.Fatalf("want compute error, got %+v", err)
+	}
+	if computeCnt != 2 {
+		t.Fatalf("want two computations, got %d", computeCnt)
+	}
+}
@@ -1,28 +1,135 @@
 package surf
 
 import (
+	"bytes"
+	"compress/flate"
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand"
+	"crypto/sha1"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-surf/surf/errors"
 )
 
-func NewCookieCache(prefix string, secret []byte) (UnboundCacheService, error) {
-	block, err := aes.NewCipher(adjustKeySize(secret))
+// NewCookieCache returns cache that is storing values in encrypted and
+// authenticated cookies. Values are encrypted with the first of given
+// secrets and can be read using any of them. To rotate secrets, put the new
+// secret first and keep old ones until all cookies encrypted with them
+// expire.
+//
+// Cookies written by older versions, that were using unauthenticated
+// encryption, are not read. Use NewCookieCacheWithOpts to read them during
+// migration.
+func NewCookieCache(prefix string, secrets ...[]byte) (UnboundCacheService, error) {
+	return NewCookieCacheWithOpts(prefix, &CookieCacheOpts{
+		Secrets: secrets,
+	})
+}
+
+// CookieCacheOpts defines options for the cookie cache.
+type CookieCacheOpts struct {
+	// Secrets used to encrypt and authenticate cookies. New cookies are
+	// always written using the first secret. All secrets can be used to
+	// read a cookie. At least one secret, not shorter than 16 bytes, is
+	// required.
+	Secrets [][]byte
+
+	// ReadLegacyUntil allows to read cookies written by older versions,
+	// that were using unauthenticated encryption, until given time.
+	// Such cookies can be tampered with, so it should be set to the end
+	// of migration, for example to the expiration time of the longest
+	// living legacy cookie. Legacy cookies that expire after that time
+	// are not read. Legacy cookies are not read if zero.
+	ReadLegacyUntil time.Time
+
+	// Compress enables compression of values before encryption. Values
+	// are compressed only if that makes them smaller.
+	Compress bool
+
+	// MaxCookieSize is the maximum size of a single cookie name and value.
+	// Bigger values are split into several cookies. Defaults to 4000
+	// bytes, which is accepted by all browsers.
+	MaxCookieSize int
+
+	// MaxSize is the maximum size of all cookies used to store a single
+	// value. Setting a bigger value fails with ErrCookieTooLarge.
+	// Defaults to 16KB.
+	MaxSize int
+
+	// Path of all cookies. Defaults to "/".
+	Path string
+
+	// Domain of all cookies. By default cookies are bound to the host
+	// that set them.
+	Domain string
+
+	// Secure marks all cookies as secure so that they are sent over HTTPS
+	// only.
+	Secure bool
+
+	// SameSite defines same site policy of all cookies. By default the
+	// attribute is not set.
+	SameSite http.SameSite
+
+	// ScriptAccess allows JavaScript to access cookies. By default all
+	// cookies are HttpOnly.
+	ScriptAccess bool
+}
+
+// ErrCookieTooLarge is returned when value does not fit into cookies size
+// budget.
+var ErrCookieTooLarge = errors.Wrap(ErrCacheMalformed, "cookie too large")
+
+// NewCookieCacheWithOpts returns cache that is storing values in encrypted
+// and authenticated cookies.
+func NewCookieCacheWithOpts(prefix string, o *CookieCacheOpts) (UnboundCacheService, error) {
+	if o == nil {
+		o = &CookieCacheOpts{}
+	}
+	env, err := newEnvelope(o.Secrets)
 	if err != nil {
-		return nil, errors.Wrap(ErrInternal, "cannot create cipher block: %s", err)
+		return nil, errors.Wrap(err, "cannot create envelope")
 	}
 	cc := unboundCookieCache{
-		prefix: prefix,
-		secret: block,
+		prefix:        prefix,
+		envelope:      env,
+		compress:      o.Compress,
+		maxCookieSize: o.MaxCookieSize,
+		maxSize:       o.MaxSize,
+		path:          o.Path,
+		domain:        o.Domain,
+		secure:        o.Secure,
+		sameSite:      o.SameSite,
+		httpOnly:      !o.ScriptAccess,
+	}
+	if cc.path == "" {
+		cc.path = "/"
+	}
+	if cc.maxCookieSize == 0 {
+		cc.maxCookieSize = 4000
+	}
+	if cc.maxSize == 0 {
+		cc.maxSize = 16 * 1024
+	}
+	if !o.ReadLegacyUntil.IsZero() {
+		cc.legacyUntil = o.ReadLegacyUntil
+		for _, secret := range o.Secrets {
+			block, err := aes.NewCipher(adjustKeySize(secret))
+			if err != nil {
+				return nil, errors.Wrap(ErrInternal, "cannot create cipher block: %s", err)
+			}
+			cc.legacy = append(cc.legacy, block)
+		}
 	}
 	return &cc, nil
 }
@@ -30,6 +137,8 @@ func NewCookieCache(prefix string, secret []byte) (UnboundCacheService, error) {
 // adjustKeySize trim given secret to biggest acceptable by AES implementation
 // key block. If given secret is too short to be used as AES key, it is
 // returned without modifications
+//
+// This is used only to read legacy cookies.
 func adjustKeySize(secret []byte) []byte {
 	size := len(secret)
 	if size > 32 {
@@ -45,32 +154,48 @@ func adjustKeySize(secret []byte) []byte {
 }
 
 type unboundCookieCache struct {
-	secret cipher.Block
-	prefix string
+	envelope      *envelope
+	legacy        []cipher.Block
+	legacyUntil   time.Time
+	prefix        string
+	compress      bool
+	maxCookieSize int
+	maxSize       int
+
+	path     string
+	domain   string
+	secure   bool
+	sameSite http.SameSite
+	httpOnly bool
 }
 
 func (c *unboundCookieCache) Bind(w http.ResponseWriter, r *http.Request) CacheService {
 	return &cookieCache{
-		prefix: c.prefix,
-		secret: c.secret,
-		w:      w,
-		r:      r,
-		staged: make(map[string]cookieCacheItem),
+		unboundCookieCache: c,
+		w:                  w,
+		r:                  r,
+		staged:             make(map[string]cookieCacheItem),
 	}
 }
 
 type cookieCache struct {
-	w      http.ResponseWriter
-	r      *http.Request
-	prefix string
-	secret cipher.Block
+	*unboundCookieCache
+
+	w http.ResponseWriter
+	r *http.Request
 
+	// mu serializes operations, so that SetNx is atomic and response
+	// headers are not written concurrently.
+	mu     sync.Mutex
 	staged map[string]cookieCacheItem
 }
 
+// cookieCacheItem represents a value that was modified during the current
+// request. Deleted item hides the value present in the request.
 type cookieCacheItem struct {
 	payload   []byte
 	validTill time.Time
+	deleted   bool
 }
 
 func (s *cookieCache) Get(ctx context.Context, key string, dest interface{}) error {
@@ -78,45 +203,48 @@ func (s *cookieCache) Get(ctx context.Context, key string, dest interface{}) err
 		"key", key,
 	).Finish()
 
+	s.mu.Lock()
+	rawPayload, err := s.lookup(key)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := CacheUnmarshal(rawPayload, dest); err != nil {
+		return errors.Wrap(err, "cannot unmarshal")
+	}
+	return nil
+}
+
+// lookup returns payload of a valid and not expired value stored under given
+// key. Staged changes take precedence over cookies sent with the request.
+func (s *cookieCache) lookup(key string) ([]byte, error) {
 	now := time.Now()
 
 	if item, ok := s.staged[key]; ok {
-		if item.validTill.Before(now) {
-			delete(s.staged, key)
-		} else {
-			if err := CacheUnmarshal(item.payload, dest); err != nil {
-				return errors.Wrap(err, "cannot unmarshal")
-			}
-			return nil
+		if item.deleted || !item.validTill.After(now) {
+			return nil, ErrMiss
 		}
+		return item.payload, nil
 	}
 
-	c, err := s.r.Cookie(s.prefix + key)
-	if err != nil {
-		return ErrMiss
+	value, ok := s.readCookie(s.cookieName(key))
+	if !ok {
+		return nil, ErrMiss
 	}
 
 	// if cookie cannot be(decoded or signature is invalid, ErrMiss
 	// is returned. User cannot deal with such issue, so no need to
 	// bother with the details
 
-	rawData, err := s.decrypt(c.Value)
+	rawPayload, exp, err := s.decrypt(s.cookieName(key), value)
 	if err != nil {
-		return errors.Wrap(ErrMiss, "cannot decrypt")
+		return nil, errors.Wrap(ErrMiss, "cannot decrypt")
 	}
-
-	rawPayload := rawData[:len(rawData)-4]
-	rawExp := rawData[len(rawData)-4:]
-	exp := time.Unix(int64(binary.LittleEndian.Uint32(rawExp)), 0)
 	if !exp.After(now) {
 		s.del(key)
-		return errors.Wrap(ErrMiss, "expired")
-	}
-
-	if err := CacheUnmarshal(rawPayload, dest); err != nil {
-		return errors.Wrap(err, "cannot unmarshal")
+		return nil, errors.Wrap(ErrMiss, "expired")
 	}
-	return nil
+	return rawPayload, nil
 }
 
 func (s *cookieCache) Set(ctx context.Context, key string, value interface{}, exp time.Duration) error {
@@ -125,6 +253,8 @@ func (s *cookieCache) Set(ctx context.Context, key string, value interface{}, ex
 		"exp", fmt.Sprint(exp),
 	).Finish()
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.set(key, value, exp)
 }
 
@@ -135,107 +265,318 @@ func (s *cookieCache) set(key string, value interface{}, exp time.Duration) erro
 	}
 
 	expAt := time.Now().Add(exp)
-	rawExp := make([]byte, 4)
-	binary.LittleEndian.PutUint32(rawExp, uint32(expAt.Unix()))
-
-	rawData := append(rawPayload, rawExp...)
-	payload, err := s.encrypt(rawData)
+	payload, err := s.encrypt(s.cookieName(key), rawPayload, expAt)
 	if err != nil {
 		return errors.Wrap(err, "cannot encrypt")
 	}
 
-	http.SetCookie(s.w, &http.Cookie{
-		Name:     s.prefix + key,
-		Value:    payload,
-		Path:     "/",
-		Expires:  expAt,
-		HttpOnly: true,
-		//Secure:   true,
-	})
-	if exp > 0 {
-		s.staged[key] = cookieCacheItem{
-			payload:   rawPayload,
-			validTill: expAt,
-		}
+	if err := s.writeCookie(s.cookieName(key), payload, expAt); err != nil {
+		return err
+	}
+	s.staged[key] = cookieCacheItem{
+		payload:   rawPayload,
+		validTill: expAt,
+		deleted:   exp <= 0,
 	}
 	return nil
 }
 
-func (s *cookieCache) encrypt(data []byte) (string, error) {
-	cipherText := make([]byte, ivSize+len(data))
+// encrypt returns cookie value that contains given payload and expiration
+// time. Cookie name is authenticated, so that the value cannot be used by
+// any other cookie.
+func (s *cookieCache) encrypt(name string, payload []byte, expAt time.Time) (string, error) {
+	var flags byte
+	if s.compress {
+		if compressed, ok := compressPayload(payload); ok {
+			payload = compressed
+			flags |= cookieFlagCompressed
+		}
+	}
+
+	data := make([]byte, 9+len(payload))
+	binary.BigEndian.PutUint64(data, uint64(expAt.Unix()))
+	data[8] = flags
+	copy(data[9:], payload)
 
-	iv := cipherText[:ivSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return "", errors.Wrap(ErrInternal, "cannot read: %s", err)
+	sealed, err := s.envelope.seal(data, []byte(name))
+	if err != nil {
+		return "", err
 	}
+	return cookieEnvelopePrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
 
-	stream := cipher.NewCFBEncrypter(s.secret, iv)
-	stream.XORKeyStream(cipherText[aes.BlockSize:], data)
+// cookieEnvelopePrefix is used to distinguish authenticated cookie values
+// from legacy ones. It does not belong to the base64 URL alphabet.
+const cookieEnvelopePrefix = "."
+
+func (s *cookieCache) decrypt(name, value string) ([]byte, time.Time, error) {
+	if !strings.HasPrefix(value, cookieEnvelopePrefix) {
+		return s.decryptLegacy(value)
+	}
 
-	return base64.URLEncoding.EncodeToString(cipherText), nil
+	sealed, err := base64.RawURLEncoding.DecodeString(value[len(cookieEnvelopePrefix):])
+	if err != nil {
+		return nil, time.Time{}, errors.WrapErr(ErrMalformed, err)
+	}
+	data, err := s.envelope.open(sealed, []byte(name))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(data) < 9 {
+		return nil, time.Time{}, errors.Wrap(ErrMalformed, "message too short")
+	}
+	exp := time.Unix(int64(binary.BigEndian.Uint64(data[:8])), 0)
+	payload := data[9:]
+	if data[8]&cookieFlagCompressed != 0 {
+		if payload, err = decompressPayload(payload); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	return payload, exp, nil
 }
 
-const ivSize = aes.BlockSize
+const cookieFlagCompressed byte = 1 << 0
 
-func (s *cookieCache) decrypt(payload string) ([]byte, error) {
-	raw, err := base64.URLEncoding.DecodeString(payload)
+// compressPayload returns flate compressed payload. False is returned if
+// compression does not make payload smaller.
+func compressPayload(payload []byte) ([]byte, bool) {
+	var b bytes.Buffer
+	fw, err := flate.NewWriter(&b, flate.BestCompression)
 	if err != nil {
-		return nil, errors.WrapErr(ErrMalformed, err)
+		return nil, false
 	}
-	if len(raw) < ivSize {
-		return nil, errors.Wrap(ErrValidation, "message too short")
+	if _, err := fw.Write(payload); err != nil {
+		return nil, false
 	}
+	if err := fw.Close(); err != nil {
+		return nil, false
+	}
+	if b.Len() >= len(payload) {
+		return nil, false
+	}
+	return b.Bytes(), true
+}
 
-	data := raw[ivSize:]
-	stream := cipher.NewCFBDecrypter(s.secret, raw[:ivSize])
-	stream.XORKeyStream(data, data)
-	return data, nil
+func decompressPayload(payload []byte) ([]byte, error) {
+	fr := flate.NewReader(bytes.NewReader(payload))
+	defer fr.Close()
+	raw, err := ioutil.ReadAll(fr)
+	if err != nil {
+		return nil, errors.Wrap(ErrMalformed, "cannot decompress: %s", err)
+	}
+	return raw, nil
 }
 
-func (s *cookieCache) SetNx(ctx context.Context, key string, value interface{}, exp time.Duration) error {
-	if _, ok := s.staged[key]; ok {
-		return errors.Wrap(ErrConflict, "exists")
+// writeCookie sets cookie with given name and value. If value is too big to
+// fit into a single cookie, it is split into chunks. Chunks are stored in
+// numbered cookies and the cookie with given name holds the chunks count.
+func (s *cookieCache) writeCookie(name, value string, expAt time.Time) error {
+	if len(name)+len(value) <= s.maxCookieSize {
+		if len(name)+len(value) > s.maxSize {
+			return errors.Wrap(ErrCookieTooLarge, "%d bytes", len(name)+len(value))
+		}
+		s.expireChunks(name, 0)
+		s.setCookie(name, value, expAt)
+		return nil
 	}
-	if _, err := s.r.Cookie(s.prefix + key); err == nil {
-		// TODO check if valid and not expired
-		return errors.Wrap(ErrConflict, "exists")
+
+	// reserve space for the chunk number suffix
+	chunkSize := s.maxCookieSize - len(name) - len("_9999")
+	if chunkSize < minCookieChunkSize {
+		return errors.Wrap(ErrCookieTooLarge, "name too long")
+	}
+	chunksCnt := (len(value) + chunkSize - 1) / chunkSize
+	if total := len(value) + chunksCnt*len(cookieChunkName(name, chunksCnt)); total > s.maxSize {
+		return errors.Wrap(ErrCookieTooLarge, "%d bytes in %d chunks", total, chunksCnt)
 	}
 
-	return s.set(key, value, exp)
+	s.expireChunks(name, chunksCnt)
+	s.setCookie(name, cookieChunksPrefix+strconv.Itoa(chunksCnt), expAt)
+	for i := 0; i < chunksCnt; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(value) {
+			end = len(value)
+		}
+		s.setCookie(cookieChunkName(name, i+1), value[i*chunkSize:end], expAt)
+	}
+	return nil
 }
 
-func (s *cookieCache) Del(ctx context.Context, key string) error {
-	defer CurrentTrace(ctx).Begin("cookie cache del",
-		"key", key,
-	).Finish()
+// readCookie returns value of a cookie with given name. Value of cookie
+// split into chunks is reassembled.
+func (s *cookieCache) readCookie(name string) (string, bool) {
+	c, err := s.r.Cookie(name)
+	if err != nil {
+		return "", false
+	}
+	if !strings.HasPrefix(c.Value, cookieChunksPrefix) {
+		return c.Value, true
+	}
+
+	chunksCnt, err := strconv.Atoi(c.Value[len(cookieChunksPrefix):])
+	if err != nil || chunksCnt < 1 || chunksCnt*minCookieChunkSize > s.maxSize {
+		return "", false
+	}
+	var value strings.Builder
+	for i := 1; i <= chunksCnt; i++ {
+		chunk, err := s.r.Cookie(cookieChunkName(name, i))
+		if err != nil {
+			return "", false
+		}
+		value.WriteString(chunk.Value)
+	}
+	return value.String(), true
+}
+
+// expireChunks removes all chunk cookies of given name, that are present in
+// the request and are numbered above given count.
+func (s *cookieCache) expireChunks(name string, keep int) {
+	for i := keep + 1; ; i++ {
+		if _, err := s.r.Cookie(cookieChunkName(name, i)); err != nil {
+			return
+		}
+		s.expireCookie(cookieChunkName(name, i))
+	}
+}
+
+func (s *cookieCache) setCookie(name, value string, expAt time.Time) {
+	http.SetCookie(s.w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     s.path,
+		Domain:   s.domain,
+		Expires:  expAt,
+		Secure:   s.secure,
+		HttpOnly: s.httpOnly,
+		SameSite: s.sameSite,
+	})
+}
+
+func (s *cookieCache) expireCookie(name string) {
+	http.SetCookie(s.w, &http.Cookie{
+		Name:     name,
+		Value:    "",
+		Path:     s.path,
+		Domain:   s.domain,
+		Expires:  time.Time{},
+		MaxAge:   -1,
+		Secure:   s.secure,
+		HttpOnly: s.httpOnly,
+		SameSite: s.sameSite,
+	})
+}
+
+// cookieName returns name of the cookie used to store value of given key.
+// Long keys are hashed, so that the name leaves enough space for the value.
+func (s *cookieCache) cookieName(key string) string {
+	const maxNameLength = 128
+
+	name := s.prefix + key
+	if len(name) <= maxNameLength {
+		return name
+	}
+	h := sha1.Sum([]byte(name))
+	suffix := hex.EncodeToString(h[:])
+	return name[:maxNameLength-len(suffix)] + suffix
+}
 
-	return s.del(key)
+func cookieChunkName(name string, n int) string {
+	return name + "_" + strconv.Itoa(n)
 }
 
-func (s *cookieCache) del(key string) error {
-	existed := false
-	if _, ok := s.staged[key]; ok {
-		existed = true
-		delete(s.staged, key)
+// cookieChunksPrefix is used to mark cookie value that holds the number of
+// chunks. It does not belong to the base64 URL alphabet.
+const cookieChunksPrefix = "~"
+
+// minCookieChunkSize is the smallest reasonable chunk size.
+const minCookieChunkSize = 64
+
+const ivSize = aes.BlockSize
+
+// decryptLegacy reads value encrypted using AES-CFB, with expiration time
+// appended to the payload as 4 bytes long unix time.
+func (s *cookieCache) decryptLegacy(value string) ([]byte, time.Time, error) {
+	now := time.Now()
+	if len(s.legacy) == 0 || !now.Before(s.legacyUntil) {
+		return nil, time.Time{}, errors.Wrap(ErrMalformed, "legacy format")
+	}
+	raw, err := base64.URLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, time.Time{}, errors.WrapErr(ErrMalformed, err)
+	}
+	if len(raw) < ivSize+4 {
+		return nil, time.Time{}, errors.Wrap(ErrValidation, "message too short")
 	}
 
-	// TODO: deleting does not remove it from the request
-	if _, err := s.r.Cookie(s.prefix + key); err == nil {
+	// Legacy format is not authenticated and it is not possible to tell
+	// which secret was used. Try all of them and use the first one
+	// that produces a value that can be a valid expiration time: not
+	// expired and not after the end of migration. Narrow range makes it
+	// unlikely that a wrong secret produces such value.
+	for _, block := range s.legacy {
+		data := make([]byte, len(raw)-ivSize)
+		stream := cipher.NewCFBDecrypter(block, raw[:ivSize])
+		stream.XORKeyStream(data, raw[ivSize:])
+
+		rawExp := data[len(data)-4:]
+		exp := time.Unix(int64(binary.LittleEndian.Uint32(rawExp)), 0)
+		if !exp.After(now) || exp.After(s.legacyUntil) {
+			continue
+		}
+		return data[:len(data)-4], exp, nil
+	}
+	return nil, time.Time{}, errors.Wrap(ErrMalformed, "cannot decrypt legacy format")
+}
 
-		// TODO: check if cookie value is not expired
+func (s *cookieCache) SetNx(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	defer CurrentTrace(ctx).Begin("cookie cache setnx",
+		"key", key,
+		"exp", fmt.Sprint(exp),
+	).Finish()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		http.SetCookie(s.w, &http.Cookie{
-			Name:    s.prefix + key,
-			Value:   "",
-			Path:    "/",
-			Expires: time.Time{},
-			MaxAge:  -1,
-		})
-		existed = true
+	switch _, err := s.lookup(key); {
+	case err == nil:
+		return errors.Wrap(ErrConflict, "exists")
+	case ErrMiss.Is(err):
+		return s.set(key, value, exp)
+	default:
+		return err
 	}
+}
 
-	if !existed {
+func (s *cookieCache) Del(ctx context.Context, key string) error {
+	defer CurrentTrace(ctx).Begin("cookie cache del",
+		"key", key,
+	).Finish()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.lookup(key)
+	if err != nil && !ErrMiss.Is(err) {
+		return err
+	}
+	s.del(key)
+	if err != nil {
 		return ErrMiss
 	}
 	return nil
 }
+
+// del removes value stored under given key and hides it from the rest of the
+// current request.
+func (s *cookieCache) del(key string) {
+	name := s.cookieName(key)
+	if _, err := s.r.Cookie(name); err == nil {
+		s.expireCookie(name)
+		s.expireChunks(name, 0)
+	} else if item, ok := s.staged[key]; ok && !item.deleted {
+		// cookie was set by the current response only
+		s.expireCookie(name)
+		s.expireChunks(name, 0)
+	}
+	s.staged[key] = cookieCacheItem{deleted: true}
+}
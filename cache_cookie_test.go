@@ -2,8 +2,14 @@ package surf
 
 import (
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -52,3 +58,325 @@ func TestCookieCacheBetweenRequests(t *testing.T) {
 		t.Fatalf("cannot get value: %v, %q", err, val)
 	}
 }
+
+func TestCookieCacheKeyRotation(t *testing.T) {
+	ctx := context.Background()
+
+	oldCache, err := NewCookieCache("", []byte("old-super-secret-test-string"))
+	if err != nil {
+		t.Fatalf("cannot create cookie cache: %s", err)
+	}
+	w1 := httptest.NewRecorder()
+	if err := oldCache.Bind(w1, httptest.NewRequest("GET", "/", nil)).Set(ctx, "key-abc", "abc", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+
+	newCache, err := NewCookieCache("",
+		[]byte("new-super-secret-test-string"),
+		[]byte("old-super-secret-test-string"))
+	if err != nil {
+		t.Fatalf("cannot create cookie cache: %s", err)
+	}
+	r2 := httptest.NewRequest("GET", "/", nil)
+	r2.Header = http.Header{"Cookie": w1.Header()["Set-Cookie"]}
+	var val string
+	if err := newCache.Bind(httptest.NewRecorder(), r2).Get(ctx, "key-abc", &val); err != nil || val != "abc" {
+		t.Fatalf("cannot get value: %v, %q", err, val)
+	}
+
+	w3 := httptest.NewRecorder()
+	if err := newCache.Bind(w3, httptest.NewRequest("GET", "/", nil)).Set(ctx, "key-abc", "abc", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	r4 := httptest.NewRequest("GET", "/", nil)
+	r4.Header = http.Header{"Cookie": w3.Header()["Set-Cookie"]}
+	if err := oldCache.Bind(httptest.NewRecorder(), r4).Get(ctx, "key-abc", &val); !ErrMiss.Is(err) {
+		t.Fatalf("want ErrMiss, got %+v", err)
+	}
+}
+
+func TestCookieCacheTampering(t *testing.T) {
+	ctx := context.Background()
+
+	cache, err := NewCookieCache("", []byte("super-secret-test-string"))
+	if err != nil {
+		t.Fatalf("cannot create cookie cache: %s", err)
+	}
+	w1 := httptest.NewRecorder()
+	if err := cache.Bind(w1, httptest.NewRequest("GET", "/", nil)).Set(ctx, "key-abc", "abc", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	c := w1.Result().Cookies()[0]
+
+	// flip a single bit of the encrypted payload
+	raw, err := base64.RawURLEncoding.DecodeString(c.Value[1:])
+	if err != nil {
+		t.Fatalf("cannot decode cookie: %s", err)
+	}
+	raw[len(raw)-1] ^= 1
+	tampered := &http.Cookie{Name: c.Name, Value: c.Value[:1] + base64.RawURLEncoding.EncodeToString(raw)}
+
+	r2 := httptest.NewRequest("GET", "/", nil)
+	r2.AddCookie(tampered)
+	var val string
+	if err := cache.Bind(httptest.NewRecorder(), r2).Get(ctx, "key-abc", &val); !ErrMiss.Is(err) {
+		t.Fatalf("want ErrMiss, got %+v (%q)", err, val)
+	}
+
+	// value cannot be used by another cookie
+	r3 := httptest.NewRequest("GET", "/", nil)
+	r3.AddCookie(&http.Cookie{Name: "key-xyz", Value: c.Value})
+	if err := cache.Bind(httptest.NewRecorder(), r3).Get(ctx, "key-xyz", &val); !ErrMiss.Is(err) {
+		t.Fatalf("want ErrMiss, got %+v (%q)", err, val)
+	}
+}
+
+func TestCookieCacheLegacyFormat(t *testing.T) {
+	ctx := context.Background()
+	secret := []byte("super-secret-test-string")
+
+	// encrypt the value the same way older versions did
+	block, err := aes.NewCipher(adjustKeySize(secret))
+	if err != nil {
+		t.Fatalf("cannot create cipher: %s", err)
+	}
+	data := []byte(`"abc"`)
+	rawExp := make([]byte, 4)
+	binary.LittleEndian.PutUint32(rawExp, uint32(time.Now().Add(time.Minute).Unix()))
+	data = append(data, rawExp...)
+	cipherText := make([]byte, aes.BlockSize+len(data))
+	if _, err := rand.Read(cipherText[:aes.BlockSize]); err != nil {
+		t.Fatalf("cannot read random: %s", err)
+	}
+	cipher.NewCFBEncrypter(block, cipherText[:aes.BlockSize]).XORKeyStream(cipherText[aes.BlockSize:], data)
+	legacy := &http.Cookie{Name: "key-abc", Value: base64.URLEncoding.EncodeToString(cipherText)}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(legacy)
+
+	for name, tc := range map[string]struct {
+		opts *CookieCacheOpts
+		want string
+	}{
+		"during migration": {
+			opts: &CookieCacheOpts{
+				Secrets:         [][]byte{[]byte("another-secret-test-string"), secret},
+				ReadLegacyUntil: time.Now().Add(time.Hour),
+			},
+			want: "abc",
+		},
+		"by default": {
+			opts: &CookieCacheOpts{Secrets: [][]byte{secret}},
+		},
+		"after migration": {
+			opts: &CookieCacheOpts{
+				Secrets:         [][]byte{secret},
+				ReadLegacyUntil: time.Now().Add(-time.Second),
+			},
+		},
+		"expiring after migration": {
+			opts: &CookieCacheOpts{
+				Secrets:         [][]byte{secret},
+				ReadLegacyUntil: time.Now().Add(30 * time.Second),
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cache, err := NewCookieCacheWithOpts("", tc.opts)
+			if err != nil {
+				t.Fatalf("cannot create cookie cache: %s", err)
+			}
+			var val string
+			err = cache.Bind(httptest.NewRecorder(), r).Get(ctx, "key-abc", &val)
+			if tc.want == "" {
+				if !ErrMiss.Is(err) {
+					t.Fatalf("want ErrMiss, got %+v", err)
+				}
+				return
+			}
+			if err != nil || val != tc.want {
+				t.Fatalf("cannot get value: %v, %q", err, val)
+			}
+		})
+	}
+
+	cache, err := NewCookieCache("", secret)
+	if err != nil {
+		t.Fatalf("cannot create cookie cache: %s", err)
+	}
+	var val string
+	if err := cache.Bind(httptest.NewRecorder(), r).Get(ctx, "key-abc", &val); !ErrMiss.Is(err) {
+		t.Fatalf("want legacy format not read by default, got %+v", err)
+	}
+}
+
+func TestCookieCacheShortSecret(t *testing.T) {
+	if _, err := NewCookieCache("", []byte("short")); !ErrValidation.Is(err) {
+		t.Fatalf("want ErrValidation, got %+v", err)
+	}
+}
+
+func TestCookieCacheChunks(t *testing.T) {
+	ctx := context.Background()
+
+	cache, err := NewCookieCacheWithOpts("", &CookieCacheOpts{
+		Secrets:       [][]byte{[]byte("super-secret-test-string")},
+		MaxCookieSize: 500,
+		MaxSize:       4000,
+	})
+	if err != nil {
+		t.Fatalf("cannot create cookie cache: %s", err)
+	}
+
+	big := strings.Repeat("x", 1500)
+	w1 := httptest.NewRecorder()
+	if err := cache.Bind(w1, httptest.NewRequest("GET", "/", nil)).Set(ctx, "key-big", big, time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	cookies := w1.Result().Cookies()
+	if len(cookies) < 4 {
+		t.Fatalf("want value split into many cookies, got %d", len(cookies))
+	}
+	for _, c := range cookies {
+		if size := len(c.Name) + len(c.Value); size > 500 {
+			t.Fatalf("cookie %q too big: %d", c.Name, size)
+		}
+	}
+
+	r2 := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		r2.AddCookie(c)
+	}
+	var val string
+	if err := cache.Bind(httptest.NewRecorder(), r2).Get(ctx, "key-big", &val); err != nil || val != big {
+		t.Fatalf("cannot get value: %v, %d bytes", err, len(val))
+	}
+
+	// writing a small value removes chunks that are no longer used
+	w3 := httptest.NewRecorder()
+	if err := cache.Bind(w3, r2).Set(ctx, "key-big", "small", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	expired := 0
+	for _, c := range w3.Result().Cookies() {
+		if c.MaxAge < 0 {
+			expired++
+		}
+	}
+	if want := len(cookies) - 1; expired != want {
+		t.Fatalf("want %d chunks expired, got %d", want, expired)
+	}
+
+	if err := cache.Bind(httptest.NewRecorder(), r2).Set(ctx, "key-big", strings.Repeat("x", 5000), time.Minute); !ErrCookieTooLarge.Is(err) {
+		t.Fatalf("want ErrCookieTooLarge, got %+v", err)
+	}
+	if !ErrCacheMalformed.Is(ErrCookieTooLarge) {
+		t.Fatal("ErrCookieTooLarge must be ErrCacheMalformed")
+	}
+}
+
+func TestCookieCacheCompression(t *testing.T) {
+	ctx := context.Background()
+
+	cache, err := NewCookieCacheWithOpts("", &CookieCacheOpts{
+		Secrets:  [][]byte{[]byte("super-secret-test-string")},
+		Compress: true,
+		MaxSize:  4000,
+	})
+	if err != nil {
+		t.Fatalf("cannot create cookie cache: %s", err)
+	}
+	RunCacheImplementationTest(t, cache.Bind(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)))
+
+	// value would not fit into the budget without compression
+	big := strings.Repeat("abc", 3000)
+	w1 := httptest.NewRecorder()
+	if err := cache.Bind(w1, httptest.NewRequest("GET", "/", nil)).Set(ctx, "key-big", big, time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	r2 := httptest.NewRequest("GET", "/", nil)
+	for _, c := range w1.Result().Cookies() {
+		r2.AddCookie(c)
+	}
+	var val string
+	if err := cache.Bind(httptest.NewRecorder(), r2).Get(ctx, "key-big", &val); err != nil || val != big {
+		t.Fatalf("cannot get value: %v, %d bytes", err, len(val))
+	}
+}
+
+func TestCookieCacheAttributes(t *testing.T) {
+	cache, err := NewCookieCacheWithOpts("", &CookieCacheOpts{
+		Secrets:  [][]byte{[]byte("super-secret-test-string")},
+		Path:     "/app",
+		Domain:   "example.com",
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	if err != nil {
+		t.Fatalf("cannot create cookie cache: %s", err)
+	}
+	w := httptest.NewRecorder()
+	if err := cache.Bind(w, httptest.NewRequest("GET", "/", nil)).Set(context.Background(), "key", "abc", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	header := w.Header().Get("Set-Cookie")
+	for _, attr := range []string{"Path=/app", "Domain=example.com", "Secure", "HttpOnly", "SameSite=Strict"} {
+		if !strings.Contains(header, attr) {
+			t.Errorf("want %q attribute in %q", attr, header)
+		}
+	}
+}
+
+func TestCookieCacheSetNxAndDel(t *testing.T) {
+	ctx := context.Background()
+
+	cache, err := NewCookieCache("", []byte("super-secret-test-string"))
+	if err != nil {
+		t.Fatalf("cannot create cookie cache: %s", err)
+	}
+
+	w1 := httptest.NewRecorder()
+	c1 := cache.Bind(w1, httptest.NewRequest("GET", "/", nil))
+	if err := c1.Set(ctx, "key-valid", "abc", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	if err := c1.Set(ctx, "key-expired", "abc", time.Second); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+
+	r2 := httptest.NewRequest("GET", "/", nil)
+	for _, c := range w1.Result().Cookies() {
+		r2.AddCookie(c)
+	}
+	r2.AddCookie(&http.Cookie{Name: "key-invalid", Value: ".invalid"})
+
+	time.Sleep(time.Second + 20*time.Millisecond)
+
+	c2 := cache.Bind(httptest.NewRecorder(), r2)
+	if err := c2.SetNx(ctx, "key-valid", "xyz", time.Minute); !ErrConflict.Is(err) {
+		t.Fatalf("want ErrConflict, got %+v", err)
+	}
+	if err := c2.SetNx(ctx, "key-expired", "xyz", time.Minute); err != nil {
+		t.Fatalf("cannot set expired key: %s", err)
+	}
+	if err := c2.SetNx(ctx, "key-invalid", "xyz", time.Minute); err != nil {
+		t.Fatalf("cannot set invalid key: %s", err)
+	}
+
+	c3 := cache.Bind(httptest.NewRecorder(), r2)
+	if err := c3.Del(ctx, "key-expired"); err != ErrMiss {
+		t.Fatalf("want ErrMiss, got %+v", err)
+	}
+	if err := c3.Del(ctx, "key-valid"); err != nil {
+		t.Fatalf("cannot delete: %s", err)
+	}
+	var val string
+	if err := c3.Get(ctx, "key-valid", &val); !ErrMiss.Is(err) {
+		t.Fatalf("want ErrMiss, got %+v (%q)", err, val)
+	}
+	if err := c3.Del(ctx, "key-valid"); err != ErrMiss {
+		t.Fatalf("want ErrMiss, got %+v", err)
+	}
+	if err := c3.SetNx(ctx, "key-valid", "xyz", time.Minute); err != nil {
+		t.Fatalf("cannot set deleted key: %s", err)
+	}
+}
@@ -0,0 +1,81 @@
+package surf
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"time"
+
+	"github.com/go-surf/surf/errors"
+)
+
+// CounterCache is implemented by caches that provide atomic read-modify-write
+// operations.
+type CounterCache interface {
+	CacheService
+
+	// Incr atomically increments integer value stored under given key by
+	// delta and returns the new value. Use negative delta to decrement.
+	// If key is not in use, value is set to delta and expires after
+	// given time, or never if expiration is not positive. Expiration
+	// time of an existing value is not changed.
+	//
+	// ErrCacheMalformed is returned if stored value is not an integer.
+	Incr(ctx context.Context, key string, delta int64, exp time.Duration) (int64, error)
+
+	// CompareAndSwap atomically sets value under given key only if
+	// current value is equal to the old one. Values are compared using
+	// their serialized representation. It returns ErrMiss if key is not
+	// used and ErrConflict if current value is different.
+	CompareAndSwap(ctx context.Context, key string, old, value interface{}, exp time.Duration) error
+}
+
+// CacheDecr atomically decrements integer value stored under given key by
+// delta and returns the new value. If key is not in use, value is set to
+// -delta. See CounterCache.Incr.
+func CacheDecr(ctx context.Context, c CounterCache, key string, delta int64, exp time.Duration) (int64, error) {
+	if delta == math.MinInt64 {
+		return 0, errors.Wrap(ErrValidation, "delta %d cannot be negated", delta)
+	}
+	return c.Incr(ctx, key, -delta, exp)
+}
+
+// counterExpireAt returns expiration time of a counter created at given
+// time. Counter created with non-positive expiration never expires.
+func counterExpireAt(now time.Time, exp time.Duration) time.Time {
+	if exp <= 0 {
+		return neverExpire
+	}
+	return now.Add(exp)
+}
+
+// neverExpire is the expiration time of values that do not expire. It is
+// the latest time that can be represented in nanoseconds.
+var neverExpire = time.Unix(0, math.MaxInt64)
+
+// incrRaw returns serialized result of incrementing given serialized value
+// by delta. If raw is nil, delta is the result.
+func incrRaw(raw []byte, delta int64) (int64, []byte, error) {
+	var n int64
+	if raw != nil {
+		if err := CacheUnmarshal(raw, &n); err != nil {
+			return 0, nil, errors.Wrap(err, "not an integer")
+		}
+	}
+	n += delta
+	b, err := CacheMarshal(n)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, b, nil
+}
+
+// equalRaw returns true if serialized representation of given value is
+// equal to given one.
+func equalRaw(raw []byte, value interface{}) (bool, error) {
+	b, err := CacheMarshal(value)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(raw, b), nil
+}
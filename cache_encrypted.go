@@ -0,0 +1,249 @@
+package surf
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/go-surf/surf/errors"
+)
+
+// EncryptedCache returns cache wrapper that encrypts and authenticates all
+// values before writing them to given cache. Keys are stored as they are.
+// See EncryptedCacheWithOpts.
+func EncryptedCache(cache CacheService, secrets ...[]byte) (CacheService, error) {
+	return EncryptedCacheWithOpts(cache, &EncryptedCacheOpts{
+		Secrets: secrets,
+	})
+}
+
+// EncryptedCacheOpts defines options for the encrypted cache.
+type EncryptedCacheOpts struct {
+	// Secrets used to encrypt and authenticate values. New values are
+	// always written using the first secret. All secrets can be used to
+	// read a value. At least one secret, not shorter than 16 bytes, is
+	// required.
+	Secrets [][]byte
+
+	// HashKeys enables replacing keys with their HMAC, so that they are
+	// not readable in the storage. Hash depends on the secret, so after
+	// rotation each lookup is made once per secret until values written
+	// with old secrets expire. Writing a value deletes values stored
+	// under keys hashed with old secrets.
+	HashKeys bool
+}
+
+// EncryptedCacheWithOpts returns cache wrapper that encrypts and
+// authenticates all values before writing them to given cache, using
+// AES-GCM. Each value is bound to its key, so that stored values cannot be
+// swapped between keys.
+func EncryptedCacheWithOpts(cache CacheService, o *EncryptedCacheOpts) (CacheService, error) {
+	if o == nil {
+		o = &EncryptedCacheOpts{}
+	}
+	env, err := newEnvelope(o.Secrets)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create envelope")
+	}
+	c := &encryptedCache{
+		cache:    cache,
+		envelope: env,
+	}
+	if o.HashKeys {
+		for _, secret := range o.Secrets {
+			c.hashKeys = append(c.hashKeys, deriveKey(secret, "surf encrypted cache key hash"))
+		}
+	}
+	return c, nil
+}
+
+type encryptedCache struct {
+	cache    CacheService
+	envelope *envelope
+
+	// hashKeys are used to compute key hashes, one for each secret. Keys
+	// are not hashed if empty.
+	hashKeys [][]byte
+}
+
+// storageKeys returns all keys under which value of given key can be
+// stored. The first one is used for writing.
+func (c *encryptedCache) storageKeys(key string) []string {
+	if len(c.hashKeys) == 0 {
+		return []string{key}
+	}
+	keys := make([]string, len(c.hashKeys))
+	for i, hk := range c.hashKeys {
+		mac := hmac.New(sha256.New, hk)
+		mac.Write([]byte(key))
+		keys[i] = hex.EncodeToString(mac.Sum(nil))
+	}
+	return keys
+}
+
+func (c *encryptedCache) storageKey(key string) string {
+	return c.storageKeys(key)[0]
+}
+
+func (c *encryptedCache) encrypt(key string, value interface{}) (*rawCacheValue, error) {
+	plaintext, err := CacheMarshal(value)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := c.envelope.seal(plaintext, []byte(key))
+	if err != nil {
+		return nil, err
+	}
+	return (*rawCacheValue)(&sealed), nil
+}
+
+func (c *encryptedCache) decrypt(key string, sealed []byte, dest interface{}) error {
+	plaintext, err := c.envelope.open(sealed, []byte(key))
+	if err != nil {
+		return errors.Wrap(ErrCacheMalformed, "cannot decrypt: %s", err)
+	}
+	return CacheUnmarshal(plaintext, dest)
+}
+
+func (c *encryptedCache) Get(ctx context.Context, key string, dest interface{}) error {
+	for _, sk := range c.storageKeys(key) {
+		var sealed rawCacheValue
+		switch err := c.cache.Get(ctx, sk, &sealed); {
+		case err == nil:
+			return c.decrypt(key, sealed, dest)
+		case ErrMiss.Is(err):
+			// try the next key
+		default:
+			return err
+		}
+	}
+	return ErrMiss
+}
+
+func (c *encryptedCache) Set(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	sealed, err := c.encrypt(key, value)
+	if err != nil {
+		return err
+	}
+	if err := c.cache.Set(ctx, c.storageKey(key), sealed, exp); err != nil {
+		return err
+	}
+	return c.delOld(ctx, key)
+}
+
+func (c *encryptedCache) SetNx(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	sealed, err := c.encrypt(key, value)
+	if err != nil {
+		return err
+	}
+	// Value written using an old secret is still in use.
+	for _, sk := range c.storageKeys(key)[1:] {
+		var raw rawCacheValue
+		switch err := c.cache.Get(ctx, sk, &raw); {
+		case err == nil:
+			return ErrConflict
+		case ErrMiss.Is(err):
+			// not in use
+		default:
+			return err
+		}
+	}
+	if err := c.cache.SetNx(ctx, c.storageKey(key), sealed, exp); err != nil {
+		return err
+	}
+	return c.delOld(ctx, key)
+}
+
+// delOld deletes values of given key stored under keys hashed with old
+// secrets, so that they are not read once the current value expires.
+func (c *encryptedCache) delOld(ctx context.Context, key string) error {
+	for _, sk := range c.storageKeys(key)[1:] {
+		if err := c.cache.Del(ctx, sk); err != nil && !ErrMiss.Is(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *encryptedCache) Del(ctx context.Context, key string) error {
+	var err error = ErrMiss
+	for _, sk := range c.storageKeys(key) {
+		switch derr := c.cache.Del(ctx, sk); {
+		case derr == nil:
+			err = nil
+		case ErrMiss.Is(derr):
+			// not stored under this key
+		default:
+			return derr
+		}
+	}
+	return err
+}
+
+func (c *encryptedCache) GetMulti(ctx context.Context, keys []string, dests []interface{}) ([]error, error) {
+	if err := validateBatch(keys, dests); err != nil {
+		return nil, err
+	}
+	storageKeys := make([]string, len(keys))
+	sealed := make([]rawCacheValue, len(keys))
+	sealedDests := make([]interface{}, len(keys))
+	for i, key := range keys {
+		storageKeys[i] = c.storageKey(key)
+		sealedDests[i] = &sealed[i]
+	}
+	errs, err := AsBatchCache(c.cache).GetMulti(ctx, storageKeys, sealedDests)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		switch {
+		case errs[i] == nil:
+			errs[i] = c.decrypt(key, sealed[i], dests[i])
+		case ErrMiss.Is(errs[i]) && len(c.hashKeys) > 1:
+			// Value might be stored under a key hashed with an
+			// old secret.
+			switch err := c.Get(ctx, key, dests[i]); {
+			case err == nil, ErrMiss.Is(err), ErrCacheMalformed.Is(err):
+				errs[i] = err
+			default:
+				return nil, err
+			}
+		}
+	}
+	return errs, nil
+}
+
+func (c *encryptedCache) SetMulti(ctx context.Context, items []CacheItem) error {
+	encrypted := make([]CacheItem, len(items))
+	var oldKeys []string
+	for i, it := range items {
+		sealed, err := c.encrypt(it.Key, it.Value)
+		if err != nil {
+			return err
+		}
+		storageKeys := c.storageKeys(it.Key)
+		encrypted[i] = CacheItem{
+			Key:   storageKeys[0],
+			Value: sealed,
+			Exp:   it.Exp,
+		}
+		oldKeys = append(oldKeys, storageKeys[1:]...)
+	}
+	if err := AsBatchCache(c.cache).SetMulti(ctx, encrypted); err != nil {
+		return err
+	}
+	if len(oldKeys) == 0 {
+		return nil
+	}
+	return AsBatchCache(c.cache).DelMulti(ctx, oldKeys)
+}
+
+func (c *encryptedCache) DelMulti(ctx context.Context, keys []string) error {
+	storageKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		storageKeys = append(storageKeys, c.storageKeys(key)...)
+	}
+	return AsBatchCache(c.cache).DelMulti(ctx, storageKeys)
+}
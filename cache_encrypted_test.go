@@ -0,0 +1,231 @@
+package surf
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncryptedCache(t *testing.T) {
+	for _, hashKeys := range []bool{false, true} {
+		cache, err := EncryptedCacheWithOpts(NewLocalMemCache(), &EncryptedCacheOpts{
+			Secrets:  [][]byte{[]byte("super-secret-test-string")},
+			HashKeys: hashKeys,
+		})
+		if err != nil {
+			t.Fatalf("cannot create encrypted cache: %s", err)
+		}
+		RunCacheConformanceTest(t, cache, &CacheCapabilities{Batch: true})
+	}
+}
+
+func TestEncryptedCacheAtRest(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "surf_cache_encrypted_test_")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFilesystemCache(dir)
+	if err != nil {
+		t.Fatalf("cannot create cache: %s", err)
+	}
+	defer fs.Close()
+
+	cache, err := EncryptedCacheWithOpts(fs, &EncryptedCacheOpts{
+		Secrets:  [][]byte{[]byte("super-secret-test-string")},
+		HashKeys: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create encrypted cache: %s", err)
+	}
+	if err := cache.Set(ctx, "user-token", "very-private-token", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if strings.Contains(string(b), "very-private-token") {
+			t.Errorf("plaintext value stored in %s", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("cannot walk cache directory: %s", err)
+	}
+}
+
+func TestEncryptedCacheHashKeys(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalMemCache()
+
+	cache, err := EncryptedCacheWithOpts(storage, &EncryptedCacheOpts{
+		Secrets:  [][]byte{[]byte("super-secret-test-string")},
+		HashKeys: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create encrypted cache: %s", err)
+	}
+	if err := cache.Set(ctx, "user:42:email", "user@example.com", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	var raw rawCacheValue
+	if err := storage.Get(ctx, "user:42:email", &raw); !ErrMiss.Is(err) {
+		t.Fatalf("want key to be hashed, got %+v", err)
+	}
+}
+
+func TestEncryptedCacheKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalMemCache()
+
+	oldSecret := []byte("old-secret-test-string")
+	newSecret := []byte("new-secret-test-string")
+
+	for _, hashKeys := range []bool{false, true} {
+		old, err := EncryptedCacheWithOpts(storage, &EncryptedCacheOpts{
+			Secrets:  [][]byte{oldSecret},
+			HashKeys: hashKeys,
+		})
+		if err != nil {
+			t.Fatalf("cannot create encrypted cache: %s", err)
+		}
+		if err := old.Set(ctx, "key", "value", time.Minute); err != nil {
+			t.Fatalf("cannot set: %s", err)
+		}
+
+		rotated, err := EncryptedCacheWithOpts(storage, &EncryptedCacheOpts{
+			Secrets:  [][]byte{newSecret, oldSecret},
+			HashKeys: hashKeys,
+		})
+		if err != nil {
+			t.Fatalf("cannot create encrypted cache: %s", err)
+		}
+		var val string
+		if err := rotated.Get(ctx, "key", &val); err != nil || val != "value" {
+			t.Fatalf("want value, got %q, %+v", val, err)
+		}
+		if err := rotated.SetNx(ctx, "key", "other", time.Minute); !ErrConflict.Is(err) {
+			t.Fatalf("want ErrConflict, got %+v", err)
+		}
+
+		fresh, err := EncryptedCacheWithOpts(storage, &EncryptedCacheOpts{
+			Secrets:  [][]byte{newSecret},
+			HashKeys: hashKeys,
+		})
+		if err != nil {
+			t.Fatalf("cannot create encrypted cache: %s", err)
+		}
+		switch err := fresh.Get(ctx, "key", &val); {
+		case hashKeys && !ErrMiss.Is(err):
+			t.Fatalf("want ErrMiss, got %+v", err)
+		case !hashKeys && !ErrCacheMalformed.Is(err):
+			t.Fatalf("want ErrCacheMalformed, got %+v", err)
+		}
+
+		if err := rotated.Del(ctx, "key"); err != nil {
+			t.Fatalf("cannot delete: %s", err)
+		}
+		if err := old.Get(ctx, "key", &val); !ErrMiss.Is(err) {
+			t.Fatalf("want ErrMiss, got %+v", err)
+		}
+	}
+}
+
+func TestEncryptedCacheKeyRotationOverwrite(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalMemCache()
+
+	oldSecret := []byte("old-secret-test-string")
+	newSecret := []byte("new-secret-test-string")
+
+	old, err := EncryptedCacheWithOpts(storage, &EncryptedCacheOpts{
+		Secrets:  [][]byte{oldSecret},
+		HashKeys: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create encrypted cache: %s", err)
+	}
+	for _, key := range []string{"set", "setmulti"} {
+		if err := old.Set(ctx, key, "old", time.Minute); err != nil {
+			t.Fatalf("cannot set: %s", err)
+		}
+	}
+
+	rotated, err := EncryptedCacheWithOpts(storage, &EncryptedCacheOpts{
+		Secrets:  [][]byte{newSecret, oldSecret},
+		HashKeys: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create encrypted cache: %s", err)
+	}
+
+	// Value written with the old secret must not be read once the value
+	// that replaced it expires.
+	if err := rotated.Set(ctx, "set", "new", 50*time.Millisecond); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	err = AsBatchCache(rotated).SetMulti(ctx, []CacheItem{
+		{Key: "setmulti", Value: "new", Exp: 50 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	for _, key := range []string{"set", "setmulti"} {
+		var val string
+		if err := rotated.Get(ctx, key, &val); !ErrMiss.Is(err) {
+			t.Fatalf("%s: want ErrMiss, got %q, %+v", key, val, err)
+		}
+	}
+}
+
+func TestEncryptedCacheValueSwap(t *testing.T) {
+	ctx := context.Background()
+	storage := NewLocalMemCache()
+
+	cache, err := EncryptedCache(storage, []byte("super-secret-test-string"))
+	if err != nil {
+		t.Fatalf("cannot create encrypted cache: %s", err)
+	}
+	if err := cache.Set(ctx, "admin", true, time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+
+	// copy encrypted value to a different key
+	var raw rawCacheValue
+	if err := storage.Get(ctx, "admin", &raw); err != nil {
+		t.Fatalf("cannot get raw value: %s", err)
+	}
+	if err := storage.Set(ctx, "other", &raw, time.Minute); err != nil {
+		t.Fatalf("cannot set raw value: %s", err)
+	}
+
+	var val bool
+	if err := cache.Get(ctx, "other", &val); !ErrCacheMalformed.Is(err) {
+		t.Fatalf("want ErrCacheMalformed, got %+v", err)
+	}
+}
+
+func TestEncryptedCacheShortSecret(t *testing.T) {
+	if _, err := EncryptedCache(NewLocalMemCache(), []byte("short")); !ErrValidation.Is(err) {
+		t.Fatalf("want ErrValidation, got %+v", err)
+	}
+	if _, err := EncryptedCache(NewLocalMemCache()); !ErrValidation.Is(err) {
+		t.Fatalf("want ErrValidation, got %+v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package surf
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/sha1"
@@ -8,32 +9,95 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-surf/surf/errors"
 )
 
-func NewFilesystemCache(rootDir string) CacheService {
-	os.MkdirAll(rootDir, 0770)
-	return &fscache{
-		rootDir: rootDir,
+// FilesystemCache is storing values in files inside of a directory. Files
+// are spread across subdirectories named after the key hash prefix, so that
+// no directory grows too big.
+//
+// Files are written atomically, by renaming a fully written temporary file,
+// so a crash never leaves a partially written value. Expired files are
+// removed periodically by a background process, which also evicts least
+// recently used files if the size limit is exceeded. Call Close to stop it
+// once cache is no longer needed.
+type FilesystemCache struct {
+	// mu serializes writes. Files are replaced atomically, so readers
+	// never see a partial write, but read-modify-write operations must be
+	// exclusive.
+	mu       sync.RWMutex
+	rootDir  string
+	maxBytes int64
+
+	stop chan struct{}
+	once sync.Once
+}
+
+var _ CounterCache = (*FilesystemCache)(nil)
+
+// FilesystemCacheOpts defines options for the filesystem cache.
+type FilesystemCacheOpts struct {
+	// MaxBytes is the maximum size of all cache files. When exceeded,
+	// least recently used files are removed by the garbage collection.
+	// Zero means no limit.
+	MaxBytes int64
+
+	// GCInterval defines how often expired files are removed. Defaults to
+	// one minute.
+	GCInterval time.Duration
+}
+
+// NewFilesystemCache returns cache that is storing values in files inside of
+// given directory, using default options.
+func NewFilesystemCache(rootDir string) (*FilesystemCache, error) {
+	return NewFilesystemCacheWithOpts(rootDir, nil)
+}
+
+// NewFilesystemCacheWithOpts returns cache that is storing values in files
+// inside of given directory. Directory is created if it does not exist.
+func NewFilesystemCacheWithOpts(rootDir string, o *FilesystemCacheOpts) (*FilesystemCache, error) {
+	if o == nil {
+		o = &FilesystemCacheOpts{}
+	}
+	interval := o.GCInterval
+	if interval <= 0 {
+		interval = time.Minute
 	}
+	if err := os.MkdirAll(rootDir, 0770); err != nil {
+		return nil, errors.Wrap(ErrInternal, "cannot create cache directory: %s", err)
+	}
+	f := &FilesystemCache{
+		rootDir:  rootDir,
+		maxBytes: o.MaxBytes,
+		stop:     make(chan struct{}),
+	}
+	go f.gcLoop(interval)
+	return f, nil
 }
 
-type fscache struct {
-	mu      sync.RWMutex
-	rootDir string
+// Close stops the background garbage collection.
+func (f *FilesystemCache) Close() error {
+	f.once.Do(func() { close(f.stop) })
+	return nil
 }
 
-func (f *fscache) cachePath(key string) string {
+// tempFilePrefix is used by files that are being written.
+const tempFilePrefix = ".tmp-"
+
+func (f *FilesystemCache) cachePath(key string) string {
 	h := sha1.Sum([]byte(key))
-	return path.Join(f.rootDir, hex.EncodeToString(h[:]))
+	name := hex.EncodeToString(h[:])
+	return filepath.Join(f.rootDir, name[:2], name)
 }
 
-func (f *fscache) Get(ctx context.Context, key string, dest interface{}) error {
+func (f *FilesystemCache) Get(ctx context.Context, key string, dest interface{}) error {
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
@@ -43,39 +107,37 @@ func (f *fscache) Get(ctx context.Context, key string, dest interface{}) error {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
-	b, err := ioutil.ReadFile(f.cachePath(key))
+	item, err := f.read(key)
 	if err != nil {
-		return ErrMiss
-	}
-	var item fscacheItem
-	if err := CacheUnmarshal(b, &item); err != nil {
-		return errors.Wrap(err, "cannot unmarshal")
-	}
-	if item.validTill.Before(time.Now()) {
-		_ = os.Remove(f.cachePath(key))
-		return ErrMiss
+		return err
 	}
 
+	// Access time is recorded as the modification time, because access
+	// time is not updated by many filesystems. Expiration time is
+	// stored in the file content.
+	now := time.Now()
+	_ = os.Chtimes(f.cachePath(key), now, now)
+
 	if err := CacheUnmarshal(item.value, dest); err != nil {
 		return errors.Wrap(err, "cannot unmarshal")
 	}
 	return nil
 }
 
-func (f *fscache) Set(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+func (f *FilesystemCache) Set(ctx context.Context, key string, value interface{}, exp time.Duration) error {
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
 	default:
 	}
 
-	f.mu.RLock()
-	defer f.mu.RUnlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
-	return f.set(ctx, key, value, exp)
+	return f.set(key, value, exp)
 }
 
-func (f *fscache) set(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+func (f *FilesystemCache) set(key string, value interface{}, exp time.Duration) error {
 	rawValue, err := CacheMarshal(value)
 	if err != nil {
 		return errors.Wrap(err, "cannot marshal")
@@ -85,19 +147,46 @@ func (f *fscache) set(ctx context.Context, key string, value interface{}, exp ti
 		validTill: time.Now().Add(exp),
 		value:     rawValue,
 	}
-	b, err := CacheMarshal(&item)
+	return f.write(key, &item)
+}
+
+// write atomically replaces file of given key with given item.
+func (f *FilesystemCache) write(key string, item *fscacheItem) error {
+	b, err := CacheMarshal(item)
 	if err != nil {
 		return errors.Wrap(err, "cannot marshal")
 	}
 
-	if err := ioutil.WriteFile(f.cachePath(key), b, 0660); err != nil {
-		_ = os.Remove(f.cachePath(key))
+	path := f.cachePath(key)
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return errors.Wrap(ErrInternal, "cannot create directory: %s", err)
+	}
+	tmp, err := ioutil.TempFile(dir, tempFilePrefix)
+	if err != nil {
+		return errors.Wrap(ErrInternal, "cannot create file: %s", err)
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0660)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
 		return errors.Wrap(ErrInternal, "cannot persist: %s", err)
 	}
 	return nil
 }
 
-func (f *fscache) SetNx(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+func (f *FilesystemCache) SetNx(ctx context.Context, key string, value interface{}, exp time.Duration) error {
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
@@ -107,19 +196,19 @@ func (f *fscache) SetNx(ctx context.Context, key string, value interface{}, exp
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	switch err := f.exists(key); err {
-	case ErrMiss:
+	switch _, err := f.read(key); {
+	case ErrMiss.Is(err):
 		// all good
-	case nil:
+	case err == nil:
 		return errors.Wrap(ErrConflict, "exist")
 	default:
 		return err
 	}
 
-	return f.set(ctx, key, value, exp)
+	return f.set(key, value, exp)
 }
 
-func (f *fscache) Del(ctx context.Context, key string) error {
+func (f *FilesystemCache) Del(ctx context.Context, key string) error {
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
@@ -129,31 +218,202 @@ func (f *fscache) Del(ctx context.Context, key string) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	if err := f.exists(key); err != nil {
+	if _, err := f.read(key); err != nil {
 		return err
 	}
 
-	os.Remove(f.cachePath(key))
+	if err := os.Remove(f.cachePath(key)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(ErrInternal, "cannot remove: %s", err)
+	}
 	return nil
 }
 
-func (f *fscache) exists(key string) error {
-	b, err := ioutil.ReadFile(f.cachePath(key))
+func (f *FilesystemCache) Incr(ctx context.Context, key string, delta int64, exp time.Duration) (int64, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	default:
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	item, err := f.read(key)
+	switch {
+	case err == nil:
+		// all good
+	case ErrMiss.Is(err):
+		item = &fscacheItem{validTill: counterExpireAt(time.Now(), exp)}
+	default:
+		return 0, err
+	}
+
+	n, raw, err := incrRaw(item.value, delta)
 	if err != nil {
-		return ErrMiss
+		return 0, err
+	}
+	item.value = raw
+	if err := f.write(key, item); err != nil {
+		return 0, err
 	}
+	return n, nil
+}
 
+func (f *FilesystemCache) CompareAndSwap(ctx context.Context, key string, old, value interface{}, exp time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	item, err := f.read(key)
+	if err != nil {
+		return err
+	}
+	if eq, err := equalRaw(item.value, old); err != nil {
+		return err
+	} else if !eq {
+		return errors.Wrap(ErrConflict, "value changed")
+	}
+	return f.set(key, value, exp)
+}
+
+// read returns item stored under given key. ErrMiss is returned if item
+// does not exist or is expired. Expired items are left for the garbage
+// collection.
+func (f *FilesystemCache) read(key string) (*fscacheItem, error) {
+	b, err := ioutil.ReadFile(f.cachePath(key))
+	if err != nil {
+		return nil, ErrMiss
+	}
 	var item fscacheItem
 	if err := CacheUnmarshal(b, &item); err != nil {
-		return errors.Wrap(err, "cannot unmarshal")
+		return nil, errors.Wrap(err, "cannot unmarshal")
 	}
 	if item.validTill.Before(time.Now()) {
-		os.Remove(f.cachePath(key))
-		return ErrMiss
+		return nil, ErrMiss
+	}
+	return &item, nil
+}
+
+func (f *FilesystemCache) gcLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-t.C:
+			if err := f.GC(); err != nil {
+				LogError(context.Background(), err, "filesystem cache garbage collection failed",
+					"dir", f.rootDir)
+			}
+		}
+	}
+}
+
+// GC removes expired files and, if the size limit is exceeded, least
+// recently used files until the total size is within the limit. Temporary
+// files left by interrupted writes are removed as well. GC is called
+// periodically by the background process.
+func (f *FilesystemCache) GC() error {
+	type fileInfo struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	now := time.Now()
+	var (
+		remove []fileInfo
+		keep   []fileInfo
+		total  int64
+	)
+	err := filepath.Walk(f.rootDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// removed concurrently
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		fi := fileInfo{path: path, size: info.Size(), modTime: info.ModTime()}
+		if strings.HasPrefix(info.Name(), tempFilePrefix) {
+			// Give writes in progress enough time to finish.
+			if now.Sub(info.ModTime()) > time.Hour {
+				remove = append(remove, fi)
+			}
+			return nil
+		}
+		if validTill, err := readValidTill(path); err != nil || validTill.Before(now) {
+			remove = append(remove, fi)
+			return nil
+		}
+		keep = append(keep, fi)
+		total += fi.size
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(ErrInternal, "cannot walk cache directory: %s", err)
+	}
+
+	if f.maxBytes > 0 && total > f.maxBytes {
+		sort.Slice(keep, func(i, j int) bool {
+			return keep[i].modTime.Before(keep[j].modTime)
+		})
+		for _, fi := range keep {
+			if total <= f.maxBytes {
+				break
+			}
+			remove = append(remove, fi)
+			total -= fi.size
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, fi := range remove {
+		// File modified since it was inspected was either accessed or
+		// replaced with a new value and must be kept.
+		info, err := os.Stat(fi.path)
+		if err != nil || !info.ModTime().Equal(fi.modTime) {
+			continue
+		}
+		if err := os.Remove(fi.path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(ErrInternal, "cannot remove: %s", err)
+		}
 	}
 	return nil
 }
 
+// readValidTill returns expiration time of the item stored in given file,
+// without reading the whole file.
+func readValidTill(path string) (time.Time, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer fd.Close()
+
+	line, err := bufio.NewReader(fd).ReadString('\n')
+	if err != nil {
+		return time.Time{}, err
+	}
+	unixNano, err := strconv.ParseInt(strings.TrimSuffix(line, "\n"), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, unixNano), nil
+}
+
 type fscacheItem struct {
 	validTill time.Time
 	value     []byte
@@ -1,9 +1,14 @@
 package surf
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestFilesystemCache(t *testing.T) {
@@ -14,6 +19,137 @@ func TestFilesystemCache(t *testing.T) {
 	t.Logf("temporary cache directory created: %s", dir)
 	defer os.RemoveAll(dir)
 
-	cache := NewFilesystemCache(dir)
-	RunCacheImplementationTest(t, cache)
+	cache, err := NewFilesystemCache(dir)
+	if err != nil {
+		t.Fatalf("cannot create cache: %s", err)
+	}
+	defer cache.Close()
+	RunCacheConformanceTest(t, cache, &CacheCapabilities{Counters: true})
+}
+
+func TestFilesystemCacheInvalidDirectory(t *testing.T) {
+	file, err := ioutil.TempFile("", "surf_cache_fs_test_")
+	if err != nil {
+		t.Fatalf("cannot create temporary file: %s", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	if _, err := NewFilesystemCache(filepath.Join(file.Name(), "cache")); !ErrInternal.Is(err) {
+		t.Fatalf("want ErrInternal, got %+v", err)
+	}
+}
+
+func TestFilesystemCacheLayout(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "surf_cache_fs_test_")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewFilesystemCache(dir)
+	if err != nil {
+		t.Fatalf("cannot create cache: %s", err)
+	}
+	defer cache.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := cache.Set(ctx, "key", strings.Repeat("x", 10000), time.Minute); err != nil {
+				t.Errorf("cannot set: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var files []string
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, rel)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("cannot walk: %s", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("want a single file, got %q", files)
+	}
+	if chunks := strings.Split(files[0], string(filepath.Separator)); len(chunks) != 2 || !strings.HasPrefix(chunks[1], chunks[0]) {
+		t.Fatalf("want file in hash prefix directory, got %q", files[0])
+	}
+}
+
+func TestFilesystemCacheGC(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "surf_cache_fs_test_")
+	if err != nil {
+		t.Fatalf("cannot create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewFilesystemCacheWithOpts(dir, &FilesystemCacheOpts{
+		MaxBytes:   350,
+		GCInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("cannot create cache: %s", err)
+	}
+	defer cache.Close()
+
+	value := strings.Repeat("x", 80)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := cache.Set(ctx, key, value, time.Minute); err != nil {
+			t.Fatalf("cannot set: %s", err)
+		}
+	}
+	if err := cache.Set(ctx, "expired", value, time.Millisecond); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+
+	// Modification time is the access time. Make "a" the least recently
+	// used one, followed by "c".
+	past := time.Now().Add(-time.Hour)
+	for i, key := range []string{"a", "c", "b", "d"} {
+		at := past.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(cache.cachePath(key), at, at); err != nil {
+			t.Fatalf("cannot change time: %s", err)
+		}
+	}
+	// left by an interrupted write
+	tmp := filepath.Join(dir, tempFilePrefix+"interrupted")
+	if err := ioutil.WriteFile(tmp, []byte("partial"), 0660); err != nil {
+		t.Fatalf("cannot write: %s", err)
+	}
+	if err := os.Chtimes(tmp, past.Add(-time.Hour), past.Add(-time.Hour)); err != nil {
+		t.Fatalf("cannot change time: %s", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if err := cache.GC(); err != nil {
+		t.Fatalf("gc failed: %s", err)
+	}
+
+	for key, exists := range map[string]bool{
+		"expired": false,
+		"a":       false,
+		"c":       true,
+		"b":       true,
+		"d":       true,
+	} {
+		_, err := os.Stat(cache.cachePath(key))
+		if exists != (err == nil) {
+			t.Errorf("%s: want exists %v, got %v", key, exists, err)
+		}
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("temporary file not removed: %v", err)
+	}
 }
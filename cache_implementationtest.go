@@ -1,25 +1,120 @@
 package surf
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"math"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
+// CacheCapabilities declares optional features of a cache implementation.
+type CacheCapabilities struct {
+	// Batch requires cache to implement BatchCacheService.
+	Batch bool
+
+	// Counters requires cache to implement CounterCache.
+	Counters bool
+
+	// Advance moves the clock used by the cache forward by given
+	// duration. If set, expiration is tested by advancing the clock
+	// instead of waiting.
+	Advance func(time.Duration)
+}
+
+// RunCacheConformanceTest ensures given cache conforms to the CacheService
+// contract and to contracts of declared optional capabilities. Capabilities
+// are optional and only CacheService is tested if nil.
+//
+// Cache must be empty and must not be used by anything else while the test
+// is running.
+func RunCacheConformanceTest(t *testing.T, c CacheService, caps *CacheCapabilities) {
+	if caps == nil {
+		caps = &CacheCapabilities{}
+	}
+
+	runCacheImplementationTest(t, c, caps.Advance)
+
+	if caps.Batch {
+		bc, ok := c.(BatchCacheService)
+		if !ok {
+			t.Fatalf("%T declares batch capability, but does not implement BatchCacheService", c)
+		}
+		t.Run("Batch", func(t *testing.T) {
+			RunBatchCacheImplementationTest(t, bc)
+		})
+	}
+	if caps.Counters {
+		cc, ok := c.(CounterCache)
+		if !ok {
+			t.Fatalf("%T declares counters capability, but does not implement CounterCache", c)
+		}
+		t.Run("Counters", func(t *testing.T) {
+			RunCounterCacheImplementationTest(t, cc)
+		})
+	}
+}
+
+// RunCacheImplementationTest ensures given cache conforms to the
+// CacheService contract. See RunCacheConformanceTest to test optional
+// capabilities as well.
 func RunCacheImplementationTest(t *testing.T, c CacheService) {
+	runCacheImplementationTest(t, c, nil)
+}
+
+// runCacheImplementationTest runs the CacheService tests. If advance is not
+// nil, it is used to move the clock of the cache instead of waiting.
+func runCacheImplementationTest(t *testing.T, c CacheService, advance func(time.Duration)) {
 	ctx := context.Background()
 
-	testCacheSimpleItemSerialization(ctx, t, c)
-	testCacheCustomItemSerialization(ctx, t, c)
-	testCacheOperations(ctx, t, c)
+	t.Run("SimpleItemSerialization", func(t *testing.T) {
+		testCacheSimpleItemSerialization(ctx, t, c)
+	})
+	t.Run("CustomItemSerialization", func(t *testing.T) {
+		testCacheCustomItemSerialization(ctx, t, c)
+	})
+	t.Run("Operations", func(t *testing.T) {
+		testCacheOperations(ctx, t, c)
+	})
+	t.Run("NonPositiveExpiration", func(t *testing.T) {
+		testCacheNonPositiveExpiration(ctx, t, c)
+	})
+	t.Run("LongKeys", func(t *testing.T) {
+		testCacheLongKeys(ctx, t, c)
+	})
+	t.Run("BinaryValues", func(t *testing.T) {
+		testCacheBinaryValues(ctx, t, c)
+	})
+	t.Run("CancelledContext", func(t *testing.T) {
+		testCacheCancelledContext(ctx, t, c)
+	})
+
+	// Scenarios below either wait or are concurrent, so they are run in
+	// parallel, using separate keys. The group returns only once all of
+	// them are done, so the cache can be released by the caller.
+	t.Run("Parallel", func(t *testing.T) {
+		t.Run("Expiration", func(t *testing.T) {
+			t.Parallel()
+			testCacheExpiration(ctx, t, c, advance)
+		})
+		t.Run("ConcurrentSetNx", func(t *testing.T) {
+			t.Parallel()
+			testCacheConcurrentSetNx(ctx, t, c)
+		})
+		t.Run("ConcurrentAccess", func(t *testing.T) {
+			t.Parallel()
+			testCacheConcurrentAccess(ctx, t, c)
+		})
+	})
 }
 
 func testCacheOperations(ctx context.Context, t *testing.T, c CacheService) {
 	// ensure basic operations are correct
-	if err := c.Set(ctx, "key-1", "abc", time.Second); err != nil {
+	if err := c.Set(ctx, "key-1", "abc", time.Minute); err != nil {
 		t.Fatalf("cannot set: %s", err)
 	}
 	var val string
@@ -36,15 +131,14 @@ func testCacheOperations(ctx context.Context, t *testing.T, c CacheService) {
 	} else if val != "abc" {
 		t.Fatalf("want abc value, got %q", val)
 	}
-
-	// wait for the value to expire and ensure it's gone
-	if err := c.Set(ctx, "key-exp", "abc", time.Second); err != nil {
-		t.Fatalf("cannot set: %s", err)
+	if err := c.Set(ctx, "key-1", "xyz", time.Minute); err != nil {
+		t.Fatalf("cannot overwrite: %s", err)
 	}
-	time.Sleep(time.Second + 20*time.Millisecond)
-	val = ""
-	if err := c.Get(ctx, "key-exp", &val); err != ErrMiss {
-		t.Fatalf("want ErrMiss, got: %+v (%q)", err, val)
+	if err := c.Get(ctx, "key-1", &val); err != nil || val != "xyz" {
+		t.Fatalf("want xyz, got %+v, %q", err, val)
+	}
+	if err := c.Get(ctx, "key-missing", &val); err != ErrMiss {
+		t.Fatalf("want ErrMiss, got %+v", err)
 	}
 
 	// deleting a key works
@@ -57,19 +151,271 @@ func testCacheOperations(ctx context.Context, t *testing.T, c CacheService) {
 	if err := c.Get(ctx, "key-2", &val); err != ErrMiss {
 		t.Fatalf("want ErrMiss, got: %+v (%q)", err, val)
 	}
+	if err := c.Del(ctx, "key-2"); err != ErrMiss {
+		t.Fatalf("want ErrMiss deleting twice, got %+v", err)
+	}
 	if err := c.Del(ctx, "key-does-not-exists"); err != ErrMiss {
 		t.Fatalf("want ErrMiss, got %+v", err)
 	}
+	if err := c.SetNx(ctx, "key-2", "456", time.Hour); err != nil {
+		t.Fatalf("cannot set deleted key: %s", err)
+	}
+}
+
+func testCacheExpiration(ctx context.Context, t *testing.T, c CacheService, advance func(time.Duration)) {
+	for _, key := range []string{"exp-get", "exp-del", "exp-setnx"} {
+		if err := c.Set(ctx, key, "abc", time.Second); err != nil {
+			t.Fatalf("cannot set %s: %s", key, err)
+		}
+	}
+	if err := c.Set(ctx, "exp-extended", "abc", time.Second); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	if err := c.Set(ctx, "exp-extended", "abc", time.Hour); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+
+	// wait for values to expire and ensure they are gone
+	if advance != nil {
+		advance(time.Second + 20*time.Millisecond)
+	} else {
+		time.Sleep(time.Second + 20*time.Millisecond)
+	}
 
-	// ensure very long keys are supported
+	var val string
+	if err := c.Get(ctx, "exp-get", &val); err != ErrMiss {
+		t.Fatalf("want ErrMiss, got: %+v (%q)", err, val)
+	}
+	if err := c.Del(ctx, "exp-del"); err != ErrMiss {
+		t.Fatalf("want ErrMiss deleting expired key, got %+v", err)
+	}
+	if err := c.SetNx(ctx, "exp-setnx", "new", time.Minute); err != nil {
+		t.Fatalf("cannot set expired key: %s", err)
+	}
+	if err := c.Get(ctx, "exp-setnx", &val); err != nil || val != "new" {
+		t.Fatalf("want new, got %+v, %q", err, val)
+	}
+	if err := c.Get(ctx, "exp-extended", &val); err != nil || val != "abc" {
+		t.Fatalf("want expiration time replaced by Set, got %+v, %q", err, val)
+	}
+}
+
+func testCacheNonPositiveExpiration(ctx context.Context, t *testing.T, c CacheService) {
+	// Value with non-positive expiration time expires immediately.
+	for _, exp := range []time.Duration{0, -time.Second} {
+		key := fmt.Sprintf("nonpositive-%d", exp)
+		var val string
+
+		if err := c.Set(ctx, key, "abc", exp); err != nil {
+			t.Fatalf("%s: cannot set: %s", exp, err)
+		}
+		if err := c.Get(ctx, key, &val); err != ErrMiss {
+			t.Fatalf("%s: want ErrMiss, got %+v (%q)", exp, err, val)
+		}
+		if err := c.SetNx(ctx, key, "abc", exp); err != nil {
+			t.Fatalf("%s: cannot set: %s", exp, err)
+		}
+		if err := c.Get(ctx, key, &val); err != ErrMiss {
+			t.Fatalf("%s: want ErrMiss, got %+v (%q)", exp, err, val)
+		}
+
+		// expiring existing value deletes it
+		if err := c.Set(ctx, key, "abc", time.Minute); err != nil {
+			t.Fatalf("%s: cannot set: %s", exp, err)
+		}
+		if err := c.Set(ctx, key, "abc", exp); err != nil {
+			t.Fatalf("%s: cannot set: %s", exp, err)
+		}
+		if err := c.Get(ctx, key, &val); err != ErrMiss {
+			t.Fatalf("%s: want ErrMiss, got %+v (%q)", exp, err, val)
+		}
+	}
+}
+
+func testCacheLongKeys(ctx context.Context, t *testing.T, c CacheService) {
+	// ensure very long keys are supported and that keys differing only
+	// at the end are not mixed up
 	veryLongKey := strings.Repeat("very-long-key", 1000)
-	if err := c.Set(ctx, veryLongKey, "123", time.Hour); err != nil {
+	for i, key := range []string{veryLongKey + "-1", veryLongKey + "-2"} {
+		if err := c.Set(ctx, key, i, time.Hour); err != nil {
+			t.Fatalf("cannot set: %s", err)
+		}
+	}
+	for i, key := range []string{veryLongKey + "-1", veryLongKey + "-2"} {
+		var val int
+		if err := c.Get(ctx, key, &val); err != nil || val != i {
+			t.Fatalf("want %d, got %+v, %d", i, err, val)
+		}
+	}
+	if err := c.Del(ctx, veryLongKey+"-1"); err != nil {
+		t.Fatalf("cannot delete: %s", err)
+	}
+	var val int
+	if err := c.Get(ctx, veryLongKey+"-2", &val); err != nil || val != 1 {
+		t.Fatalf("want 1, got %+v, %d", err, val)
+	}
+
+	// keys with special characters
+	for i, key := range []string{"key with spaces", "key\twith\ncontrol", "klucz-żółw-ключ", "key:{tag}"} {
+		if err := c.Set(ctx, key, i, time.Hour); err != nil {
+			t.Fatalf("%q: cannot set: %s", key, err)
+		}
+		if err := c.Get(ctx, key, &val); err != nil || val != i {
+			t.Fatalf("%q: want %d, got %+v, %d", key, i, err, val)
+		}
+	}
+}
+
+func testCacheBinaryValues(ctx context.Context, t *testing.T, c CacheService) {
+	value := make([]byte, 256*4)
+	for i := range value {
+		value[i] = byte(i)
+	}
+	if err := c.Set(ctx, "binary", value, time.Minute); err != nil {
 		t.Fatalf("cannot set: %s", err)
 	}
-	val = ""
-	if err := c.Get(ctx, veryLongKey, &val); err != nil || val != "123" {
-		t.Fatalf("want 123, got %+v, %q", err, val)
+	var res []byte
+	if err := c.Get(ctx, "binary", &res); err != nil {
+		t.Fatalf("cannot get: %s", err)
+	}
+	if !bytes.Equal(value, res) {
+		t.Fatalf("binary value changed: %x", res)
+	}
+
+	// empty values are not a miss
+	if err := c.Set(ctx, "binary-empty", []byte{}, time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	res = nil
+	if err := c.Get(ctx, "binary-empty", &res); err != nil || len(res) != 0 {
+		t.Fatalf("want empty value, got %+v, %x", err, res)
+	}
+}
+
+func testCacheCancelledContext(ctx context.Context, t *testing.T, c CacheService) {
+	if err := c.Set(ctx, "cancelled", "abc", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	// Cache may ignore cancelled context, but if it fails the operation,
+	// the error must not be mistaken for a result of the operation.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		var val string
+		switch err := c.Get(cancelled, "cancelled", &val); {
+		case err == nil:
+			if val != "abc" {
+				t.Errorf("Get: want abc, got %q", val)
+			}
+		case ErrMiss.Is(err):
+			t.Errorf("Get: cancelled operation returned ErrMiss")
+		}
+		switch err := c.SetNx(cancelled, "cancelled", "xyz", time.Minute); {
+		case err == nil:
+			t.Errorf("SetNx: want conflict or failure, got success")
+		case ErrConflict.Is(err), ErrMiss.Is(err):
+		}
+		if err := c.Set(cancelled, "cancelled-set", "abc", time.Minute); err == nil {
+			if err := c.Get(ctx, "cancelled-set", &val); err != nil || val != "abc" {
+				t.Errorf("Set: succeeded, but value is not stored: %+v, %q", err, val)
+			}
+		}
+		if err := c.Del(cancelled, "cancelled"); ErrMiss.Is(err) {
+			t.Errorf("Del: cancelled operation returned ErrMiss")
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("operations with cancelled context did not return")
+	}
+}
+
+func testCacheConcurrentSetNx(ctx context.Context, t *testing.T, c CacheService) {
+	const (
+		rounds  = 10
+		workers = 8
+	)
+	for round := 0; round < rounds; round++ {
+		key := fmt.Sprintf("setnx-race-%d", round)
+
+		var (
+			wg      sync.WaitGroup
+			mu      sync.Mutex
+			winners []int
+		)
+		start := make(chan struct{})
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				switch err := c.SetNx(ctx, key, i, time.Minute); {
+				case err == nil:
+					mu.Lock()
+					winners = append(winners, i)
+					mu.Unlock()
+				case !ErrConflict.Is(err):
+					t.Errorf("cannot set: %s", err)
+				}
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+
+		if len(winners) != 1 {
+			t.Fatalf("round %d: want exactly one SetNx to succeed, got %v", round, winners)
+		}
+		var val int
+		if err := c.Get(ctx, key, &val); err != nil || val != winners[0] {
+			t.Fatalf("round %d: want %d stored, got %+v, %d", round, winners[0], err, val)
+		}
+	}
+}
+
+func testCacheConcurrentAccess(ctx context.Context, t *testing.T, c CacheService) {
+	const (
+		workers = 8
+		ops     = 50
+		keys    = 4
+	)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := 0; n < ops; n++ {
+				key := fmt.Sprintf("concurrent-%d", (i+n)%keys)
+				switch n % 3 {
+				case 0:
+					if err := c.Set(ctx, key, &testCacheItem{A: key, B: i}, time.Minute); err != nil {
+						t.Errorf("cannot set: %s", err)
+					}
+				case 1:
+					var item testCacheItem
+					switch err := c.Get(ctx, key, &item); {
+					case err == nil:
+						if item.A != key || item.B < 0 || item.B >= workers {
+							t.Errorf("unexpected value of %s: %#v", key, item)
+						}
+					case err != ErrMiss:
+						t.Errorf("cannot get: %s", err)
+					}
+				case 2:
+					if err := c.Del(ctx, key); err != nil && err != ErrMiss {
+						t.Errorf("cannot delete: %s", err)
+					}
+				}
+			}
+		}(i)
 	}
+	wg.Wait()
 }
 
 func testCacheSimpleItemSerialization(ctx context.Context, t *testing.T, c CacheService) {
@@ -136,3 +482,212 @@ func (it *testCacheItem2) UnmarshalCache(raw []byte) error {
 	_, err := fmt.Sscanf(string(raw), "%d\t%s", &it.B, &it.A)
 	return err
 }
+
+// RunBatchCacheImplementationTest ensures batch operations of given cache
+// are correct.
+func RunBatchCacheImplementationTest(t *testing.T, c BatchCacheService) {
+	ctx := context.Background()
+
+	err := c.SetMulti(ctx, []CacheItem{
+		{Key: "batch-1", Value: "one", Exp: time.Minute},
+		{Key: "batch-2", Value: &testCacheItem{A: "two", B: 2}, Exp: time.Minute},
+		{Key: "batch-3", Value: "three", Exp: time.Minute},
+	})
+	if err != nil {
+		t.Fatalf("cannot set multi: %s", err)
+	}
+
+	var (
+		one   string
+		two   testCacheItem
+		three string
+		none  string
+	)
+	keys := []string{"batch-1", "batch-2", "batch-missing", "batch-3"}
+	errs, err := c.GetMulti(ctx, keys, []interface{}{&one, &two, &none, &three})
+	if err != nil {
+		t.Fatalf("cannot get multi: %s", err)
+	}
+	if len(errs) != len(keys) {
+		t.Fatalf("want %d results, got %d", len(keys), len(errs))
+	}
+	if errs[0] != nil || one != "one" {
+		t.Fatalf("want one, got %+v, %q", errs[0], one)
+	}
+	if want := (testCacheItem{A: "two", B: 2}); errs[1] != nil || two != want {
+		t.Fatalf("want %#v, got %+v, %#v", want, errs[1], two)
+	}
+	if !ErrMiss.Is(errs[2]) {
+		t.Fatalf("want ErrMiss, got %+v (%q)", errs[2], none)
+	}
+	if errs[3] != nil || three != "three" {
+		t.Fatalf("want three, got %+v, %q", errs[3], three)
+	}
+
+	if _, err := c.GetMulti(ctx, keys, []interface{}{&one}); !ErrValidation.Is(err) {
+		t.Fatalf("want ErrValidation, got %+v", err)
+	}
+
+	if err := c.DelMulti(ctx, []string{"batch-1", "batch-3", "batch-missing"}); err != nil {
+		t.Fatalf("cannot delete multi: %s", err)
+	}
+	errs, err = c.GetMulti(ctx, []string{"batch-1", "batch-2", "batch-3"}, []interface{}{&one, &two, &three})
+	if err != nil {
+		t.Fatalf("cannot get multi: %s", err)
+	}
+	if !ErrMiss.Is(errs[0]) || errs[1] != nil || !ErrMiss.Is(errs[2]) {
+		t.Fatalf("unexpected results after delete: %v", errs)
+	}
+}
+
+// RunCounterCacheImplementationTest ensures atomic operations of given cache
+// are correct.
+func RunCounterCacheImplementationTest(t *testing.T, c CounterCache) {
+	ctx := context.Background()
+
+	if n, err := c.Incr(ctx, "counter", 3, time.Minute); err != nil || n != 3 {
+		t.Fatalf("want 3, got %d, %+v", n, err)
+	}
+	if n, err := c.Incr(ctx, "counter", -5, time.Minute); err != nil || n != -2 {
+		t.Fatalf("want -2, got %d, %+v", n, err)
+	}
+	var stored int64
+	if err := c.Get(ctx, "counter", &stored); err != nil || stored != -2 {
+		t.Fatalf("want -2 stored, got %d, %+v", stored, err)
+	}
+	if n, err := CacheDecr(ctx, c, "counter", 4, time.Minute); err != nil || n != -6 {
+		t.Fatalf("want -6, got %d, %+v", n, err)
+	}
+	if n, err := CacheDecr(ctx, c, "counter-decr", 2, time.Minute); err != nil || n != -2 {
+		t.Fatalf("want -2, got %d, %+v", n, err)
+	}
+	if _, err := CacheDecr(ctx, c, "counter", math.MinInt64, time.Minute); !ErrValidation.Is(err) {
+		t.Fatalf("want ErrValidation, got %+v", err)
+	}
+
+	// Counter created without expiration does not expire, and expiration
+	// given to later calls does not change that.
+	if n, err := c.Incr(ctx, "counter-persistent", 1, 0); err != nil || n != 1 {
+		t.Fatalf("want 1, got %d, %+v", n, err)
+	}
+	if n, err := c.Incr(ctx, "counter-persistent", 1, time.Millisecond); err != nil || n != 2 {
+		t.Fatalf("want 2, got %d, %+v", n, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n, err := c.Incr(ctx, "counter-persistent", 1, time.Minute); err != nil || n != 3 {
+		t.Fatalf("want 3, got %d, %+v", n, err)
+	}
+
+	if err := c.Set(ctx, "counter-text", "abc", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	if _, err := c.Incr(ctx, "counter-text", 1, time.Minute); !ErrCacheMalformed.Is(err) {
+		t.Fatalf("want ErrCacheMalformed, got %+v", err)
+	}
+
+	const workers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Incr(ctx, "counter-concurrent", 1, time.Minute); err != nil {
+				t.Errorf("cannot increment: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := c.Get(ctx, "counter-concurrent", &stored); err != nil || stored != workers {
+		t.Fatalf("want %d, got %d, %+v", workers, stored, err)
+	}
+
+	if err := c.CompareAndSwap(ctx, "cas-missing", "a", "b", time.Minute); !ErrMiss.Is(err) {
+		t.Fatalf("want ErrMiss, got %+v", err)
+	}
+	if err := c.Set(ctx, "cas", &testCacheItem{A: "a", B: 1}, time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	err := c.CompareAndSwap(ctx, "cas", &testCacheItem{A: "x", B: 1}, &testCacheItem{A: "b", B: 2}, time.Minute)
+	if !ErrConflict.Is(err) {
+		t.Fatalf("want ErrConflict, got %+v", err)
+	}
+	err = c.CompareAndSwap(ctx, "cas", &testCacheItem{A: "a", B: 1}, &testCacheItem{A: "b", B: 2}, time.Minute)
+	if err != nil {
+		t.Fatalf("cannot compare and swap: %s", err)
+	}
+	var item testCacheItem
+	if err := c.Get(ctx, "cas", &item); err != nil {
+		t.Fatalf("cannot get: %s", err)
+	}
+	if want := (testCacheItem{A: "b", B: 2}); item != want {
+		t.Fatalf("want %#v, got %#v", want, item)
+	}
+}
+
+// RunTaggedCacheImplementationTest ensures tag based invalidation works with
+// given cache used as a storage.
+func RunTaggedCacheImplementationTest(t *testing.T, c CacheService) {
+	ctx := context.Background()
+	tc := NewTaggedCache(c)
+
+	RunCacheImplementationTest(t, tc)
+
+	if err := tc.SetTagged(ctx, "tagged-1", "one", time.Minute, "user:42", "listing"); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	if err := tc.SetTagged(ctx, "tagged-2", "two", time.Minute, "user:42"); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	if err := tc.SetTagged(ctx, "tagged-3", "three", time.Minute, "listing"); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	if err := tc.Set(ctx, "untagged", "four", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+
+	var val string
+	if err := tc.Get(ctx, "tagged-1", &val); err != nil || val != "one" {
+		t.Fatalf("want one, got %q, %+v", val, err)
+	}
+
+	if err := tc.InvalidateTag(ctx, "user:42"); err != nil {
+		t.Fatalf("cannot invalidate tag: %s", err)
+	}
+	for _, key := range []string{"tagged-1", "tagged-2"} {
+		if err := tc.Get(ctx, key, &val); !ErrMiss.Is(err) {
+			t.Fatalf("%s: want ErrMiss, got %+v (%q)", key, err, val)
+		}
+	}
+	if err := tc.Get(ctx, "tagged-3", &val); err != nil || val != "three" {
+		t.Fatalf("want three, got %q, %+v", val, err)
+	}
+	if err := tc.Get(ctx, "untagged", &val); err != nil || val != "four" {
+		t.Fatalf("want four, got %q, %+v", val, err)
+	}
+
+	// invalidated entry is not in use
+	if err := tc.SetNxTagged(ctx, "tagged-2", "two again", time.Minute, "user:42"); err != nil {
+		t.Fatalf("cannot set invalidated entry: %s", err)
+	}
+	if err := tc.Get(ctx, "tagged-2", &val); err != nil || val != "two again" {
+		t.Fatalf("want two again, got %q, %+v", val, err)
+	}
+	if err := tc.SetNxTagged(ctx, "tagged-2", "conflict", time.Minute, "user:42"); !ErrConflict.Is(err) {
+		t.Fatalf("want ErrConflict, got %+v", err)
+	}
+
+	if err := tc.InvalidateTag(ctx, "listing"); err != nil {
+		t.Fatalf("cannot invalidate tag: %s", err)
+	}
+	if err := tc.Get(ctx, "tagged-3", &val); !ErrMiss.Is(err) {
+		t.Fatalf("want ErrMiss, got %+v (%q)", err, val)
+	}
+	if err := tc.Get(ctx, "tagged-2", &val); err != nil || val != "two again" {
+		t.Fatalf("want two again, got %q, %+v", val, err)
+	}
+
+	// tag that was never used can be invalidated
+	if err := tc.InvalidateTag(ctx, "never-used"); err != nil {
+		t.Fatalf("cannot invalidate tag: %s", err)
+	}
+}
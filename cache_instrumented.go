@@ -0,0 +1,546 @@
+package surf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InstrumentedCache is a cache wrapper that collects metrics of all
+// operations. Number of hits, misses and errors, latency and payload size
+// are grouped by key prefix and operation.
+//
+// Metrics can be exposed in Prometheus text format, either by serving the
+// cache over HTTP or by using WriteCacheMetrics. Pass instrumented caches to
+// DebugToolbarMiddleware to inspect them in the debug toolbar.
+//
+// Payload size is the size of the value serialized using CacheMarshal,
+// which requires serializing every value once more. It is collected only if
+// enabled with InstrumentedCacheOpts.PayloadSize.
+//
+// InstrumentedCache does not implement CounterCache, so that wrapping a
+// cache without counters does not claim support for them. Use
+// InstrumentedCounterCache to wrap a CounterCache.
+type InstrumentedCache struct {
+	name        string
+	cache       CacheService
+	keyPrefix   func(string) string
+	payloadSize bool
+
+	mu    sync.Mutex
+	stats map[cacheStatKey]*cacheStat
+}
+
+var _ BatchCacheService = (*InstrumentedCache)(nil)
+
+// InstrumentedCacheOpts defines options for the instrumented cache.
+type InstrumentedCacheOpts struct {
+	// KeyPrefix returns the prefix by which metrics of given key are
+	// grouped. Defaults to the part of the key before the first colon,
+	// or an empty string if key contains no colon.
+	KeyPrefix func(key string) string
+
+	// PayloadSize enables collecting the size of values read or
+	// written. Each value is serialized once more to measure it.
+	PayloadSize bool
+}
+
+// NewInstrumentedCache returns cache wrapper collecting metrics of given
+// cache. Name identifies the cache in metrics and must be unique. Use
+// NewInstrumentedCounterCache if given cache implements CounterCache.
+func NewInstrumentedCache(cache CacheService, name string, o *InstrumentedCacheOpts) *InstrumentedCache {
+	if o == nil {
+		o = &InstrumentedCacheOpts{}
+	}
+	keyPrefix := o.KeyPrefix
+	if keyPrefix == nil {
+		keyPrefix = defaultKeyPrefix
+	}
+	return &InstrumentedCache{
+		name:        name,
+		cache:       cache,
+		keyPrefix:   keyPrefix,
+		payloadSize: o.PayloadSize,
+		stats:       make(map[cacheStatKey]*cacheStat),
+	}
+}
+
+// InstrumentedCounterCache is an InstrumentedCache that wraps a
+// CounterCache and collects metrics of its atomic operations as well.
+type InstrumentedCounterCache struct {
+	*InstrumentedCache
+	counters CounterCache
+}
+
+var _ CounterCache = (*InstrumentedCounterCache)(nil)
+
+// NewInstrumentedCounterCache returns cache wrapper collecting metrics of
+// given cache, including its atomic operations. See NewInstrumentedCache.
+func NewInstrumentedCounterCache(cache CounterCache, name string, o *InstrumentedCacheOpts) *InstrumentedCounterCache {
+	return &InstrumentedCounterCache{
+		InstrumentedCache: NewInstrumentedCache(cache, name, o),
+		counters:          cache,
+	}
+}
+
+func defaultKeyPrefix(key string) string {
+	if i := strings.IndexByte(key, ':'); i >= 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+// Name returns the name of the cache.
+func (c *InstrumentedCache) Name() string {
+	return c.name
+}
+
+func (c *InstrumentedCache) Get(ctx context.Context, key string, dest interface{}) error {
+	start := time.Now()
+	err := c.cache.Get(ctx, key, dest)
+	var size int
+	if err == nil {
+		size = c.size(dest)
+	}
+	c.observe(ctx, "Get", key, start, size, err)
+	return err
+}
+
+func (c *InstrumentedCache) Set(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	start := time.Now()
+	err := c.cache.Set(ctx, key, value, exp)
+	c.observe(ctx, "Set", key, start, c.size(value), err)
+	return err
+}
+
+func (c *InstrumentedCache) SetNx(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	start := time.Now()
+	err := c.cache.SetNx(ctx, key, value, exp)
+	var size int
+	if err == nil {
+		size = c.size(value)
+	}
+	c.observe(ctx, "SetNx", key, start, size, err)
+	return err
+}
+
+func (c *InstrumentedCache) Del(ctx context.Context, key string) error {
+	start := time.Now()
+	err := c.cache.Del(ctx, key)
+	c.observe(ctx, "Del", key, start, 0, err)
+	return err
+}
+
+func (c *InstrumentedCounterCache) Incr(ctx context.Context, key string, delta int64, exp time.Duration) (int64, error) {
+	start := time.Now()
+	n, err := c.counters.Incr(ctx, key, delta, exp)
+	c.observe(ctx, "Incr", key, start, 0, err)
+	return n, err
+}
+
+func (c *InstrumentedCounterCache) CompareAndSwap(ctx context.Context, key string, old, value interface{}, exp time.Duration) error {
+	start := time.Now()
+	err := c.counters.CompareAndSwap(ctx, key, old, value, exp)
+	var size int
+	if err == nil {
+		size = c.size(value)
+	}
+	c.observe(ctx, "CompareAndSwap", key, start, size, err)
+	return err
+}
+
+func (c *InstrumentedCache) GetMulti(ctx context.Context, keys []string, dests []interface{}) ([]error, error) {
+	start := time.Now()
+	errs, err := AsBatchCache(c.cache).GetMulti(ctx, keys, dests)
+	sizes := make([]int, len(keys))
+	results := make([]error, len(keys))
+	for i := range keys {
+		if err != nil {
+			results[i] = err
+			continue
+		}
+		results[i] = errs[i]
+		if errs[i] == nil {
+			sizes[i] = c.size(dests[i])
+		}
+	}
+	c.observeBatch(ctx, "GetMulti", keys, start, sizes, results)
+	return errs, err
+}
+
+func (c *InstrumentedCache) SetMulti(ctx context.Context, items []CacheItem) error {
+	start := time.Now()
+	err := AsBatchCache(c.cache).SetMulti(ctx, items)
+	keys := make([]string, len(items))
+	sizes := make([]int, len(items))
+	results := make([]error, len(items))
+	for i, it := range items {
+		keys[i] = it.Key
+		sizes[i] = c.size(it.Value)
+		results[i] = err
+	}
+	c.observeBatch(ctx, "SetMulti", keys, start, sizes, results)
+	return err
+}
+
+func (c *InstrumentedCache) DelMulti(ctx context.Context, keys []string) error {
+	start := time.Now()
+	err := AsBatchCache(c.cache).DelMulti(ctx, keys)
+	results := make([]error, len(keys))
+	for i := range keys {
+		results[i] = err
+	}
+	c.observeBatch(ctx, "DelMulti", keys, start, make([]int, len(keys)), results)
+	return err
+}
+
+// size returns the size of serialized value or zero if it cannot be
+// serialized or payload size is not collected.
+func (c *InstrumentedCache) size(value interface{}) int {
+	if !c.payloadSize {
+		return 0
+	}
+	b, err := CacheMarshal(value)
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
+
+// cacheResult returns the name of the result of an operation that returned
+// given error.
+func cacheResult(op string, err error) string {
+	switch {
+	case err == nil && (op == "Get" || op == "GetMulti"):
+		return "hit"
+	case err == nil:
+		return "ok"
+	case ErrMiss.Is(err):
+		return "miss"
+	case ErrConflict.Is(err):
+		return "conflict"
+	default:
+		return "error"
+	}
+}
+
+// cacheResults is the order in which results are listed.
+var cacheResults = []string{"hit", "miss", "ok", "conflict", "error"}
+
+func (c *InstrumentedCache) observe(ctx context.Context, op, key string, start time.Time, size int, err error) {
+	took := time.Since(start)
+	result := cacheResult(op, err)
+
+	c.mu.Lock()
+	st := c.stat(c.keyPrefix(key), op)
+	st.observe(took)
+	st.results[result]++
+	st.bytes += uint64(size)
+	c.mu.Unlock()
+
+	recordCacheOp(ctx, &cacheOp{
+		Cache:    c.name,
+		Op:       op,
+		Key:      key,
+		Result:   result,
+		Duration: took,
+		Size:     size,
+	})
+}
+
+// observeBatch records the result of every key of a batch operation.
+// Latency is recorded once for every prefix of given keys.
+func (c *InstrumentedCache) observeBatch(ctx context.Context, op string, keys []string, start time.Time, sizes []int, errs []error) {
+	took := time.Since(start)
+
+	results := make(map[string]int)
+	var size int
+	c.mu.Lock()
+	observed := make(map[string]bool)
+	for i, key := range keys {
+		prefix := c.keyPrefix(key)
+		st := c.stat(prefix, op)
+		if !observed[prefix] {
+			observed[prefix] = true
+			st.observe(took)
+		}
+		result := cacheResult(op, errs[i])
+		st.results[result]++
+		st.bytes += uint64(sizes[i])
+		results[result]++
+		size += sizes[i]
+	}
+	c.mu.Unlock()
+
+	summary := make([]string, 0, len(results))
+	for _, name := range cacheResults {
+		if n := results[name]; n > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", n, name))
+		}
+	}
+	recordCacheOp(ctx, &cacheOp{
+		Cache:    c.name,
+		Op:       op,
+		Key:      strings.Join(keys, " "),
+		Result:   strings.Join(summary, ", "),
+		Duration: took,
+		Size:     size,
+	})
+}
+
+// stat returns metrics of given prefix and operation. Lock must be acquired
+// by the caller.
+func (c *InstrumentedCache) stat(prefix, op string) *cacheStat {
+	k := cacheStatKey{prefix: prefix, op: op}
+	st, ok := c.stats[k]
+	if !ok {
+		st = &cacheStat{
+			results: make(map[string]uint64),
+			buckets: make([]uint64, len(cacheLatencyBuckets)),
+		}
+		c.stats[k] = st
+	}
+	return st
+}
+
+type cacheStatKey struct {
+	prefix string
+	op     string
+}
+
+type cacheStat struct {
+	results map[string]uint64
+	// buckets counts calls that took no longer than the latency bucket
+	// with the same index.
+	buckets  []uint64
+	calls    uint64
+	duration time.Duration
+	bytes    uint64
+}
+
+func (st *cacheStat) observe(took time.Duration) {
+	st.calls++
+	st.duration += took
+	for i, le := range cacheLatencyBuckets {
+		if took <= le {
+			st.buckets[i]++
+		}
+	}
+}
+
+// cacheLatencyBuckets are upper bounds of latency histogram buckets.
+var cacheLatencyBuckets = []time.Duration{
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+}
+
+// CacheStats contains metrics of a single operation on keys with the same
+// prefix.
+type CacheStats struct {
+	Prefix string
+	Op     string
+
+	// Number of keys by the result of the operation. Batch operations
+	// count a result for every key.
+	Hits      uint64
+	Misses    uint64
+	OK        uint64
+	Conflicts uint64
+	Errors    uint64
+
+	// Calls is the number of calls. Duration is the total time spent in
+	// all of them.
+	Calls    uint64
+	Duration time.Duration
+
+	// Bytes is the total size of values read or written. It is zero
+	// unless payload size is collected.
+	Bytes uint64
+}
+
+// AvgDuration returns the average duration of a call.
+func (s CacheStats) AvgDuration() time.Duration {
+	if s.Calls == 0 {
+		return 0
+	}
+	return s.Duration / time.Duration(s.Calls)
+}
+
+// Stats returns current metrics, ordered by prefix and operation.
+func (c *InstrumentedCache) Stats() []CacheStats {
+	stats, _ := c.snapshot()
+	return stats
+}
+
+// snapshot returns current metrics, ordered by prefix and operation, and
+// latency histogram buckets of metrics with the same index.
+func (c *InstrumentedCache) snapshot() ([]CacheStats, [][]uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]cacheStatKey, 0, len(c.stats))
+	for k := range c.stats {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].prefix != keys[j].prefix {
+			return keys[i].prefix < keys[j].prefix
+		}
+		return keys[i].op < keys[j].op
+	})
+
+	stats := make([]CacheStats, len(keys))
+	buckets := make([][]uint64, len(keys))
+	for i, k := range keys {
+		st := c.stats[k]
+		stats[i] = CacheStats{
+			Prefix:    k.prefix,
+			Op:        k.op,
+			Hits:      st.results["hit"],
+			Misses:    st.results["miss"],
+			OK:        st.results["ok"],
+			Conflicts: st.results["conflict"],
+			Errors:    st.results["error"],
+			Calls:     st.calls,
+			Duration:  st.duration,
+			Bytes:     st.bytes,
+		}
+		buckets[i] = append([]uint64(nil), st.buckets...)
+	}
+	return stats, buckets
+}
+
+// ServeHTTP writes metrics of the cache in Prometheus text format.
+func (c *InstrumentedCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := WriteCacheMetrics(w, c); err != nil {
+		LogError(r.Context(), err, "cannot write cache metrics")
+	}
+}
+
+// WriteCacheMetrics writes metrics of given caches in Prometheus text
+// format.
+func WriteCacheMetrics(w io.Writer, caches ...*InstrumentedCache) error {
+	type cacheStats struct {
+		name        string
+		stats       []CacheStats
+		buckets     [][]uint64
+		payloadSize bool
+	}
+	all := make([]cacheStats, len(caches))
+	for i, c := range caches {
+		stats, buckets := c.snapshot()
+		all[i] = cacheStats{name: c.name, stats: stats, buckets: buckets, payloadSize: c.payloadSize}
+	}
+
+	var b bytes.Buffer
+
+	b.WriteString("# HELP surf_cache_operations_total Number of cache operations on a single key by result.\n")
+	b.WriteString("# TYPE surf_cache_operations_total counter\n")
+	for _, c := range all {
+		for _, s := range c.stats {
+			counts := []uint64{s.Hits, s.Misses, s.OK, s.Conflicts, s.Errors}
+			for i, result := range cacheResults {
+				if counts[i] == 0 {
+					continue
+				}
+				fmt.Fprintf(&b, "surf_cache_operations_total{%s,result=%q} %d\n",
+					metricLabels(c.name, s), result, counts[i])
+			}
+		}
+	}
+
+	b.WriteString("# HELP surf_cache_operation_duration_seconds Latency of cache calls.\n")
+	b.WriteString("# TYPE surf_cache_operation_duration_seconds histogram\n")
+	for _, c := range all {
+		for i, s := range c.stats {
+			labels := metricLabels(c.name, s)
+			for j, le := range cacheLatencyBuckets {
+				fmt.Fprintf(&b, "surf_cache_operation_duration_seconds_bucket{%s,le=%q} %d\n",
+					labels, formatMetricFloat(le.Seconds()), c.buckets[i][j])
+			}
+			fmt.Fprintf(&b, "surf_cache_operation_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, s.Calls)
+			fmt.Fprintf(&b, "surf_cache_operation_duration_seconds_sum{%s} %s\n", labels, formatMetricFloat(s.Duration.Seconds()))
+			fmt.Fprintf(&b, "surf_cache_operation_duration_seconds_count{%s} %d\n", labels, s.Calls)
+		}
+	}
+
+	b.WriteString("# HELP surf_cache_payload_bytes_total Size of values read from or written to the cache.\n")
+	b.WriteString("# TYPE surf_cache_payload_bytes_total counter\n")
+	for _, c := range all {
+		if !c.payloadSize {
+			continue
+		}
+		for _, s := range c.stats {
+			fmt.Fprintf(&b, "surf_cache_payload_bytes_total{%s} %d\n", metricLabels(c.name, s), s.Bytes)
+		}
+	}
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func metricLabels(cache string, s CacheStats) string {
+	return `cache="` + escapeMetricLabel(cache) +
+		`",prefix="` + escapeMetricLabel(s.Prefix) +
+		`",op="` + escapeMetricLabel(s.Op) + `"`
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeMetricLabel(s string) string {
+	return metricLabelEscaper.Replace(s)
+}
+
+func formatMetricFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// cacheOp describes a single cache operation done while handling a
+// request.
+type cacheOp struct {
+	Cache    string
+	Op       string
+	Key      string
+	Result   string
+	Duration time.Duration
+	Size     int
+}
+
+// cacheOpRecorder collects cache operations of a request, so that they can
+// be displayed by the debug toolbar.
+type cacheOpRecorder struct {
+	sync.Mutex
+	ops []*cacheOp
+}
+
+func attachCacheOpRecorder(ctx context.Context, rec *cacheOpRecorder) context.Context {
+	return context.WithValue(ctx, "surf:cacheops", rec)
+}
+
+func recordCacheOp(ctx context.Context, op *cacheOp) {
+	rec, ok := ctx.Value("surf:cacheops").(*cacheOpRecorder)
+	if !ok {
+		return
+	}
+	rec.Lock()
+	rec.ops = append(rec.ops, op)
+	rec.Unlock()
+}
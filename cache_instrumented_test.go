@@ -0,0 +1,284 @@
+package surf
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstrumentedCache(t *testing.T) {
+	RunCacheConformanceTest(t, NewInstrumentedCache(NewLocalMemCache(), "local", nil), &CacheCapabilities{
+		Batch: true,
+	})
+}
+
+func TestInstrumentedCounterCache(t *testing.T) {
+	RunCacheConformanceTest(t, NewInstrumentedCounterCache(NewLocalMemCache(), "local", nil), &CacheCapabilities{
+		Batch:    true,
+		Counters: true,
+	})
+}
+
+func TestInstrumentedCacheStats(t *testing.T) {
+	ctx := context.Background()
+	cache := NewInstrumentedCache(NewLocalMemCache(), "local", &InstrumentedCacheOpts{
+		PayloadSize: true,
+	})
+
+	if err := cache.Set(ctx, "user:1", "bob", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	var val string
+	if err := cache.Get(ctx, "user:1", &val); err != nil {
+		t.Fatalf("cannot get: %s", err)
+	}
+	if err := cache.Get(ctx, "user:2", &val); err != ErrMiss {
+		t.Fatalf("want ErrMiss, got %+v", err)
+	}
+	if err := cache.SetNx(ctx, "user:1", "alice", time.Minute); !ErrConflict.Is(err) {
+		t.Fatalf("want ErrConflict, got %+v", err)
+	}
+	if err := cache.Get(ctx, "nocolon", &val); err != ErrMiss {
+		t.Fatalf("want ErrMiss, got %+v", err)
+	}
+	errs, err := cache.GetMulti(ctx, []string{"user:1", "user:3", "post:1"}, []interface{}{&val, &val, &val})
+	if err != nil {
+		t.Fatalf("cannot get multi: %s", err)
+	}
+	if errs[0] != nil || errs[1] != ErrMiss || errs[2] != ErrMiss {
+		t.Fatalf("unexpected results: %v", errs)
+	}
+
+	want := []CacheStats{
+		{Prefix: "", Op: "Get", Misses: 1, Calls: 1},
+		{Prefix: "post", Op: "GetMulti", Misses: 1, Calls: 1},
+		{Prefix: "user", Op: "Get", Hits: 1, Misses: 1, Calls: 2, Bytes: 5},
+		{Prefix: "user", Op: "GetMulti", Hits: 1, Misses: 1, Calls: 1, Bytes: 5},
+		{Prefix: "user", Op: "Set", OK: 1, Calls: 1, Bytes: 5},
+		{Prefix: "user", Op: "SetNx", Conflicts: 1, Calls: 1},
+	}
+	stats := cache.Stats()
+	if len(stats) != len(want) {
+		t.Fatalf("want %d stats, got %+v", len(want), stats)
+	}
+	for i, st := range stats {
+		if st.Duration <= 0 {
+			t.Errorf("%d: duration not measured: %+v", i, st)
+		}
+		st.Duration = 0
+		if st != want[i] {
+			t.Errorf("%d: want %+v, got %+v", i, want[i], st)
+		}
+	}
+}
+
+func TestInstrumentedCacheWithoutCounters(t *testing.T) {
+	ctx := context.Background()
+	var cache CacheService = NewInstrumentedCache(PrefixCache(NewLocalMemCache(), "x"), "prefixed", nil)
+
+	if _, ok := cache.(CounterCache); ok {
+		t.Fatal("want counters not supported")
+	}
+
+	// Compute cache must not use counters to lock computations.
+	compute := NewComputeCache(cache, nil)
+	var val string
+	err := compute.GetOrCompute(ctx, "key", &val, time.Minute, func() (interface{}, error) {
+		return "computed", nil
+	})
+	if err != nil || val != "computed" {
+		t.Fatalf("want computed, got %q, %+v", val, err)
+	}
+}
+
+func TestWriteCacheMetrics(t *testing.T) {
+	ctx := context.Background()
+	cache := NewInstrumentedCache(NewLocalMemCache(), `lo"cal`, &InstrumentedCacheOpts{
+		PayloadSize: true,
+	})
+
+	if err := cache.Set(ctx, "user:1", 42, time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	var val int
+	if err := cache.Get(ctx, "user:1", &val); err != nil {
+		t.Fatalf("cannot get: %s", err)
+	}
+
+	var b bytes.Buffer
+	if err := WriteCacheMetrics(&b, cache); err != nil {
+		t.Fatalf("cannot write metrics: %s", err)
+	}
+	out := b.String()
+	for _, line := range []string{
+		"# TYPE surf_cache_operations_total counter\n",
+		`surf_cache_operations_total{cache="lo\"cal",prefix="user",op="Get",result="hit"} 1` + "\n",
+		`surf_cache_operations_total{cache="lo\"cal",prefix="user",op="Set",result="ok"} 1` + "\n",
+		"# TYPE surf_cache_operation_duration_seconds histogram\n",
+		`surf_cache_operation_duration_seconds_bucket{cache="lo\"cal",prefix="user",op="Get",le="2.5"} 1` + "\n",
+		`surf_cache_operation_duration_seconds_bucket{cache="lo\"cal",prefix="user",op="Get",le="+Inf"} 1` + "\n",
+		`surf_cache_operation_duration_seconds_count{cache="lo\"cal",prefix="user",op="Get"} 1` + "\n",
+		`surf_cache_payload_bytes_total{cache="lo\"cal",prefix="user",op="Set"} 2` + "\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("missing %q in output:\n%s", line, out)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	cache.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("unexpected content type: %q", ct)
+	}
+	if w.Body.String() != out {
+		t.Errorf("served metrics differ from written:\n%s", w.Body.String())
+	}
+}
+
+func TestInstrumentedCacheWithoutPayloadSize(t *testing.T) {
+	ctx := context.Background()
+	cache := NewInstrumentedCache(NewLocalMemCache(), "local", nil)
+
+	if err := cache.Set(ctx, "user:1", 42, time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	for _, st := range cache.Stats() {
+		if st.Bytes != 0 {
+			t.Errorf("payload size collected: %+v", st)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := WriteCacheMetrics(&b, cache); err != nil {
+		t.Fatalf("cannot write metrics: %s", err)
+	}
+	if strings.Contains(b.String(), "surf_cache_payload_bytes_total{") {
+		t.Errorf("payload size metric written:\n%s", b.String())
+	}
+}
+
+func TestCacheKeyLister(t *testing.T) {
+	ctx := context.Background()
+
+	mem := NewMemCache(nil)
+	defer mem.Close()
+
+	for name, cache := range map[string]interface {
+		CacheService
+		CacheKeyLister
+	}{
+		"local": NewLocalMemCache(),
+		"mem":   mem,
+	} {
+		t.Run(name, func(t *testing.T) {
+			for _, key := range []string{"b:2", "a:1", "b:1"} {
+				if err := cache.Set(ctx, key, 1, time.Minute); err != nil {
+					t.Fatalf("cannot set %q: %s", key, err)
+				}
+			}
+			if err := cache.Set(ctx, "b:expired", 1, time.Millisecond); err != nil {
+				t.Fatalf("cannot set: %s", err)
+			}
+			time.Sleep(5 * time.Millisecond)
+
+			keys, err := cache.Keys(ctx, "b:")
+			if err != nil {
+				t.Fatalf("cannot list keys: %s", err)
+			}
+			if strings.Join(keys, " ") != "b:1 b:2" {
+				t.Fatalf("unexpected keys: %q", keys)
+			}
+			if keys, _ := cache.Keys(ctx, ""); len(keys) != 3 {
+				t.Fatalf("want 3 keys, got %q", keys)
+			}
+		})
+	}
+}
+
+func TestDebugToolbarCaches(t *testing.T) {
+	mem := NewLocalMemCache()
+	cache := NewInstrumentedCache(mem, "local", nil)
+
+	app := HandlerFunc(func(w http.ResponseWriter, r *http.Request) Response {
+		var val string
+		cache.Get(r.Context(), "user:1", &val)
+		cache.Set(r.Context(), "user:1", "bob", time.Minute)
+		return nil
+	})
+	h := WithMiddlewares(app, []Middleware{DebugToolbarMiddleware("/_/debugtoolbar/", cache)})
+
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		if resp := h.HandleHTTPRequest(w, r); resp != nil {
+			resp.ServeHTTP(w, r)
+		}
+		return w
+	}
+
+	serve(httptest.NewRequest("GET", "/", nil))
+
+	dt := h.(*debugtoolbarMiddleware)
+	dtCtx := dt.history.Front().Value.(*debugtoolbarContext)
+	if len(dtCtx.CacheOps) != 2 {
+		t.Fatalf("want 2 cache operations, got %d", len(dtCtx.CacheOps))
+	}
+	if op := dtCtx.CacheOps[0]; op.Cache != "local" || op.Op != "Get" || op.Key != "user:1" || op.Result != "miss" {
+		t.Fatalf("unexpected operation: %+v", op)
+	}
+	if body := serve(httptest.NewRequest("GET", "/_/debugtoolbar/"+dtCtx.RequestID+"/", nil)).Body.String(); !strings.Contains(body, "Cache operations") {
+		t.Fatalf("cache operations not rendered:\n%s", body)
+	}
+
+	if body := serve(httptest.NewRequest("GET", "/_/debugtoolbar/caches/", nil)).Body.String(); !strings.Contains(body, "Browse keys") {
+		t.Fatalf("cache panel not rendered:\n%s", body)
+	}
+
+	body := serve(httptest.NewRequest("GET", "/_/debugtoolbar/caches/local/?prefix=user", nil)).Body.String()
+	if !strings.Contains(body, "user:1") || !strings.Contains(body, "bob") {
+		t.Fatalf("key not listed:\n%s", body)
+	}
+
+	deleteKey := func(header http.Header) int {
+		r := httptest.NewRequest("POST", "/_/debugtoolbar/caches/local/", strings.NewReader(url.Values{"key": {"user:1"}}.Encode()))
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serve(r).Code
+	}
+	var val string
+	for _, header := range []http.Header{
+		nil,
+		{"Origin": {"https://evil.com"}},
+		{"Referer": {"https://evil.com/example.com"}},
+	} {
+		if code := deleteKey(header); code != http.StatusForbidden {
+			t.Fatalf("%v: want forbidden, got %d", header, code)
+		}
+	}
+	if err := mem.Get(context.Background(), "user:1", &val); err != nil {
+		t.Fatalf("want key kept after cross origin request, got %+v", err)
+	}
+	if code := deleteKey(http.Header{"Origin": {"http://example.com"}}); code != http.StatusSeeOther {
+		t.Fatalf("want redirect, got %d", code)
+	}
+	if err := mem.Get(context.Background(), "user:1", &val); err != ErrMiss {
+		t.Fatalf("want key deleted, got %+v", err)
+	}
+
+	if w := serve(httptest.NewRequest("GET", "/_/debugtoolbar/caches/unknown/", nil)); w.Code != http.StatusNotFound {
+		t.Fatalf("want not found, got %d", w.Code)
+	}
+
+	// browsing does not affect metrics
+	for _, st := range cache.Stats() {
+		if st.Calls != 1 {
+			t.Fatalf("unexpected stats: %+v", st)
+		}
+	}
+}
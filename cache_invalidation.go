@@ -0,0 +1,63 @@
+package surf
+
+import (
+	"context"
+	"sync"
+)
+
+// InvalidationBus broadcasts messages between cache instances, usually
+// running in different processes.
+//
+// Delivery is not guaranteed. Messages published while a subscriber is
+// disconnected are lost.
+type InvalidationBus interface {
+	// Publish sends given message to all subscribers.
+	Publish(ctx context.Context, message string) error
+
+	// Subscribe registers function that is called with every published
+	// message. Returned function cancels the subscription.
+	Subscribe(fn func(message string)) (cancel func())
+}
+
+// NewLocalInvalidationBus returns InvalidationBus that delivers messages
+// only within the current process. Messages are delivered synchronously.
+func NewLocalInvalidationBus() InvalidationBus {
+	return &localInvalidationBus{
+		subscribers: make(map[int]func(string)),
+	}
+}
+
+type localInvalidationBus struct {
+	mu          sync.RWMutex
+	lastID      int
+	subscribers map[int]func(string)
+}
+
+func (b *localInvalidationBus) Publish(ctx context.Context, message string) error {
+	b.mu.RLock()
+	subscribers := make([]func(string), 0, len(b.subscribers))
+	for _, fn := range b.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	b.mu.RUnlock()
+
+	for _, fn := range subscribers {
+		fn(message)
+	}
+	return nil
+}
+
+func (b *localInvalidationBus) Subscribe(fn func(string)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	id := b.lastID
+	b.subscribers[id] = fn
+
+	return func() {
+		b.mu.Lock()
+		delete(b.subscribers, id)
+		b.mu.Unlock()
+	}
+}
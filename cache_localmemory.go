@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -20,10 +22,11 @@ type cacheitem struct {
 	ExpAt time.Time
 }
 
-var _ CacheService = (*LocalMemCache)(nil)
+var _ CounterCache = (*LocalMemCache)(nil)
+var _ CacheKeyLister = (*LocalMemCache)(nil)
 
 // NewLocalMemCache returns local memory cache intance. This is strictly for
-// testing and must not be used for end application.
+// testing and must not be used for end application. Use NewMemCache instead.
 func NewLocalMemCache() *LocalMemCache {
 	return &LocalMemCache{
 		mem: make(map[string]*cacheitem),
@@ -91,13 +94,84 @@ func (c *LocalMemCache) Del(ctx context.Context, key string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if _, ok := c.mem[key]; !ok {
+	it, ok := c.mem[key]
+	if !ok {
 		return ErrMiss
 	}
 	delete(c.mem, key)
+	if it.ExpAt.Before(time.Now()) {
+		return ErrMiss
+	}
 	return nil
 }
 
+func (c *LocalMemCache) Incr(ctx context.Context, key string, delta int64, exp time.Duration) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	it, ok := c.mem[key]
+	if !ok || it.ExpAt.Before(now) {
+		it = &cacheitem{
+			Key:   key,
+			ExpAt: counterExpireAt(now, exp),
+		}
+	}
+
+	n, b, err := incrRaw(it.Value, delta)
+	if err != nil {
+		return 0, err
+	}
+	c.mem[key] = &cacheitem{
+		Key:   key,
+		Value: b,
+		ExpAt: it.ExpAt,
+	}
+	return n, nil
+}
+
+func (c *LocalMemCache) CompareAndSwap(ctx context.Context, key string, old, value interface{}, exp time.Duration) error {
+	b, err := CacheMarshal(value)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	it, ok := c.mem[key]
+	if !ok || it.ExpAt.Before(time.Now()) {
+		return ErrMiss
+	}
+	if eq, err := equalRaw(it.Value, old); err != nil {
+		return err
+	} else if !eq {
+		return ErrConflict
+	}
+
+	c.mem[key] = &cacheitem{
+		Key:   key,
+		Value: b,
+		ExpAt: time.Now().Add(exp),
+	}
+	return nil
+}
+
+func (c *LocalMemCache) Keys(ctx context.Context, prefix string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	keys := make([]string, 0, len(c.mem))
+	for key, it := range c.mem {
+		if strings.HasPrefix(key, prefix) && !it.ExpAt.Before(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
 func (c *LocalMemCache) Flush() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -5,5 +5,5 @@ import "testing"
 func TestLocalMemoryCache(t *testing.T) {
 	cache := NewLocalMemCache()
 
-	RunCacheImplementationTest(t, cache)
+	RunCacheConformanceTest(t, cache, &CacheCapabilities{Counters: true})
 }
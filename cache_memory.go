@@ -0,0 +1,415 @@
+package surf
+
+import (
+	"container/list"
+	"context"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MemCache is an in-process cache with a bounded size. When the limit is
+// reached, least recently used entries are evicted. Keys are spread across
+// shards, each one protected by its own lock, so that concurrent access to
+// different keys does not contend.
+//
+// Expired entries are removed periodically by a background process. Call
+// Close to stop it once cache is no longer needed.
+type MemCache struct {
+	// Counters are accessed atomically and must be first in the struct
+	// to guarantee 64 bit alignment.
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	expirations uint64
+
+	shards []*memCacheShard
+	stop   chan struct{}
+	once   sync.Once
+}
+
+var _ CounterCache = (*MemCache)(nil)
+var _ CacheKeyLister = (*MemCache)(nil)
+
+// MemCacheOpts defines options for the memory cache.
+type MemCacheOpts struct {
+	// MaxEntries is the maximum number of stored entries. Zero means no
+	// limit.
+	MaxEntries int
+
+	// MaxBytes is the maximum size of all stored keys and serialized
+	// values. Zero means no limit.
+	MaxBytes int64
+
+	// Shards is the number of independently locked partitions. Defaults
+	// to 16.
+	Shards int
+
+	// CleanupInterval defines how often expired entries are removed.
+	// Defaults to one minute.
+	CleanupInterval time.Duration
+}
+
+// NewMemCache returns in-process cache instance. Options are optional and
+// defaults are used for all zero values.
+//
+// Size limits are divided equally between shards.
+func NewMemCache(o *MemCacheOpts) *MemCache {
+	if o == nil {
+		o = &MemCacheOpts{}
+	}
+	shards := o.Shards
+	if shards <= 0 {
+		shards = 16
+	}
+	interval := o.CleanupInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	c := &MemCache{
+		shards: make([]*memCacheShard, shards),
+		stop:   make(chan struct{}),
+	}
+	for i := range c.shards {
+		shard := &memCacheShard{
+			cache: c,
+			items: make(map[string]*list.Element),
+			lru:   list.New(),
+		}
+		if o.MaxEntries > 0 {
+			shard.maxEntries = (o.MaxEntries + shards - 1) / shards
+		}
+		if o.MaxBytes > 0 {
+			shard.maxBytes = (o.MaxBytes + int64(shards) - 1) / int64(shards)
+		}
+		c.shards[i] = shard
+	}
+
+	go c.cleanup(interval)
+
+	return c
+}
+
+// Close stops the background cleanup process.
+func (c *MemCache) Close() error {
+	c.once.Do(func() { close(c.stop) })
+	return nil
+}
+
+func (c *MemCache) cleanup(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case now := <-t.C:
+			for _, s := range c.shards {
+				s.removeExpired(now)
+			}
+		}
+	}
+}
+
+func (c *MemCache) shard(key string) *memCacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+func (c *MemCache) Get(ctx context.Context, key string, dest interface{}) error {
+	raw, ok := c.shard(key).get(key, time.Now())
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return ErrMiss
+	}
+	atomic.AddUint64(&c.hits, 1)
+	return CacheUnmarshal(raw, dest)
+}
+
+func (c *MemCache) Set(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	raw, err := CacheMarshal(value)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	c.shard(key).set(key, raw, now.Add(exp), now, false)
+	return nil
+}
+
+func (c *MemCache) SetNx(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	raw, err := CacheMarshal(value)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if !c.shard(key).set(key, raw, now.Add(exp), now, true) {
+		return ErrConflict
+	}
+	return nil
+}
+
+func (c *MemCache) Del(ctx context.Context, key string) error {
+	if !c.shard(key).del(key, time.Now()) {
+		return ErrMiss
+	}
+	return nil
+}
+
+func (c *MemCache) Incr(ctx context.Context, key string, delta int64, exp time.Duration) (int64, error) {
+	now := time.Now()
+	var n int64
+	err := c.shard(key).update(key, now, func(current []byte, expAt time.Time, ok bool) ([]byte, time.Time, error) {
+		if !ok {
+			current, expAt = nil, counterExpireAt(now, exp)
+		}
+		var (
+			b   []byte
+			err error
+		)
+		n, b, err = incrRaw(current, delta)
+		return b, expAt, err
+	})
+	return n, err
+}
+
+func (c *MemCache) CompareAndSwap(ctx context.Context, key string, old, value interface{}, exp time.Duration) error {
+	b, err := CacheMarshal(value)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return c.shard(key).update(key, now, func(current []byte, expAt time.Time, ok bool) ([]byte, time.Time, error) {
+		if !ok {
+			return nil, expAt, ErrMiss
+		}
+		if eq, err := equalRaw(current, old); err != nil {
+			return nil, expAt, err
+		} else if !eq {
+			return nil, expAt, ErrConflict
+		}
+		return b, now.Add(exp), nil
+	})
+}
+
+// Keys returns sorted keys of all entries that are not expired and start
+// with given prefix.
+func (c *MemCache) Keys(ctx context.Context, prefix string) ([]string, error) {
+	now := time.Now()
+	var keys []string
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for key, el := range s.items {
+			if strings.HasPrefix(key, prefix) && el.Value.(*memCacheEntry).expAt.After(now) {
+				keys = append(keys, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Flush removes all entries.
+func (c *MemCache) Flush() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.items = make(map[string]*list.Element)
+		s.lru.Init()
+		s.bytes = 0
+		s.mu.Unlock()
+	}
+}
+
+// MemCacheStats contains memory cache usage information.
+type MemCacheStats struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+	Entries     int
+	Bytes       int64
+}
+
+// Stats returns current cache usage information.
+func (c *MemCache) Stats() MemCacheStats {
+	st := MemCacheStats{
+		Hits:        atomic.LoadUint64(&c.hits),
+		Misses:      atomic.LoadUint64(&c.misses),
+		Evictions:   atomic.LoadUint64(&c.evictions),
+		Expirations: atomic.LoadUint64(&c.expirations),
+	}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		st.Entries += len(s.items)
+		st.Bytes += s.bytes
+		s.mu.Unlock()
+	}
+	return st
+}
+
+type memCacheShard struct {
+	cache      *MemCache
+	maxEntries int
+	maxBytes   int64
+
+	mu    sync.Mutex
+	items map[string]*list.Element
+	// lru keeps the most recently used entries in front.
+	lru   *list.List
+	bytes int64
+}
+
+type memCacheEntry struct {
+	key   string
+	value []byte
+	expAt time.Time
+}
+
+func (e *memCacheEntry) size() int64 {
+	return int64(len(e.key) + len(e.value))
+}
+
+func (s *memCacheShard) get(key string, now time.Time) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*memCacheEntry)
+	if !entry.expAt.After(now) {
+		s.remove(el)
+		atomic.AddUint64(&s.cache.expirations, 1)
+		return nil, false
+	}
+	s.lru.MoveToFront(el)
+	return entry.value, true
+}
+
+// set stores given value. If onlyNew is true, value is stored only if the
+// key is not in use and false is returned otherwise.
+func (s *memCacheShard) set(key string, value []byte, expAt, now time.Time, onlyNew bool) bool {
+	entry := &memCacheEntry{
+		key:   key,
+		value: value,
+		expAt: expAt,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		if onlyNew && el.Value.(*memCacheEntry).expAt.After(now) {
+			return false
+		}
+	}
+	s.store(entry)
+	return true
+}
+
+// store puts given entry in front of the LRU list, replacing existing entry
+// of the same key, and evicts entries if limits are exceeded. Lock must be
+// acquired by the caller.
+func (s *memCacheShard) store(entry *memCacheEntry) {
+	if el, ok := s.items[entry.key]; ok {
+		s.remove(el)
+	}
+
+	if s.maxBytes > 0 && entry.size() > s.maxBytes {
+		// Value would evict everything else and still not fit.
+		// Behave as if it was stored and immediately evicted.
+		atomic.AddUint64(&s.cache.evictions, 1)
+		return
+	}
+
+	s.items[entry.key] = s.lru.PushFront(entry)
+	s.bytes += entry.size()
+
+	for s.overLimit() {
+		s.remove(s.lru.Back())
+		atomic.AddUint64(&s.cache.evictions, 1)
+	}
+}
+
+// update atomically replaces value under given key with the one returned by
+// given function. Function is called with the current value and its
+// expiration time. If key is not in use, ok is false.
+func (s *memCacheShard) update(
+	key string,
+	now time.Time,
+	fn func(current []byte, expAt time.Time, ok bool) ([]byte, time.Time, error),
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		current []byte
+		expAt   time.Time
+		ok      bool
+	)
+	if el, exists := s.items[key]; exists {
+		entry := el.Value.(*memCacheEntry)
+		if entry.expAt.After(now) {
+			current, expAt, ok = entry.value, entry.expAt, true
+		}
+	}
+
+	value, expAt, err := fn(current, expAt, ok)
+	if err != nil {
+		return err
+	}
+	s.store(&memCacheEntry{
+		key:   key,
+		value: value,
+		expAt: expAt,
+	})
+	return nil
+}
+
+func (s *memCacheShard) overLimit() bool {
+	if s.maxEntries > 0 && len(s.items) > s.maxEntries {
+		return true
+	}
+	if s.maxBytes > 0 && s.bytes > s.maxBytes {
+		return true
+	}
+	return false
+}
+
+func (s *memCacheShard) del(key string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[key]
+	if !ok {
+		return false
+	}
+	s.remove(el)
+	return el.Value.(*memCacheEntry).expAt.After(now)
+}
+
+func (s *memCacheShard) removeExpired(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, el := range s.items {
+		if !el.Value.(*memCacheEntry).expAt.After(now) {
+			s.remove(el)
+			atomic.AddUint64(&s.cache.expirations, 1)
+		}
+	}
+}
+
+// remove deletes given element. Lock must be acquired by the caller.
+func (s *memCacheShard) remove(el *list.Element) {
+	entry := s.lru.Remove(el).(*memCacheEntry)
+	delete(s.items, entry.key)
+	s.bytes -= entry.size()
+}
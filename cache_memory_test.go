@@ -0,0 +1,95 @@
+package surf
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemCache(t *testing.T) {
+	cache := NewMemCache(nil)
+	defer cache.Close()
+
+	RunCacheConformanceTest(t, cache, &CacheCapabilities{Counters: true})
+}
+
+func TestMemCacheMaxEntries(t *testing.T) {
+	ctx := context.Background()
+
+	cache := NewMemCache(&MemCacheOpts{MaxEntries: 3, Shards: 1})
+	defer cache.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := cache.Set(ctx, fmt.Sprintf("key-%d", i), i, time.Minute); err != nil {
+			t.Fatalf("cannot set: %s", err)
+		}
+	}
+	// use the oldest entry so that it is not evicted
+	var val int
+	if err := cache.Get(ctx, "key-0", &val); err != nil {
+		t.Fatalf("cannot get: %s", err)
+	}
+	if err := cache.Set(ctx, "key-3", 3, time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+
+	if err := cache.Get(ctx, "key-1", &val); err != ErrMiss {
+		t.Fatalf("want least recently used entry evicted, got %+v", err)
+	}
+	for _, key := range []string{"key-0", "key-2", "key-3"} {
+		if err := cache.Get(ctx, key, &val); err != nil {
+			t.Fatalf("cannot get %s: %s", key, err)
+		}
+	}
+
+	st := cache.Stats()
+	if st.Entries != 3 || st.Evictions != 1 || st.Hits != 4 || st.Misses != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+func TestMemCacheMaxBytes(t *testing.T) {
+	ctx := context.Background()
+
+	cache := NewMemCache(&MemCacheOpts{MaxBytes: 100, Shards: 1})
+	defer cache.Close()
+
+	for i := 0; i < 10; i++ {
+		// each entry is 5 bytes long key and 14 bytes long value
+		if err := cache.Set(ctx, fmt.Sprintf("key-%d", i), "abcdefghijkl", time.Minute); err != nil {
+			t.Fatalf("cannot set: %s", err)
+		}
+	}
+	if st := cache.Stats(); st.Bytes > 100 || st.Entries != 5 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+
+	// value bigger than the whole cache is never stored
+	if err := cache.Set(ctx, "key-big", make([]byte, 200), time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	var val []byte
+	if err := cache.Get(ctx, "key-big", &val); err != ErrMiss {
+		t.Fatalf("want ErrMiss, got %+v", err)
+	}
+}
+
+func TestMemCacheCleanup(t *testing.T) {
+	ctx := context.Background()
+
+	cache := NewMemCache(&MemCacheOpts{CleanupInterval: 10 * time.Millisecond})
+	defer cache.Close()
+
+	if err := cache.Set(ctx, "key-1", 1, 20*time.Millisecond); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	if err := cache.Set(ctx, "key-2", 2, time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if st := cache.Stats(); st.Entries != 1 || st.Expirations != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
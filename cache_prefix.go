@@ -35,3 +35,28 @@ func (c *prefixedCache) SetNx(ctx context.Context, key string, value interface{}
 func (c *prefixedCache) Del(ctx context.Context, key string) error {
 	return c.cache.Del(ctx, c.prefix+key)
 }
+
+func (c *prefixedCache) GetMulti(ctx context.Context, keys []string, dests []interface{}) ([]error, error) {
+	return AsBatchCache(c.cache).GetMulti(ctx, c.prefixed(keys), dests)
+}
+
+func (c *prefixedCache) SetMulti(ctx context.Context, items []CacheItem) error {
+	prefixed := make([]CacheItem, len(items))
+	for i, it := range items {
+		it.Key = c.prefix + it.Key
+		prefixed[i] = it
+	}
+	return AsBatchCache(c.cache).SetMulti(ctx, prefixed)
+}
+
+func (c *prefixedCache) DelMulti(ctx context.Context, keys []string) error {
+	return AsBatchCache(c.cache).DelMulti(ctx, c.prefixed(keys))
+}
+
+func (c *prefixedCache) prefixed(keys []string) []string {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = c.prefix + key
+	}
+	return prefixed
+}
@@ -0,0 +1,245 @@
+package surf
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of the ResilientCache circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed passes all operations to the wrapped cache.
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen does not pass operations to the wrapped cache, because
+	// it is failing.
+	CircuitOpen
+
+	// CircuitHalfOpen passes a single operation to the wrapped cache, to
+	// check if it recovered. Other operations are handled as if the
+	// circuit was open.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "CircuitState(" + strconv.Itoa(int(s)) + ")"
+	}
+}
+
+// ResilientCacheOpts defines options for the resilient cache.
+type ResilientCacheOpts struct {
+	// Timeout limits the duration of a single operation of the wrapped
+	// cache. Defaults to 250ms.
+	Timeout time.Duration
+
+	// FailureThreshold is the number of consecutive failures that open
+	// the circuit. Defaults to 5.
+	FailureThreshold int
+
+	// OpenDuration is how long the circuit stays open before an operation
+	// is passed to the wrapped cache again. Defaults to 10s.
+	OpenDuration time.Duration
+
+	// Fallback handles operations while the circuit is open, for example
+	// a local memory cache. Values written to it are not copied to the
+	// wrapped cache once it recovers, so they should have short
+	// expiration. If nil, while the circuit is open, the cache behaves
+	// as if every value expired immediately: Get and Del return ErrMiss
+	// and Set discards the value. SetNx returns ErrConflict, so that no
+	// caller assumes it owns a key, for example a lock, that was never
+	// written.
+	Fallback CacheService
+}
+
+// ResilientCache protects the application from a slow or unavailable cache
+// backend. Each operation of the wrapped cache is limited by a timeout,
+// which requires the wrapped cache to respect context cancellation.
+//
+// Consecutive failures open the circuit, after which the wrapped cache is
+// not used until the open duration passes. Then a single operation is
+// passed to the wrapped cache and its result decides whether the circuit
+// closes or opens again. Cache misses and conflicts are not failures. Every
+// state change is logged using LogError.
+//
+// While the circuit is closed, errors of the wrapped cache are returned.
+type ResilientCache struct {
+	cache        CacheService
+	fallback     CacheService
+	timeout      time.Duration
+	threshold    int
+	openDuration time.Duration
+	now          func() time.Time
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	// probing is true if an operation is checking the wrapped cache,
+	// while the circuit is half-open.
+	probing bool
+	// lastErr is the failure that most recently opened the circuit.
+	lastErr error
+}
+
+var _ CacheService = (*ResilientCache)(nil)
+
+// NewResilientCache returns cache wrapping given cache with a circuit
+// breaker.
+func NewResilientCache(cache CacheService, o *ResilientCacheOpts) *ResilientCache {
+	if o == nil {
+		o = &ResilientCacheOpts{}
+	}
+	c := &ResilientCache{
+		cache:        cache,
+		fallback:     o.Fallback,
+		timeout:      o.Timeout,
+		threshold:    o.FailureThreshold,
+		openDuration: o.OpenDuration,
+		now:          time.Now,
+	}
+	if c.timeout <= 0 {
+		c.timeout = 250 * time.Millisecond
+	}
+	if c.threshold <= 0 {
+		c.threshold = 5
+	}
+	if c.openDuration <= 0 {
+		c.openDuration = 10 * time.Second
+	}
+	return c
+}
+
+// State returns the current state of the circuit.
+func (c *ResilientCache) State() CircuitState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// acquire returns true if an operation can be passed to the wrapped cache.
+// Probe is true if the operation decides about closing the circuit.
+func (c *ResilientCache) acquire(ctx context.Context) (ok, probe bool) {
+	c.mu.Lock()
+	prev := c.state
+	switch c.state {
+	case CircuitClosed:
+		ok = true
+	case CircuitOpen:
+		if c.now().Sub(c.openedAt) < c.openDuration {
+			break
+		}
+		c.state = CircuitHalfOpen
+		fallthrough
+	case CircuitHalfOpen:
+		if !c.probing {
+			c.probing = true
+			ok, probe = true, true
+		}
+	}
+	state, lastErr := c.state, c.lastErr
+	c.mu.Unlock()
+
+	if state != prev {
+		logCircuitState(ctx, lastErr, prev, state)
+	}
+	return ok, probe
+}
+
+// release updates the circuit with the result of an operation passed to the
+// wrapped cache.
+func (c *ResilientCache) release(ctx context.Context, probe bool, err error) {
+	c.mu.Lock()
+	prev := c.state
+	if probe {
+		c.probing = false
+	}
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// The caller gave up, which says nothing about the wrapped
+		// cache.
+	case isCacheFailure(ctx, err):
+		c.failures++
+		if probe || (c.state == CircuitClosed && c.failures >= c.threshold) {
+			c.state = CircuitOpen
+			c.openedAt = c.now()
+			c.lastErr = err
+		}
+	default:
+		c.failures = 0
+		if probe {
+			c.state = CircuitClosed
+		}
+	}
+	state, lastErr := c.state, c.lastErr
+	c.mu.Unlock()
+
+	if state != prev {
+		logCircuitState(ctx, lastErr, prev, state)
+	}
+}
+
+func logCircuitState(ctx context.Context, err error, from, to CircuitState) {
+	LogError(ctx, err, "cache circuit "+to.String(),
+		"from", from.String(),
+		"to", to.String())
+}
+
+// do calls given function with the wrapped cache if the circuit allows it,
+// or with the fallback cache. If the circuit is open and there is no
+// fallback cache, the result of open is returned.
+func (c *ResilientCache) do(ctx context.Context, fn func(context.Context, CacheService) error, open func() error) error {
+	ok, probe := c.acquire(ctx)
+	if !ok {
+		if c.fallback != nil {
+			return fn(ctx, c.fallback)
+		}
+		return open()
+	}
+
+	opctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	err := fn(opctx, c.cache)
+	c.release(ctx, probe, err)
+	return err
+}
+
+func resilientMiss() error { return ErrMiss }
+
+func resilientDiscard() error { return nil }
+
+func resilientConflict() error { return ErrConflict }
+
+func (c *ResilientCache) Get(ctx context.Context, key string, dest interface{}) error {
+	return c.do(ctx, func(ctx context.Context, cache CacheService) error {
+		return cache.Get(ctx, key, dest)
+	}, resilientMiss)
+}
+
+func (c *ResilientCache) Set(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	return c.do(ctx, func(ctx context.Context, cache CacheService) error {
+		return cache.Set(ctx, key, value, exp)
+	}, resilientDiscard)
+}
+
+func (c *ResilientCache) SetNx(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	return c.do(ctx, func(ctx context.Context, cache CacheService) error {
+		return cache.SetNx(ctx, key, value, exp)
+	}, resilientConflict)
+}
+
+func (c *ResilientCache) Del(ctx context.Context, key string) error {
+	return c.do(ctx, func(ctx context.Context, cache CacheService) error {
+		return cache.Del(ctx, key)
+	}, resilientMiss)
+}
@@ -0,0 +1,309 @@
+package surf
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResilientCache(t *testing.T) {
+	RunCacheConformanceTest(t, NewResilientCache(NewLocalMemCache(), nil), nil)
+}
+
+func TestResilientCacheCircuit(t *testing.T) {
+	logs := &recordingLogger{}
+	ctx := attachLogger(context.Background(), logs)
+	backend := &flakyCache{CacheService: NewLocalMemCache()}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := NewResilientCache(backend, &ResilientCacheOpts{
+		FailureThreshold: 3,
+		OpenDuration:     time.Minute,
+	})
+	cache.now = func() time.Time { return now }
+
+	if err := cache.Set(ctx, "key", "value", time.Hour); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+
+	backend.fail(errBrokenCache)
+	var val string
+	for i := 0; i < 3; i++ {
+		if state := cache.State(); state != CircuitClosed {
+			t.Fatalf("%d: want closed circuit, got %s", i, state)
+		}
+		if err := cache.Get(ctx, "key", &val); err != errBrokenCache {
+			t.Fatalf("%d: want backend error, got %+v", i, err)
+		}
+	}
+	if state := cache.State(); state != CircuitOpen {
+		t.Fatalf("want open circuit, got %s", state)
+	}
+
+	// open circuit does not call the backend
+	calls := backend.calls()
+	if err := cache.Get(ctx, "key", &val); err != ErrMiss {
+		t.Fatalf("want ErrMiss, got %+v", err)
+	}
+	if err := cache.Set(ctx, "key", "new", time.Hour); err != nil {
+		t.Fatalf("want write discarded, got %+v", err)
+	}
+	if err := cache.SetNx(ctx, "key", "new", time.Hour); err != ErrConflict {
+		t.Fatalf("want ErrConflict, got %+v", err)
+	}
+	if err := cache.Del(ctx, "key"); err != ErrMiss {
+		t.Fatalf("want ErrMiss, got %+v", err)
+	}
+	if n := backend.calls(); n != calls {
+		t.Fatalf("want no backend calls, got %d", n-calls)
+	}
+
+	// failed probe opens the circuit again
+	now = now.Add(time.Minute)
+	if err := cache.Get(ctx, "key", &val); err != errBrokenCache {
+		t.Fatalf("want backend error, got %+v", err)
+	}
+	if state := cache.State(); state != CircuitOpen {
+		t.Fatalf("want open circuit, got %s", state)
+	}
+	if err := cache.Get(ctx, "key", &val); err != ErrMiss {
+		t.Fatalf("want ErrMiss, got %+v", err)
+	}
+
+	// successful probe closes the circuit
+	backend.fail(nil)
+	now = now.Add(time.Minute)
+	if err := cache.Get(ctx, "key", &val); err != nil || val != "value" {
+		t.Fatalf("want value, got %+v, %q", err, val)
+	}
+	if state := cache.State(); state != CircuitClosed {
+		t.Fatalf("want closed circuit, got %s", state)
+	}
+
+	want := []string{
+		"cache circuit open: from closed to open",
+		"cache circuit half-open: from open to half-open",
+		"cache circuit open: from half-open to open",
+		"cache circuit half-open: from open to half-open",
+		"cache circuit closed: from half-open to closed",
+	}
+	if got := logs.entries(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected logs:\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestResilientCacheTimeout(t *testing.T) {
+	ctx := context.Background()
+	backend := &flakyCache{CacheService: NewLocalMemCache()}
+	cache := NewResilientCache(backend, &ResilientCacheOpts{
+		Timeout:          20 * time.Millisecond,
+		FailureThreshold: 1,
+	})
+
+	// operation cancelled by the caller is not a failure
+	backend.block(true)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	var val string
+	if err := cache.Get(cancelled, "key", &val); err == nil || err == ErrMiss {
+		t.Fatalf("want context error, got %+v", err)
+	}
+	if state := cache.State(); state != CircuitClosed {
+		t.Fatalf("want closed circuit, got %s", state)
+	}
+
+	start := time.Now()
+	if err := cache.Get(ctx, "key", &val); err != context.DeadlineExceeded {
+		t.Fatalf("want deadline exceeded, got %+v", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("operation not cancelled, took %s", took)
+	}
+	if state := cache.State(); state != CircuitOpen {
+		t.Fatalf("want open circuit, got %s", state)
+	}
+}
+
+func TestResilientCacheSingleProbe(t *testing.T) {
+	ctx := context.Background()
+	backend := &flakyCache{CacheService: NewLocalMemCache()}
+	now := time.Now()
+	cache := NewResilientCache(backend, &ResilientCacheOpts{
+		Timeout:          time.Minute,
+		FailureThreshold: 1,
+		OpenDuration:     time.Minute,
+	})
+	cache.now = func() time.Time { return now }
+
+	backend.fail(errBrokenCache)
+	var val string
+	if err := cache.Get(ctx, "key", &val); err != errBrokenCache {
+		t.Fatalf("want backend error, got %+v", err)
+	}
+
+	backend.fail(nil)
+	backend.block(true)
+	now = now.Add(time.Minute)
+	probed := make(chan error)
+	go func() {
+		var val string
+		probed <- cache.Get(ctx, "key", &val)
+	}()
+	for cache.State() != CircuitHalfOpen || backend.calls() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// probe is in progress, other operations are not passed to the
+	// backend
+	if err := cache.Get(ctx, "key", &val); err != ErrMiss {
+		t.Fatalf("want ErrMiss, got %+v", err)
+	}
+	if n := backend.calls(); n != 2 {
+		t.Fatalf("want 2 backend calls, got %d", n)
+	}
+
+	backend.block(false)
+	if err := <-probed; err != ErrMiss {
+		t.Fatalf("want ErrMiss from probe, got %+v", err)
+	}
+	if state := cache.State(); state != CircuitClosed {
+		t.Fatalf("want closed circuit, got %s", state)
+	}
+}
+
+func TestResilientCacheFallback(t *testing.T) {
+	ctx := context.Background()
+	backend := &flakyCache{CacheService: NewLocalMemCache()}
+	fallback := NewLocalMemCache()
+	cache := NewResilientCache(backend, &ResilientCacheOpts{
+		FailureThreshold: 1,
+		Fallback:         fallback,
+	})
+
+	if err := cache.Set(ctx, "key", "remote", time.Hour); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	backend.fail(errBrokenCache)
+	if err := cache.Set(ctx, "key", "value", time.Hour); err != errBrokenCache {
+		t.Fatalf("want backend error, got %+v", err)
+	}
+
+	if err := cache.Set(ctx, "key", "local", time.Hour); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	var val string
+	if err := cache.Get(ctx, "key", &val); err != nil || val != "local" {
+		t.Fatalf("want local value, got %+v, %q", err, val)
+	}
+	if err := cache.SetNx(ctx, "key", "other", time.Hour); !ErrConflict.Is(err) {
+		t.Fatalf("want ErrConflict, got %+v", err)
+	}
+	if err := fallback.Get(ctx, "key", &val); err != nil || val != "local" {
+		t.Fatalf("want value in fallback cache, got %+v, %q", err, val)
+	}
+}
+
+// flakyCache is a cache that can be made to fail or to block operations
+// until the context is done.
+type flakyCache struct {
+	CacheService
+
+	mu      sync.Mutex
+	err     error
+	blocked chan struct{}
+	n       int
+}
+
+func (c *flakyCache) fail(err error) {
+	c.mu.Lock()
+	c.err = err
+	c.mu.Unlock()
+}
+
+func (c *flakyCache) block(block bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case block && c.blocked == nil:
+		c.blocked = make(chan struct{})
+	case !block && c.blocked != nil:
+		close(c.blocked)
+		c.blocked = nil
+	}
+}
+
+func (c *flakyCache) calls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+func (c *flakyCache) before(ctx context.Context) error {
+	c.mu.Lock()
+	c.n++
+	err, blocked := c.err, c.blocked
+	c.mu.Unlock()
+
+	if blocked != nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-blocked:
+		}
+	}
+	return err
+}
+
+func (c *flakyCache) Get(ctx context.Context, key string, dest interface{}) error {
+	if err := c.before(ctx); err != nil {
+		return err
+	}
+	return c.CacheService.Get(ctx, key, dest)
+}
+
+func (c *flakyCache) Set(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	if err := c.before(ctx); err != nil {
+		return err
+	}
+	return c.CacheService.Set(ctx, key, value, exp)
+}
+
+func (c *flakyCache) SetNx(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	if err := c.before(ctx); err != nil {
+		return err
+	}
+	return c.CacheService.SetNx(ctx, key, value, exp)
+}
+
+func (c *flakyCache) Del(ctx context.Context, key string) error {
+	if err := c.before(ctx); err != nil {
+		return err
+	}
+	return c.CacheService.Del(ctx, key)
+}
+
+// recordingLogger keeps error messages together with their key-value
+// pairs.
+type recordingLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (lg *recordingLogger) Info(ctx context.Context, message string, keyvals ...string) {
+}
+
+func (lg *recordingLogger) Error(ctx context.Context, err error, message string, keyvals ...string) {
+	if err == nil {
+		panic("error logged without error")
+	}
+	lg.mu.Lock()
+	lg.logs = append(lg.logs, message+": "+strings.Join(keyvals, " "))
+	lg.mu.Unlock()
+}
+
+func (lg *recordingLogger) entries() []string {
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	return append([]string(nil), lg.logs...)
+}
@@ -0,0 +1,290 @@
+package surf
+
+import (
+	"context"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-surf/surf/errors"
+)
+
+// ShardedCache returns cache that spreads keys across given caches, using
+// consistent hashing. All shards have the same weight and are identified by
+// their position, so new shards must be appended to keep existing keys in
+// place. See NewShardedCache.
+func ShardedCache(shards []CacheService) CacheService {
+	cs := make([]CacheShard, len(shards))
+	for i, cache := range shards {
+		cs[i] = CacheShard{
+			Name:  "shard-" + strconv.Itoa(i),
+			Cache: cache,
+		}
+	}
+	c, err := NewShardedCache(cs, nil)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// CacheShard is a single backend of the sharded cache.
+type CacheShard struct {
+	// Name identifies the shard on the hash ring. It must be unique and
+	// must not change, otherwise keys are relocated.
+	Name string
+
+	// Cache used to store keys of this shard.
+	Cache CacheService
+
+	// Weight defines the share of keys stored by this shard, relative to
+	// other shards. Defaults to 1.
+	Weight int
+}
+
+// ShardedCacheOpts defines options for the sharded cache.
+type ShardedCacheOpts struct {
+	// VirtualNodes is the number of points on the hash ring for each
+	// weight unit of a shard. More points give more even distribution of
+	// keys. Defaults to 160.
+	VirtualNodes int
+
+	// Failover enables using the next shard on the ring if the shard
+	// owning a key fails. Cache misses and conflicts are not failures.
+	//
+	// Failover trades consistency for availability. Writes and deletes
+	// made while the owning shard fails reach only the next shard, so
+	// once the owning shard recovers it serves the value it held before,
+	// including a value that was deleted or replaced in the meantime.
+	// Values written to the next shard can be served again if the owning
+	// shard fails later. Use failover only for values that can be stale
+	// for up to their expiration time.
+	Failover bool
+}
+
+// NewShardedCache returns cache that spreads keys across given shards,
+// using consistent hashing. Adding or removing a shard relocates only keys
+// of that shard. Returned cache implements BatchCacheService, with each
+// batch split into one batch per shard.
+func NewShardedCache(shards []CacheShard, o *ShardedCacheOpts) (CacheService, error) {
+	if len(shards) == 0 {
+		return nil, errors.Wrap(ErrValidation, "no shard")
+	}
+	if o == nil {
+		o = &ShardedCacheOpts{}
+	}
+	vnodes := o.VirtualNodes
+	if vnodes <= 0 {
+		vnodes = 160
+	}
+
+	c := &shardedCache{
+		shards:   make([]CacheService, len(shards)),
+		failover: o.Failover,
+	}
+	names := make(map[string]struct{}, len(shards))
+	for i, s := range shards {
+		if _, ok := names[s.Name]; ok {
+			return nil, errors.Wrap(ErrValidation, "duplicated shard name %q", s.Name)
+		}
+		names[s.Name] = struct{}{}
+		if s.Cache == nil {
+			return nil, errors.Wrap(ErrValidation, "shard %q without cache", s.Name)
+		}
+		weight := s.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+
+		c.shards[i] = s.Cache
+		for n := 0; n < weight*vnodes; n++ {
+			c.ring = append(c.ring, shardPoint{
+				hash:  crc32.ChecksumIEEE([]byte(s.Name + "-" + strconv.Itoa(n))),
+				shard: i,
+			})
+		}
+	}
+	sort.Slice(c.ring, func(i, j int) bool {
+		return c.ring[i].hash < c.ring[j].hash
+	})
+	return c, nil
+}
+
+type shardedCache struct {
+	shards   []CacheService
+	ring     []shardPoint
+	failover bool
+}
+
+type shardPoint struct {
+	hash  uint32
+	shard int
+}
+
+// candidates returns indexes of shards that can store given key, in order
+// of preference. Without failover, only the owning shard is returned.
+func (c *shardedCache) candidates(key string) []int {
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(c.ring), func(i int) bool {
+		return c.ring[i].hash >= h
+	})
+
+	if !c.failover {
+		return []int{c.ring[start%len(c.ring)].shard}
+	}
+
+	seen := make(map[int]bool, len(c.shards))
+	candidates := make([]int, 0, len(c.shards))
+	for i := 0; i < len(c.ring) && len(candidates) < len(c.shards); i++ {
+		shard := c.ring[(start+i)%len(c.ring)].shard
+		if !seen[shard] {
+			seen[shard] = true
+			candidates = append(candidates, shard)
+		}
+	}
+	return candidates
+}
+
+// isCacheFailure returns true if given error means that cache cannot be
+// used, as opposed to a result of the operation.
+func isCacheFailure(ctx context.Context, err error) bool {
+	switch {
+	case err == nil, ctx.Err() != nil:
+		return false
+	case ErrMiss.Is(err), ErrConflict.Is(err), ErrCacheMalformed.Is(err), ErrValidation.Is(err):
+		return false
+	default:
+		return true
+	}
+}
+
+// do calls given function with shards that can store given key, until one
+// of them does not fail.
+func (c *shardedCache) do(ctx context.Context, key string, fn func(CacheService) error) error {
+	var err error
+	for _, shard := range c.candidates(key) {
+		if err = fn(c.shards[shard]); !isCacheFailure(ctx, err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *shardedCache) Get(ctx context.Context, key string, dest interface{}) error {
+	return c.do(ctx, key, func(cache CacheService) error {
+		return cache.Get(ctx, key, dest)
+	})
+}
+
+func (c *shardedCache) Set(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	return c.do(ctx, key, func(cache CacheService) error {
+		return cache.Set(ctx, key, value, exp)
+	})
+}
+
+func (c *shardedCache) SetNx(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	return c.do(ctx, key, func(cache CacheService) error {
+		return cache.SetNx(ctx, key, value, exp)
+	})
+}
+
+func (c *shardedCache) Del(ctx context.Context, key string) error {
+	return c.do(ctx, key, func(cache CacheService) error {
+		return cache.Del(ctx, key)
+	})
+}
+
+// byShard groups indexes of given keys by the shard owning them.
+func (c *shardedCache) byShard(keys []string) map[int][]int {
+	groups := make(map[int][]int)
+	for i, key := range keys {
+		shard := c.candidates(key)[0]
+		groups[shard] = append(groups[shard], i)
+	}
+	return groups
+}
+
+func (c *shardedCache) GetMulti(ctx context.Context, keys []string, dests []interface{}) ([]error, error) {
+	if err := validateBatch(keys, dests); err != nil {
+		return nil, err
+	}
+	errs := make([]error, len(keys))
+	for shard, idxs := range c.byShard(keys) {
+		shardKeys := make([]string, len(idxs))
+		shardDests := make([]interface{}, len(idxs))
+		for i, idx := range idxs {
+			shardKeys[i] = keys[idx]
+			shardDests[i] = dests[idx]
+		}
+		shardErrs, err := AsBatchCache(c.shards[shard]).GetMulti(ctx, shardKeys, shardDests)
+		if err != nil {
+			if !c.failover || !isCacheFailure(ctx, err) {
+				return nil, err
+			}
+			// Fall back to single key operations, each using the
+			// next shard.
+			for _, idx := range idxs {
+				switch err := c.Get(ctx, keys[idx], dests[idx]); {
+				case err == nil, ErrMiss.Is(err), ErrCacheMalformed.Is(err):
+					errs[idx] = err
+				default:
+					return nil, err
+				}
+			}
+			continue
+		}
+		for i, idx := range idxs {
+			errs[idx] = shardErrs[i]
+		}
+	}
+	return errs, nil
+}
+
+func (c *shardedCache) SetMulti(ctx context.Context, items []CacheItem) error {
+	keys := make([]string, len(items))
+	for i, it := range items {
+		keys[i] = it.Key
+	}
+	for shard, idxs := range c.byShard(keys) {
+		shardItems := make([]CacheItem, len(idxs))
+		for i, idx := range idxs {
+			shardItems[i] = items[idx]
+		}
+		err := AsBatchCache(c.shards[shard]).SetMulti(ctx, shardItems)
+		if err == nil {
+			continue
+		}
+		if !c.failover || !isCacheFailure(ctx, err) {
+			return err
+		}
+		for _, it := range shardItems {
+			if err := c.Set(ctx, it.Key, it.Value, it.Exp); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *shardedCache) DelMulti(ctx context.Context, keys []string) error {
+	for shard, idxs := range c.byShard(keys) {
+		shardKeys := make([]string, len(idxs))
+		for i, idx := range idxs {
+			shardKeys[i] = keys[idx]
+		}
+		err := AsBatchCache(c.shards[shard]).DelMulti(ctx, shardKeys)
+		if err == nil {
+			continue
+		}
+		if !c.failover || !isCacheFailure(ctx, err) {
+			return err
+		}
+		for _, key := range shardKeys {
+			if err := c.Del(ctx, key); err != nil && !ErrMiss.Is(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package surf
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-surf/surf/errors"
+)
+
+func TestShardedCache(t *testing.T) {
+	cache := ShardedCache([]CacheService{
+		NewLocalMemCache(),
+		NewLocalMemCache(),
+		NewLocalMemCache(),
+	})
+	RunCacheConformanceTest(t, cache, &CacheCapabilities{Batch: true})
+}
+
+func TestShardedCacheDistribution(t *testing.T) {
+	ctx := context.Background()
+
+	small := NewLocalMemCache()
+	big := NewLocalMemCache()
+	cache, err := NewShardedCache([]CacheShard{
+		{Name: "small", Cache: small, Weight: 1},
+		{Name: "big", Cache: big, Weight: 3},
+	}, nil)
+	if err != nil {
+		t.Fatalf("cannot create sharded cache: %s", err)
+	}
+
+	const total = 2000
+	for i := 0; i < total; i++ {
+		if err := cache.Set(ctx, fmt.Sprintf("key-%d", i), i, time.Minute); err != nil {
+			t.Fatalf("cannot set: %s", err)
+		}
+	}
+	var inBig int
+	for i := 0; i < total; i++ {
+		var v int
+		if big.Get(ctx, fmt.Sprintf("key-%d", i), &v) == nil {
+			inBig++
+		}
+	}
+	// expected 75% of keys in the big shard
+	if inBig < total*65/100 || inBig > total*85/100 {
+		t.Fatalf("big shard holds %d of %d keys", inBig, total)
+	}
+}
+
+func TestShardedCacheAddingShard(t *testing.T) {
+	shards := []CacheShard{
+		{Name: "a", Cache: NewLocalMemCache()},
+		{Name: "b", Cache: NewLocalMemCache()},
+		{Name: "c", Cache: NewLocalMemCache()},
+	}
+	before, err := NewShardedCache(shards, nil)
+	if err != nil {
+		t.Fatalf("cannot create sharded cache: %s", err)
+	}
+	after, err := NewShardedCache(append(shards, CacheShard{Name: "d", Cache: NewLocalMemCache()}), nil)
+	if err != nil {
+		t.Fatalf("cannot create sharded cache: %s", err)
+	}
+
+	// keys are moved only to the new shard
+	var moved int
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		was := before.(*shardedCache).candidates(key)[0]
+		now := after.(*shardedCache).candidates(key)[0]
+		if was != now {
+			if now != 3 {
+				t.Fatalf("%s moved from %d to %d", key, was, now)
+			}
+			moved++
+		}
+	}
+	if moved < 150 || moved > 350 {
+		t.Fatalf("%d of 1000 keys moved", moved)
+	}
+}
+
+func TestShardedCacheFailover(t *testing.T) {
+	ctx := context.Background()
+
+	broken := &brokenCache{}
+	healthy := NewLocalMemCache()
+	shards := []CacheShard{
+		{Name: "broken", Cache: broken},
+		{Name: "healthy", Cache: healthy},
+	}
+
+	withoutFailover, err := NewShardedCache(shards, nil)
+	if err != nil {
+		t.Fatalf("cannot create sharded cache: %s", err)
+	}
+	var failed int
+	for i := 0; i < 100; i++ {
+		if err := withoutFailover.Set(ctx, fmt.Sprintf("key-%d", i), i, time.Minute); err != nil {
+			failed++
+		}
+	}
+	if failed == 0 {
+		t.Fatal("want some keys to be stored in the broken shard")
+	}
+
+	cache, err := NewShardedCache(shards, &ShardedCacheOpts{Failover: true})
+	if err != nil {
+		t.Fatalf("cannot create sharded cache: %s", err)
+	}
+	RunCacheConformanceTest(t, cache, &CacheCapabilities{Batch: true})
+}
+
+func TestShardedCacheInvalidShards(t *testing.T) {
+	if _, err := NewShardedCache(nil, nil); !ErrValidation.Is(err) {
+		t.Fatalf("want ErrValidation, got %+v", err)
+	}
+	_, err := NewShardedCache([]CacheShard{
+		{Name: "a", Cache: NewLocalMemCache()},
+		{Name: "a", Cache: NewLocalMemCache()},
+	}, nil)
+	if !ErrValidation.Is(err) {
+		t.Fatalf("want ErrValidation, got %+v", err)
+	}
+}
+
+// brokenCache fails all operations.
+type brokenCache struct{}
+
+var errBrokenCache = errors.Wrap(ErrInternal, "broken cache")
+
+func (brokenCache) Get(context.Context, string, interface{}) error {
+	return errBrokenCache
+}
+
+func (brokenCache) Set(context.Context, string, interface{}, time.Duration) error {
+	return errBrokenCache
+}
+
+func (brokenCache) SetNx(context.Context, string, interface{}, time.Duration) error {
+	return errBrokenCache
+}
+
+func (brokenCache) Del(context.Context, string) error {
+	return errBrokenCache
+}
@@ -4,25 +4,119 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"math"
+	"math/rand"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-surf/surf/errors"
 )
 
+// StampedeProtect returns cache wrapper that protects from cache stampede
+// using default options. See StampedeProtectWithOpts.
 func StampedeProtect(cache CacheService) CacheService {
-	return &stampedeProtectedCache{
+	return StampedeProtectWithOpts(cache, nil)
+}
+
+// StampedeProtectWithOpts returns cache wrapper that protects from cache
+// stampede.
+//
+// When a value is missing, only one client is allowed to compute it, while
+// others wait for the result. Before a value expires, clients decide
+// independently whether to recompute it early, using probabilistic early
+// expiration (XFetch). The chance of early recomputation grows as the
+// expiration time approaches and is higher for values that take longer to
+// compute. Computation time is measured between a cache miss and the Set
+// call for the same key.
+//
+// Computation locks acquired by this instance are tracked by key. The first
+// Set call for a key after a miss, with any context, releases the lock and
+// measures computation time since the miss.
+func StampedeProtectWithOpts(cache CacheService, o *StampedeProtectOpts) *StampedeProtectedCache {
+	if o == nil {
+		o = &StampedeProtectOpts{}
+	}
+	beta := o.Beta
+	if beta <= 0 {
+		beta = 1
+	}
+	computationLock := o.ComputationLock
+	if computationLock <= 0 {
+		computationLock = 2 * time.Second
+	}
+	return &StampedeProtectedCache{
 		cache:           cache,
-		computationLock: 2 * time.Second,
+		computationLock: computationLock,
+		beta:            beta,
+		random:          rand.Float64,
+		locks:           make(map[string]*stampedeLock),
 	}
 }
 
-type stampedeProtectedCache struct {
+type StampedeProtectOpts struct {
+	// Beta scales the probability of early recomputation. Values greater
+	// than 1 favor earlier recomputation, values lower than 1 favor later
+	// recomputation. Defaults to 1.
+	Beta float64
+
+	// ComputationLock is how long a client that was allowed to compute
+	// a value has before another client is allowed to compute it as
+	// well. Defaults to 2 seconds.
+	ComputationLock time.Duration
+}
+
+// StampedeProtectedCache is a CacheService that protects from cache
+// stampede.
+type StampedeProtectedCache struct {
+	// Counters are accessed atomically.
+	hits           uint64
+	misses         uint64
+	earlyRefreshes uint64
+
 	cache           CacheService
 	computationLock time.Duration
+	beta            float64
+	random          func() float64
+
+	// locks holds computation locks acquired by this instance, to
+	// release them and measure how long computing the value takes.
+	mu    sync.Mutex
+	locks map[string]*stampedeLock
 }
 
-func (s *stampedeProtectedCache) Get(ctx context.Context, key string, dest interface{}) error {
+// stampedeLock is a computation lock acquired by a Get call that returned a
+// miss.
+type stampedeLock struct {
+	// token is the value of the lock, unique for each acquisition.
+	token string
+	// at is the time the lock was acquired.
+	at time.Time
+}
+
+// StampedeStats is a snapshot of StampedeProtectedCache counters.
+type StampedeStats struct {
+	// Hits is the number of lookups that returned a cached value.
+	Hits uint64
+	// Misses is the number of lookups that returned a miss, including
+	// early refreshes.
+	Misses uint64
+	// EarlyRefreshes is the number of lookups that returned a miss
+	// before the value expired, so that it is recomputed early.
+	EarlyRefreshes uint64
+}
+
+// Stats returns current counters.
+func (s *StampedeProtectedCache) Stats() StampedeStats {
+	return StampedeStats{
+		Hits:           atomic.LoadUint64(&s.hits),
+		Misses:         atomic.LoadUint64(&s.misses),
+		EarlyRefreshes: atomic.LoadUint64(&s.earlyRefreshes),
+	}
+}
+
+func (s *StampedeProtectedCache) Get(ctx context.Context, key string, dest interface{}) error {
 	var it stampedeProtectedItem
 
 readProtectedItem:
@@ -37,22 +131,26 @@ readProtectedItem:
 			// return cache miss - we are allowed to recompute. If
 			// we don't get the lock, wait and retry until value is
 			// in cache again.
-			if s.cache.SetNx(ctx, key+":stampedelock", 1, s.computationLock) == nil {
+			if s.lock(ctx, key, false) {
 				return ErrMiss
 			}
-			time.Sleep(25 * time.Millisecond)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(25 * time.Millisecond):
+			}
 		default:
 			return err
 		}
 	}
 
-	if it.refreshAt.Before(time.Now()) {
+	if s.shouldRefresh(&it, time.Now()) {
 		// Acquire task computation lock. If we get it, return
 		// cache miss so that the client will recompute the
 		// result. Otherwise return cached value - cached value
 		// is still valid and another client is already
 		// recomputing the task.
-		if s.cache.SetNx(ctx, key+":stampedelock", 1, s.computationLock) == nil {
+		if s.lock(ctx, key, true) {
 			return ErrMiss
 		}
 	}
@@ -60,65 +158,138 @@ readProtectedItem:
 	if err := CacheUnmarshal(it.value, dest); err != nil {
 		return errors.Wrap(err, "cannot unmarshal")
 	}
+	atomic.AddUint64(&s.hits, 1)
 	return nil
 }
 
-func (s *stampedeProtectedCache) Set(ctx context.Context, key string, value interface{}, exp time.Duration) error {
-	rawValue, err := CacheMarshal(value)
-	if err != nil {
-		return err
+// shouldRefresh returns true if given item should be recomputed before it
+// expires. Each call decides independently, with probability growing as the
+// expiration time approaches.
+func (s *StampedeProtectedCache) shouldRefresh(it *stampedeProtectedItem, now time.Time) bool {
+	if it.delta <= 0 {
+		return !now.Before(it.expireAt)
+	}
+	// 1 - random is in (0, 1], so the logarithm is finite.
+	gap := -float64(it.delta) * s.beta * math.Log(1-s.random())
+	return !now.Add(time.Duration(gap)).Before(it.expireAt)
+}
+
+// lock acquires computation lock of given key. It returns true and records a
+// miss if the lock was acquired.
+func (s *StampedeProtectedCache) lock(ctx context.Context, key string, early bool) bool {
+	token := generateID()
+	if s.cache.SetNx(ctx, key+":stampedelock", token, s.computationLock) != nil {
+		return false
 	}
 
-	it := stampedeProtectedItem{
-		refreshAt: time.Now().Add(exp).Add(-refreshMargin(exp)),
-		value:     rawValue,
+	atomic.AddUint64(&s.misses, 1)
+	if early {
+		atomic.AddUint64(&s.earlyRefreshes, 1)
 	}
-	return s.cache.Set(ctx, key, &it, exp)
+
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Values that are never set leave their entries behind.
+	if len(s.locks) > 1024 {
+		for k, l := range s.locks {
+			if now.Sub(l.at) > time.Minute {
+				delete(s.locks, k)
+			}
+		}
+	}
+	s.locks[key] = &stampedeLock{token: token, at: now}
+	return true
 }
 
-func (s *stampedeProtectedCache) SetNx(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+// newItem returns item for given value. If the computation lock of given key
+// was acquired by this instance, computation time is measured since then and
+// the lock is returned, so that it can be released.
+func (s *StampedeProtectedCache) newItem(key string, value interface{}, exp time.Duration) (*stampedeProtectedItem, *stampedeLock, error) {
 	rawValue, err := CacheMarshal(value)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	var delta time.Duration
+
+	s.mu.Lock()
+	lock, ok := s.locks[key]
+	if ok {
+		delta = now.Sub(lock.at)
+		delete(s.locks, key)
 	}
+	s.mu.Unlock()
 
-	it := stampedeProtectedItem{
-		refreshAt: time.Now().Add(exp).Add(-refreshMargin(exp)),
-		value:     rawValue,
+	it := &stampedeProtectedItem{
+		expireAt: now.Add(exp),
+		delta:    delta,
+		value:    rawValue,
 	}
-	return s.cache.SetNx(ctx, key, &it, exp)
+	return it, lock, nil
 }
 
-func refreshMargin(exp time.Duration) time.Duration {
-	if exp > 10*time.Minute {
-		return time.Minute
+// unlock releases computation lock of given key, so that the value can be
+// refreshed early. Lock that expired and was acquired by another client is
+// not released.
+func (s *StampedeProtectedCache) unlock(ctx context.Context, key string, lock *stampedeLock) {
+	if lock == nil {
+		return
 	}
-	if exp > time.Minute {
-		return 10 * time.Second
+	lockKey := key + ":stampedelock"
+	var token string
+	if err := s.cache.Get(ctx, lockKey, &token); err != nil || token != lock.token {
+		return
 	}
-	if exp > 30*time.Second {
-		return 3 * time.Second
+	if err := s.cache.Del(ctx, lockKey); err != nil && !ErrMiss.Is(err) {
+		LogError(ctx, err, "cannot release computation lock",
+			"key", key)
 	}
-	if exp > 10*time.Second {
-		return time.Second
+}
+
+func (s *StampedeProtectedCache) Set(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	it, lock, err := s.newItem(key, value, exp)
+	if err != nil {
+		return err
 	}
-	if exp > 5*time.Second {
-		return 500 * time.Millisecond
+	if err := s.cache.Set(ctx, key, it, exp); err != nil {
+		return err
+	}
+	s.unlock(ctx, key, lock)
+	return nil
+}
+
+func (s *StampedeProtectedCache) SetNx(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	it, lock, err := s.newItem(key, value, exp)
+	if err != nil {
+		return err
 	}
-	return 0
+	if err := s.cache.SetNx(ctx, key, it, exp); err != nil {
+		return err
+	}
+	s.unlock(ctx, key, lock)
+	return nil
 }
 
-func (s *stampedeProtectedCache) Del(ctx context.Context, key string) error {
+func (s *StampedeProtectedCache) Del(ctx context.Context, key string) error {
 	return s.cache.Del(ctx, key)
 }
 
+// stampedeProtectedItem is serialized as the expiration time and the
+// computation time in nanoseconds, separated by a space, followed by a new
+// line and the value. Items written by previous versions hold only the
+// refresh time, which is read as the expiration time.
 type stampedeProtectedItem struct {
-	refreshAt time.Time
-	value     []byte
+	expireAt time.Time
+	delta    time.Duration
+	value    []byte
 }
 
 func (it stampedeProtectedItem) MarshalCache() ([]byte, error) {
-	raw := fmt.Sprintf("%d\n%s", it.refreshAt.UnixNano(), it.value)
+	raw := fmt.Sprintf("%d %d\n%s", it.expireAt.UnixNano(), int64(it.delta), it.value)
 	return []byte(raw), nil
 }
 
@@ -127,11 +298,94 @@ func (it *stampedeProtectedItem) UnmarshalCache(raw []byte) error {
 	if len(chunks) != 2 {
 		return errors.Wrap(ErrCacheMalformed, "invalid format: %s", raw)
 	}
-	unixNano, err := strconv.ParseInt(string(chunks[0]), 10, 64)
+	header := bytes.SplitN(chunks[0], []byte{' '}, 2)
+	unixNano, err := strconv.ParseInt(string(header[0]), 10, 64)
 	if err != nil {
 		return errors.Wrap(ErrCacheMalformed, "invalid expiration format: %s", err)
 	}
-	it.refreshAt = time.Unix(0, unixNano)
+	it.expireAt = time.Unix(0, unixNano)
+	it.delta = 0
+	if len(header) == 2 {
+		delta, err := strconv.ParseInt(string(header[1]), 10, 64)
+		if err != nil {
+			return errors.Wrap(ErrCacheMalformed, "invalid computation time format: %s", err)
+		}
+		it.delta = time.Duration(delta)
+	}
 	it.value = chunks[1]
 	return nil
 }
+
+func (s *StampedeProtectedCache) GetMulti(ctx context.Context, keys []string, dests []interface{}) ([]error, error) {
+	if err := validateBatch(keys, dests); err != nil {
+		return nil, err
+	}
+
+	items := make([]stampedeProtectedItem, len(keys))
+	itemDests := make([]interface{}, len(keys))
+	for i := range items {
+		itemDests[i] = &items[i]
+	}
+	errs, err := AsBatchCache(s.cache).GetMulti(ctx, keys, itemDests)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for i, key := range keys {
+		switch {
+		case errs[i] == nil:
+			// Same as with a single key lookup, the first client
+			// that acquires the computation lock recomputes the
+			// value.
+			if s.shouldRefresh(&items[i], now) && s.lock(ctx, key, true) {
+				errs[i] = ErrMiss
+				continue
+			}
+			if err := CacheUnmarshal(items[i].value, dests[i]); err != nil {
+				errs[i] = errors.Wrap(err, "cannot unmarshal")
+			} else {
+				atomic.AddUint64(&s.hits, 1)
+			}
+		case ErrMiss.Is(errs[i]):
+			// Fall back to a single key lookup that either
+			// acquires the computation lock or waits for the
+			// value to be computed.
+			switch err := s.Get(ctx, key, dests[i]); {
+			case err == nil, ErrMiss.Is(err), ErrCacheMalformed.Is(err):
+				errs[i] = err
+			default:
+				return nil, err
+			}
+		}
+	}
+	return errs, nil
+}
+
+func (s *StampedeProtectedCache) SetMulti(ctx context.Context, items []CacheItem) error {
+	protected := make([]CacheItem, len(items))
+	locks := make([]*stampedeLock, len(items))
+	for i, it := range items {
+		item, lock, err := s.newItem(it.Key, it.Value, it.Exp)
+		if err != nil {
+			return err
+		}
+		locks[i] = lock
+		protected[i] = CacheItem{
+			Key:   it.Key,
+			Value: item,
+			Exp:   it.Exp,
+		}
+	}
+	if err := AsBatchCache(s.cache).SetMulti(ctx, protected); err != nil {
+		return err
+	}
+	for i, it := range items {
+		s.unlock(ctx, it.Key, locks[i])
+	}
+	return nil
+}
+
+func (s *StampedeProtectedCache) DelMulti(ctx context.Context, keys []string) error {
+	return AsBatchCache(s.cache).DelMulti(ctx, keys)
+}
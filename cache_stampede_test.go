@@ -10,7 +10,7 @@ import (
 
 func TestStampedeCacheProtection(t *testing.T) {
 	cache := StampedeProtect(NewLocalMemCache())
-	RunCacheImplementationTest(t, cache)
+	RunCacheConformanceTest(t, cache, &CacheCapabilities{Batch: true})
 }
 
 func TestStampedeCacheProtectionMultipleReaders(t *testing.T) {
@@ -45,7 +45,7 @@ func TestStampedeCacheProtectionMultipleReaders(t *testing.T) {
 					atomic.AddUint64(&computeCnt, 1)
 
 					if err := cache.Set(ctx, "value-1", "whatever", exp); err != nil {
-						t.Fatalf("cannot set: %s", err)
+						t.Errorf("cannot set: %s", err)
 					}
 				}
 			}()
@@ -64,3 +64,140 @@ func TestStampedeCacheProtectionMultipleReaders(t *testing.T) {
 		time.Sleep(exp)
 	}
 }
+
+func TestStampedeProtectEarlyRefresh(t *testing.T) {
+	ctx := context.Background()
+
+	cache := StampedeProtectWithOpts(NewLocalMemCache(), nil)
+
+	var value string
+	if err := cache.Get(ctx, "key", &value); err != ErrMiss {
+		t.Fatalf("want ErrMiss, got %+v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := cache.Set(ctx, "key", "value", 200*time.Millisecond); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+
+	// Random value close to 1 gives a long early refresh window, close to
+	// 0 gives none.
+	cache.random = func() float64 { return 0.1 }
+	if err := cache.Get(ctx, "key", &value); err != nil || value != "value" {
+		t.Fatalf("want value, got %q, %+v", value, err)
+	}
+	cache.random = func() float64 { return 0.999 }
+	if err := cache.Get(ctx, "key", &value); err != ErrMiss {
+		t.Fatalf("want early refresh, got %+v", err)
+	}
+	// only one client is recomputing
+	if err := cache.Get(ctx, "key", &value); err != nil || value != "value" {
+		t.Fatalf("want value, got %q, %+v", value, err)
+	}
+
+	want := StampedeStats{Hits: 2, Misses: 2, EarlyRefreshes: 1}
+	if got := cache.Stats(); got != want {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+}
+
+func TestStampedeProtectedItemSerialization(t *testing.T) {
+	it := stampedeProtectedItem{
+		expireAt: time.Unix(0, 1500000000123456789),
+		delta:    42 * time.Millisecond,
+		value:    []byte("multi\nline value"),
+	}
+	raw, err := it.MarshalCache()
+	if err != nil {
+		t.Fatalf("cannot marshal: %s", err)
+	}
+	var got stampedeProtectedItem
+	if err := got.UnmarshalCache(raw); err != nil {
+		t.Fatalf("cannot unmarshal: %s", err)
+	}
+	if !got.expireAt.Equal(it.expireAt) || got.delta != it.delta || string(got.value) != string(it.value) {
+		t.Fatalf("want %+v, got %+v", it, got)
+	}
+
+	// format written by previous versions
+	if err := got.UnmarshalCache([]byte("1500000000123456789\nvalue")); err != nil {
+		t.Fatalf("cannot unmarshal legacy format: %s", err)
+	}
+	if !got.expireAt.Equal(it.expireAt) || got.delta != 0 || string(got.value) != "value" {
+		t.Fatalf("unexpected legacy item: %+v", got)
+	}
+}
+
+func TestStampedeProtectLockReleasedByDerivedContext(t *testing.T) {
+	storage := NewLocalMemCache()
+	cache := StampedeProtectWithOpts(storage, nil)
+
+	ctx := context.Background()
+
+	var value string
+	if err := cache.Get(ctx, "key", &value); err != ErrMiss {
+		t.Fatalf("want ErrMiss, got %+v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// Value is usually computed with a context derived from the one
+	// passed to Get, for example with a deadline or a tracing span.
+	type ctxKey struct{}
+	derived, cancel := context.WithTimeout(context.WithValue(ctx, ctxKey{}, "span"), time.Minute)
+	defer cancel()
+	if err := cache.Set(derived, "key", "value", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	if err := storage.Get(ctx, "key:stampedelock", &value); !ErrMiss.Is(err) {
+		t.Fatalf("want lock released, got %+v", err)
+	}
+	var it stampedeProtectedItem
+	if err := storage.Get(ctx, "key", &it); err != nil {
+		t.Fatalf("cannot get: %s", err)
+	}
+	if it.delta < 5*time.Millisecond {
+		t.Fatalf("want computation time measured, got %s", it.delta)
+	}
+	if len(cache.locks) != 0 {
+		t.Fatalf("want no lock state kept, got %d", len(cache.locks))
+	}
+}
+
+func TestStampedeProtectLockOwnedByCall(t *testing.T) {
+	storage := NewLocalMemCache()
+	cache := StampedeProtectWithOpts(storage, nil)
+
+	ctx := context.Background()
+
+	var value string
+	if err := cache.Get(ctx, "key", &value); err != ErrMiss {
+		t.Fatalf("want ErrMiss, got %+v", err)
+	}
+
+	// Lock that expired and was acquired by another client is not
+	// released by its previous owner.
+	if err := storage.Set(ctx, "key:stampedelock", "another-client", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	if err := cache.Set(ctx, "key", "owner", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	if err := storage.Get(ctx, "key:stampedelock", &value); err != nil || value != "another-client" {
+		t.Fatalf("want lock of another client kept, got %q, %+v", value, err)
+	}
+
+	if err := storage.Del(ctx, "key:stampedelock"); err != nil {
+		t.Fatalf("cannot delete: %s", err)
+	}
+	if err := storage.Del(ctx, "key"); err != nil {
+		t.Fatalf("cannot delete: %s", err)
+	}
+	if err := cache.Get(ctx, "key", &value); err != ErrMiss {
+		t.Fatalf("want ErrMiss, got %+v", err)
+	}
+	if err := cache.Set(ctx, "key", "owner", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	if err := storage.Get(ctx, "key:stampedelock", &value); !ErrMiss.Is(err) {
+		t.Fatalf("want lock released by its owner, got %+v", err)
+	}
+}
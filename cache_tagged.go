@@ -0,0 +1,262 @@
+package surf
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/go-surf/surf/errors"
+)
+
+// NewTaggedCache returns cache wrapper that allows to group entries using
+// tags and invalidate all entries of a group at once.
+//
+// Each tag has a version stored in the wrapped cache. Tagged entry stores
+// versions of its tags from the time it was written and is considered a miss
+// if any of them has changed since. Invalidating a tag is a single write that
+// changes its version, so no key scans are needed and any CacheService can
+// be used as a storage. Stale entries are not removed, they expire as usual.
+func NewTaggedCache(cache CacheService) *TaggedCache {
+	return &TaggedCache{
+		cache: AsBatchCache(cache),
+	}
+}
+
+// TaggedCache is a CacheService that supports tag based invalidation.
+type TaggedCache struct {
+	cache BatchCacheService
+}
+
+var _ CacheService = (*TaggedCache)(nil)
+
+const (
+	// tagKeyPrefix is used to build key of the tag version.
+	tagKeyPrefix = "surf-tag:"
+
+	// tagVersionExp is how long a tag version is kept. If tag version
+	// expires, all entries tagged with it become a miss.
+	tagVersionExp = 30 * 24 * time.Hour
+)
+
+func (c *TaggedCache) Get(ctx context.Context, key string, dest interface{}) error {
+	var item taggedCacheItem
+	if err := c.cache.Get(ctx, key, &item); err != nil {
+		return err
+	}
+	if fresh, err := c.isFresh(ctx, &item); err != nil {
+		return err
+	} else if !fresh {
+		return ErrMiss
+	}
+	return CacheUnmarshal(item.value, dest)
+}
+
+// Set stores value under given key, without any tags.
+func (c *TaggedCache) Set(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	return c.SetTagged(ctx, key, value, exp)
+}
+
+// SetNx stores value under given key, without any tags, only if the key is
+// not in use.
+func (c *TaggedCache) SetNx(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	return c.SetNxTagged(ctx, key, value, exp)
+}
+
+// SetTagged stores value under given key and associates it with all given
+// tags.
+func (c *TaggedCache) SetTagged(ctx context.Context, key string, value interface{}, exp time.Duration, tags ...string) error {
+	item, err := c.newItem(ctx, value, tags)
+	if err != nil {
+		return err
+	}
+	return c.cache.Set(ctx, key, item, exp)
+}
+
+// SetNxTagged stores value under given key and associates it with all given
+// tags, only if the key is not in use. Entry invalidated by any of its tags
+// is not considered to be in use.
+func (c *TaggedCache) SetNxTagged(ctx context.Context, key string, value interface{}, exp time.Duration, tags ...string) error {
+	item, err := c.newItem(ctx, value, tags)
+	if err != nil {
+		return err
+	}
+	err = c.cache.SetNx(ctx, key, item, exp)
+	if !ErrConflict.Is(err) {
+		return err
+	}
+
+	// Existing entry might be stale, in which case it should be
+	// replaced.
+	var current taggedCacheItem
+	switch err := c.cache.Get(ctx, key, &current); {
+	case err == nil:
+		if fresh, err := c.isFresh(ctx, &current); err != nil {
+			return err
+		} else if fresh {
+			return ErrConflict
+		}
+		if err := c.cache.Del(ctx, key); err != nil && !ErrMiss.Is(err) {
+			return err
+		}
+	case ErrMiss.Is(err):
+		// expired in the meantime
+	default:
+		return err
+	}
+	return c.cache.SetNx(ctx, key, item, exp)
+}
+
+func (c *TaggedCache) Del(ctx context.Context, key string) error {
+	return c.cache.Del(ctx, key)
+}
+
+// InvalidateTag makes all entries tagged with given tag a miss.
+func (c *TaggedCache) InvalidateTag(ctx context.Context, tag string) error {
+	if err := c.cache.Set(ctx, tagKeyPrefix+tag, generateID(), tagVersionExp); err != nil {
+		return errors.Wrap(err, "cannot set tag version")
+	}
+	return nil
+}
+
+// newItem returns item for given value, with current versions of all given
+// tags. Tags without a version get one.
+func (c *TaggedCache) newItem(ctx context.Context, value interface{}, tags []string) (*taggedCacheItem, error) {
+	raw, err := CacheMarshal(value)
+	if err != nil {
+		return nil, err
+	}
+	item := &taggedCacheItem{value: raw}
+	if len(tags) == 0 {
+		return item, nil
+	}
+
+	versions, err := c.versions(ctx, tags)
+	if err != nil {
+		return nil, err
+	}
+	for i, tag := range tags {
+		if versions[i] == "" {
+			if versions[i], err = c.createVersion(ctx, tag); err != nil {
+				return nil, err
+			}
+		}
+		item.tags = append(item.tags, taggedCacheTag{name: tag, version: versions[i]})
+	}
+	return item, nil
+}
+
+// createVersion returns version of given tag, creating one if necessary.
+func (c *TaggedCache) createVersion(ctx context.Context, tag string) (string, error) {
+	version := generateID()
+	switch err := c.cache.SetNx(ctx, tagKeyPrefix+tag, version, tagVersionExp); {
+	case err == nil:
+		return version, nil
+	case ErrConflict.Is(err):
+		// created concurrently
+		if err := c.cache.Get(ctx, tagKeyPrefix+tag, &version); err != nil {
+			return "", errors.Wrap(err, "cannot get tag version")
+		}
+		return version, nil
+	default:
+		return "", errors.Wrap(err, "cannot set tag version")
+	}
+}
+
+// versions returns current versions of all given tags. Version of a tag that
+// does not have one is an empty string.
+func (c *TaggedCache) versions(ctx context.Context, tags []string) ([]string, error) {
+	keys := make([]string, len(tags))
+	dests := make([]interface{}, len(tags))
+	versions := make([]string, len(tags))
+	for i, tag := range tags {
+		keys[i] = tagKeyPrefix + tag
+		dests[i] = &versions[i]
+	}
+	errs, err := c.cache.GetMulti(ctx, keys, dests)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get tag versions")
+	}
+	for i, err := range errs {
+		if err != nil {
+			// missing or malformed version is never matching
+			versions[i] = ""
+		}
+	}
+	return versions, nil
+}
+
+// isFresh returns true if none of the item tags was invalidated.
+func (c *TaggedCache) isFresh(ctx context.Context, item *taggedCacheItem) (bool, error) {
+	if len(item.tags) == 0 {
+		return true, nil
+	}
+	names := make([]string, len(item.tags))
+	for i, t := range item.tags {
+		names[i] = t.name
+	}
+	versions, err := c.versions(ctx, names)
+	if err != nil {
+		return false, err
+	}
+	for i, t := range item.tags {
+		if versions[i] != t.version {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// taggedCacheItem is serialized as the number of tags, followed by length
+// prefixed name and version of each tag, followed by the value.
+type taggedCacheItem struct {
+	tags  []taggedCacheTag
+	value []byte
+}
+
+type taggedCacheTag struct {
+	name    string
+	version string
+}
+
+var _ CacheMarshaler = (*taggedCacheItem)(nil)
+
+func (it *taggedCacheItem) MarshalCache() ([]byte, error) {
+	b := binary.AppendUvarint(nil, uint64(len(it.tags)))
+	for _, t := range it.tags {
+		b = binary.AppendUvarint(b, uint64(len(t.name)))
+		b = append(b, t.name...)
+		b = binary.AppendUvarint(b, uint64(len(t.version)))
+		b = append(b, t.version...)
+	}
+	return append(b, it.value...), nil
+}
+
+func (it *taggedCacheItem) UnmarshalCache(raw []byte) error {
+	readString := func() (string, bool) {
+		n, size := binary.Uvarint(raw)
+		if size <= 0 || uint64(len(raw)-size) < n {
+			return "", false
+		}
+		s := string(raw[size : size+int(n)])
+		raw = raw[size+int(n):]
+		return s, true
+	}
+
+	count, size := binary.Uvarint(raw)
+	if size <= 0 || count > uint64(len(raw)) {
+		return errors.Wrap(ErrCacheMalformed, "invalid tags count")
+	}
+	raw = raw[size:]
+	it.tags = make([]taggedCacheTag, count)
+	for i := range it.tags {
+		var ok bool
+		if it.tags[i].name, ok = readString(); !ok {
+			return errors.Wrap(ErrCacheMalformed, "invalid tag name")
+		}
+		if it.tags[i].version, ok = readString(); !ok {
+			return errors.Wrap(ErrCacheMalformed, "invalid tag version")
+		}
+	}
+	it.value = append([]byte(nil), raw...)
+	return nil
+}
@@ -0,0 +1,59 @@
+package surf
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestTaggedCache(t *testing.T) {
+	t.Run("local memory", func(t *testing.T) {
+		RunTaggedCacheImplementationTest(t, NewLocalMemCache())
+	})
+	t.Run("memory", func(t *testing.T) {
+		cache := NewMemCache(nil)
+		defer cache.Close()
+		RunTaggedCacheImplementationTest(t, cache)
+	})
+	t.Run("filesystem", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "surf_cache_tagged_test_")
+		if err != nil {
+			t.Fatalf("cannot create temporary directory: %s", err)
+		}
+		defer os.RemoveAll(dir)
+		cache, err := NewFilesystemCache(dir)
+		if err != nil {
+			t.Fatalf("cannot create cache: %s", err)
+		}
+		defer cache.Close()
+		RunTaggedCacheImplementationTest(t, cache)
+	})
+}
+
+func TestTaggedCacheItemSerialization(t *testing.T) {
+	item := taggedCacheItem{
+		tags: []taggedCacheTag{
+			{name: "user:42", version: "v1"},
+			{name: "", version: "v2"},
+		},
+		value: []byte(`{"a": 1}`),
+	}
+	raw, err := item.MarshalCache()
+	if err != nil {
+		t.Fatalf("cannot marshal: %s", err)
+	}
+	var got taggedCacheItem
+	if err := got.UnmarshalCache(raw); err != nil {
+		t.Fatalf("cannot unmarshal: %s", err)
+	}
+	if !reflect.DeepEqual(item, got) {
+		t.Fatalf("want %#v, got %#v", item, got)
+	}
+
+	for i := 0; i < len(raw)-len(item.value); i++ {
+		if err := got.UnmarshalCache(raw[:i]); !ErrCacheMalformed.Is(err) {
+			t.Fatalf("%d bytes: want ErrCacheMalformed, got %+v", i, err)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package surf
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TieredCache returns cache that keeps a copy of values in a local cache,
+// in front of the remote cache shared by many processes. Reads are served
+// from the local cache if possible and fall back to the remote one. Writes go
+// to both caches.
+//
+// Local copies are kept for at most localTTL. When a value is modified, all
+// other processes are notified using given invalidation bus and drop their
+// local copies. Because bus delivery is not guaranteed, localTTL is the
+// upper limit of how long a stale value can be served. Bus can be nil, in
+// which case other processes are not notified. Call Close to cancel the bus
+// subscription once the cache is no longer used.
+//
+// Values written through this cache are kept locally no longer than their
+// expiration. Values read from the remote cache are kept locally for the
+// full localTTL, because the remote cache does not expose how long they
+// remain valid, and can be served up to localTTL after they expired.
+func TieredCache(local, remote CacheService, localTTL time.Duration, bus InvalidationBus) *TieredCacheService {
+	c := &TieredCacheService{
+		id:       generateID(),
+		local:    local,
+		remote:   remote,
+		localTTL: localTTL,
+		bus:      bus,
+	}
+	if bus != nil {
+		c.unsubscribe = bus.Subscribe(c.onInvalidate)
+	}
+	return c
+}
+
+// TieredCacheService is a CacheService that keeps a copy of values in a
+// local cache. See TieredCache.
+type TieredCacheService struct {
+	// id is used to ignore invalidation messages sent by this instance.
+	id       string
+	local    CacheService
+	remote   CacheService
+	localTTL time.Duration
+	bus      InvalidationBus
+
+	closeOnce   sync.Once
+	unsubscribe func()
+}
+
+// Close cancels the invalidation bus subscription. Local copies are no
+// longer invalidated when other processes modify values, so the cache
+// must not be used after it is closed.
+func (c *TieredCacheService) Close() error {
+	c.closeOnce.Do(func() {
+		if c.unsubscribe != nil {
+			c.unsubscribe()
+		}
+	})
+	return nil
+}
+
+func (c *TieredCacheService) Get(ctx context.Context, key string, dest interface{}) error {
+	var raw rawCacheValue
+	switch err := c.local.Get(ctx, key, &raw); {
+	case err == nil:
+		return CacheUnmarshal(raw, dest)
+	case ErrMiss.Is(err):
+		// fall back to the remote cache
+	default:
+		LogError(ctx, err, "cannot read local cache",
+			"key", key)
+	}
+
+	if err := c.remote.Get(ctx, key, &raw); err != nil {
+		return err
+	}
+	if err := c.local.Set(ctx, key, &raw, c.localTTL); err != nil {
+		LogError(ctx, err, "cannot write local cache",
+			"key", key)
+	}
+	return CacheUnmarshal(raw, dest)
+}
+
+func (c *TieredCacheService) Set(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	raw, err := CacheMarshal(value)
+	if err != nil {
+		return err
+	}
+	if err := c.remote.Set(ctx, key, (*rawCacheValue)(&raw), exp); err != nil {
+		return err
+	}
+	c.setLocal(ctx, key, raw, exp)
+	c.invalidate(ctx, key)
+	return nil
+}
+
+func (c *TieredCacheService) SetNx(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	raw, err := CacheMarshal(value)
+	if err != nil {
+		return err
+	}
+	if err := c.remote.SetNx(ctx, key, (*rawCacheValue)(&raw), exp); err != nil {
+		return err
+	}
+	c.setLocal(ctx, key, raw, exp)
+	c.invalidate(ctx, key)
+	return nil
+}
+
+func (c *TieredCacheService) Del(ctx context.Context, key string) error {
+	err := c.remote.Del(ctx, key)
+	if lerr := c.local.Del(ctx, key); lerr != nil && !ErrMiss.Is(lerr) {
+		LogError(ctx, lerr, "cannot delete from local cache",
+			"key", key)
+	}
+	c.invalidate(ctx, key)
+	return err
+}
+
+func (c *TieredCacheService) setLocal(ctx context.Context, key string, raw []byte, exp time.Duration) {
+	if exp > c.localTTL {
+		exp = c.localTTL
+	}
+	if err := c.local.Set(ctx, key, (*rawCacheValue)(&raw), exp); err != nil {
+		LogError(ctx, err, "cannot write local cache",
+			"key", key)
+	}
+}
+
+// invalidate notifies other processes that value under given key has
+// changed.
+func (c *TieredCacheService) invalidate(ctx context.Context, key string) {
+	if c.bus == nil {
+		return
+	}
+	if err := c.bus.Publish(ctx, c.id+" "+key); err != nil {
+		LogError(ctx, err, "cannot publish cache invalidation",
+			"key", key)
+	}
+}
+
+func (c *TieredCacheService) onInvalidate(message string) {
+	chunks := strings.SplitN(message, " ", 2)
+	if len(chunks) != 2 || chunks[0] == c.id {
+		return
+	}
+	_ = c.local.Del(context.Background(), chunks[1])
+}
+
+// rawCacheValue is an already serialized value. It allows to pass
+// serialized value between caches without decoding it. Only pointer
+// implements CacheMarshaler.
+type rawCacheValue []byte
+
+var _ CacheMarshaler = (*rawCacheValue)(nil)
+
+func (r rawCacheValue) MarshalCache() ([]byte, error) {
+	return r, nil
+}
+
+func (r *rawCacheValue) UnmarshalCache(raw []byte) error {
+	*r = append((*r)[:0], raw...)
+	return nil
+}
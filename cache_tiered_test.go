@@ -0,0 +1,92 @@
+package surf
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTieredCache(t *testing.T) {
+	cache := TieredCache(NewLocalMemCache(), NewLocalMemCache(), time.Minute, nil)
+	RunCacheImplementationTest(t, cache)
+}
+
+func TestTieredCacheInvalidation(t *testing.T) {
+	ctx := context.Background()
+
+	remote := NewLocalMemCache()
+	bus := NewLocalInvalidationBus()
+	localA := NewLocalMemCache()
+	localB := NewLocalMemCache()
+	cacheA := TieredCache(localA, remote, time.Minute, bus)
+	defer cacheA.Close()
+	cacheB := TieredCache(localB, remote, time.Minute, bus)
+	defer cacheB.Close()
+
+	if err := cacheA.Set(ctx, "key", "first", time.Hour); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	var val string
+	if err := cacheB.Get(ctx, "key", &val); err != nil || val != "first" {
+		t.Fatalf("want first, got %+v, %q", err, val)
+	}
+	// value is now served from the local cache
+	if err := localB.Get(ctx, "key", &val); err != nil || val != "first" {
+		t.Fatalf("want local copy, got %+v, %q", err, val)
+	}
+
+	if err := cacheA.Set(ctx, "key", "second", time.Hour); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	if err := localA.Get(ctx, "key", &val); err != nil || val != "second" {
+		t.Fatalf("writer must keep its local copy, got %+v, %q", err, val)
+	}
+	if err := cacheB.Get(ctx, "key", &val); err != nil || val != "second" {
+		t.Fatalf("want second, got %+v, %q", err, val)
+	}
+
+	if err := cacheA.Del(ctx, "key"); err != nil {
+		t.Fatalf("cannot delete: %s", err)
+	}
+	if err := cacheB.Get(ctx, "key", &val); err != ErrMiss {
+		t.Fatalf("want ErrMiss, got %+v, %q", err, val)
+	}
+
+	// closed cache no longer receives invalidation messages
+	if err := cacheB.Close(); err != nil {
+		t.Fatalf("cannot close: %s", err)
+	}
+	if err := cacheB.Set(ctx, "key", "third", time.Hour); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	if err := cacheA.Set(ctx, "key", "fourth", time.Hour); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	if err := localB.Get(ctx, "key", &val); err != nil || val != "third" {
+		t.Fatalf("want local copy kept, got %+v, %q", err, val)
+	}
+}
+
+func TestTieredCacheLocalTTL(t *testing.T) {
+	ctx := context.Background()
+
+	local := NewLocalMemCache()
+	remote := NewLocalMemCache()
+	cache := TieredCache(local, remote, 50*time.Millisecond, nil)
+
+	if err := cache.Set(ctx, "key", "first", time.Hour); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	// modify the value bypassing the tiered cache
+	if err := remote.Set(ctx, "key", "second", time.Hour); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	var val string
+	if err := cache.Get(ctx, "key", &val); err != nil || val != "first" {
+		t.Fatalf("want local copy, got %+v, %q", err, val)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := cache.Get(ctx, "key", &val); err != nil || val != "second" {
+		t.Fatalf("want second, got %+v, %q", err, val)
+	}
+}
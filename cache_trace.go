@@ -2,6 +2,8 @@ package surf
 
 import (
 	"context"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -68,3 +70,54 @@ func (c *tracedCache) Del(ctx context.Context, key string) error {
 	}
 	return err
 }
+
+func (c *tracedCache) GetMulti(ctx context.Context, keys []string, dests []interface{}) ([]error, error) {
+	span := CurrentTrace(ctx).Begin(c.prefix + " GetMulti")
+	errs, err := AsBatchCache(c.cache).GetMulti(ctx, keys, dests)
+	if err != nil {
+		span.Finish(
+			"keys", strings.Join(keys, " "),
+			"err", err.Error())
+	} else {
+		var hits int
+		for _, e := range errs {
+			if e == nil {
+				hits++
+			}
+		}
+		span.Finish(
+			"keys", strings.Join(keys, " "),
+			"hits", strconv.Itoa(hits))
+	}
+	return errs, err
+}
+
+func (c *tracedCache) SetMulti(ctx context.Context, items []CacheItem) error {
+	span := CurrentTrace(ctx).Begin(c.prefix + " SetMulti")
+	err := AsBatchCache(c.cache).SetMulti(ctx, items)
+	keys := make([]string, len(items))
+	for i, it := range items {
+		keys[i] = it.Key
+	}
+	if err != nil {
+		span.Finish(
+			"keys", strings.Join(keys, " "),
+			"err", err.Error())
+	} else {
+		span.Finish("keys", strings.Join(keys, " "))
+	}
+	return err
+}
+
+func (c *tracedCache) DelMulti(ctx context.Context, keys []string) error {
+	span := CurrentTrace(ctx).Begin(c.prefix + " DelMulti")
+	err := AsBatchCache(c.cache).DelMulti(ctx, keys)
+	if err != nil {
+		span.Finish(
+			"keys", strings.Join(keys, " "),
+			"err", err.Error())
+	} else {
+		span.Finish("keys", strings.Join(keys, " "))
+	}
+	return err
+}
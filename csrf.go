@@ -2,80 +2,267 @@ package surf
 
 import (
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
-	"errors"
+	"encoding/binary"
 	"fmt"
 	"html/template"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
 	"time"
+
+	"github.com/go-surf/surf/errors"
 )
 
+// CsrfMiddleware returns middleware that protects from CSRF attacks. Token
+// is kept in the cache service bound to each request.
 func CsrfMiddleware(
 	cache UnboundCacheService,
 	tmpl HTMLRenderer) Middleware {
+	return CsrfMiddlewareWithOpts(cache, tmpl, nil)
+}
+
+// CsrfMiddlewareWithOpts returns middleware that protects from CSRF attacks.
+// Token is kept in the cache service bound to each request.
+//
+// Options are optional and defaults are used for all zero values.
+func CsrfMiddlewareWithOpts(
+	cache UnboundCacheService,
+	tmpl HTMLRenderer,
+	o *CsrfOpts) Middleware {
+	if o == nil {
+		o = &CsrfOpts{}
+	}
+	if o.Lifetime == 0 {
+		o.Lifetime = 30 * time.Minute
+	}
+	assignDefaultCsrfOpts(o, tmpl)
+
+	store := &cacheCsrfStore{
+		cache:    cache,
+		lifetime: o.Lifetime,
+	}
+	return newCsrfMiddleware(store, o)
+}
+
+// SignedCsrfMiddleware returns middleware that protects from CSRF attacks
+// without any server side storage. Token is kept in a cookie and signed
+// using given secret, so that it cannot be forged by the client. Each
+// request token must match the cookie token (double submit).
+//
+// Secret must be at least 32 bytes long, otherwise this function panics.
+//
+// Options are optional and defaults are used for all zero values.
+func SignedCsrfMiddleware(
+	secret []byte,
+	tmpl HTMLRenderer,
+	o *CsrfOpts) Middleware {
+	if len(secret) < minCsrfSecretSize {
+		panic(fmt.Sprintf("CSRF secret must be at least %d bytes long", minCsrfSecretSize))
+	}
+	if o == nil {
+		o = &CsrfOpts{}
+	}
+	if o.Lifetime == 0 {
+		o.Lifetime = 12 * time.Hour
+	}
+	assignDefaultCsrfOpts(o, tmpl)
+
+	store := &signedCsrfStore{
+		secret:    secret,
+		lifetime:  o.Lifetime,
+		sessionID: o.SessionID,
+		secure:    o.Secure,
+		now:       time.Now,
+	}
+	return newCsrfMiddleware(store, o)
+}
+
+// minCsrfSecretSize is the minimal length of the secret used to sign CSRF
+// tokens. Shorter secrets are weaker than the SHA-256 HMAC they are used
+// with.
+const minCsrfSecretSize = 32
+
+func newCsrfMiddleware(store csrfStore, o *CsrfOpts) Middleware {
+	trusted := make([]*url.URL, 0, len(o.TrustedOrigins))
+	for _, origin := range o.TrustedOrigins {
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			panic(fmt.Sprintf("invalid trusted origin %q", origin))
+		}
+		trusted = append(trusted, u)
+	}
+
 	return func(handler interface{}) Handler {
 		return &csrfMiddleware{
-			handler: AsHandler(handler),
-			cache:   cache,
-			tmpl:    tmpl,
+			handler:   AsHandler(handler),
+			store:     store,
+			trusted:   trusted,
+			exempt:    o.Exempt,
+			onFailure: o.OnFailure,
+		}
+	}
+}
+
+// CsrfOpts defines options for the CSRF protection.
+type CsrfOpts struct {
+	// Lifetime defines how long a single token is valid. Defaults to 30
+	// minutes for tokens kept in a cache and to 12 hours for signed
+	// tokens.
+	Lifetime time.Duration
+
+	// SessionID returns identifier of the session that the request
+	// belongs to. Signed token is bound to the session and cannot be used
+	// with any other. When not set, tokens are not bound to any session.
+	SessionID func(*http.Request) string
+
+	// Secure marks token cookie as secure so that it is sent over HTTPS
+	// only.
+	Secure bool
+
+	// TrustedOrigins is a list of origins, other than the one serving the
+	// request, that are allowed to make unsafe requests. Each origin must
+	// contain scheme and host, for example https://www.example.com. Use
+	// *. host prefix to trust all subdomains, for example
+	// https://*.example.com, which matches any port unless one is given.
+	TrustedOrigins []string
+
+	// Exempt returns true for requests that must not be verified, for
+	// example webhook calls. See CsrfExempt.
+	Exempt func(*http.Request) bool
+
+	// OnFailure returns response for the request that failed the
+	// verification. Returned reason is always of ErrCsrf kind. By default
+	// JSON error is returned to API calls and standard HTML response is
+	// rendered for all other requests.
+	OnFailure func(w http.ResponseWriter, r *http.Request, reason error) Response
+}
+
+func assignDefaultCsrfOpts(o *CsrfOpts, tmpl HTMLRenderer) {
+	if o.SessionID == nil {
+		o.SessionID = func(*http.Request) string { return "" }
+	}
+	if o.Exempt == nil {
+		o.Exempt = func(*http.Request) bool { return false }
+	}
+	if o.OnFailure == nil {
+		o.OnFailure = csrfFailureResponse(tmpl)
+	}
+}
+
+// CsrfExempt returns a function that returns true for all requests matching
+// any of given paths and methods. Path is a regular expression that must
+// match the whole request path. Methods is a comma separated list of methods
+// and '*' matches any method.
+//
+// Returned function can be used as CsrfOpts.Exempt value.
+func CsrfExempt(methods string, paths ...string) func(*http.Request) bool {
+	rxs := make([]*regexp.Regexp, 0, len(paths))
+	for _, path := range paths {
+		rxs = append(rxs, regexp.MustCompile(`^`+path+`$`))
+	}
+	methodsSet := make(map[string]struct{})
+	for _, method := range strings.Split(methods, ",") {
+		methodsSet[strings.TrimSpace(method)] = struct{}{}
+	}
+
+	return func(r *http.Request) bool {
+		if _, ok := methodsSet[r.Method]; !ok {
+			if _, ok := methodsSet["*"]; !ok {
+				return false
+			}
 		}
+		for _, rx := range rxs {
+			if rx.MatchString(r.URL.Path) {
+				return true
+			}
+		}
+		return false
 	}
 }
 
+var (
+	// ErrCsrf is returned when request cannot pass CSRF protection.
+	ErrCsrf = errors.Wrap(ErrPermission, "csrf")
+
+	// ErrCsrfOrigin is returned when unsafe request is made from an
+	// untrusted origin.
+	ErrCsrfOrigin = errors.Wrap(ErrCsrf, "origin")
+
+	// ErrCsrfToken is returned when request token is missing or invalid.
+	ErrCsrfToken = errors.Wrap(ErrCsrf, "token")
+)
+
 type csrfMiddleware struct {
-	handler Handler
-	cache   UnboundCacheService
-	tmpl    HTMLRenderer
+	handler   Handler
+	store     csrfStore
+	trusted   []*url.URL
+	exempt    func(*http.Request) bool
+	onFailure func(http.ResponseWriter, *http.Request, error) Response
+}
+
+// csrfStore keeps tokens of all clients.
+type csrfStore interface {
+	// bind returns token store of the client that made the request.
+	bind(w http.ResponseWriter, r *http.Request) boundCsrfStore
+}
+
+// boundCsrfStore keeps the token of a single client.
+type boundCsrfStore interface {
+	// load returns token issued for the client. Empty string is returned
+	// if there is no valid token.
+	load(ctx context.Context) (string, error)
+
+	// issue creates and stores a new token for the client.
+	issue(ctx context.Context) (string, error)
 }
 
 func (m *csrfMiddleware) HandleHTTPRequest(w http.ResponseWriter, r *http.Request) Response {
 	ctx := r.Context()
 
-	store := m.cache.Bind(w, r)
+	store := m.store.bind(w, r)
 
-	var storeToken string
-	switch err := store.Get(ctx, CsrfKey, &storeToken); err {
-	case nil, ErrMiss:
-	default:
+	storeToken, err := store.load(ctx)
+	if err != nil {
 		LogError(ctx, err, "cannot get csrf token from store")
-		return rejectResp("cannot get csrf token")
+		return m.onFailure(w, r, errors.Wrap(ErrCsrf, "cannot get csrf token"))
 	}
 
-	if !isSafeMethod(r.Method) {
-		// if using https, make sure referer does not come from untrusted source
-		if r.URL.Scheme == "https" {
-			if ref, err := url.Parse(r.Referer()); err != nil {
-				return rejectResp("missing referer")
-			} else if ref.Scheme != "https" {
-				return rejectResp("invalid referer")
-			}
+	if !isSafeMethod(r.Method) && !m.exempt(r) {
+		if err := m.verifyOrigin(r); err != nil {
+			LogInfo(ctx, "csrf origin verification failed",
+				"reason", err.Error(),
+				"origin", r.Header.Get("Origin"),
+				"referer", r.Referer())
+			return m.onFailure(w, r, err)
 		}
 
 		reqToken := requestToken(r)
 		if reqToken == "" {
 			LogError(ctx, errors.New("no csrf"), "no csrf token in request")
-			return rejectResp("no csrf token in request")
+			return m.onFailure(w, r, errors.Wrap(ErrCsrfToken, "no csrf token in request"))
 		}
 
-		if reqToken != storeToken {
+		if storeToken == "" || !csrfTokenEqual(unmaskCsrfToken(reqToken), storeToken) {
 			LogInfo(ctx, "csrf token missmatch",
-				"requestToken", reqToken,
-				"storeToken", storeToken)
-			return rejectResp("csrf token missmatch")
+				"requestToken", reqToken)
+			return m.onFailure(w, r, errors.Wrap(ErrCsrfToken, "csrf token missmatch"))
 		}
 	}
 
 	if storeToken == "" {
-		storeToken = newCsrfToken()
-		if err := store.Set(ctx, CsrfKey, storeToken, 30*time.Minute); err != nil {
+		storeToken, err = store.issue(ctx)
+		if err != nil {
 			LogError(ctx, err, "cannot store csrf token")
 		}
 	}
 
-	ctx = context.WithValue(ctx, "surf:csrf-token", storeToken)
+	ctx = context.WithValue(ctx, "surf:csrf-token", maskCsrfToken(storeToken))
 	r = r.WithContext(ctx)
 
 	// protect clients from caching response
@@ -84,6 +271,212 @@ func (m *csrfMiddleware) HandleHTTPRequest(w http.ResponseWriter, r *http.Reques
 	return m.handler.HandleHTTPRequest(w, r)
 }
 
+// verifyOrigin returns an error if the request was made from an untrusted
+// origin. Origin header is used if present. Otherwise, only for secure
+// requests, Referer header is required and verified.
+func (m *csrfMiddleware) verifyOrigin(r *http.Request) error {
+	secure := isSecureRequest(r)
+
+	if origin := r.Header.Get("Origin"); origin != "" && origin != "null" {
+		u, err := url.Parse(origin)
+		if err != nil {
+			return errors.Wrap(ErrCsrfOrigin, "malformed origin")
+		}
+		if !m.isTrusted(r, u) {
+			return errors.Wrap(ErrCsrfOrigin, "untrusted origin %s", origin)
+		}
+		return nil
+	}
+
+	if !secure {
+		return nil
+	}
+
+	referer := r.Referer()
+	if referer == "" {
+		return errors.Wrap(ErrCsrfOrigin, "missing referer")
+	}
+	u, err := url.Parse(referer)
+	if err != nil {
+		return errors.Wrap(ErrCsrfOrigin, "malformed referer")
+	}
+	if u.Scheme != "https" {
+		return errors.Wrap(ErrCsrfOrigin, "insecure referer")
+	}
+	if !m.isTrusted(r, u) {
+		return errors.Wrap(ErrCsrfOrigin, "untrusted referer %s", u.Host)
+	}
+	return nil
+}
+
+// isTrusted returns true if given URL is of the same host as the request or
+// of any of the trusted origins.
+//
+// Scheme is not compared for the same host, because a request passed by a
+// TLS terminating proxy cannot be told apart from an insecure one, unless
+// the proxy sets the X-Forwarded-Proto header.
+func (m *csrfMiddleware) isTrusted(r *http.Request, u *url.URL) bool {
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, t := range m.trusted {
+		if u.Scheme != t.Scheme {
+			continue
+		}
+		if !strings.HasPrefix(t.Host, "*.") {
+			if strings.EqualFold(u.Host, t.Host) {
+				return true
+			}
+			continue
+		}
+		// Subdomain pattern matches any port, unless it specifies
+		// one.
+		if t.Port() != "" && u.Port() != t.Port() {
+			continue
+		}
+		if strings.HasSuffix(strings.ToLower(u.Hostname()), strings.ToLower(t.Hostname()[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSecureRequest returns true if request was made over HTTPS, including
+// requests that are passed by a TLS terminating proxy.
+func isSecureRequest(r *http.Request) bool {
+	return r.TLS != nil ||
+		r.URL.Scheme == "https" ||
+		r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+type cacheCsrfStore struct {
+	cache    UnboundCacheService
+	lifetime time.Duration
+}
+
+func (s *cacheCsrfStore) bind(w http.ResponseWriter, r *http.Request) boundCsrfStore {
+	return &boundCacheCsrfStore{
+		cache:    s.cache.Bind(w, r),
+		lifetime: s.lifetime,
+	}
+}
+
+type boundCacheCsrfStore struct {
+	cache    CacheService
+	lifetime time.Duration
+}
+
+func (s *boundCacheCsrfStore) load(ctx context.Context) (string, error) {
+	var token string
+	switch err := s.cache.Get(ctx, CsrfKey, &token); err {
+	case nil, ErrMiss:
+		return token, nil
+	default:
+		return "", err
+	}
+}
+
+func (s *boundCacheCsrfStore) issue(ctx context.Context) (string, error) {
+	token := newCsrfToken()
+	if err := s.cache.Set(ctx, CsrfKey, token, s.lifetime); err != nil {
+		return token, err
+	}
+	return token, nil
+}
+
+// signedCsrfStore keeps the token in a cookie. Token is made of random
+// value, creation time and a signature of both, bound to the session ID.
+type signedCsrfStore struct {
+	secret    []byte
+	lifetime  time.Duration
+	sessionID func(*http.Request) string
+	secure    bool
+	now       func() time.Time
+}
+
+const (
+	csrfRandomSize    = 18
+	csrfTimestampSize = 8
+	csrfSignatureSize = sha256.Size
+)
+
+func (s *signedCsrfStore) bind(w http.ResponseWriter, r *http.Request) boundCsrfStore {
+	return &boundSignedCsrfStore{
+		store: s,
+		w:     w,
+		r:     r,
+	}
+}
+
+type boundSignedCsrfStore struct {
+	store *signedCsrfStore
+	w     http.ResponseWriter
+	r     *http.Request
+}
+
+func (b *boundSignedCsrfStore) load(ctx context.Context) (string, error) {
+	s, r := b.store, b.r
+
+	c, err := r.Cookie(CsrfKey)
+	if err != nil {
+		return "", nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil || len(raw) != csrfRandomSize+csrfTimestampSize+csrfSignatureSize {
+		return "", nil
+	}
+
+	payload := raw[:csrfRandomSize+csrfTimestampSize]
+	signature := raw[csrfRandomSize+csrfTimestampSize:]
+	if !hmac.Equal(signature, s.sign(r, payload)) {
+		return "", nil
+	}
+
+	created := time.Unix(int64(binary.BigEndian.Uint64(payload[csrfRandomSize:])), 0)
+	if created.Add(s.lifetime).Before(s.now()) {
+		return "", nil
+	}
+	return c.Value, nil
+}
+
+func (b *boundSignedCsrfStore) issue(ctx context.Context) (string, error) {
+	s, r := b.store, b.r
+	now := s.now()
+
+	payload := make([]byte, csrfRandomSize+csrfTimestampSize)
+	if _, err := rand.Read(payload[:csrfRandomSize]); err != nil {
+		return "", fmt.Errorf("cannot read random value: %s", err)
+	}
+	binary.BigEndian.PutUint64(payload[csrfRandomSize:], uint64(now.Unix()))
+
+	token := base64.RawURLEncoding.EncodeToString(append(payload, s.sign(r, payload)...))
+
+	http.SetCookie(b.w, &http.Cookie{
+		Name:     CsrfKey,
+		Value:    token,
+		Path:     "/",
+		Expires:  now.Add(s.lifetime),
+		HttpOnly: true,
+		Secure:   s.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token, nil
+}
+
+func (s *signedCsrfStore) sign(r *http.Request, payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	sessionID := s.sessionID(r)
+	// prefix session ID with its length so that session ID and payload
+	// boundary is not ambiguous
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(len(sessionID)))
+	mac.Write(size[:])
+	mac.Write([]byte(sessionID))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
 func requestToken(r *http.Request) string {
 	if val := r.Header.Get(CsrfKey); val != "" {
 		return val
@@ -107,10 +500,72 @@ func newCsrfToken() string {
 	return strings.TrimRight(base64.URLEncoding.EncodeToString(b), "=")
 }
 
-func rejectResp(reason string) Response {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.Error(w, reason, http.StatusForbidden)
-	})
+// maskCsrfToken returns token XORed with a random pad, prefixed with that
+// pad. Masked value is different for every response, which protects the
+// token from BREACH attacks.
+func maskCsrfToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	masked := make([]byte, 2*len(token))
+	pad := masked[:len(token)]
+	if _, err := rand.Read(pad); err != nil {
+		panic(err)
+	}
+	for i := 0; i < len(token); i++ {
+		masked[len(token)+i] = token[i] ^ pad[i]
+	}
+	return csrfMaskPrefix + base64.RawURLEncoding.EncodeToString(masked)
+}
+
+// unmaskCsrfToken returns token as masked by maskCsrfToken. Value that was
+// not masked is returned unchanged.
+func unmaskCsrfToken(token string) string {
+	if !strings.HasPrefix(token, csrfMaskPrefix) {
+		return token
+	}
+	masked, err := base64.RawURLEncoding.DecodeString(token[len(csrfMaskPrefix):])
+	if err != nil || len(masked)%2 != 0 {
+		return ""
+	}
+	size := len(masked) / 2
+	raw := make([]byte, size)
+	for i := 0; i < size; i++ {
+		raw[i] = masked[i] ^ masked[size+i]
+	}
+	return string(raw)
+}
+
+// csrfMaskPrefix is used to recognize masked tokens. It does not belong to
+// the base64 URL alphabet.
+const csrfMaskPrefix = "."
+
+// csrfTokenEqual compares tokens in constant time.
+func csrfTokenEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// csrfFailureResponse returns failure handler that responds with JSON error
+// to API calls. For all other calls standard response is rendered using
+// given renderer or plain text if renderer is nil.
+func csrfFailureResponse(tmpl HTMLRenderer) func(http.ResponseWriter, *http.Request, error) Response {
+	return func(w http.ResponseWriter, r *http.Request, reason error) Response {
+		if isJSONRequest(r) {
+			return JSONErr(http.StatusForbidden, reason.Error())
+		}
+		if tmpl == nil {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, reason.Error(), http.StatusForbidden)
+			})
+		}
+		return StdResponse(r.Context(), tmpl, http.StatusForbidden)
+	}
+}
+
+// isJSONRequest returns true if the client expects a JSON response.
+func isJSONRequest(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json") ||
+		strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
 }
 
 func isSafeMethod(method string) bool {
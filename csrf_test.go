@@ -0,0 +1,351 @@
+package surf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedCsrfMiddleware(t *testing.T) {
+	now := time.Now()
+	sessionID := "session-1"
+
+	mw := SignedCsrfMiddleware(testCsrfSecret, nil, &CsrfOpts{
+		Lifetime:  time.Hour,
+		SessionID: func(*http.Request) string { return sessionID },
+	})
+	var token string
+	handler := mw(func(w http.ResponseWriter, r *http.Request) Response {
+		token = CsrfToken(r.Context())
+		return nil
+	})
+	handler.(*csrfMiddleware).store.(*signedCsrfStore).now = func() time.Time { return now }
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	serveCsrfRequest(handler, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d", w.Code)
+	}
+	if token == "" {
+		t.Fatal("no token in context")
+	}
+	cookies := w.Header()["Set-Cookie"]
+
+	firstToken := token
+	serveCsrfRequest(handler, httptest.NewRecorder(), withCookies(httptest.NewRequest("GET", "/", nil), cookies))
+	if token == firstToken {
+		t.Fatal("token is not masked")
+	}
+
+	cases := map[string]struct {
+		token     string
+		cookies   []string
+		sessionID string
+		now       time.Time
+		wantCode  int
+	}{
+		"valid token": {
+			token:     firstToken,
+			cookies:   cookies,
+			sessionID: "session-1",
+			now:       now,
+			wantCode:  http.StatusOK,
+		},
+		"valid token from another response": {
+			token:     token,
+			cookies:   cookies,
+			sessionID: "session-1",
+			now:       now,
+			wantCode:  http.StatusOK,
+		},
+		"no token": {
+			cookies:   cookies,
+			sessionID: "session-1",
+			now:       now,
+			wantCode:  http.StatusForbidden,
+		},
+		"no cookie": {
+			token:     firstToken,
+			sessionID: "session-1",
+			now:       now,
+			wantCode:  http.StatusForbidden,
+		},
+		"invalid token": {
+			token:     "abc",
+			cookies:   cookies,
+			sessionID: "session-1",
+			now:       now,
+			wantCode:  http.StatusForbidden,
+		},
+		"another session": {
+			token:     firstToken,
+			cookies:   cookies,
+			sessionID: "session-2",
+			now:       now,
+			wantCode:  http.StatusForbidden,
+		},
+		"expired token": {
+			token:     firstToken,
+			cookies:   cookies,
+			sessionID: "session-1",
+			now:       now.Add(2 * time.Hour),
+			wantCode:  http.StatusForbidden,
+		},
+	}
+
+	for tname, tc := range cases {
+		t.Run(tname, func(t *testing.T) {
+			sessionID = tc.sessionID
+			now = tc.now
+
+			r := withCookies(httptest.NewRequest("POST", "/", nil), tc.cookies)
+			if tc.token != "" {
+				r.Header.Set(CsrfKey, tc.token)
+			}
+			w := httptest.NewRecorder()
+			serveCsrfRequest(handler, w, r)
+			if w.Code != tc.wantCode {
+				t.Fatalf("want %d, got %d: %s", tc.wantCode, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestCacheCsrfMiddleware(t *testing.T) {
+	cache := NewUnboundCache(NewLocalMemCache(), "session")
+	var token string
+	handler := CsrfMiddleware(cache, nil)(func(w http.ResponseWriter, r *http.Request) Response {
+		token = CsrfToken(r.Context())
+		return nil
+	})
+
+	w := httptest.NewRecorder()
+	serveCsrfRequest(handler, w, httptest.NewRequest("GET", "/", nil))
+	cookies := w.Header()["Set-Cookie"]
+
+	r := withCookies(httptest.NewRequest("POST", "/", nil), cookies)
+	r.Header.Set(CsrfKey, token)
+	w = httptest.NewRecorder()
+	serveCsrfRequest(handler, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", w.Code, w.Body)
+	}
+
+	r = withCookies(httptest.NewRequest("POST", "/", nil), cookies)
+	r.Header.Set(CsrfKey, newCsrfToken())
+	w = httptest.NewRecorder()
+	serveCsrfRequest(handler, w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("want 403, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestCsrfOriginVerification(t *testing.T) {
+	var token string
+	mw := SignedCsrfMiddleware(testCsrfSecret, nil, &CsrfOpts{
+		TrustedOrigins: []string{
+			"https://trusted.example.com",
+			"https://*.partner.com",
+		},
+		Exempt: CsrfExempt("POST", `/webhooks/.*`),
+	})
+	handler := mw(func(w http.ResponseWriter, r *http.Request) Response {
+		token = CsrfToken(r.Context())
+		return nil
+	})
+
+	w := httptest.NewRecorder()
+	serveCsrfRequest(handler, w, httptest.NewRequest("GET", "https://example.com/", nil))
+	cookies := w.Header()["Set-Cookie"]
+
+	cases := map[string]struct {
+		url      string
+		header   http.Header
+		noToken  bool
+		wantCode int
+	}{
+		"same origin": {
+			url:      "https://example.com/",
+			header:   http.Header{"Origin": {"https://example.com"}},
+			wantCode: http.StatusOK,
+		},
+		"same origin referer": {
+			url:      "https://example.com/",
+			header:   http.Header{"Referer": {"https://example.com/form"}},
+			wantCode: http.StatusOK,
+		},
+		"trusted origin": {
+			url:      "https://example.com/",
+			header:   http.Header{"Origin": {"https://trusted.example.com"}},
+			wantCode: http.StatusOK,
+		},
+		"trusted subdomain origin": {
+			url:      "https://example.com/",
+			header:   http.Header{"Origin": {"https://www.partner.com"}},
+			wantCode: http.StatusOK,
+		},
+		"untrusted origin": {
+			url:      "https://example.com/",
+			header:   http.Header{"Origin": {"https://evil.com"}},
+			wantCode: http.StatusForbidden,
+		},
+		"same host behind TLS terminating proxy": {
+			url:      "http://example.com/",
+			header:   http.Header{"Origin": {"https://example.com"}},
+			wantCode: http.StatusOK,
+		},
+		"untrusted scheme": {
+			url:      "https://example.com/",
+			header:   http.Header{"Origin": {"http://trusted.example.com"}},
+			wantCode: http.StatusForbidden,
+		},
+		"trusted subdomain origin with port": {
+			url:      "https://example.com/",
+			header:   http.Header{"Origin": {"https://www.partner.com:8443"}},
+			wantCode: http.StatusOK,
+		},
+		"untrusted domain with trusted suffix": {
+			url:      "https://example.com/",
+			header:   http.Header{"Origin": {"https://evilpartner.com"}},
+			wantCode: http.StatusForbidden,
+		},
+		"secure request without referer": {
+			url:      "https://example.com/",
+			wantCode: http.StatusForbidden,
+		},
+		"untrusted referer": {
+			url:      "https://example.com/",
+			header:   http.Header{"Referer": {"https://evil.com/example.com"}},
+			wantCode: http.StatusForbidden,
+		},
+		"insecure referer": {
+			url:      "https://example.com/",
+			header:   http.Header{"Referer": {"http://example.com/"}},
+			wantCode: http.StatusForbidden,
+		},
+		"insecure request without referer": {
+			url:      "http://example.com/",
+			wantCode: http.StatusOK,
+		},
+		"proxied secure request without referer": {
+			url:      "http://example.com/",
+			header:   http.Header{"X-Forwarded-Proto": {"https"}},
+			wantCode: http.StatusForbidden,
+		},
+		"exempt path": {
+			url:      "https://example.com/webhooks/github",
+			noToken:  true,
+			wantCode: http.StatusOK,
+		},
+		"not exempt path": {
+			url:      "https://example.com/webhooks",
+			header:   http.Header{"Origin": {"https://example.com"}},
+			noToken:  true,
+			wantCode: http.StatusForbidden,
+		},
+	}
+
+	for tname, tc := range cases {
+		t.Run(tname, func(t *testing.T) {
+			r := withCookies(httptest.NewRequest("POST", tc.url, nil), cookies)
+			for name, values := range tc.header {
+				r.Header[name] = values
+			}
+			if !tc.noToken {
+				r.Header.Set(CsrfKey, token)
+			}
+			w := httptest.NewRecorder()
+			serveCsrfRequest(handler, w, r)
+			if w.Code != tc.wantCode {
+				t.Fatalf("want %d, got %d: %s", tc.wantCode, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestCsrfFailureResponse(t *testing.T) {
+	handler := SignedCsrfMiddleware(testCsrfSecret, newDefaultRenderer(), nil)(
+		func(w http.ResponseWriter, r *http.Request) Response {
+			return nil
+		})
+
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	serveCsrfRequest(handler, w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("want 403, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Fatalf("want JSON response, got %q", ct)
+	}
+
+	r = httptest.NewRequest("POST", "/", nil)
+	w = httptest.NewRecorder()
+	serveCsrfRequest(handler, w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("want 403, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Fatalf("want HTML response, got %q", ct)
+	}
+
+	var reason error
+	handler = SignedCsrfMiddleware(testCsrfSecret, nil, &CsrfOpts{
+		OnFailure: func(w http.ResponseWriter, r *http.Request, err error) Response {
+			reason = err
+			return StdJSONResp(http.StatusTeapot)
+		},
+	})(func(w http.ResponseWriter, r *http.Request) Response {
+		return nil
+	})
+	w = httptest.NewRecorder()
+	serveCsrfRequest(handler, w, httptest.NewRequest("POST", "/", nil))
+	if w.Code != http.StatusTeapot {
+		t.Fatalf("want 418, got %d", w.Code)
+	}
+	if !ErrCsrfToken.Is(reason) {
+		t.Fatalf("want ErrCsrfToken, got %+v", reason)
+	}
+}
+
+func TestCsrfTokenMasking(t *testing.T) {
+	token := newCsrfToken()
+	masked := maskCsrfToken(token)
+	if masked == token {
+		t.Fatal("token not masked")
+	}
+	if got := unmaskCsrfToken(masked); got != token {
+		t.Fatalf("want %q, got %q", token, got)
+	}
+	if got := unmaskCsrfToken(token); got != token {
+		t.Fatalf("unmasked token must not change: want %q, got %q", token, got)
+	}
+}
+
+func serveCsrfRequest(h Handler, w http.ResponseWriter, r *http.Request) {
+	if resp := h.HandleHTTPRequest(w, r); resp != nil {
+		resp.ServeHTTP(w, r)
+	}
+}
+
+func withCookies(r *http.Request, cookies []string) *http.Request {
+	for _, c := range cookies {
+		r.Header.Add("Cookie", c)
+	}
+	return r
+}
+
+var testCsrfSecret = []byte("super-secret-test-string-32-bytes")
+
+func TestSignedCsrfMiddlewareShortSecret(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("want panic")
+		}
+	}()
+	SignedCsrfMiddleware([]byte("too-short"), nil, nil)
+}
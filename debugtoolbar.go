@@ -2,6 +2,7 @@ package surf
 
 import (
 	"container/list"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
@@ -11,11 +12,18 @@ import (
 	"time"
 )
 
-func DebugToolbarMiddleware(rootPath string) Middleware {
+// DebugToolbarMiddleware returns middleware that records information about
+// handled requests and serves it under given root path.
+//
+// Given caches are listed in the cache panel together with their metrics.
+// Keys of caches implementing CacheKeyLister can be browsed and deleted.
+// Keys can be deleted only by requests made from the debug toolbar page.
+func DebugToolbarMiddleware(rootPath string, caches ...*InstrumentedCache) Middleware {
 	return func(handler interface{}) Handler {
 		return &debugtoolbarMiddleware{
 			handler:     AsHandler(handler),
 			rootPath:    rootPath,
+			caches:      caches,
 			history:     list.New(),
 			historySize: 500,
 		}
@@ -25,6 +33,7 @@ func DebugToolbarMiddleware(rootPath string) Middleware {
 type debugtoolbarMiddleware struct {
 	handler     Handler
 	rootPath    string
+	caches      []*InstrumentedCache
 	historySize int
 
 	mu      sync.Mutex
@@ -33,6 +42,11 @@ type debugtoolbarMiddleware struct {
 
 func (dt *debugtoolbarMiddleware) HandleHTTPRequest(w http.ResponseWriter, r *http.Request) Response {
 	if strings.HasPrefix(r.URL.Path, dt.rootPath) {
+		if rest := strings.TrimPrefix(r.URL.Path, dt.rootPath); rest == "caches" || strings.HasPrefix(rest, "caches/") {
+			dt.serveCaches(w, r, strings.Trim(rest[len("caches"):], "/"))
+			return nil
+		}
+
 		requestID := Path(r.URL.Path).LastChunk()
 
 		if requestID == "debugtoolbar" {
@@ -44,7 +58,14 @@ func (dt *debugtoolbarMiddleware) HandleHTTPRequest(w http.ResponseWriter, r *ht
 			}
 			dt.mu.Unlock()
 
-			if err := tmpl.ExecuteTemplate(w, "listing", history); err != nil {
+			listing := struct {
+				History []*debugtoolbarContext
+				Caches  bool
+			}{
+				History: history,
+				Caches:  len(dt.caches) > 0,
+			}
+			if err := tmpl.ExecuteTemplate(w, "listing", listing); err != nil {
 				LogError(r.Context(), err, "cannot render debugtoolbar listing")
 			}
 			return nil
@@ -67,6 +88,9 @@ func (dt *debugtoolbarMiddleware) HandleHTTPRequest(w http.ResponseWriter, r *ht
 	var logrec logRecorder
 	ctx = attachLogger(r.Context(), &logrec)
 
+	var cacherec cacheOpRecorder
+	ctx = attachCacheOpRecorder(ctx, &cacherec)
+
 	r = r.WithContext(ctx)
 
 	response := dt.handler.HandleHTTPRequest(w, r)
@@ -81,6 +105,7 @@ func (dt *debugtoolbarMiddleware) HandleHTTPRequest(w http.ResponseWriter, r *ht
 		RequestMethod: r.Method,
 		traceSpans:    traceSpans,
 		LogEntries:    logrec.entries,
+		CacheOps:      cacherec.ops,
 	}
 	dt.addReqInfo(dtCtx)
 
@@ -122,6 +147,133 @@ func (dt *debugtoolbarMiddleware) reqInfo(reqID string) (*debugtoolbarContext, b
 	return nil, false
 }
 
+// debugtoolbarMaxKeys is the maximum number of keys listed by the cache
+// panel.
+const debugtoolbarMaxKeys = 500
+
+// serveCaches serves the cache panel. If name is not empty, keys of the
+// cache with that name are listed instead.
+func (dt *debugtoolbarMiddleware) serveCaches(w http.ResponseWriter, r *http.Request, name string) {
+	ctx := r.Context()
+
+	if name == "" {
+		caches := make([]*debugtoolbarCache, 0, len(dt.caches))
+		for _, c := range dt.caches {
+			_, enumerable := c.cache.(CacheKeyLister)
+			caches = append(caches, &debugtoolbarCache{
+				Name:       c.name,
+				Enumerable: enumerable,
+				Stats:      c.Stats(),
+			})
+		}
+		if err := tmpl.ExecuteTemplate(w, "caches", caches); err != nil {
+			LogError(ctx, err, "cannot render debugtoolbar caches")
+		}
+		return
+	}
+
+	var cache *InstrumentedCache
+	for _, c := range dt.caches {
+		if c.name == name {
+			cache = c
+			break
+		}
+	}
+	if cache == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "no cache: %s\n", name)
+		return
+	}
+	lister, ok := cache.cache.(CacheKeyLister)
+	if !ok {
+		fmt.Fprintf(w, "cache does not support listing keys: %s\n", name)
+		return
+	}
+
+	// Deleting and reading keys is done using the wrapped cache, so
+	// that browsing does not affect metrics.
+	if r.Method == "POST" {
+		// Deleting must not be possible from another site.
+		if !isSameOrigin(r) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "cross origin request rejected\n")
+			return
+		}
+		key := r.PostFormValue("key")
+		if err := cache.cache.Del(ctx, key); err != nil && !ErrMiss.Is(err) {
+			LogError(ctx, err, "cannot delete cache key",
+				"cache", name,
+				"key", key)
+		}
+		http.Redirect(w, r, r.URL.String(), http.StatusSeeOther)
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	keys, err := lister.Keys(ctx, prefix)
+	if err != nil {
+		LogError(ctx, err, "cannot list cache keys",
+			"cache", name)
+		fmt.Fprintf(w, "cannot list keys: %s\n", err)
+		return
+	}
+	listing := debugtoolbarKeys{
+		Cache:  name,
+		Prefix: prefix,
+		Total:  len(keys),
+	}
+	if len(keys) > debugtoolbarMaxKeys {
+		keys = keys[:debugtoolbarMaxKeys]
+	}
+	for _, key := range keys {
+		entry := debugtoolbarKey{Key: key}
+		var raw json.RawMessage
+		if err := cache.cache.Get(ctx, key, &raw); err != nil {
+			entry.Err = err.Error()
+		} else {
+			entry.Value = string(raw)
+		}
+		listing.Keys = append(listing.Keys, entry)
+	}
+	if err := tmpl.ExecuteTemplate(w, "cachekeys", listing); err != nil {
+		LogError(ctx, err, "cannot render debugtoolbar cache keys")
+	}
+}
+
+// isSameOrigin returns true if given request was made from a page served by
+// the same host. Origin header is used if present, Referer otherwise.
+// Requests without either are rejected.
+func isSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || origin == "null" {
+		origin = r.Referer()
+	}
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+type debugtoolbarCache struct {
+	Name       string
+	Enumerable bool
+	Stats      []CacheStats
+}
+
+type debugtoolbarKeys struct {
+	Cache  string
+	Prefix string
+	Total  int
+	Keys   []debugtoolbarKey
+}
+
+type debugtoolbarKey struct {
+	Key   string
+	Value string
+	Err   string
+}
+
 // debugtoolbarContext contains information about single request.
 type debugtoolbarContext struct {
 	RequestID     string
@@ -130,6 +282,7 @@ type debugtoolbarContext struct {
 
 	traceSpans []*span
 	LogEntries []*logEntry
+	CacheOps   []*cacheOp
 }
 
 func (dc *debugtoolbarContext) Duration() time.Duration {
@@ -204,6 +357,7 @@ var tmpl = template.Must(template.New("").Parse(`
 		.mute,
 		.mute a { color: #333; }
 	</style>
+	{{if .Caches}}<p><a href="./caches/">Caches</a></p>{{end}}
 	<table>
 	<thead>
 		<th>
@@ -213,7 +367,7 @@ var tmpl = template.Must(template.New("").Parse(`
 		</th>
 	</thead>
 	<tbody>
-		{{range .}}
+		{{range .History}}
 			<tr class="{{if not .TraceSpans}}mute{{end}}">
 				<td>{{.RequestMethod}}</td>
 				<td>{{if eq .Duration 0}}-{{else}}{{.Duration}}{{end}}</td>
@@ -269,6 +423,27 @@ Duration:    {{.Duration}}
     </div>
   {{end}}
 
+  {{if .CacheOps}}
+    <h2>Cache operations</h2>
+    <table>
+      <thead>
+        <tr><td>cache</td><td>operation</td><td>key</td><td>result</td><td>size</td><td>duration</td></tr>
+      </thead>
+      <tbody>
+        {{range .CacheOps}}
+          <tr>
+            <td>{{.Cache}}</td>
+            <td>{{.Op}}</td>
+            <td><code>{{.Key}}</code></td>
+            <td>{{.Result}}</td>
+            <td>{{.Size}}</td>
+            <td>{{.Duration}}</td>
+          </tr>
+        {{end}}
+      </tbody>
+    </table>
+  {{end}}
+
   {{if .LogEntries}}
     <h2>Log messages</h2>
     <table>
@@ -302,4 +477,78 @@ Duration:    {{.Duration}}
   {{end}}
 </div>
 {{end}}
+
+
+
+{{define "caches" -}}
+	{{- template "header"}}
+	<p><a href="../">All recent traces</a></p>
+	{{range .}}
+		<h2>{{.Name}}</h2>
+		{{if .Enumerable}}<p><a href="./{{.Name}}/">Browse keys</a></p>{{end}}
+		<table>
+		<thead>
+			<tr>
+				<td>prefix</td>
+				<td>operation</td>
+				<td>calls</td>
+				<td>hits</td>
+				<td>misses</td>
+				<td>ok</td>
+				<td>conflicts</td>
+				<td>errors</td>
+				<td>bytes</td>
+				<td>avg duration</td>
+			</tr>
+		</thead>
+		<tbody>
+			{{range .Stats}}
+				<tr>
+					<td><code>{{.Prefix}}</code></td>
+					<td>{{.Op}}</td>
+					<td>{{.Calls}}</td>
+					<td>{{.Hits}}</td>
+					<td>{{.Misses}}</td>
+					<td>{{.OK}}</td>
+					<td>{{.Conflicts}}</td>
+					<td>{{.Errors}}</td>
+					<td>{{.Bytes}}</td>
+					<td>{{.AvgDuration}}</td>
+				</tr>
+			{{else}}
+				<tr><td>no operations</td></tr>
+			{{end}}
+		</tbody>
+		</table>
+	{{end}}
+{{- end}}
+
+
+
+{{define "cachekeys" -}}
+	{{- template "header"}}
+	<p><a href="../">All caches</a></p>
+	<h2>{{.Cache}}</h2>
+	<form method="get">
+		<input name="prefix" value="{{.Prefix}}" placeholder="key prefix">
+		<button>Filter</button>
+	</form>
+	<p>{{.Total}} keys{{if gt .Total (len .Keys)}}, first {{len .Keys}} shown{{end}}</p>
+	<table>
+	<tbody>
+		{{range .Keys}}
+			<tr>
+				<td><code>{{.Key}}</code></td>
+				<td>{{if .Err}}<em>{{.Err}}</em>{{else}}<code>{{.Value}}</code>{{end}}</td>
+				<td>
+					<form method="post">
+						<input type="hidden" name="key" value="{{.Key}}">
+						<button>Delete</button>
+					</form>
+				</td>
+			</tr>
+		{{end}}
+	</tbody>
+	</table>
+{{- end}}
 `))
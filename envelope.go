@@ -0,0 +1,122 @@
+package surf
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+
+	"github.com/go-surf/surf/errors"
+)
+
+// envelope provides authenticated encryption using AES-GCM.
+//
+// Sealed message format is
+//
+//	version (1 byte) | key ID (4 bytes) | nonce (12 bytes) | ciphertext
+//
+// Envelope can use many keys. The first one is always used to seal a
+// message, while all of them are used to open it. This allows to rotate
+// secrets without losing access to already sealed messages.
+type envelope struct {
+	keys []envelopeKey
+}
+
+type envelopeKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+const (
+	envelopeVersion   byte = 1
+	envelopeKeyIDSize      = 4
+	envelopeHeaderLen      = 1 + envelopeKeyIDSize
+
+	// minSecretSize is the minimal accepted secret length.
+	minSecretSize = 16
+)
+
+// newEnvelope returns envelope using given secrets. Secrets can be of any
+// length, but not shorter than 16 bytes. Encryption keys are derived from
+// secrets, so that secrets are never truncated.
+func newEnvelope(secrets [][]byte) (*envelope, error) {
+	if len(secrets) == 0 {
+		return nil, errors.Wrap(ErrValidation, "no secret")
+	}
+	e := &envelope{
+		keys: make([]envelopeKey, 0, len(secrets)),
+	}
+	for i, secret := range secrets {
+		if len(secret) < minSecretSize {
+			return nil, errors.Wrap(ErrValidation, "secret %d too short, must be at least %d bytes", i, minSecretSize)
+		}
+		block, err := aes.NewCipher(deriveKey(secret, "surf envelope encryption key"))
+		if err != nil {
+			return nil, errors.Wrap(ErrInternal, "cannot create cipher block: %s", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, errors.Wrap(ErrInternal, "cannot create GCM: %s", err)
+		}
+		e.keys = append(e.keys, envelopeKey{
+			id:   deriveKey(secret, "surf envelope key id")[:envelopeKeyIDSize],
+			aead: aead,
+		})
+	}
+	return e, nil
+}
+
+// deriveKey returns 32 bytes long key derived from given secret for given
+// purpose.
+func deriveKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// seal encrypts and authenticates given plaintext. Additional data is
+// authenticated, but not encrypted and not included in the result. The
+// same additional data must be provided to open the message.
+func (e *envelope) seal(plaintext, additionalData []byte) ([]byte, error) {
+	key := e.keys[0]
+	nonceSize := key.aead.NonceSize()
+
+	sealed := make([]byte, envelopeHeaderLen+nonceSize, envelopeHeaderLen+nonceSize+len(plaintext)+key.aead.Overhead())
+	sealed[0] = envelopeVersion
+	copy(sealed[1:], key.id)
+	nonce := sealed[envelopeHeaderLen:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(ErrInternal, "cannot read nonce: %s", err)
+	}
+	return key.aead.Seal(sealed, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts given message and verifies its authenticity.
+func (e *envelope) open(sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < envelopeHeaderLen {
+		return nil, errors.Wrap(ErrMalformed, "message too short")
+	}
+	if sealed[0] != envelopeVersion {
+		return nil, errors.Wrap(ErrMalformed, "unknown version %d", sealed[0])
+	}
+
+	keyID := sealed[1:envelopeHeaderLen]
+	for _, key := range e.keys {
+		if !hmac.Equal(key.id, keyID) {
+			continue
+		}
+		nonceSize := key.aead.NonceSize()
+		if len(sealed) < envelopeHeaderLen+nonceSize {
+			return nil, errors.Wrap(ErrMalformed, "message too short")
+		}
+		nonce := sealed[envelopeHeaderLen : envelopeHeaderLen+nonceSize]
+		plaintext, err := key.aead.Open(nil, nonce, sealed[envelopeHeaderLen+nonceSize:], additionalData)
+		if err != nil {
+			return nil, errors.Wrap(ErrMalformed, "cannot open: %s", err)
+		}
+		return plaintext, nil
+	}
+	return nil, errors.Wrap(ErrMalformed, "unknown key")
+}
@@ -1,5 +1,7 @@
 module github.com/go-surf/surf
 
+go 1.21
+
 require (
 	github.com/gomodule/redigo v2.0.0+incompatible
 	github.com/lib/pq v1.0.0
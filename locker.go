@@ -0,0 +1,242 @@
+package surf
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-surf/surf/errors"
+)
+
+// Locker provides mutual exclusion between processes, for example to
+// ensure that a cron job or a migration is run by a single process only.
+//
+// Each lock is a lease that expires after given time unless extended. A
+// process that was paused for longer than the lease, for example by garbage
+// collection, may still believe it holds the lock. Use fencing token of the
+// lock to reject its writes.
+type Locker interface {
+	// Acquire obtains lock of given name for given duration. ErrLocked is
+	// returned if the lock is held by another owner. Use WaitLock to wait
+	// until the lock is available.
+	Acquire(ctx context.Context, name string, ttl time.Duration) (*Lock, error)
+
+	// Release frees given lock. ErrLockLost is returned if the lock
+	// expired or is held by another owner, in which case nothing is done.
+	Release(ctx context.Context, lock *Lock) error
+
+	// Extend renews given lock for given duration, counting from now.
+	// ErrLockLost is returned if the lock expired or is held by another
+	// owner.
+	Extend(ctx context.Context, lock *Lock, ttl time.Duration) error
+}
+
+// Lock represents a lock acquired by Locker.
+type Lock struct {
+	// Name of the lock.
+	Name string
+
+	// Token is a random value identifying the owner. Only the owner can
+	// release or extend the lock.
+	Token string
+
+	// Fence is a fencing token. It is greater than the fence of any
+	// previous acquisition of the lock with the same name, so that a
+	// storage can reject writes made by a stale lock owner.
+	Fence int64
+}
+
+var (
+	// ErrLocked is returned when a lock is held by another owner.
+	ErrLocked = errors.Wrap(ErrConflict, "locked")
+
+	// ErrLockLost is returned when a lock expired or was acquired by
+	// another owner.
+	ErrLockLost = errors.Wrap(ErrConflict, "lock lost")
+)
+
+// WaitLock acquires lock of given name, waiting until it is available or
+// until context is done.
+func WaitLock(ctx context.Context, locker Locker, name string, ttl time.Duration) (*Lock, error) {
+	backoff := 10 * time.Millisecond
+	for {
+		lock, err := locker.Acquire(ctx, name, ttl)
+		if !ErrLocked.Is(err) {
+			return lock, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff < 500*time.Millisecond {
+			backoff *= 2
+		}
+	}
+}
+
+// WithLock acquires lock of given name, waiting until it is available, and
+// calls given function while holding it. Lock is extended in the background
+// for as long as the function runs, and released once it returns. If the
+// lock is lost, context passed to the function is cancelled.
+func WithLock(
+	ctx context.Context,
+	locker Locker,
+	name string,
+	ttl time.Duration,
+	fn func(context.Context, *Lock) error,
+) error {
+	lock, err := WaitLock(ctx, locker, name, ttl)
+	if err != nil {
+		return errors.Wrap(err, "cannot acquire lock")
+	}
+
+	fnCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		renewLock(fnCtx, locker, lock, ttl, cancel)
+	}()
+
+	fnErr := fn(fnCtx, lock)
+
+	cancel()
+	<-renewed
+
+	// Lock must be released even if the context was cancelled.
+	releaseCtx, done := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer done()
+	if err := locker.Release(releaseCtx, lock); err != nil && !ErrLockLost.Is(err) {
+		LogError(ctx, err, "cannot release lock",
+			"lock", lock.Name)
+	}
+	return fnErr
+}
+
+// renewLock extends given lock every third of its lifetime, until context
+// is done. If the lock cannot be extended before it expires, lost function
+// is called.
+func renewLock(ctx context.Context, locker Locker, lock *Lock, ttl time.Duration, lost func()) {
+	t := time.NewTicker(ttl / 3)
+	defer t.Stop()
+
+	expireAt := time.Now().Add(ttl)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		now := time.Now()
+		err := locker.Extend(ctx, lock, ttl)
+		switch {
+		case err == nil:
+			expireAt = now.Add(ttl)
+		case ctx.Err() != nil:
+			return
+		case ErrLockLost.Is(err) || !time.Now().Before(expireAt):
+			LogError(ctx, err, "lock lost",
+				"lock", lock.Name)
+			lost()
+			return
+		default:
+			// Try again, the lock is still valid.
+			LogError(ctx, err, "cannot extend lock",
+				"lock", lock.Name)
+		}
+	}
+}
+
+// NewCacheLocker returns Locker that is storing locks in given cache.
+// Cache must be shared by all processes, for example redis or memcached
+// backed, in order to provide mutual exclusion between them.
+//
+// Lock is released or extended using CompareAndSwap, so that only its owner
+// can do it. Fencing tokens are generated using Incr.
+func NewCacheLocker(cache CounterCache) Locker {
+	return &cacheLocker{cache: cache}
+}
+
+type cacheLocker struct {
+	cache CounterCache
+}
+
+// lockFenceExp is the expiration time of fencing token counters. Counter
+// must outlive any lock, otherwise fencing tokens start from the beginning.
+const lockFenceExp = 10 * 365 * 24 * time.Hour
+
+func lockCacheKey(name string) string {
+	return "surf-lock:" + name
+}
+
+func (l *cacheLocker) Acquire(ctx context.Context, name string, ttl time.Duration) (*Lock, error) {
+	token := generateID()
+	err := l.cache.SetNx(ctx, lockCacheKey(name), token, ttl)
+	if ErrConflict.Is(err) {
+		// Released lock is kept for a moment, see Release.
+		err = l.cache.CompareAndSwap(ctx, lockCacheKey(name), releasedLock, token, ttl)
+		if ErrMiss.Is(err) {
+			err = l.cache.SetNx(ctx, lockCacheKey(name), token, ttl)
+		}
+	}
+	switch {
+	case err == nil:
+		// lock acquired
+	case ErrConflict.Is(err):
+		return nil, ErrLocked
+	default:
+		return nil, errors.Wrap(err, "cannot set lock")
+	}
+
+	lock := &Lock{Name: name, Token: token}
+
+	// Fencing token is generated only while holding the lock, so that
+	// owners get increasing tokens. If the lock expired before the token
+	// was generated, the next owner might have got a lower one, so the
+	// lock must be still held afterwards.
+	fence, err := l.cache.Incr(ctx, lockCacheKey(name)+":fence", 1, lockFenceExp)
+	if err != nil {
+		if rerr := l.Release(ctx, lock); rerr != nil && !ErrLockLost.Is(rerr) {
+			LogError(ctx, rerr, "cannot release lock",
+				"lock", name)
+		}
+		return nil, errors.Wrap(err, "cannot generate fencing token")
+	}
+	lock.Fence = fence
+	switch err := l.Extend(ctx, lock, ttl); {
+	case err == nil:
+		return lock, nil
+	case ErrLockLost.Is(err):
+		return nil, ErrLocked
+	default:
+		return nil, errors.Wrap(err, "cannot verify lock")
+	}
+}
+
+// releasedLock is the value of a lock that was released.
+const releasedLock = ""
+
+func (l *cacheLocker) Release(ctx context.Context, lock *Lock) error {
+	// CacheService has no compare and delete operation. Replace the
+	// token with a value that expires almost immediately instead, which
+	// Acquire treats as a free lock.
+	return l.swap(ctx, lock, releasedLock, time.Millisecond)
+}
+
+func (l *cacheLocker) Extend(ctx context.Context, lock *Lock, ttl time.Duration) error {
+	return l.swap(ctx, lock, lock.Token, ttl)
+}
+
+func (l *cacheLocker) swap(ctx context.Context, lock *Lock, value string, ttl time.Duration) error {
+	switch err := l.cache.CompareAndSwap(ctx, lockCacheKey(lock.Name), lock.Token, value, ttl); {
+	case err == nil:
+		return nil
+	case ErrMiss.Is(err), ErrConflict.Is(err):
+		return ErrLockLost
+	default:
+		return err
+	}
+}
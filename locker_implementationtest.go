@@ -0,0 +1,119 @@
+package surf
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// RunLockerImplementationTest ensures given locker provides mutual exclusion
+// and follows the Locker contract. Lock expiration is not tested, because
+// some implementations tie the lock to a connection instead.
+func RunLockerImplementationTest(t *testing.T, l Locker) {
+	ctx := context.Background()
+
+	lock, err := l.Acquire(ctx, "lock-a", time.Minute)
+	if err != nil {
+		t.Fatalf("cannot acquire: %s", err)
+	}
+	if lock.Name != "lock-a" || lock.Token == "" {
+		t.Fatalf("invalid lock: %+v", lock)
+	}
+	if _, err := l.Acquire(ctx, "lock-a", time.Minute); !ErrLocked.Is(err) {
+		t.Fatalf("want ErrLocked, got %+v", err)
+	}
+
+	other, err := l.Acquire(ctx, "lock-b", time.Minute)
+	if err != nil {
+		t.Fatalf("cannot acquire another lock: %s", err)
+	}
+	if err := l.Release(ctx, other); err != nil {
+		t.Fatalf("cannot release another lock: %s", err)
+	}
+
+	stolen := &Lock{Name: lock.Name, Token: "not-an-owner", Fence: lock.Fence}
+	if err := l.Extend(ctx, stolen, time.Minute); !ErrLockLost.Is(err) {
+		t.Fatalf("want ErrLockLost extending lock of another owner, got %+v", err)
+	}
+	if err := l.Release(ctx, stolen); !ErrLockLost.Is(err) {
+		t.Fatalf("want ErrLockLost releasing lock of another owner, got %+v", err)
+	}
+	if _, err := l.Acquire(ctx, "lock-a", time.Minute); !ErrLocked.Is(err) {
+		t.Fatalf("want lock held, got %+v", err)
+	}
+
+	if err := l.Extend(ctx, lock, time.Minute); err != nil {
+		t.Fatalf("cannot extend: %s", err)
+	}
+	if err := l.Release(ctx, lock); err != nil {
+		t.Fatalf("cannot release: %s", err)
+	}
+	if err := l.Release(ctx, lock); !ErrLockLost.Is(err) {
+		t.Fatalf("want ErrLockLost releasing twice, got %+v", err)
+	}
+	if err := l.Extend(ctx, lock, time.Minute); !ErrLockLost.Is(err) {
+		t.Fatalf("want ErrLockLost extending released lock, got %+v", err)
+	}
+
+	// Released lock may be held by another owner for a very short time,
+	// so wait for it.
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	next, err := WaitLock(waitCtx, l, "lock-a", time.Minute)
+	if err != nil {
+		t.Fatalf("cannot acquire released lock: %s", err)
+	}
+	if next.Fence <= lock.Fence {
+		t.Fatalf("want fencing token greater than %d, got %d", lock.Fence, next.Fence)
+	}
+	if next.Token == lock.Token {
+		t.Fatal("owner token reused")
+	}
+	if err := l.Release(ctx, next); err != nil {
+		t.Fatalf("cannot release: %s", err)
+	}
+
+	testLockerMutualExclusion(ctx, t, l)
+}
+
+func testLockerMutualExclusion(ctx context.Context, t *testing.T, l Locker) {
+	const workers = 8
+
+	var (
+		wg        sync.WaitGroup
+		holders   int32
+		lastFence int64
+		mu        sync.Mutex
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+			err := WithLock(waitCtx, l, "lock-concurrent", time.Minute, func(ctx context.Context, lock *Lock) error {
+				if n := atomic.AddInt32(&holders, 1); n != 1 {
+					t.Errorf("%d lock holders", n)
+				}
+				defer atomic.AddInt32(&holders, -1)
+
+				mu.Lock()
+				if lock.Fence <= lastFence {
+					t.Errorf("fencing token %d not greater than previous %d", lock.Fence, lastFence)
+				}
+				lastFence = lock.Fence
+				mu.Unlock()
+
+				time.Sleep(5 * time.Millisecond)
+				return nil
+			})
+			if err != nil {
+				t.Errorf("cannot run with lock: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,109 @@
+package surf
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCacheLocker(t *testing.T) {
+	cache := NewLocalMemCache()
+	RunLockerImplementationTest(t, NewCacheLocker(cache))
+}
+
+func TestCacheLockerExpiration(t *testing.T) {
+	ctx := context.Background()
+	l := NewCacheLocker(NewLocalMemCache())
+
+	lock, err := l.Acquire(ctx, "lock", 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("cannot acquire: %s", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	next, err := l.Acquire(ctx, "lock", time.Minute)
+	if err != nil {
+		t.Fatalf("cannot acquire expired lock: %s", err)
+	}
+	if err := l.Extend(ctx, lock, time.Minute); !ErrLockLost.Is(err) {
+		t.Fatalf("want ErrLockLost, got %+v", err)
+	}
+	if err := l.Release(ctx, lock); !ErrLockLost.Is(err) {
+		t.Fatalf("want ErrLockLost, got %+v", err)
+	}
+	if err := l.Release(ctx, next); err != nil {
+		t.Fatalf("cannot release: %s", err)
+	}
+}
+
+func TestCacheLockerFenceTakenByOwnerOnly(t *testing.T) {
+	ctx := context.Background()
+	l := NewCacheLocker(NewLocalMemCache())
+
+	lock, err := l.Acquire(ctx, "lock", time.Minute)
+	if err != nil {
+		t.Fatalf("cannot acquire: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := l.Acquire(ctx, "lock", time.Minute); !ErrLocked.Is(err) {
+			t.Fatalf("want ErrLocked, got %+v", err)
+		}
+	}
+	if err := l.Release(ctx, lock); err != nil {
+		t.Fatalf("cannot release: %s", err)
+	}
+
+	next, err := WaitLock(ctx, l, "lock", time.Minute)
+	if err != nil {
+		t.Fatalf("cannot acquire: %s", err)
+	}
+	if next.Fence != lock.Fence+1 {
+		t.Fatalf("want fencing token %d, got %d", lock.Fence+1, next.Fence)
+	}
+}
+
+func TestWithLockRenewal(t *testing.T) {
+	ctx := context.Background()
+	l := NewCacheLocker(NewLocalMemCache())
+
+	err := WithLock(ctx, l, "lock", 30*time.Millisecond, func(ctx context.Context, lock *Lock) error {
+		// Run for longer than the lease, which must be renewed.
+		time.Sleep(100 * time.Millisecond)
+		if _, err := l.Acquire(ctx, "lock", time.Minute); !ErrLocked.Is(err) {
+			t.Errorf("want lock held, got %+v", err)
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatalf("cannot run with lock: %s", err)
+	}
+
+	// released
+	lock, err := l.Acquire(ctx, "lock", time.Minute)
+	if err != nil {
+		t.Fatalf("cannot acquire: %s", err)
+	}
+	l.Release(ctx, lock)
+}
+
+func TestWithLockLost(t *testing.T) {
+	ctx := context.Background()
+	cache := NewLocalMemCache()
+	l := NewCacheLocker(cache)
+
+	err := WithLock(ctx, l, "lock", 30*time.Millisecond, func(ctx context.Context, lock *Lock) error {
+		// lock taken over by another owner
+		if err := cache.Set(ctx, "surf-lock:lock", "intruder", time.Minute); err != nil {
+			t.Fatalf("cannot set: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+			return nil
+		}
+	})
+	if err != context.Canceled {
+		t.Fatalf("want context cancelled, got %+v", err)
+	}
+}
@@ -0,0 +1,356 @@
+package memcache
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+)
+
+// NewMemcacheCache returns a CacheService implementation that is using
+// memcached servers of given client as a storage backend. Returned cache
+// implements BatchCacheService.
+func NewMemcacheCache(client *Client) surf.CacheService {
+	return &memcache{
+		client: client,
+	}
+}
+
+type memcache struct {
+	client *Client
+}
+
+var _ surf.BatchCacheService = (*memcache)(nil)
+
+// maxKeyLength is the longest key accepted by memcached.
+const maxKeyLength = 250
+
+// buildKey returns key that can be used by memcached. Keys that are too long
+// or contain whitespace or control characters are replaced by their hash.
+func (m *memcache) buildKey(key string) string {
+	valid := len(key) > 0
+	for i := 0; i < len(key) && valid; i++ {
+		valid = key[i] > ' ' && key[i] != 0x7f
+	}
+	if valid && len(key) <= maxKeyLength {
+		return key
+	}
+
+	h := sha1.Sum([]byte(key))
+	suffix := hex.EncodeToString(h[:])
+	if !valid {
+		return "sha1:" + suffix
+	}
+	return key[:maxKeyLength-len(suffix)-1] + ":" + suffix
+}
+
+// expiration returns memcached expiration time for given duration. Duration
+// is rounded up to full seconds. Durations longer than 30 days must be
+// provided as a unix timestamp.
+func expiration(exp time.Duration) int64 {
+	if exp <= 0 {
+		// expire immediately
+		return -1
+	}
+	seconds := int64((exp + time.Second - 1) / time.Second)
+	if seconds > 30*24*60*60 {
+		return time.Now().Add(exp).Unix()
+	}
+	return seconds
+}
+
+func (m *memcache) Get(ctx context.Context, key string, dest interface{}) error {
+	key = m.buildKey(key)
+	raws, err := m.getMulti(ctx, []string{key})
+	if err != nil {
+		return err
+	}
+	raw, ok := raws[key]
+	if !ok {
+		return surf.ErrMiss
+	}
+	return surf.CacheUnmarshal(raw, dest)
+}
+
+func (m *memcache) Set(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	return m.store(ctx, "set", key, value, exp)
+}
+
+func (m *memcache) SetNx(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	return m.store(ctx, "add", key, value, exp)
+}
+
+func (m *memcache) store(ctx context.Context, cmd, key string, value interface{}, exp time.Duration) error {
+	raw, err := surf.CacheMarshal(value)
+	if err != nil {
+		return err
+	}
+	key = m.buildKey(key)
+
+	s := m.client.server(key)
+	cn, err := m.client.conn(ctx, s)
+	if err != nil {
+		return err
+	}
+	if err := writeStore(cn, cmd, key, raw, exp); err != nil {
+		return cn.fail(err)
+	}
+	if err := cn.rw.Flush(); err != nil {
+		return cn.fail(err)
+	}
+	stored, err := readStoreReply(cn)
+	if err != nil {
+		return cn.fail(err)
+	}
+	s.release(cn)
+	if !stored {
+		return surf.ErrConflict
+	}
+	return nil
+}
+
+func (m *memcache) Del(ctx context.Context, key string) error {
+	key = m.buildKey(key)
+
+	s := m.client.server(key)
+	cn, err := m.client.conn(ctx, s)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(cn.rw, "delete %s\r\n", key); err != nil {
+		return cn.fail(err)
+	}
+	if err := cn.rw.Flush(); err != nil {
+		return cn.fail(err)
+	}
+	deleted, err := readDeleteReply(cn)
+	if err != nil {
+		return cn.fail(err)
+	}
+	s.release(cn)
+	if !deleted {
+		return surf.ErrMiss
+	}
+	return nil
+}
+
+func (m *memcache) GetMulti(ctx context.Context, keys []string, dests []interface{}) ([]error, error) {
+	if len(keys) != len(dests) {
+		return nil, errors.Wrap(surf.ErrValidation, "%d keys and %d destinations", len(keys), len(dests))
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	built := make([]string, len(keys))
+	for i, key := range keys {
+		built[i] = m.buildKey(key)
+	}
+	raws, err := m.getMulti(ctx, built)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(keys))
+	for i, key := range built {
+		raw, ok := raws[key]
+		if !ok {
+			errs[i] = surf.ErrMiss
+			continue
+		}
+		errs[i] = surf.CacheUnmarshal(raw, dests[i])
+	}
+	return errs, nil
+}
+
+// getMulti returns values of all found keys. Keys are grouped by server and
+// each server is asked for all its keys with a single request.
+func (m *memcache) getMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	raws := make(map[string][]byte, len(keys))
+	for s, keys := range m.byServer(keys) {
+		cn, err := m.client.conn(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fmt.Fprintf(cn.rw, "get %s\r\n", strings.Join(keys, " ")); err != nil {
+			return nil, cn.fail(err)
+		}
+		if err := cn.rw.Flush(); err != nil {
+			return nil, cn.fail(err)
+		}
+		if err := readValues(cn, raws); err != nil {
+			return nil, cn.fail(err)
+		}
+		s.release(cn)
+	}
+	return raws, nil
+}
+
+func (m *memcache) SetMulti(ctx context.Context, items []surf.CacheItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	raws := make(map[string][]byte, len(items))
+	exps := make(map[string]time.Duration, len(items))
+	keys := make([]string, 0, len(items))
+	for _, it := range items {
+		raw, err := surf.CacheMarshal(it.Value)
+		if err != nil {
+			return err
+		}
+		key := m.buildKey(it.Key)
+		if _, ok := raws[key]; !ok {
+			keys = append(keys, key)
+		}
+		raws[key] = raw
+		exps[key] = it.Exp
+	}
+
+	for s, keys := range m.byServer(keys) {
+		cn, err := m.client.conn(ctx, s)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := writeStore(cn, "set", key, raws[key], exps[key]); err != nil {
+				return cn.fail(err)
+			}
+		}
+		if err := cn.rw.Flush(); err != nil {
+			return cn.fail(err)
+		}
+		for range keys {
+			if _, err := readStoreReply(cn); err != nil {
+				return cn.fail(err)
+			}
+		}
+		s.release(cn)
+	}
+	return nil
+}
+
+func (m *memcache) DelMulti(ctx context.Context, keys []string) error {
+	built := make([]string, len(keys))
+	for i, key := range keys {
+		built[i] = m.buildKey(key)
+	}
+
+	for s, keys := range m.byServer(built) {
+		cn, err := m.client.conn(ctx, s)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if _, err := fmt.Fprintf(cn.rw, "delete %s\r\n", key); err != nil {
+				return cn.fail(err)
+			}
+		}
+		if err := cn.rw.Flush(); err != nil {
+			return cn.fail(err)
+		}
+		for range keys {
+			if _, err := readDeleteReply(cn); err != nil {
+				return cn.fail(err)
+			}
+		}
+		s.release(cn)
+	}
+	return nil
+}
+
+// byServer groups given keys by the server responsible for them.
+func (m *memcache) byServer(keys []string) map[*server][]string {
+	groups := make(map[*server][]string)
+	for _, key := range keys {
+		s := m.client.server(key)
+		groups[s] = append(groups[s], key)
+	}
+	return groups
+}
+
+func writeStore(cn *conn, cmd, key string, raw []byte, exp time.Duration) error {
+	if _, err := fmt.Fprintf(cn.rw, "%s %s 0 %d %d\r\n", cmd, key, expiration(exp), len(raw)); err != nil {
+		return err
+	}
+	if _, err := cn.rw.Write(raw); err != nil {
+		return err
+	}
+	_, err := cn.rw.WriteString("\r\n")
+	return err
+}
+
+// readStoreReply returns true if value was stored and false if it was not
+// stored because condition was not met.
+func readStoreReply(cn *conn) (bool, error) {
+	line, err := cn.readLine()
+	if err != nil {
+		return false, err
+	}
+	switch line {
+	case "STORED":
+		return true, nil
+	case "NOT_STORED":
+		return false, nil
+	default:
+		return false, replyError(line)
+	}
+}
+
+// readDeleteReply returns true if value was deleted and false if it did not
+// exist.
+func readDeleteReply(cn *conn) (bool, error) {
+	line, err := cn.readLine()
+	if err != nil {
+		return false, err
+	}
+	switch line {
+	case "DELETED":
+		return true, nil
+	case "NOT_FOUND":
+		return false, nil
+	default:
+		return false, replyError(line)
+	}
+}
+
+// readValues reads response of the get command into given map.
+func readValues(cn *conn, raws map[string][]byte) error {
+	for {
+		line, err := cn.readLine()
+		if err != nil {
+			return err
+		}
+		if line == "END" {
+			return nil
+		}
+		// VALUE <key> <flags> <bytes>
+		chunks := strings.Split(line, " ")
+		if len(chunks) != 4 || chunks[0] != "VALUE" {
+			return replyError(line)
+		}
+		size, err := strconv.Atoi(chunks[3])
+		if err != nil || size < 0 {
+			return errors.Wrap(ErrMemcache, "invalid value size: %s", line)
+		}
+		raw := make([]byte, size+2)
+		if _, err := io.ReadFull(cn.rw, raw); err != nil {
+			return err
+		}
+		if string(raw[size:]) != "\r\n" {
+			return errors.Wrap(ErrMemcache, "malformed value")
+		}
+		raws[chunks[1]] = raw[:size]
+	}
+}
+
+func replyError(line string) error {
+	return errors.Wrap(ErrMemcache, "unexpected response: %s", line)
+}
@@ -0,0 +1,149 @@
+package memcache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-surf/surf"
+)
+
+func TestMemcacheCache(t *testing.T) {
+	client := EnsureMemcached(t)
+	defer client.Close()
+	cache := NewMemcacheCache(client)
+
+	surf.RunCacheConformanceTest(t, cache, &surf.CacheCapabilities{Batch: true})
+}
+
+func TestMemcacheManyServers(t *testing.T) {
+	ctx := context.Background()
+
+	var addrs []string
+	servers := make(map[string]*FakeServer)
+	for i := 0; i < 3; i++ {
+		srv, err := StartFakeServer()
+		if err != nil {
+			t.Fatalf("cannot start server: %s", err)
+		}
+		defer srv.Close()
+		addrs = append(addrs, srv.Addr())
+		servers[srv.Addr()] = srv
+	}
+	client, err := NewClient(addrs, nil)
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+	defer client.Close()
+	cache := NewMemcacheCache(client)
+
+	surf.RunBatchCacheImplementationTest(t, cache.(surf.BatchCacheService))
+
+	keys := make([]string, 300)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+		if err := cache.Set(ctx, keys[i], i, time.Minute); err != nil {
+			t.Fatalf("cannot set: %s", err)
+		}
+	}
+	// Addresses are random, so only check that all servers are used.
+	// Distribution is tested with fixed addresses in
+	// TestMemcacheConsistentHashing.
+	for addr, srv := range servers {
+		srv.mu.Lock()
+		n := len(srv.items)
+		srv.mu.Unlock()
+		if n == 0 {
+			t.Errorf("server %s holds no keys", addr)
+		}
+	}
+
+	dests := make([]interface{}, len(keys))
+	values := make([]int, len(keys))
+	for i := range dests {
+		dests[i] = &values[i]
+	}
+	errs, err := cache.(surf.BatchCacheService).GetMulti(ctx, keys, dests)
+	if err != nil {
+		t.Fatalf("cannot get multi: %s", err)
+	}
+	for i, err := range errs {
+		if err != nil || values[i] != i {
+			t.Fatalf("%s: want %d, got %d, %+v", keys[i], i, values[i], err)
+		}
+	}
+}
+
+func TestMemcacheConsistentHashing(t *testing.T) {
+	addrs := []string{"10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211", "10.0.0.4:11211"}
+	before, err := NewClient(addrs, nil)
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+	after, err := NewClient(addrs[:3], nil)
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+
+	// Only keys of the removed server must be relocated.
+	perServer := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		was := before.server(key).addr
+		perServer[was]++
+		if was != addrs[3] && after.server(key).addr != was {
+			t.Fatalf("%s relocated from %s to %s", key, was, after.server(key).addr)
+		}
+	}
+
+	// Keys are spread evenly between servers.
+	for _, addr := range addrs {
+		if n := perServer[addr]; n < 150 {
+			t.Errorf("server %s holds only %d keys", addr, n)
+		}
+	}
+}
+
+func TestMemcacheBuildKey(t *testing.T) {
+	m := &memcache{}
+	cases := map[string]string{
+		"simple":                    "simple",
+		"with space":                "sha1:",
+		"with\nnew line":            "sha1:",
+		strings.Repeat("a", 250):    strings.Repeat("a", 250),
+		strings.Repeat("a", 251):    strings.Repeat("a", 209) + ":",
+		strings.Repeat("a", 100000): strings.Repeat("a", 209) + ":",
+	}
+	for key, prefix := range cases {
+		got := m.buildKey(key)
+		if len(got) > maxKeyLength || !strings.HasPrefix(got, prefix) {
+			t.Errorf("%.20q: unexpected key %q", key, got)
+		}
+	}
+}
+
+func TestMemcacheServerUnavailable(t *testing.T) {
+	srv, err := StartFakeServer()
+	if err != nil {
+		t.Fatalf("cannot start server: %s", err)
+	}
+	client, err := NewClient([]string{srv.Addr()}, &ClientOpts{Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("cannot create client: %s", err)
+	}
+	defer client.Close()
+	cache := NewMemcacheCache(client)
+
+	ctx := context.Background()
+	if err := cache.Set(ctx, "key", "value", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	srv.Close()
+
+	var val string
+	if err := cache.Get(ctx, "key", &val); !ErrMemcache.Is(err) {
+		t.Fatalf("want ErrMemcache, got %+v", err)
+	}
+}
@@ -0,0 +1,227 @@
+package memcache
+
+import (
+	"bufio"
+	"context"
+	"hash/crc32"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+)
+
+// Client is a memcached client using the text protocol. Keys are
+// distributed between servers using consistent hashing, so that adding or
+// removing a server relocates only a small part of the keys.
+//
+// Client is safe for concurrent use.
+type Client struct {
+	timeout time.Duration
+	ring    []ringPoint
+	servers map[string]*server
+}
+
+// ClientOpts defines options for the memcached client.
+type ClientOpts struct {
+	// MaxIdle is the maximum number of idle connections kept for each
+	// server. Defaults to 4.
+	MaxIdle int
+
+	// Timeout is the maximum duration of a single network operation,
+	// unless context deadline is earlier. Defaults to one second.
+	Timeout time.Duration
+}
+
+// NewClient returns client using given memcached servers, each defined as
+// a host:port address.
+func NewClient(addrs []string, o *ClientOpts) (*Client, error) {
+	if len(addrs) == 0 {
+		return nil, errors.Wrap(surf.ErrValidation, "no server")
+	}
+	if o == nil {
+		o = &ClientOpts{}
+	}
+	maxIdle := o.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = 4
+	}
+	timeout := o.Timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+
+	c := &Client{
+		timeout: timeout,
+		servers: make(map[string]*server, len(addrs)),
+	}
+	for _, addr := range addrs {
+		if _, ok := c.servers[addr]; ok {
+			return nil, errors.Wrap(surf.ErrValidation, "duplicated server %s", addr)
+		}
+		c.servers[addr] = &server{
+			addr: addr,
+			idle: make(chan *conn, maxIdle),
+		}
+		for i := 0; i < ringPointsPerServer; i++ {
+			c.ring = append(c.ring, ringPoint{
+				hash: crc32.ChecksumIEEE([]byte(addr + "-" + strconv.Itoa(i))),
+				addr: addr,
+			})
+		}
+	}
+	sort.Slice(c.ring, func(i, j int) bool {
+		return c.ring[i].hash < c.ring[j].hash
+	})
+	return c, nil
+}
+
+// Close closes all idle connections.
+func (c *Client) Close() error {
+	for _, s := range c.servers {
+		s.close()
+	}
+	return nil
+}
+
+// ringPointsPerServer is the number of points each server has on the ring.
+// More points give more even distribution of keys.
+const ringPointsPerServer = 160
+
+type ringPoint struct {
+	hash uint32
+	addr string
+}
+
+// server returns server responsible for given key.
+func (c *Client) server(key string) *server {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(c.ring), func(i int) bool {
+		return c.ring[i].hash >= h
+	})
+	if i == len(c.ring) {
+		i = 0
+	}
+	return c.servers[c.ring[i].addr]
+}
+
+// conn returns connection to given server, with deadline set.
+func (c *Client) conn(ctx context.Context, s *server) (*conn, error) {
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	cn, err := s.conn(ctx, deadline)
+	if err != nil {
+		return nil, errors.Wrap(ErrMemcache, "cannot connect to %s: %s", s.addr, err)
+	}
+	if err := cn.nc.SetDeadline(deadline); err != nil {
+		cn.nc.Close()
+		return nil, errors.Wrap(ErrMemcache, "cannot set deadline: %s", err)
+	}
+	return cn, nil
+}
+
+// Ping ensures all servers are reachable.
+func (c *Client) Ping(ctx context.Context) error {
+	for _, s := range c.servers {
+		cn, err := c.conn(ctx, s)
+		if err != nil {
+			return err
+		}
+		if _, err := cn.rw.WriteString("version\r\n"); err != nil {
+			return cn.fail(err)
+		}
+		if err := cn.rw.Flush(); err != nil {
+			return cn.fail(err)
+		}
+		line, err := cn.readLine()
+		if err != nil {
+			return cn.fail(err)
+		}
+		if len(line) < 8 || line[:8] != "VERSION " {
+			return cn.fail(errors.Wrap(ErrMemcache, "unexpected response: %s", line))
+		}
+		s.release(cn)
+	}
+	return nil
+}
+
+type server struct {
+	addr string
+	idle chan *conn
+}
+
+func (s *server) conn(ctx context.Context, deadline time.Time) (*conn, error) {
+	select {
+	case cn := <-s.idle:
+		return cn, nil
+	default:
+	}
+
+	dialer := net.Dialer{Deadline: deadline}
+	nc, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{
+		server: s,
+		nc:     nc,
+		rw:     bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc)),
+	}, nil
+}
+
+// release returns connection to the pool of idle connections.
+func (s *server) release(cn *conn) {
+	select {
+	case s.idle <- cn:
+	default:
+		cn.nc.Close()
+	}
+}
+
+func (s *server) close() {
+	for {
+		select {
+		case cn := <-s.idle:
+			cn.nc.Close()
+		default:
+			return
+		}
+	}
+}
+
+type conn struct {
+	server *server
+	nc     net.Conn
+	rw     *bufio.ReadWriter
+}
+
+// fail closes connection that is in an unknown state and returns given
+// error, wrapped if it does not come from the memcached.
+func (cn *conn) fail(err error) error {
+	cn.nc.Close()
+	if ErrMemcache.Is(err) {
+		return err
+	}
+	return errors.Wrap(ErrMemcache, "%s: %s", cn.server.addr, err)
+}
+
+// readLine returns a single response line, without the line terminator.
+func (cn *conn) readLine() (string, error) {
+	line, err := cn.rw.ReadSlice('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.Wrap(ErrMemcache, "malformed response line")
+	}
+	return string(line[:len(line)-2]), nil
+}
+
+// ErrMemcache is returned whenever there is an issue with the storage. This
+// can be for example a connection failure or an unexpected server response.
+var ErrMemcache = errors.Wrap(surf.ErrInternal, "memcache")
@@ -0,0 +1,216 @@
+package memcache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeServer is an in-process memcached server implementing a subset of the
+// text protocol: get, set, add, replace, delete, flush_all, version and
+// quit. It is meant to be used in tests only.
+type FakeServer struct {
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mu    sync.Mutex
+	items map[string]fakeItem
+	conns map[net.Conn]struct{}
+}
+
+type fakeItem struct {
+	flags string
+	value []byte
+	expAt time.Time
+}
+
+// StartFakeServer starts a fake memcached server listening on a random
+// local port.
+func StartFakeServer() (*FakeServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &FakeServer{
+		ln:    ln,
+		items: make(map[string]fakeItem),
+		conns: make(map[net.Conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns address the server is listening on.
+func (s *FakeServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server and closes all client connections.
+func (s *FakeServer) Close() error {
+	err := s.ln.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *FakeServer) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(c)
+
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+			c.Close()
+		}()
+	}
+}
+
+func (s *FakeServer) handle(c net.Conn) {
+	rw := bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			rw.WriteString("ERROR\r\n")
+		} else if !s.exec(rw, args) {
+			return
+		}
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// exec executes a single command. It returns false if connection must be
+// closed.
+func (s *FakeServer) exec(rw *bufio.ReadWriter, args []string) bool {
+	now := time.Now()
+
+	switch cmd := args[0]; cmd {
+	case "get":
+		s.mu.Lock()
+		for _, key := range args[1:] {
+			it, ok := s.items[key]
+			if !ok || it.expired(now) {
+				continue
+			}
+			fmt.Fprintf(rw, "VALUE %s %s %d\r\n", key, it.flags, len(it.value))
+			rw.Write(it.value)
+			rw.WriteString("\r\n")
+		}
+		s.mu.Unlock()
+		rw.WriteString("END\r\n")
+	case "set", "add", "replace":
+		// <cmd> <key> <flags> <exptime> <bytes> [noreply]
+		if len(args) < 5 {
+			rw.WriteString("ERROR\r\n")
+			return true
+		}
+		exptime, err1 := strconv.ParseInt(args[3], 10, 64)
+		size, err2 := strconv.Atoi(args[4])
+		if err1 != nil || err2 != nil || size < 0 {
+			rw.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return true
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rw, data); err != nil {
+			return false
+		}
+		if string(data[size:]) != "\r\n" {
+			rw.WriteString("CLIENT_ERROR bad data chunk\r\n")
+			return true
+		}
+
+		s.mu.Lock()
+		current, exists := s.items[args[1]]
+		exists = exists && !current.expired(now)
+		stored := cmd == "set" || (cmd == "add" && !exists) || (cmd == "replace" && exists)
+		if stored {
+			s.items[args[1]] = fakeItem{
+				flags: args[2],
+				value: data[:size],
+				expAt: fakeExpiration(now, exptime),
+			}
+		}
+		s.mu.Unlock()
+
+		if len(args) > 5 && args[5] == "noreply" {
+			return true
+		}
+		if stored {
+			rw.WriteString("STORED\r\n")
+		} else {
+			rw.WriteString("NOT_STORED\r\n")
+		}
+	case "delete":
+		if len(args) < 2 {
+			rw.WriteString("ERROR\r\n")
+			return true
+		}
+		s.mu.Lock()
+		it, ok := s.items[args[1]]
+		delete(s.items, args[1])
+		s.mu.Unlock()
+		if ok && !it.expired(now) {
+			rw.WriteString("DELETED\r\n")
+		} else {
+			rw.WriteString("NOT_FOUND\r\n")
+		}
+	case "flush_all":
+		s.mu.Lock()
+		s.items = make(map[string]fakeItem)
+		s.mu.Unlock()
+		rw.WriteString("OK\r\n")
+	case "version":
+		rw.WriteString("VERSION 1.6.0-fake\r\n")
+	case "quit":
+		return false
+	default:
+		rw.WriteString("ERROR\r\n")
+	}
+	return true
+}
+
+// fakeExpiration returns expiration time for given exptime argument, as
+// defined by the memcached protocol.
+func fakeExpiration(now time.Time, exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return now
+	case exptime > 30*24*60*60:
+		return time.Unix(exptime, 0)
+	default:
+		return now.Add(time.Duration(exptime) * time.Second)
+	}
+}
+
+func (it fakeItem) expired(now time.Time) bool {
+	return !it.expAt.IsZero() && !now.Before(it.expAt)
+}
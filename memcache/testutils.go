@@ -0,0 +1,40 @@
+package memcache
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+// EnsureMemcached returns a memcached client. If MEMCACHED_ADDRS environment
+// variable is set, it is used as a comma separated list of servers and the
+// test is skipped if they are not available. Otherwise an in-process fake
+// server is started for the duration of the test.
+// It is the clients responsibility to close the client when no longer
+// needed.
+func EnsureMemcached(t *testing.T) *Client {
+	t.Helper()
+
+	var addrs []string
+	if env := os.Getenv("MEMCACHED_ADDRS"); env != "" {
+		addrs = strings.Split(env, ",")
+	} else {
+		srv, err := StartFakeServer()
+		if err != nil {
+			t.Fatalf("cannot start fake memcached server: %s", err)
+		}
+		t.Cleanup(func() { srv.Close() })
+		addrs = []string{srv.Addr()}
+	}
+
+	client, err := NewClient(addrs, nil)
+	if err != nil {
+		t.Fatalf("cannot create memcached client: %s", err)
+	}
+	if err := client.Ping(context.Background()); err != nil {
+		client.Close()
+		t.Skipf("memcached not available: %s", err)
+	}
+	return client
+}
@@ -0,0 +1,40 @@
+package rediscache
+
+import (
+	"context"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/gomodule/redigo/redis"
+)
+
+// NewInvalidationBus returns an InvalidationBus implementation that is using
+// redis pub/sub on given channel.
+//
+// Each subscription holds a dedicated connection. If the connection is
+// lost, subscription reconnects automatically. Messages published while
+// disconnected are lost.
+func NewInvalidationBus(pool *redis.Pool, channel string) surf.InvalidationBus {
+	return &invalidationBus{
+		client:  NewClient(pool, nil),
+		channel: channel,
+	}
+}
+
+type invalidationBus struct {
+	client  *Client
+	channel string
+}
+
+func (b *invalidationBus) Publish(ctx context.Context, message string) error {
+	if _, err := b.client.Publish(ctx, b.channel, message); err != nil {
+		return errors.Wrap(ErrRedis, "cannot PUBLISH: %s", err)
+	}
+	return nil
+}
+
+func (b *invalidationBus) Subscribe(fn func(string)) func() {
+	return b.client.Subscribe([]string{b.channel}, func(_ string, data []byte) {
+		fn(string(data))
+	})
+}
@@ -0,0 +1,49 @@
+package rediscache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-surf/surf"
+)
+
+func TestInvalidationBus(t *testing.T) {
+	pool := EnsureRedis(t)
+	defer pool.Close()
+
+	bus := NewInvalidationBus(pool, "test-invalidation-bus")
+	received := make(chan string, 16)
+	cancel := bus.Subscribe(func(msg string) { received <- msg })
+	defer cancel()
+
+	// subscription is established asynchronously, so keep publishing
+	// until the first message is received
+	ctx := context.Background()
+	deadline := time.After(2 * time.Second)
+	for {
+		if err := bus.Publish(ctx, "ping"); err != nil {
+			t.Fatalf("cannot publish: %s", err)
+		}
+		select {
+		case msg := <-received:
+			if msg != "ping" {
+				t.Fatalf("want ping, got %q", msg)
+			}
+			return
+		case <-deadline:
+			t.Fatal("no message received")
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+func TestTieredCacheWithRedis(t *testing.T) {
+	pool := EnsureRedis(t)
+	defer pool.Close()
+
+	remote := NewRedisCache(pool)
+	cache := surf.TieredCache(surf.NewLocalMemCache(), remote, time.Minute, NewInvalidationBus(pool, "test-tiered-cache"))
+	defer cache.Close()
+	surf.RunCacheImplementationTest(t, cache)
+}
@@ -12,7 +12,8 @@ import (
 )
 
 // NewRedisCache returns a CacheService implementation that is using given
-// redis pool as a storage backend.
+// redis pool as a storage backend. Returned cache implements
+// BatchCacheService and CounterCache.
 func NewRedisCache(pool *redis.Pool) surf.CacheService {
 	return &redisCache{
 		pool: pool,
@@ -23,7 +24,7 @@ type redisCache struct {
 	pool *redis.Pool
 }
 
-func (r *redisCache) buildKey(key string) string {
+func buildKey(key string) string {
 	const maxKeyLength = 250
 
 	// prevent from using long keys
@@ -36,6 +37,17 @@ func (r *redisCache) buildKey(key string) string {
 	return key[maxKeyLength-len(suffix):] + suffix
 }
 
+// milliseconds returns expiration time in milliseconds, rounded up, as
+// expected by the PX argument. Redis rejects non-positive expiration time,
+// so the result is never lower than one millisecond.
+func milliseconds(exp time.Duration) int64 {
+	ms := int64((exp + time.Millisecond - 1) / time.Millisecond)
+	if ms < 1 {
+		return 1
+	}
+	return ms
+}
+
 func (r *redisCache) Get(ctx context.Context, key string, dest interface{}) error {
 	rc, err := r.pool.GetContext(ctx)
 	if err != nil {
@@ -43,7 +55,7 @@ func (r *redisCache) Get(ctx context.Context, key string, dest interface{}) erro
 	}
 	defer rc.Close()
 
-	raw, err := redis.Bytes(rc.Do("GET", r.buildKey(key)))
+	raw, err := redis.Bytes(rc.Do("GET", buildKey(key)))
 	switch err {
 	case nil:
 		// all good
@@ -71,7 +83,14 @@ func (r *redisCache) Set(ctx context.Context, key string, value interface{}, exp
 	}
 	defer rc.Close()
 
-	if _, err := rc.Do("SET", r.buildKey(key), raw, "PX", int32(exp/time.Millisecond)); err != nil {
+	if exp <= 0 {
+		// Value expires immediately.
+		if _, err := rc.Do("DEL", buildKey(key)); err != nil {
+			return errors.Wrap(ErrRedis, "cannot delete: %s", err)
+		}
+		return nil
+	}
+	if _, err := rc.Do("SET", buildKey(key), raw, "PX", milliseconds(exp)); err != nil {
 		return errors.Wrap(ErrRedis, "cannot SET: %s", err)
 	}
 	return nil
@@ -89,7 +108,19 @@ func (r *redisCache) SetNx(ctx context.Context, key string, value interface{}, e
 	}
 	defer rc.Close()
 
-	switch resp, err := rc.Do("SET", r.buildKey(key), raw, "PX", int32(exp/time.Millisecond), "NX"); err {
+	if exp <= 0 {
+		// Value expires immediately, so only the conflict is reported.
+		switch n, err := redis.Int(rc.Do("EXISTS", buildKey(key))); {
+		case err != nil:
+			return errors.Wrap(ErrRedis, "cannot check key: %s", err)
+		case n > 0:
+			return ErrConflict
+		default:
+			return nil
+		}
+	}
+
+	switch resp, err := rc.Do("SET", buildKey(key), raw, "PX", milliseconds(exp), "NX"); err {
 	case nil, redis.ErrNil:
 		// if set was successful, resp will be OK and not nil. From
 		// redis documentation http://redis.io/commands/set
@@ -107,6 +138,105 @@ func (r *redisCache) SetNx(ctx context.Context, key string, value interface{}, e
 	}
 }
 
+func (r *redisCache) GetMulti(ctx context.Context, keys []string, dests []interface{}) ([]error, error) {
+	if len(keys) != len(dests) {
+		return nil, errors.Wrap(surf.ErrValidation, "%d keys and %d destinations", len(keys), len(dests))
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	rc, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(ErrRedis, "cannot get connection: %s", err)
+	}
+	defer rc.Close()
+
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = buildKey(key)
+	}
+	raws, err := redis.ByteSlices(rc.Do("MGET", args...))
+	if err != nil {
+		return nil, errors.Wrap(ErrRedis, "cannot MGET: %s", err)
+	}
+
+	errs := make([]error, len(keys))
+	for i, raw := range raws {
+		if raw == nil {
+			errs[i] = ErrMiss
+			continue
+		}
+		errs[i] = surf.CacheUnmarshal(raw, dests[i])
+	}
+	return errs, nil
+}
+
+func (r *redisCache) SetMulti(ctx context.Context, items []surf.CacheItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	raws := make([][]byte, len(items))
+	for i, it := range items {
+		raw, err := surf.CacheMarshal(it.Value)
+		if err != nil {
+			return err
+		}
+		raws[i] = raw
+	}
+
+	rc, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return errors.Wrap(ErrRedis, "cannot get connection: %s", err)
+	}
+	defer rc.Close()
+
+	for i, it := range items {
+		var err error
+		if it.Exp <= 0 {
+			err = rc.Send("DEL", buildKey(it.Key))
+		} else {
+			err = rc.Send("SET", buildKey(it.Key), raws[i], "PX", milliseconds(it.Exp))
+		}
+		if err != nil {
+			return errors.Wrap(ErrRedis, "cannot SET: %s", err)
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return errors.Wrap(ErrRedis, "cannot flush: %s", err)
+	}
+	// read all replies, even if one of them is an error
+	var firstErr error
+	for range items {
+		if _, err := rc.Receive(); err != nil && firstErr == nil {
+			firstErr = errors.Wrap(ErrRedis, "cannot SET: %s", err)
+		}
+	}
+	return firstErr
+}
+
+func (r *redisCache) DelMulti(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	rc, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return errors.Wrap(ErrRedis, "cannot get connection: %s", err)
+	}
+	defer rc.Close()
+
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = buildKey(key)
+	}
+	if _, err := rc.Do("DEL", args...); err != nil {
+		return errors.Wrap(ErrRedis, "cannot delete: %s", err)
+	}
+	return nil
+}
+
 func (r *redisCache) Del(ctx context.Context, key string) error {
 	rc, err := r.pool.GetContext(ctx)
 	if err != nil {
@@ -114,7 +244,7 @@ func (r *redisCache) Del(ctx context.Context, key string) error {
 	}
 	defer rc.Close()
 
-	n, err := redis.Int(rc.Do("DEL", r.buildKey(key)))
+	n, err := redis.Int(rc.Do("DEL", buildKey(key)))
 	if err != nil {
 		return errors.Wrap(ErrRedis, "cannot delete: %s", err)
 	}
@@ -124,6 +254,91 @@ func (r *redisCache) Del(ctx context.Context, key string) error {
 	return nil
 }
 
+// incrScriptSrc increments value and sets expiration time only if the key
+// was not in use. Expiration of zero milliseconds means no expiration.
+const incrScriptSrc = `
+local created = redis.call("EXISTS", KEYS[1]) == 0
+local n = redis.call("INCRBY", KEYS[1], ARGV[1])
+if created and tonumber(ARGV[2]) > 0 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return n
+`
+
+// counterMilliseconds returns expiration time of a new counter in
+// milliseconds, or zero if the counter must not expire.
+func counterMilliseconds(exp time.Duration) int64 {
+	if exp <= 0 {
+		return 0
+	}
+	return milliseconds(exp)
+}
+
+var incrScript = redis.NewScript(1, incrScriptSrc)
+
+func (r *redisCache) Incr(ctx context.Context, key string, delta int64, exp time.Duration) (int64, error) {
+	rc, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return 0, errors.Wrap(ErrRedis, "cannot get connection: %s", err)
+	}
+	defer rc.Close()
+
+	n, err := redis.Int64(incrScript.Do(rc, buildKey(key), delta, counterMilliseconds(exp)))
+	if err != nil {
+		if _, ok := err.(redis.Error); ok {
+			// stored value is not an integer
+			return 0, errors.Wrap(surf.ErrCacheMalformed, "cannot INCRBY: %s", err)
+		}
+		return 0, errors.Wrap(ErrRedis, "cannot INCRBY: %s", err)
+	}
+	return n, nil
+}
+
+// casScriptSrc sets new value only if the current one is equal to the
+// expected one. It returns -1 if the key is not in use, 0 if the value is
+// different and 1 if the value was set.
+const casScriptSrc = `
+local current = redis.call("GET", KEYS[1])
+if not current then
+	return -1
+end
+if current ~= ARGV[1] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+return 1
+`
+
+var casScript = redis.NewScript(1, casScriptSrc)
+
+func (r *redisCache) CompareAndSwap(ctx context.Context, key string, old, value interface{}, exp time.Duration) error {
+	rawOld, err := surf.CacheMarshal(old)
+	if err != nil {
+		return err
+	}
+	raw, err := surf.CacheMarshal(value)
+	if err != nil {
+		return err
+	}
+
+	rc, err := r.pool.GetContext(ctx)
+	if err != nil {
+		return errors.Wrap(ErrRedis, "cannot get connection: %s", err)
+	}
+	defer rc.Close()
+
+	switch res, err := redis.Int(casScript.Do(rc, buildKey(key), rawOld, raw, milliseconds(exp))); {
+	case err != nil:
+		return errors.Wrap(ErrRedis, "cannot compare and swap: %s", err)
+	case res == -1:
+		return ErrMiss
+	case res == 0:
+		return ErrConflict
+	default:
+		return nil
+	}
+}
+
 var (
 	// ErrRedis is returned whenever there is an issue with the storage.
 	// This can be for example an exhausted pool issues or a connection
@@ -132,8 +347,8 @@ var (
 	ErrRedis = errors.Wrap(surf.ErrInternal, "redis")
 
 	// ErrMiss is an alias.
-	ErrMiss = errors.Wrap(surf.ErrMiss, "redis")
+	ErrMiss = surf.ErrMiss
 
 	// ErrConflict is an alias.
-	ErrConflict = errors.Wrap(surf.ErrConflict, "redis")
+	ErrConflict = surf.ErrConflict
 )
@@ -1,15 +1,40 @@
 package rediscache
 
 import (
+	"os"
 	"testing"
 
 	"github.com/go-surf/surf"
+	"github.com/gomodule/redigo/redis"
 )
 
 func TestRedisCache(t *testing.T) {
+	caps := &surf.CacheCapabilities{
+		Batch:    true,
+		Counters: true,
+	}
+
+	var pool *redis.Pool
+	if os.Getenv("REDIS_URL") == "" {
+		// Expiration is tested using the fake server clock.
+		srv, err := StartFakeServer()
+		if err != nil {
+			t.Fatalf("cannot start fake redis server: %s", err)
+		}
+		defer srv.Close()
+		pool = srv.Pool()
+		caps.Advance = srv.Advance
+	} else {
+		pool = EnsureRedis(t)
+	}
+	defer pool.Close()
+
+	surf.RunCacheConformanceTest(t, NewRedisCache(pool), caps)
+}
+
+func TestRedisTaggedCache(t *testing.T) {
 	pool := EnsureRedis(t)
 	defer pool.Close()
-	cache := NewRedisCache(pool)
 
-	surf.RunCacheImplementationTest(t, cache)
+	surf.RunTaggedCacheImplementationTest(t, NewRedisCache(pool))
 }
@@ -0,0 +1,436 @@
+package rediscache
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/gomodule/redigo/redis"
+)
+
+// Client is a redis client built on top of a connection pool. It provides
+// pipelining, Lua scripts and pub/sub subscriptions. Every command is traced
+// using the trace of the context it is called with.
+//
+// Client is safe for concurrent use.
+type Client struct {
+	pool   *redis.Pool
+	prefix string
+
+	mu      sync.Mutex
+	scripts map[string]*Script
+}
+
+// ClientOpts defines options for the redis client.
+type ClientOpts struct {
+	// TracePrefix is the prefix of trace span descriptions. Defaults to
+	// "redis".
+	TracePrefix string
+}
+
+// NewClient returns client using given pool.
+func NewClient(pool *redis.Pool, o *ClientOpts) *Client {
+	if o == nil {
+		o = &ClientOpts{}
+	}
+	prefix := o.TracePrefix
+	if prefix == "" {
+		prefix = "redis"
+	}
+	return &Client{
+		pool:    pool,
+		prefix:  prefix,
+		scripts: make(map[string]*Script),
+	}
+}
+
+// Pool returns connection pool used by the client.
+func (c *Client) Pool() *redis.Pool {
+	return c.pool
+}
+
+func (c *Client) conn(ctx context.Context) (redis.Conn, error) {
+	rc, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(ErrRedis, "cannot get connection: %s", err)
+	}
+	return rc, nil
+}
+
+// Do executes a single command and returns its reply. Error replies are
+// returned as redis.Error, other failures as ErrRedis.
+func (c *Client) Do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	span := surf.CurrentTrace(ctx).Begin(c.prefix+" "+cmd, argsTrace(args)...)
+
+	reply, err := c.do(ctx, cmd, args...)
+	finishSpan(span, err)
+	return reply, err
+}
+
+func (c *Client) do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	rc, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	reply, err := rc.Do(cmd, args...)
+	return reply, wrapConnErr(err)
+}
+
+// wrapConnErr returns given error as ErrRedis, unless it is an error reply.
+func wrapConnErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(redis.Error); ok {
+		return err
+	}
+	return errors.Wrap(ErrRedis, "%s", err)
+}
+
+// argsTrace returns trace key values describing given command arguments.
+// Only the first argument, which is usually the key, is included.
+func argsTrace(args []interface{}) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	switch arg := args[0].(type) {
+	case string:
+		return []string{"arg", arg}
+	case []byte:
+		return []string{"arg", string(arg)}
+	default:
+		return nil
+	}
+}
+
+func finishSpan(span surf.TraceSpan, err error) {
+	if err != nil {
+		span.Finish("err", err.Error())
+	} else {
+		span.Finish()
+	}
+}
+
+// Pipeline returns a new pipeline. Commands added to the pipeline are sent
+// together by Exec, using a single round trip.
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{client: c}
+}
+
+// Pipeline is a batch of commands sent together. Pipeline is not safe for
+// concurrent use.
+type Pipeline struct {
+	client *Client
+	cmds   []*PipelineCmd
+}
+
+// PipelineCmd is a command of a pipeline. Its result is available after the
+// pipeline is executed.
+type PipelineCmd struct {
+	name  string
+	args  []interface{}
+	reply interface{}
+	err   error
+}
+
+// Result returns reply of the command. It can be used with redis reply
+// helpers, for example redis.String(cmd.Result()).
+func (cmd *PipelineCmd) Result() (interface{}, error) {
+	return cmd.reply, cmd.err
+}
+
+// Do adds a command to the pipeline.
+func (p *Pipeline) Do(cmd string, args ...interface{}) *PipelineCmd {
+	pc := &PipelineCmd{
+		name: cmd,
+		args: args,
+		err:  errors.Wrap(ErrRedis, "pipeline not executed"),
+	}
+	p.cmds = append(p.cmds, pc)
+	return pc
+}
+
+// Script adds execution of given script to the pipeline. Script source is
+// always sent, because a missing script cannot be retried within a
+// pipeline.
+func (p *Pipeline) Script(s *Script, keysAndArgs ...interface{}) *PipelineCmd {
+	args := make([]interface{}, 0, len(keysAndArgs)+2)
+	args = append(args, s.src, s.keyCount)
+	args = append(args, keysAndArgs...)
+	return p.Do("EVAL", args...)
+}
+
+// Len returns the number of commands in the pipeline.
+func (p *Pipeline) Len() int {
+	return len(p.cmds)
+}
+
+// Exec sends all commands of the pipeline and reads their replies. Error is
+// returned only if the pipeline could not be executed. Error replies of
+// single commands are available as their results. Executed commands are
+// removed from the pipeline, so that it can be reused.
+func (p *Pipeline) Exec(ctx context.Context) error {
+	cmds := p.cmds
+	p.cmds = nil
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	names := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		names[i] = cmd.name
+	}
+	span := surf.CurrentTrace(ctx).Begin(p.client.prefix+" pipeline",
+		"cmds", strings.Join(names, " "),
+		"size", strconv.Itoa(len(cmds)))
+
+	err := p.exec(ctx, cmds)
+	if err != nil {
+		for _, cmd := range cmds {
+			cmd.reply, cmd.err = nil, err
+		}
+	}
+	finishSpan(span, err)
+	return err
+}
+
+func (p *Pipeline) exec(ctx context.Context, cmds []*PipelineCmd) error {
+	rc, err := p.client.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	for _, cmd := range cmds {
+		if err := rc.Send(cmd.name, cmd.args...); err != nil {
+			return errors.Wrap(ErrRedis, "cannot send: %s", err)
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return errors.Wrap(ErrRedis, "cannot flush: %s", err)
+	}
+	for _, cmd := range cmds {
+		cmd.reply, cmd.err = rc.Receive()
+		if cmd.err != nil {
+			if _, ok := cmd.err.(redis.Error); !ok {
+				return errors.Wrap(ErrRedis, "cannot receive: %s", cmd.err)
+			}
+		}
+	}
+	return nil
+}
+
+// Script is a Lua script registered with the client.
+type Script struct {
+	client   *Client
+	name     string
+	src      string
+	keyCount int
+	script   *redis.Script
+}
+
+// RegisterScript registers Lua script with given name, number of keys and
+// source. Script is executed using EVALSHA, falling back to EVAL if the
+// server does not have it cached. Registering a script with the same name
+// again replaces it.
+func (c *Client) RegisterScript(name string, keyCount int, src string) *Script {
+	s := &Script{
+		client:   c,
+		name:     name,
+		src:      src,
+		keyCount: keyCount,
+		script:   redis.NewScript(keyCount, src),
+	}
+	c.mu.Lock()
+	c.scripts[name] = s
+	c.mu.Unlock()
+	return s
+}
+
+// Script returns script registered with given name or nil.
+func (c *Client) Script(name string) *Script {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.scripts[name]
+}
+
+// LoadScripts loads all registered scripts into the script cache of the
+// server, so that they can be executed by hash only.
+func (c *Client) LoadScripts(ctx context.Context) error {
+	span := surf.CurrentTrace(ctx).Begin(c.prefix + " load scripts")
+
+	c.mu.Lock()
+	pipeline := c.Pipeline()
+	for _, s := range c.scripts {
+		pipeline.Do("SCRIPT", "LOAD", s.src)
+	}
+	cmds := pipeline.cmds
+	c.mu.Unlock()
+
+	err := pipeline.exec(ctx, cmds)
+	if err == nil {
+		for _, cmd := range cmds {
+			if cmd.err != nil {
+				err = errors.Wrap(ErrRedis, "cannot load script: %s", cmd.err)
+				break
+			}
+		}
+	}
+	finishSpan(span, err)
+	return err
+}
+
+// Do executes the script with given keys and arguments.
+func (s *Script) Do(ctx context.Context, keysAndArgs ...interface{}) (interface{}, error) {
+	span := surf.CurrentTrace(ctx).Begin(s.client.prefix+" script "+s.name, argsTrace(keysAndArgs)...)
+
+	reply, err := s.do(ctx, keysAndArgs)
+	finishSpan(span, err)
+	return reply, err
+}
+
+func (s *Script) do(ctx context.Context, keysAndArgs []interface{}) (interface{}, error) {
+	rc, err := s.client.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	reply, err := s.script.Do(rc, keysAndArgs...)
+	return reply, wrapConnErr(err)
+}
+
+// Publish sends message to given channel and returns the number of clients
+// that received it.
+func (c *Client) Publish(ctx context.Context, channel string, message interface{}) (int, error) {
+	return redis.Int(c.Do(ctx, "PUBLISH", channel, message))
+}
+
+// Subscribe calls given function with every message published to given
+// channels, until returned cancel function is called. Function is called
+// sequentially, from a single goroutine.
+//
+// Each subscription holds a dedicated connection. If the connection is
+// lost, subscription reconnects automatically. Messages published while
+// disconnected are lost.
+func (c *Client) Subscribe(channels []string, fn func(channel string, data []byte)) (cancel func()) {
+	s := &subscription{
+		pool:     c.pool,
+		channels: channels,
+		fn:       fn,
+		after:    time.After,
+		stop:     make(chan struct{}),
+	}
+	go s.run()
+	return s.cancel
+}
+
+type subscription struct {
+	pool     *redis.Pool
+	channels []string
+	fn       func(string, []byte)
+
+	// after is used to wait before reconnecting.
+	after func(time.Duration) <-chan time.Time
+
+	stop chan struct{}
+	once sync.Once
+
+	mu   sync.Mutex
+	conn *redis.PubSubConn
+}
+
+func (s *subscription) run() {
+	const minBackoff = 50 * time.Millisecond
+	backoff := minBackoff
+	for {
+		subscribed, err := s.receive()
+		if err == nil {
+			// cancelled
+			return
+		}
+		if subscribed {
+			// Backoff grows only with consecutive failures.
+			backoff = minBackoff
+		}
+
+		select {
+		case <-s.stop:
+			return
+		case <-s.after(backoff):
+		}
+		if backoff < 5*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// receive delivers messages until connection is closed. It returns nil error
+// only if subscription was cancelled. Returned flag is true if subscription
+// was confirmed before the connection was closed.
+func (s *subscription) receive() (subscribed bool, err error) {
+	psc := &redis.PubSubConn{Conn: s.pool.Get()}
+	defer func() {
+		// cancel may be writing to the connection
+		s.mu.Lock()
+		s.conn = nil
+		psc.Close()
+		s.mu.Unlock()
+	}()
+
+	s.mu.Lock()
+	select {
+	case <-s.stop:
+		s.mu.Unlock()
+		return false, nil
+	default:
+	}
+	s.conn = psc
+	s.mu.Unlock()
+
+	channels := make([]interface{}, len(s.channels))
+	for i, ch := range s.channels {
+		channels[i] = ch
+	}
+	if err := psc.Subscribe(channels...); err != nil {
+		return false, err
+	}
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			s.fn(v.Channel, v.Data)
+		case redis.Subscription:
+			switch {
+			case v.Kind == "subscribe":
+				subscribed = true
+			case v.Kind == "unsubscribe" && v.Count == 0:
+				return subscribed, nil
+			}
+		case error:
+			select {
+			case <-s.stop:
+				return subscribed, nil
+			default:
+				return subscribed, v
+			}
+		}
+	}
+}
+
+func (s *subscription) cancel() {
+	s.once.Do(func() {
+		s.mu.Lock()
+		close(s.stop)
+		if s.conn != nil {
+			s.conn.Unsubscribe()
+		}
+		s.mu.Unlock()
+	})
+}
@@ -0,0 +1,252 @@
+package rediscache
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestClientPipeline(t *testing.T) {
+	ctx := context.Background()
+	pool := EnsureRedis(t)
+	defer pool.Close()
+	client := NewClient(pool, nil)
+
+	if _, err := client.Do(ctx, "SET", "text", "abc"); err != nil {
+		t.Fatalf("cannot SET: %s", err)
+	}
+
+	p := client.Pipeline()
+	set := p.Do("SET", "pipeline", "1")
+	incr := p.Do("INCR", "pipeline")
+	invalid := p.Do("INCR", "text")
+	get := p.Do("GET", "pipeline")
+	if p.Len() != 4 {
+		t.Fatalf("want 4 commands, got %d", p.Len())
+	}
+	if _, err := get.Result(); !ErrRedis.Is(err) {
+		t.Fatalf("want ErrRedis before execution, got %+v", err)
+	}
+	if err := p.Exec(ctx); err != nil {
+		t.Fatalf("cannot execute pipeline: %s", err)
+	}
+	if p.Len() != 0 {
+		t.Fatalf("want executed commands removed, got %d", p.Len())
+	}
+
+	if res, err := redis.String(set.Result()); err != nil || res != "OK" {
+		t.Errorf("SET: want OK, got %q, %v", res, err)
+	}
+	if n, err := redis.Int(incr.Result()); err != nil || n != 2 {
+		t.Errorf("INCR: want 2, got %d, %v", n, err)
+	}
+	if _, err := invalid.Result(); err == nil {
+		t.Error("INCR of text: want error reply")
+	} else if _, ok := err.(redis.Error); !ok {
+		t.Errorf("INCR of text: want error reply, got %T", err)
+	}
+	if v, err := redis.String(get.Result()); err != nil || v != "2" {
+		t.Errorf("GET: want 2, got %q, %v", v, err)
+	}
+
+	// empty pipeline is a no-op
+	if err := p.Exec(ctx); err != nil {
+		t.Fatalf("cannot execute empty pipeline: %s", err)
+	}
+}
+
+func TestClientScripts(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := StartFakeServer()
+	if err != nil {
+		t.Fatalf("cannot start fake server: %s", err)
+	}
+	defer srv.Close()
+	pool := srv.Pool()
+	defer pool.Close()
+	client := NewClient(pool, nil)
+
+	const src = `return redis.call("INCRBY", KEYS[1], ARGV[1])`
+	srv.RegisterScript(src, func(call func(...string) interface{}, keys, args []string) interface{} {
+		return call("INCRBY", keys[0], args[0])
+	})
+
+	script := client.RegisterScript("incrby", 1, src)
+	if client.Script("incrby") != script {
+		t.Fatal("script not registered")
+	}
+	if client.Script("unknown") != nil {
+		t.Fatal("want nil for unknown script")
+	}
+
+	// script is not cached by the server, EVAL is used
+	if n, err := redis.Int(script.Do(ctx, "counter", 2)); err != nil || n != 2 {
+		t.Fatalf("want 2, got %d, %v", n, err)
+	}
+	if err := client.LoadScripts(ctx); err != nil {
+		t.Fatalf("cannot load scripts: %s", err)
+	}
+	if n, err := redis.Int(script.Do(ctx, "counter", 3)); err != nil || n != 5 {
+		t.Fatalf("want 5, got %d, %v", n, err)
+	}
+
+	p := client.Pipeline()
+	first := p.Script(script, "counter", 1)
+	second := p.Script(script, "counter", 1)
+	if err := p.Exec(ctx); err != nil {
+		t.Fatalf("cannot execute pipeline: %s", err)
+	}
+	if n, err := redis.Int(first.Result()); err != nil || n != 6 {
+		t.Fatalf("want 6, got %d, %v", n, err)
+	}
+	if n, err := redis.Int(second.Result()); err != nil || n != 7 {
+		t.Fatalf("want 7, got %d, %v", n, err)
+	}
+
+	unsupported := client.RegisterScript("unsupported", 0, `return 1`)
+	if err := client.LoadScripts(ctx); !ErrRedis.Is(err) {
+		t.Fatalf("want ErrRedis loading unsupported script, got %+v", err)
+	}
+	if _, err := unsupported.Do(ctx); err == nil {
+		t.Fatal("want error running unsupported script")
+	}
+}
+
+func TestClientSubscribe(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := StartFakeServer()
+	if err != nil {
+		t.Fatalf("cannot start fake server: %s", err)
+	}
+	defer srv.Close()
+	pool := srv.Pool()
+	defer pool.Close()
+	client := NewClient(pool, nil)
+
+	type message struct {
+		channel string
+		data    string
+	}
+	received := make(chan message, 16)
+	cancel := client.Subscribe([]string{"first", "second"}, func(channel string, data []byte) {
+		received <- message{channel: channel, data: string(data)}
+	})
+	defer cancel()
+
+	// Subscription is established asynchronously, so keep publishing
+	// until the first message is received.
+	expect := func(channel string) {
+		t.Helper()
+		deadline := time.After(5 * time.Second)
+		for {
+			// Publishing fails once for every pooled connection
+			// that was closed.
+			_, _ = client.Publish(ctx, channel, "ping")
+			select {
+			case msg := <-received:
+				if msg.channel != channel || msg.data != "ping" {
+					t.Fatalf("want ping on %s, got %+v", channel, msg)
+				}
+				// drain duplicates
+				for len(received) > 0 {
+					<-received
+				}
+				return
+			case <-deadline:
+				t.Fatalf("no message received on %s", channel)
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}
+
+	expect("first")
+	expect("second")
+
+	// subscription reconnects
+	srv.CloseConnections()
+	expect("second")
+
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	if n, err := client.Publish(ctx, "first", "ping"); err != nil || n != 0 {
+		t.Fatalf("want no subscribers after cancel, got %d, %v", n, err)
+	}
+}
+
+func TestClientSubscribeBackoffReset(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := StartFakeServer()
+	if err != nil {
+		t.Fatalf("cannot start fake server: %s", err)
+	}
+	defer srv.Close()
+	pool := srv.Pool()
+	defer pool.Close()
+	client := NewClient(pool, nil)
+
+	// Subscription uses its own pool, so that it is not given a pooled
+	// connection closed by the server.
+	subPool := srv.Pool()
+	defer subPool.Close()
+
+	received := make(chan struct{}, 16)
+	var (
+		mu     sync.Mutex
+		delays []time.Duration
+	)
+	s := &subscription{
+		pool:     subPool,
+		channels: []string{"events"},
+		fn:       func(string, []byte) { received <- struct{}{} },
+		after: func(d time.Duration) <-chan time.Time {
+			mu.Lock()
+			delays = append(delays, d)
+			mu.Unlock()
+			return time.After(time.Millisecond)
+		},
+		stop: make(chan struct{}),
+	}
+	go s.run()
+	defer s.cancel()
+
+	expect := func() {
+		t.Helper()
+		deadline := time.After(5 * time.Second)
+		for {
+			_, _ = client.Publish(ctx, "events", "ping")
+			select {
+			case <-received:
+				for len(received) > 0 {
+					<-received
+				}
+				return
+			case <-deadline:
+				t.Fatal("no message received")
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}
+
+	expect()
+	for i := 0; i < 2; i++ {
+		srv.CloseConnections()
+		expect()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(delays) != 2 {
+		t.Fatalf("want 2 reconnections, got %v", delays)
+	}
+	for _, d := range delays {
+		if d != 50*time.Millisecond {
+			t.Fatalf("want backoff reset after each confirmed subscription, got %v", delays)
+		}
+	}
+}
@@ -0,0 +1,491 @@
+package rediscache
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/gomodule/redigo/redis"
+)
+
+// Cluster is a Redis Cluster client. Commands are routed to the node
+// serving the hash slot of their key. Slot map is loaded using CLUSTER SLOTS
+// and updated whenever a node responds with a MOVED redirection or cannot be
+// connected to, for example after a failover. ASK redirections, used while a
+// slot is being migrated, are followed without updating the slot map.
+//
+// Cluster is safe for concurrent use.
+type Cluster struct {
+	seeds       []string
+	timeout     time.Duration
+	maxIdle     int
+	idleTimeout time.Duration
+	password    string
+
+	mu    sync.RWMutex
+	slots [clusterSlots]string
+	pools map[string]*redis.Pool
+
+	refreshing sync.Mutex
+
+	// refreshPending is set while a background refresh is running. It is
+	// accessed atomically.
+	refreshPending int32
+}
+
+// ClusterOpts defines options for the Redis Cluster client.
+type ClusterOpts struct {
+	// MaxIdle is the maximum number of idle connections kept for each
+	// node. Defaults to 3.
+	MaxIdle int
+
+	// IdleTimeout closes connections that remain idle longer. Defaults to
+	// 4 minutes.
+	IdleTimeout time.Duration
+
+	// Timeout is used for connecting, reading and writing. Defaults to one
+	// second.
+	Timeout time.Duration
+
+	// Password is used to authenticate to cluster nodes.
+	Password string
+}
+
+// clusterSlots is the number of hash slots in Redis Cluster.
+const clusterSlots = 16384
+
+// backgroundRefreshTimeout limits the time slot map refresh started by a
+// command can take.
+const backgroundRefreshTimeout = 5 * time.Second
+
+// maxRedirects is the maximum number of redirections followed for a single
+// command.
+const maxRedirects = 8
+
+// NewCluster returns client of the cluster that given nodes, each defined
+// as a host:port address, are part of. Not all nodes must be provided, the
+// rest is discovered. Nodes are not contacted until the first command is
+// executed.
+func NewCluster(addrs []string, o *ClusterOpts) (*Cluster, error) {
+	if len(addrs) == 0 {
+		return nil, errors.Wrap(surf.ErrValidation, "no node")
+	}
+	if o == nil {
+		o = &ClusterOpts{}
+	}
+	c := &Cluster{
+		seeds:       append([]string(nil), addrs...),
+		timeout:     o.Timeout,
+		maxIdle:     o.MaxIdle,
+		idleTimeout: o.IdleTimeout,
+		password:    o.Password,
+		pools:       make(map[string]*redis.Pool),
+	}
+	if c.timeout <= 0 {
+		c.timeout = time.Second
+	}
+	if c.maxIdle <= 0 {
+		c.maxIdle = 3
+	}
+	if c.idleTimeout <= 0 {
+		c.idleTimeout = 4 * time.Minute
+	}
+	return c, nil
+}
+
+// Close closes connections to all nodes.
+func (c *Cluster) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for addr, p := range c.pools {
+		p.Close()
+		delete(c.pools, addr)
+	}
+	return nil
+}
+
+// pool returns connection pool of the node with given address.
+func (c *Cluster) pool(addr string) *redis.Pool {
+	c.mu.RLock()
+	p, ok := c.pools[addr]
+	c.mu.RUnlock()
+	if ok {
+		return p
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, ok := c.pools[addr]; ok {
+		return p
+	}
+	opts := []redis.DialOption{
+		redis.DialConnectTimeout(c.timeout),
+		redis.DialReadTimeout(c.timeout),
+		redis.DialWriteTimeout(c.timeout),
+	}
+	if c.password != "" {
+		opts = append(opts, redis.DialPassword(c.password))
+	}
+	p = &redis.Pool{
+		MaxIdle:     c.maxIdle,
+		IdleTimeout: c.idleTimeout,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr, opts...)
+		},
+	}
+	c.pools[addr] = p
+	return p
+}
+
+// Slot returns hash slot of given key. If key contains a non empty hash
+// tag, for example "{user:1}:profile", only the tag is hashed, so that
+// related keys can be stored in the same slot.
+func Slot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// nodeAddr returns address of the node serving given slot. Slot map is
+// loaded if the slot is not known.
+func (c *Cluster) nodeAddr(ctx context.Context, slot int) (string, error) {
+	c.mu.RLock()
+	addr := c.slots[slot]
+	c.mu.RUnlock()
+	if addr != "" {
+		return addr, nil
+	}
+
+	if err := c.Refresh(ctx); err != nil {
+		return "", err
+	}
+
+	c.mu.RLock()
+	addr = c.slots[slot]
+	c.mu.RUnlock()
+	if addr == "" {
+		return "", errors.Wrap(ErrRedis, "slot %d not served", slot)
+	}
+	return addr, nil
+}
+
+// Refresh loads slot map from the first node that responds. Seed nodes are
+// asked first.
+func (c *Cluster) Refresh(ctx context.Context) error {
+	c.refreshing.Lock()
+	defer c.refreshing.Unlock()
+
+	addrs := append([]string(nil), c.seeds...)
+	c.mu.RLock()
+	for addr := range c.pools {
+		addrs = append(addrs, addr)
+	}
+	c.mu.RUnlock()
+
+	var lastErr error
+	seen := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+
+		slots, err := c.loadSlots(ctx, addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.mu.Lock()
+		c.slots = *slots
+		c.mu.Unlock()
+		return nil
+	}
+	return errors.Wrap(ErrRedis, "cannot load cluster slots: %s", lastErr)
+}
+
+// refreshInBackground loads slot map without blocking the caller. Only one
+// background refresh runs at a time, requests made while it is running are
+// dropped.
+func (c *Cluster) refreshInBackground(ctx context.Context) {
+	if !atomic.CompareAndSwapInt32(&c.refreshPending, 0, 1) {
+		return
+	}
+	// Keep context values, for example the logger, but not the
+	// cancellation of the command that triggered the refresh.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), backgroundRefreshTimeout)
+	go func() {
+		defer atomic.StoreInt32(&c.refreshPending, 0)
+		defer cancel()
+		if err := c.Refresh(ctx); err != nil {
+			surf.LogError(ctx, err, "cannot refresh cluster slots")
+		}
+	}()
+}
+
+func (c *Cluster) loadSlots(ctx context.Context, addr string) (*[clusterSlots]string, error) {
+	rc, err := c.pool(addr).GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	ranges, err := redis.Values(rc.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Each range is described as [start, end, [host, port, ...], replicas...]
+	var slots [clusterSlots]string
+	for _, r := range ranges {
+		desc, err := redis.Values(r, nil)
+		if err != nil || len(desc) < 3 {
+			return nil, errors.Wrap(ErrRedis, "invalid slot range: %v", r)
+		}
+		start, err := redis.Int(desc[0], nil)
+		if err != nil {
+			return nil, errors.Wrap(ErrRedis, "invalid slot range start: %s", err)
+		}
+		end, err := redis.Int(desc[1], nil)
+		if err != nil {
+			return nil, errors.Wrap(ErrRedis, "invalid slot range end: %s", err)
+		}
+		node, err := redis.Values(desc[2], nil)
+		if err != nil || len(node) < 2 {
+			return nil, errors.Wrap(ErrRedis, "invalid slot node: %v", desc[2])
+		}
+		host, err := redis.String(node[0], nil)
+		if err != nil {
+			return nil, errors.Wrap(ErrRedis, "invalid node host: %s", err)
+		}
+		port, err := redis.Int(node[1], nil)
+		if err != nil {
+			return nil, errors.Wrap(ErrRedis, "invalid node port: %s", err)
+		}
+		if host == "" {
+			// node does not know its own address
+			host, _, _ = net.SplitHostPort(addr)
+		}
+		if start < 0 || end >= clusterSlots || start > end {
+			return nil, errors.Wrap(ErrRedis, "invalid slot range %d-%d", start, end)
+		}
+		nodeAddr := net.JoinHostPort(host, strconv.Itoa(port))
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = nodeAddr
+		}
+	}
+	return &slots, nil
+}
+
+// clusterCmd is a single key command executed by the cluster.
+type clusterCmd struct {
+	key  string
+	name string
+	args []interface{}
+}
+
+// Do executes a single key command on the node serving given key.
+// Redirections are followed. Error replies are returned as redis.Error.
+func (c *Cluster) Do(ctx context.Context, key string, cmd string, args ...interface{}) (interface{}, error) {
+	replies, errs := c.pipeline(ctx, []clusterCmd{{key: key, name: cmd, args: args}})
+	return replies[0], errs[0]
+}
+
+// pipeline executes given commands, grouped by node, with commands of each
+// node sent in a single round trip. Commands that are redirected are
+// retried. Reply and error of each command is returned.
+func (c *Cluster) pipeline(ctx context.Context, cmds []clusterCmd) ([]interface{}, []error) {
+	replies := make([]interface{}, len(cmds))
+	errs := make([]error, len(cmds))
+
+	// ask holds addresses given by ASK redirection. Such command must be
+	// sent to that node only once, preceded by ASKING.
+	ask := make(map[int]string)
+	pending := make([]int, len(cmds))
+	for i := range cmds {
+		pending[i] = i
+	}
+
+	// refresh is set if the slot map is likely outdated.
+	refresh := false
+	for attempt := 0; len(pending) > 0; attempt++ {
+		if attempt > maxRedirects {
+			for _, i := range pending {
+				errs[i] = errors.Wrap(ErrRedis, "too many redirections")
+			}
+			break
+		}
+		if attempt > 0 && ctx.Err() != nil {
+			for _, i := range pending {
+				errs[i] = ctx.Err()
+			}
+			break
+		}
+
+		groups := make(map[string][]int)
+		for _, i := range pending {
+			addr, ok := ask[i]
+			if !ok {
+				var err error
+				if addr, err = c.nodeAddr(ctx, Slot(cmds[i].key)); err != nil {
+					errs[i] = err
+					continue
+				}
+			}
+			groups[addr] = append(groups[addr], i)
+		}
+
+		var retry []int
+		asking := ask
+		ask = make(map[int]string)
+		for addr, idxs := range groups {
+			results, err := c.send(ctx, addr, cmds, idxs, asking)
+			if err != nil {
+				for _, i := range idxs {
+					errs[i] = err
+				}
+				// Node might have failed and its slots might
+				// be served by another node now.
+				if ctx.Err() == nil {
+					refresh = true
+				}
+				continue
+			}
+			for n, i := range idxs {
+				replies[i], errs[i] = results[n].reply, results[n].err
+				rerr, ok := errs[i].(redis.Error)
+				if !ok {
+					continue
+				}
+				switch kind, slot, target := parseRedirect(rerr); kind {
+				case "MOVED":
+					c.mu.Lock()
+					c.slots[slot] = target
+					c.mu.Unlock()
+					refresh = true
+					retry = append(retry, i)
+				case "ASK":
+					ask[i] = target
+					retry = append(retry, i)
+				case "TRYAGAIN":
+					retry = append(retry, i)
+				}
+			}
+		}
+		if len(retry) > 0 && attempt > 0 {
+			// Give the cluster time to settle, for example to finish
+			// migrating keys of a slot.
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Duration(attempt) * 10 * time.Millisecond):
+			}
+		}
+		pending = retry
+	}
+
+	if refresh {
+		// MOVED means slots were reassigned, most likely more than the
+		// one reported, and a node that cannot be reached might have
+		// been replaced, so load the whole map again.
+		c.refreshInBackground(ctx)
+	}
+	return replies, errs
+}
+
+type cmdResult struct {
+	reply interface{}
+	err   error
+}
+
+// send writes commands of given indexes to the node with given address and
+// returns their results. Error is returned only if the node cannot be used.
+func (c *Cluster) send(ctx context.Context, addr string, cmds []clusterCmd, idxs []int, asking map[int]string) ([]cmdResult, error) {
+	rc, err := c.pool(addr).GetContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(ErrRedis, "cannot get connection to %s: %s", addr, err)
+	}
+	defer rc.Close()
+
+	for _, i := range idxs {
+		if _, ok := asking[i]; ok {
+			if err := rc.Send("ASKING"); err != nil {
+				return nil, errors.Wrap(ErrRedis, "%s: cannot send: %s", addr, err)
+			}
+		}
+		if err := rc.Send(cmds[i].name, cmds[i].args...); err != nil {
+			return nil, errors.Wrap(ErrRedis, "%s: cannot send: %s", addr, err)
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return nil, errors.Wrap(ErrRedis, "%s: cannot flush: %s", addr, err)
+	}
+
+	results := make([]cmdResult, len(idxs))
+	for n, i := range idxs {
+		if _, ok := asking[i]; ok {
+			if _, err := rc.Receive(); err != nil {
+				if _, ok := err.(redis.Error); !ok {
+					return nil, errors.Wrap(ErrRedis, "%s: cannot receive: %s", addr, err)
+				}
+			}
+		}
+		reply, err := rc.Receive()
+		if err != nil {
+			if _, ok := err.(redis.Error); !ok {
+				return nil, errors.Wrap(ErrRedis, "%s: cannot receive: %s", addr, err)
+			}
+		}
+		results[n] = cmdResult{reply: reply, err: err}
+	}
+	return results, nil
+}
+
+// parseRedirect returns redirection kind, slot and target node address of
+// given error reply. Empty kind is returned if error is not a redirection.
+func parseRedirect(err redis.Error) (kind string, slot int, addr string) {
+	chunks := strings.Fields(string(err))
+	if len(chunks) == 0 {
+		return "", 0, ""
+	}
+	switch chunks[0] {
+	case "MOVED", "ASK":
+		if len(chunks) != 3 {
+			return "", 0, ""
+		}
+		slot, err := strconv.Atoi(chunks[1])
+		if err != nil || slot < 0 || slot >= clusterSlots {
+			return "", 0, ""
+		}
+		return chunks[0], slot, chunks[2]
+	case "TRYAGAIN":
+		return chunks[0], 0, ""
+	default:
+		return "", 0, ""
+	}
+}
+
+// crc16 returns CRC-16/XMODEM checksum of given string, as used by Redis
+// Cluster for key hashing.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,226 @@
+package rediscache
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/gomodule/redigo/redis"
+)
+
+// NewClusterCache returns a CacheService implementation that is using given
+// Redis Cluster as a storage backend. Returned cache implements
+// BatchCacheService and CounterCache. Batch operations are split into one
+// pipeline per node, so keys do not have to share a hash slot.
+func NewClusterCache(cluster *Cluster) surf.CacheService {
+	return &clusterCache{
+		cluster: cluster,
+	}
+}
+
+type clusterCache struct {
+	cluster *Cluster
+}
+
+var (
+	_ surf.BatchCacheService = (*clusterCache)(nil)
+	_ surf.CounterCache      = (*clusterCache)(nil)
+)
+
+// do executes a single key command. Key is transformed using buildKey and
+// passed as the first argument.
+func (c *clusterCache) do(ctx context.Context, cmd, key string, args ...interface{}) (interface{}, error) {
+	key = buildKey(key)
+	return c.cluster.Do(ctx, key, cmd, append([]interface{}{key}, args...)...)
+}
+
+func (c *clusterCache) Get(ctx context.Context, key string, dest interface{}) error {
+	raw, err := redis.Bytes(c.do(ctx, "GET", key))
+	switch err {
+	case nil:
+		// all good
+	case redis.ErrNil:
+		return ErrMiss
+	default:
+		return errors.Wrap(ErrRedis, "cannot GET: %s", err)
+	}
+	return surf.CacheUnmarshal(raw, dest)
+}
+
+func (c *clusterCache) Set(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	raw, err := surf.CacheMarshal(value)
+	if err != nil {
+		return err
+	}
+	if exp <= 0 {
+		// Value expires immediately.
+		if _, err := c.do(ctx, "DEL", key); err != nil {
+			return errors.Wrap(ErrRedis, "cannot delete: %s", err)
+		}
+		return nil
+	}
+	if _, err := c.do(ctx, "SET", key, raw, "PX", milliseconds(exp)); err != nil {
+		return errors.Wrap(ErrRedis, "cannot SET: %s", err)
+	}
+	return nil
+}
+
+func (c *clusterCache) SetNx(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	raw, err := surf.CacheMarshal(value)
+	if err != nil {
+		return err
+	}
+	if exp <= 0 {
+		// Value expires immediately, so only the conflict is reported.
+		switch n, err := redis.Int(c.do(ctx, "EXISTS", key)); {
+		case err != nil:
+			return errors.Wrap(ErrRedis, "cannot check key: %s", err)
+		case n > 0:
+			return ErrConflict
+		default:
+			return nil
+		}
+	}
+	resp, err := c.do(ctx, "SET", key, raw, "PX", milliseconds(exp), "NX")
+	if err != nil {
+		return errors.Wrap(ErrRedis, "cannot SET: %s", err)
+	}
+	// null reply means the key is in use
+	if resp == nil {
+		return ErrConflict
+	}
+	return nil
+}
+
+func (c *clusterCache) Del(ctx context.Context, key string) error {
+	n, err := redis.Int(c.do(ctx, "DEL", key))
+	if err != nil {
+		return errors.Wrap(ErrRedis, "cannot delete: %s", err)
+	}
+	if n == 0 {
+		return ErrMiss
+	}
+	return nil
+}
+
+func (c *clusterCache) GetMulti(ctx context.Context, keys []string, dests []interface{}) ([]error, error) {
+	if len(keys) != len(dests) {
+		return nil, errors.Wrap(surf.ErrValidation, "%d keys and %d destinations", len(keys), len(dests))
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	cmds := make([]clusterCmd, len(keys))
+	for i, key := range keys {
+		key = buildKey(key)
+		cmds[i] = clusterCmd{key: key, name: "GET", args: []interface{}{key}}
+	}
+	replies, cmdErrs := c.cluster.pipeline(ctx, cmds)
+
+	errs := make([]error, len(keys))
+	for i := range keys {
+		raw, err := redis.Bytes(replies[i], cmdErrs[i])
+		switch err {
+		case nil:
+			errs[i] = surf.CacheUnmarshal(raw, dests[i])
+		case redis.ErrNil:
+			errs[i] = ErrMiss
+		default:
+			return nil, errors.Wrap(ErrRedis, "cannot GET: %s", err)
+		}
+	}
+	return errs, nil
+}
+
+func (c *clusterCache) SetMulti(ctx context.Context, items []surf.CacheItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	cmds := make([]clusterCmd, len(items))
+	for i, it := range items {
+		raw, err := surf.CacheMarshal(it.Value)
+		if err != nil {
+			return err
+		}
+		key := buildKey(it.Key)
+		if it.Exp <= 0 {
+			cmds[i] = clusterCmd{key: key, name: "DEL", args: []interface{}{key}}
+			continue
+		}
+		cmds[i] = clusterCmd{
+			key:  key,
+			name: "SET",
+			args: []interface{}{key, raw, "PX", milliseconds(it.Exp)},
+		}
+	}
+	_, errs := c.cluster.pipeline(ctx, cmds)
+	for _, err := range errs {
+		if err != nil {
+			return errors.Wrap(ErrRedis, "cannot SET: %s", err)
+		}
+	}
+	return nil
+}
+
+func (c *clusterCache) DelMulti(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	cmds := make([]clusterCmd, len(keys))
+	for i, key := range keys {
+		key = buildKey(key)
+		cmds[i] = clusterCmd{key: key, name: "DEL", args: []interface{}{key}}
+	}
+	_, errs := c.cluster.pipeline(ctx, cmds)
+	for _, err := range errs {
+		if err != nil {
+			return errors.Wrap(ErrRedis, "cannot delete: %s", err)
+		}
+	}
+	return nil
+}
+
+func (c *clusterCache) Incr(ctx context.Context, key string, delta int64, exp time.Duration) (int64, error) {
+	n, err := redis.Int64(c.eval(ctx, incrScriptSrc, key, delta, counterMilliseconds(exp)))
+	if err != nil {
+		if _, ok := err.(redis.Error); ok {
+			// stored value is not an integer
+			return 0, errors.Wrap(surf.ErrCacheMalformed, "cannot INCRBY: %s", err)
+		}
+		return 0, errors.Wrap(ErrRedis, "cannot INCRBY: %s", err)
+	}
+	return n, nil
+}
+
+func (c *clusterCache) CompareAndSwap(ctx context.Context, key string, old, value interface{}, exp time.Duration) error {
+	rawOld, err := surf.CacheMarshal(old)
+	if err != nil {
+		return err
+	}
+	raw, err := surf.CacheMarshal(value)
+	if err != nil {
+		return err
+	}
+
+	switch res, err := redis.Int(c.eval(ctx, casScriptSrc, key, rawOld, raw, milliseconds(exp))); {
+	case err != nil:
+		return errors.Wrap(ErrRedis, "cannot compare and swap: %s", err)
+	case res == -1:
+		return ErrMiss
+	case res == 0:
+		return ErrConflict
+	default:
+		return nil
+	}
+}
+
+// eval executes given script with a single key. Script source is always
+// sent, so that scripts do not have to be loaded on every node first.
+func (c *clusterCache) eval(ctx context.Context, src, key string, args ...interface{}) (interface{}, error) {
+	key = buildKey(key)
+	return c.cluster.Do(ctx, key, "EVAL", append([]interface{}{src, 1, key}, args...)...)
+}
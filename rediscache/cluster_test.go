@@ -0,0 +1,328 @@
+package rediscache
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/gomodule/redigo/redis"
+)
+
+// stubCluster is a set of stub nodes sharing a slot assignment. Slots can
+// be moved between nodes, or be in the middle of a migration.
+type stubCluster struct {
+	t     *testing.T
+	nodes []*stubServer
+
+	mu        sync.Mutex
+	owner     [clusterSlots]int
+	migrating map[int]int
+}
+
+// startStubCluster returns cluster with slots evenly assigned to given
+// number of nodes.
+func startStubCluster(t *testing.T, nodes int) *stubCluster {
+	c := &stubCluster{
+		t:         t,
+		migrating: make(map[int]int),
+	}
+	for i := 0; i < nodes; i++ {
+		i := i
+		store := newStubStore()
+		c.nodes = append(c.nodes, startStubServer(t, func(sc *stubConn, args []string) interface{} {
+			return c.handle(i, store, sc, args)
+		}))
+	}
+	for slot := range c.owner {
+		c.owner[slot] = slot * nodes / clusterSlots
+	}
+	return c
+}
+
+func (c *stubCluster) handle(node int, store *stubStore, sc *stubConn, args []string) interface{} {
+	asking := sc.asking
+	sc.asking = false
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return FakeStatus("PONG")
+	case "ASKING":
+		sc.asking = true
+		return FakeStatus("OK")
+	case "CLUSTER":
+		return c.slotsReply()
+	}
+
+	key := args[1]
+	if strings.HasPrefix(strings.ToUpper(args[0]), "EVAL") {
+		key = args[3]
+	}
+	slot := Slot(key)
+	owner := c.owner[slot]
+	target, migrating := c.migrating[slot]
+	switch {
+	case owner == node:
+		// Keys already migrated are served by the target node.
+		if migrating && !store.has(key) {
+			return redis.Error("ASK " + strconv.Itoa(slot) + " " + c.nodes[target].Addr())
+		}
+	case migrating && target == node && asking:
+		// importing slot
+	default:
+		return redis.Error("MOVED " + strconv.Itoa(slot) + " " + c.nodes[owner].Addr())
+	}
+	return store.exec(args)
+}
+
+func (c *stubCluster) slotsReply() interface{} {
+	var ranges []interface{}
+	start := 0
+	for slot := 1; slot <= clusterSlots; slot++ {
+		if slot < clusterSlots && c.owner[slot] == c.owner[start] {
+			continue
+		}
+		host, port := splitAddr(c.t, c.nodes[c.owner[start]].Addr())
+		ranges = append(ranges, []interface{}{
+			int64(start), int64(slot - 1),
+			[]interface{}{[]byte(host), int64(port), []byte("node-" + strconv.Itoa(c.owner[start]))},
+		})
+		start = slot
+	}
+	return ranges
+}
+
+// move assigns slot of given key to given node.
+func (c *stubCluster) move(key string, node int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	slot := Slot(key)
+	c.owner[slot] = node
+	delete(c.migrating, slot)
+}
+
+// migrate marks slot of given key as migrating to given node.
+func (c *stubCluster) migrate(key string, node int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.migrating[Slot(key)] = node
+}
+
+func (c *stubCluster) addrs() []string {
+	addrs := make([]string, len(c.nodes))
+	for i, n := range c.nodes {
+		addrs[i] = n.Addr()
+	}
+	return addrs
+}
+
+func TestSlot(t *testing.T) {
+	cases := map[string]int{
+		// values as computed by CLUSTER KEYSLOT
+		"":                 0,
+		"foo":              12182,
+		"123456789":        12739,
+		"{foo}.a":          12182,
+		"x{foo}{bar}":      12182,
+		"foo{{bar}}zap":    Slot("{bar"),
+		"foo{}{bar}":       int(crc16("foo{}{bar}") % clusterSlots),
+		"no{closing brace": int(crc16("no{closing brace") % clusterSlots),
+	}
+	for key, want := range cases {
+		if got := Slot(key); got != want {
+			t.Errorf("%q: want slot %d, got %d", key, want, got)
+		}
+	}
+}
+
+func TestClusterCache(t *testing.T) {
+	c := startStubCluster(t, 3)
+	cluster, err := NewCluster(c.addrs()[:1], nil)
+	if err != nil {
+		t.Fatalf("cannot create cluster: %s", err)
+	}
+	defer cluster.Close()
+
+	surf.RunCacheConformanceTest(t, NewClusterCache(cluster), &surf.CacheCapabilities{
+		Batch:    true,
+		Counters: true,
+	})
+}
+
+func TestClusterMoved(t *testing.T) {
+	ctx := context.Background()
+
+	c := startStubCluster(t, 2)
+	cluster, err := NewCluster(c.addrs(), nil)
+	if err != nil {
+		t.Fatalf("cannot create cluster: %s", err)
+	}
+	defer cluster.Close()
+	cache := NewClusterCache(cluster)
+
+	// "foo" is served by the second node
+	if err := cache.Set(ctx, "foo", "1", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	c.move("foo", 0)
+
+	if err := cache.Set(ctx, "foo", "2", time.Minute); err != nil {
+		t.Fatalf("cannot set after slot was moved: %s", err)
+	}
+	var val string
+	if err := cache.Get(ctx, "foo", &val); err != nil || val != "2" {
+		t.Fatalf("want 2, got %q, %v", val, err)
+	}
+
+	cluster.mu.RLock()
+	addr := cluster.slots[Slot("foo")]
+	cluster.mu.RUnlock()
+	if addr != c.nodes[0].Addr() {
+		t.Fatalf("slot map not updated, slot served by %s", addr)
+	}
+}
+
+func TestClusterAsk(t *testing.T) {
+	ctx := context.Background()
+
+	c := startStubCluster(t, 2)
+	cluster, err := NewCluster(c.addrs(), nil)
+	if err != nil {
+		t.Fatalf("cannot create cluster: %s", err)
+	}
+	defer cluster.Close()
+	cache := NewClusterCache(cluster)
+
+	// "{tag}a" and "{tag}b" share a slot served by the first node
+	c.move("{tag}", 0)
+	if err := cache.Set(ctx, "{tag}a", "a", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	c.migrate("{tag}a", 1)
+
+	// Key not present in the migrating node is written to the importing
+	// one.
+	if err := cache.Set(ctx, "{tag}b", "b", time.Minute); err != nil {
+		t.Fatalf("cannot set during migration: %s", err)
+	}
+	var a, b string
+	errs, err := cache.(surf.BatchCacheService).GetMulti(ctx, []string{"{tag}a", "{tag}b"}, []interface{}{&a, &b})
+	if err != nil {
+		t.Fatalf("cannot get: %s", err)
+	}
+	if errs[0] != nil || a != "a" || errs[1] != nil || b != "b" {
+		t.Fatalf("want a and b, got %q, %q, %v", a, b, errs)
+	}
+
+	// ASK redirection must not update the slot map.
+	cluster.mu.RLock()
+	addr := cluster.slots[Slot("{tag}")]
+	cluster.mu.RUnlock()
+	if addr != c.nodes[0].Addr() {
+		t.Fatalf("slot map updated by ASK, slot served by %s", addr)
+	}
+
+	c.move("{tag}", 1)
+	if err := cache.Get(ctx, "{tag}b", &b); err != nil || b != "b" {
+		t.Fatalf("want b after migration, got %q, %v", b, err)
+	}
+}
+
+func TestClusterUnavailable(t *testing.T) {
+	unavailable := startStubServer(t, nil)
+	unavailable.Close()
+
+	cluster, err := NewCluster([]string{unavailable.Addr()}, &ClusterOpts{Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("cannot create cluster: %s", err)
+	}
+	defer cluster.Close()
+
+	var val string
+	if err := NewClusterCache(cluster).Get(context.Background(), "a", &val); !ErrRedis.Is(err) {
+		t.Fatalf("want ErrRedis, got %+v", err)
+	}
+}
+
+func TestClusterNodeFailure(t *testing.T) {
+	ctx := context.Background()
+
+	c := startStubCluster(t, 2)
+	cluster, err := NewCluster(c.addrs(), &ClusterOpts{Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("cannot create cluster: %s", err)
+	}
+	defer cluster.Close()
+	cache := NewClusterCache(cluster)
+
+	// "foo" is served by the second node
+	if err := cache.Set(ctx, "foo", "1", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+
+	// Slot is taken over by the first node after the second one failed.
+	c.move("foo", 0)
+	c.nodes[1].Close()
+
+	if err := cache.Set(ctx, "foo", "2", time.Minute); !ErrRedis.Is(err) {
+		t.Fatalf("want ErrRedis, got %+v", err)
+	}
+	for deadline := time.Now().Add(time.Second); ; {
+		cluster.mu.RLock()
+		addr := cluster.slots[Slot("foo")]
+		cluster.mu.RUnlock()
+		if addr == c.nodes[0].Addr() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slot map not refreshed, slot served by %s", addr)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := cache.Set(ctx, "foo", "2", time.Minute); err != nil {
+		t.Fatalf("cannot set after failover: %s", err)
+	}
+}
+
+func TestClusterRefreshCoalesced(t *testing.T) {
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	slotsCalls := 0
+	c := startStubCluster(t, 1)
+	release := make(chan struct{})
+	slow := startStubServer(t, func(sc *stubConn, args []string) interface{} {
+		mu.Lock()
+		slotsCalls++
+		mu.Unlock()
+		<-release
+		return c.slotsReply()
+	})
+
+	cluster, err := NewCluster([]string{slow.Addr()}, nil)
+	if err != nil {
+		t.Fatalf("cannot create cluster: %s", err)
+	}
+	defer cluster.Close()
+
+	for i := 0; i < 10; i++ {
+		cluster.refreshInBackground(ctx)
+	}
+	close(release)
+	for atomic.LoadInt32(&cluster.refreshPending) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if slotsCalls != 1 {
+		t.Fatalf("want one refresh, got %d", slotsCalls)
+	}
+}
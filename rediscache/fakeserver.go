@@ -0,0 +1,633 @@
+package rediscache
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// FakeServer is an in-process redis server implementing commands used by
+// surf: PING, GET, SET (with EX, PX, NX and XX), DEL, EXISTS, MGET, INCR,
+// INCRBY, EXPIRE, PEXPIRE, TTL, PTTL, FLUSHALL, PUBLISH, SUBSCRIBE,
+// UNSUBSCRIBE, EVAL, EVALSHA and SCRIPT LOAD. It is meant to be used in tests
+// only.
+//
+// Lua is not supported. Instead, scripts are recognized by their source and
+// executed by a Go implementation. Scripts used by this package are always
+// supported, others must be provided using RegisterScript.
+//
+// Expiration is using the server clock, which can be moved forward with
+// Advance, so that tests do not have to sleep.
+type FakeServer struct {
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mu      sync.Mutex
+	offset  time.Duration
+	items   map[string]fakeItem
+	conns   map[*fakeConn]struct{}
+	subs    map[string]map[*fakeConn]struct{}
+	scripts map[string]FakeScript
+}
+
+// FakeScript is a Go implementation of a Lua script, executed atomically by
+// the fake server. Call executes a command, like redis.call does in Lua, and
+// returns its reply. Replies are nil, int64, []byte, []interface{},
+// redis.Error or a status string of FakeStatus type.
+type FakeScript func(call func(args ...string) interface{}, keys, args []string) interface{}
+
+// FakeStatus is a simple string reply, for example OK.
+type FakeStatus string
+
+type fakeItem struct {
+	value []byte
+	expAt time.Time
+}
+
+// fakeScripts are Go implementations of scripts used by this package.
+var fakeScripts = map[string]FakeScript{
+	scriptSHA(incrScriptSrc): func(call func(...string) interface{}, keys, args []string) interface{} {
+		created := call("EXISTS", keys[0]) == int64(0)
+		n := call("INCRBY", keys[0], args[0])
+		if _, ok := n.(redis.Error); ok {
+			return n
+		}
+		if created && args[1] != "0" {
+			call("PEXPIRE", keys[0], args[1])
+		}
+		return n
+	},
+	scriptSHA(casScriptSrc): func(call func(...string) interface{}, keys, args []string) interface{} {
+		current, ok := call("GET", keys[0]).([]byte)
+		if !ok {
+			return int64(-1)
+		}
+		if string(current) != args[0] {
+			return int64(0)
+		}
+		call("SET", keys[0], args[1], "PX", args[2])
+		return int64(1)
+	},
+	scriptSHA(acquireScriptSrc): func(call func(...string) interface{}, keys, args []string) interface{} {
+		if call("EXISTS", keys[0]) == int64(1) {
+			return int64(0)
+		}
+		fence := call("INCR", keys[1])
+		call("SET", keys[0], args[0], "PX", args[1])
+		return fence
+	},
+	scriptSHA(releaseScriptSrc): func(call func(...string) interface{}, keys, args []string) interface{} {
+		if current, ok := call("GET", keys[0]).([]byte); ok && string(current) == args[0] {
+			return call("DEL", keys[0])
+		}
+		return int64(0)
+	},
+	scriptSHA(extendScriptSrc): func(call func(...string) interface{}, keys, args []string) interface{} {
+		if current, ok := call("GET", keys[0]).([]byte); ok && string(current) == args[0] {
+			return call("PEXPIRE", keys[0], args[1])
+		}
+		return int64(0)
+	},
+}
+
+// StartFakeServer starts a fake redis server listening on a random local
+// port.
+func StartFakeServer() (*FakeServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &FakeServer{
+		ln:      ln,
+		items:   make(map[string]fakeItem),
+		conns:   make(map[*fakeConn]struct{}),
+		subs:    make(map[string]map[*fakeConn]struct{}),
+		scripts: make(map[string]FakeScript),
+	}
+	for sha, fn := range fakeScripts {
+		s.scripts[sha] = fn
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns address the server is listening on.
+func (s *FakeServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Pool returns a connection pool of this server.
+func (s *FakeServer) Pool() *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 10 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", s.Addr())
+		},
+	}
+}
+
+// Close stops the server and closes all client connections.
+func (s *FakeServer) Close() error {
+	err := s.ln.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.nc.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// CloseConnections closes all client connections, as if the network
+// failed, while the server keeps running.
+func (s *FakeServer) CloseConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.nc.Close()
+	}
+}
+
+// Now returns current time of the server clock.
+func (s *FakeServer) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now()
+}
+
+func (s *FakeServer) now() time.Time {
+	return time.Now().Add(s.offset)
+}
+
+// Advance moves the server clock forward by given duration.
+func (s *FakeServer) Advance(d time.Duration) {
+	s.mu.Lock()
+	s.offset += d
+	s.mu.Unlock()
+}
+
+// RegisterScript registers Go implementation of a Lua script with given
+// source.
+func (s *FakeServer) RegisterScript(src string, fn FakeScript) {
+	s.mu.Lock()
+	s.scripts[scriptSHA(src)] = fn
+	s.mu.Unlock()
+}
+
+func scriptSHA(src string) string {
+	h := sha1.Sum([]byte(src))
+	return hex.EncodeToString(h[:])
+}
+
+type fakeConn struct {
+	nc net.Conn
+
+	// wmu serializes writes, because messages of subscribed channels are
+	// written by publishing connections.
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	// channels is the set of subscribed channels, guarded by server mutex.
+	channels map[string]struct{}
+}
+
+func (c *fakeConn) write(reply interface{}) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	writeFakeReply(c.w, reply)
+	return c.w.Flush()
+}
+
+func (s *FakeServer) serve() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &fakeConn{
+			nc:       nc,
+			w:        bufio.NewWriter(nc),
+			channels: make(map[string]struct{}),
+		}
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(c)
+
+			s.mu.Lock()
+			delete(s.conns, c)
+			for channel := range c.channels {
+				delete(s.subs[channel], c)
+			}
+			s.mu.Unlock()
+			nc.Close()
+		}()
+	}
+}
+
+func (s *FakeServer) handle(c *fakeConn) {
+	r := bufio.NewReader(c.nc)
+	for {
+		args, err := readFakeCommand(r)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "QUIT":
+			c.write(FakeStatus("OK"))
+			return
+		case "SUBSCRIBE":
+			if len(args) < 2 {
+				c.write(wrongArgs(args[0]))
+				continue
+			}
+			s.subscribe(c, args[1:])
+		case "UNSUBSCRIBE":
+			s.unsubscribe(c, args[1:])
+		case "PUBLISH":
+			if len(args) != 3 {
+				c.write(wrongArgs(args[0]))
+				continue
+			}
+			c.write(s.publish(args[1], args[2]))
+		default:
+			s.mu.Lock()
+			subscribed := len(c.channels) > 0
+			s.mu.Unlock()
+			if subscribed {
+				c.write(redis.Error("ERR only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT allowed in this context"))
+				continue
+			}
+			s.mu.Lock()
+			reply := s.exec(args)
+			s.mu.Unlock()
+			if err := c.write(reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *FakeServer) subscribe(c *fakeConn, channels []string) {
+	for _, channel := range channels {
+		s.mu.Lock()
+		if s.subs[channel] == nil {
+			s.subs[channel] = make(map[*fakeConn]struct{})
+		}
+		s.subs[channel][c] = struct{}{}
+		c.channels[channel] = struct{}{}
+		count := int64(len(c.channels))
+		s.mu.Unlock()
+		c.write([]interface{}{[]byte("subscribe"), []byte(channel), count})
+	}
+}
+
+func (s *FakeServer) unsubscribe(c *fakeConn, channels []string) {
+	if len(channels) == 0 {
+		s.mu.Lock()
+		for channel := range c.channels {
+			channels = append(channels, channel)
+		}
+		s.mu.Unlock()
+		if len(channels) == 0 {
+			c.write([]interface{}{[]byte("unsubscribe"), nil, int64(0)})
+			return
+		}
+	}
+	for _, channel := range channels {
+		s.mu.Lock()
+		delete(s.subs[channel], c)
+		delete(c.channels, channel)
+		count := int64(len(c.channels))
+		s.mu.Unlock()
+		c.write([]interface{}{[]byte("unsubscribe"), []byte(channel), count})
+	}
+}
+
+// publish delivers message to all subscribers of given channel and returns
+// the number of subscribers.
+func (s *FakeServer) publish(channel, message string) interface{} {
+	s.mu.Lock()
+	subscribers := make([]*fakeConn, 0, len(s.subs[channel]))
+	for c := range s.subs[channel] {
+		subscribers = append(subscribers, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range subscribers {
+		c.write([]interface{}{[]byte("message"), []byte(channel), []byte(message)})
+	}
+	return int64(len(subscribers))
+}
+
+// exec executes a single command and returns its reply. Server mutex must be
+// held.
+func (s *FakeServer) exec(args []string) interface{} {
+	now := s.now()
+
+	switch cmd := strings.ToUpper(args[0]); cmd {
+	case "PING":
+		if len(args) > 1 {
+			return []byte(args[1])
+		}
+		return FakeStatus("PONG")
+	case "SELECT", "AUTH":
+		return FakeStatus("OK")
+	case "ROLE":
+		return []interface{}{[]byte("master"), int64(0), []interface{}{}}
+	case "FLUSHALL", "FLUSHDB":
+		s.items = make(map[string]fakeItem)
+		return FakeStatus("OK")
+	case "GET":
+		if len(args) != 2 {
+			return wrongArgs(cmd)
+		}
+		if it, ok := s.get(args[1], now); ok {
+			return it.value
+		}
+		return nil
+	case "MGET":
+		if len(args) < 2 {
+			return wrongArgs(cmd)
+		}
+		values := make([]interface{}, len(args)-1)
+		for i, key := range args[1:] {
+			if it, ok := s.get(key, now); ok {
+				values[i] = it.value
+			}
+		}
+		return values
+	case "SET":
+		return s.set(args, now)
+	case "DEL", "EXISTS":
+		if len(args) < 2 {
+			return wrongArgs(cmd)
+		}
+		var n int64
+		for _, key := range args[1:] {
+			if _, ok := s.get(key, now); ok {
+				n++
+				if cmd == "DEL" {
+					delete(s.items, key)
+				}
+			}
+		}
+		return n
+	case "INCR", "INCRBY":
+		delta := "1"
+		if cmd == "INCRBY" {
+			if len(args) != 3 {
+				return wrongArgs(cmd)
+			}
+			delta = args[2]
+		} else if len(args) != 2 {
+			return wrongArgs(cmd)
+		}
+		return s.incr(args[1], delta, now)
+	case "EXPIRE", "PEXPIRE":
+		if len(args) != 3 {
+			return wrongArgs(cmd)
+		}
+		n, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return errNotInteger
+		}
+		it, ok := s.get(args[1], now)
+		if !ok {
+			return int64(0)
+		}
+		unit := time.Millisecond
+		if cmd == "EXPIRE" {
+			unit = time.Second
+		}
+		if n <= 0 {
+			delete(s.items, args[1])
+			return int64(1)
+		}
+		it.expAt = now.Add(time.Duration(n) * unit)
+		s.items[args[1]] = it
+		return int64(1)
+	case "TTL", "PTTL":
+		if len(args) != 2 {
+			return wrongArgs(cmd)
+		}
+		it, ok := s.get(args[1], now)
+		switch {
+		case !ok:
+			return int64(-2)
+		case it.expAt.IsZero():
+			return int64(-1)
+		case cmd == "TTL":
+			return int64((it.expAt.Sub(now) + time.Second/2) / time.Second)
+		default:
+			return int64(it.expAt.Sub(now) / time.Millisecond)
+		}
+	case "EVAL", "EVALSHA":
+		if len(args) < 3 {
+			return wrongArgs(cmd)
+		}
+		sha := args[1]
+		if cmd == "EVAL" {
+			sha = scriptSHA(args[1])
+		}
+		fn, ok := s.scripts[sha]
+		if !ok {
+			if cmd == "EVALSHA" {
+				return redis.Error("NOSCRIPT No matching script. Please use EVAL.")
+			}
+			return redis.Error("ERR script not supported by the fake server")
+		}
+		numKeys, err := strconv.Atoi(args[2])
+		if err != nil || numKeys < 0 || numKeys > len(args)-3 {
+			return redis.Error("ERR Number of keys can't be greater than number of args")
+		}
+		keys := args[3 : 3+numKeys]
+		call := func(args ...string) interface{} { return s.exec(args) }
+		return fn(call, keys, args[3+numKeys:])
+	case "SCRIPT":
+		if len(args) != 3 || strings.ToUpper(args[1]) != "LOAD" {
+			return redis.Error("ERR unknown SCRIPT subcommand")
+		}
+		sha := scriptSHA(args[2])
+		if _, ok := s.scripts[sha]; !ok {
+			return redis.Error("ERR script not supported by the fake server")
+		}
+		return []byte(sha)
+	default:
+		return redis.Error("ERR unknown command '" + args[0] + "'")
+	}
+}
+
+// get returns item stored under given key. Expired items are removed.
+func (s *FakeServer) get(key string, now time.Time) (fakeItem, bool) {
+	it, ok := s.items[key]
+	if !ok {
+		return it, false
+	}
+	if !it.expAt.IsZero() && !now.Before(it.expAt) {
+		delete(s.items, key)
+		return it, false
+	}
+	return it, true
+}
+
+func (s *FakeServer) set(args []string, now time.Time) interface{} {
+	if len(args) < 3 {
+		return wrongArgs(args[0])
+	}
+	key, value := args[1], args[2]
+	var (
+		expAt  time.Time
+		nx, xx bool
+	)
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				return redis.Error("ERR syntax error")
+			}
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+			if n <= 0 {
+				return redis.Error("ERR invalid expire time in 'set' command")
+			}
+			unit := time.Millisecond
+			if opt == "EX" {
+				unit = time.Second
+			}
+			expAt = now.Add(time.Duration(n) * unit)
+		default:
+			return redis.Error("ERR syntax error")
+		}
+	}
+	if nx && xx {
+		return redis.Error("ERR syntax error")
+	}
+
+	_, exists := s.get(key, now)
+	if (nx && exists) || (xx && !exists) {
+		return nil
+	}
+	s.items[key] = fakeItem{value: []byte(value), expAt: expAt}
+	return FakeStatus("OK")
+}
+
+func (s *FakeServer) incr(key, delta string, now time.Time) interface{} {
+	d, err := strconv.ParseInt(delta, 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	it, ok := s.get(key, now)
+	var n int64
+	if ok {
+		if n, err = strconv.ParseInt(string(it.value), 10, 64); err != nil {
+			return errNotInteger
+		}
+	}
+	n += d
+	// expiration time is kept
+	it.value = []byte(strconv.FormatInt(n, 10))
+	s.items[key] = it
+	return n
+}
+
+var errNotInteger = redis.Error("ERR value is not an integer or out of range")
+
+func wrongArgs(cmd string) redis.Error {
+	return redis.Error("ERR wrong number of arguments for '" + strings.ToLower(cmd) + "' command")
+}
+
+// readFakeCommand reads a command sent either as an array of bulk strings or
+// as an inline command.
+func readFakeCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readFakeLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid array length: %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := readFakeLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("bulk string expected: %q", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid bulk string length: %q", line)
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func readFakeLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func writeFakeReply(w *bufio.Writer, reply interface{}) {
+	switch r := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case FakeStatus:
+		fmt.Fprintf(w, "+%s\r\n", r)
+	case redis.Error:
+		fmt.Fprintf(w, "-%s\r\n", r)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", r)
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n", len(r))
+		w.Write(r)
+		w.WriteString("\r\n")
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(r))
+		for _, v := range r {
+			writeFakeReply(w, v)
+		}
+	default:
+		fmt.Fprintf(w, "-ERR unsupported reply type %T\r\n", reply)
+	}
+}
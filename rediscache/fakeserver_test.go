@@ -0,0 +1,168 @@
+package rediscache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/gomodule/redigo/redis"
+)
+
+func startFakeServer(t *testing.T) (*FakeServer, redis.Conn) {
+	t.Helper()
+
+	srv, err := StartFakeServer()
+	if err != nil {
+		t.Fatalf("cannot start fake server: %s", err)
+	}
+	t.Cleanup(func() { srv.Close() })
+
+	rc, err := redis.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("cannot connect: %s", err)
+	}
+	t.Cleanup(func() { rc.Close() })
+	return srv, rc
+}
+
+func TestFakeServerExpiration(t *testing.T) {
+	srv, rc := startFakeServer(t)
+
+	if _, err := rc.Do("SET", "a", "1", "EX", 10); err != nil {
+		t.Fatalf("cannot SET: %s", err)
+	}
+	if _, err := rc.Do("SET", "b", "2"); err != nil {
+		t.Fatalf("cannot SET: %s", err)
+	}
+	if ttl, err := redis.Int(rc.Do("TTL", "a")); err != nil || ttl != 10 {
+		t.Fatalf("want TTL 10, got %d, %v", ttl, err)
+	}
+	if ttl, err := redis.Int(rc.Do("TTL", "b")); err != nil || ttl != -1 {
+		t.Fatalf("want TTL -1, got %d, %v", ttl, err)
+	}
+	if ttl, err := redis.Int(rc.Do("TTL", "missing")); err != nil || ttl != -2 {
+		t.Fatalf("want TTL -2, got %d, %v", ttl, err)
+	}
+
+	srv.Advance(9 * time.Second)
+	if v, err := redis.String(rc.Do("GET", "a")); err != nil || v != "1" {
+		t.Fatalf("want 1, got %q, %v", v, err)
+	}
+	if pttl, err := redis.Int(rc.Do("PTTL", "a")); err != nil || pttl > 1000 || pttl < 900 {
+		t.Fatalf("want PTTL close to 1000, got %d, %v", pttl, err)
+	}
+
+	srv.Advance(time.Second)
+	if _, err := redis.String(rc.Do("GET", "a")); err != redis.ErrNil {
+		t.Fatalf("want expired, got %v", err)
+	}
+
+	if n, err := redis.Int(rc.Do("EXPIRE", "b", 5)); err != nil || n != 1 {
+		t.Fatalf("cannot EXPIRE: %d, %v", n, err)
+	}
+	if n, err := redis.Int(rc.Do("EXPIRE", "missing", 5)); err != nil || n != 0 {
+		t.Fatalf("want 0 for missing key, got %d, %v", n, err)
+	}
+	srv.Advance(5 * time.Second)
+	if n, err := redis.Int(rc.Do("EXISTS", "b")); err != nil || n != 0 {
+		t.Fatalf("want b expired, got %d, %v", n, err)
+	}
+}
+
+func TestFakeServerCommands(t *testing.T) {
+	_, rc := startFakeServer(t)
+
+	if res, err := rc.Do("SET", "a", "1", "PX", 1000, "NX"); err != nil || res != "OK" {
+		t.Fatalf("cannot SET NX: %v, %v", res, err)
+	}
+	if res, err := rc.Do("SET", "a", "2", "NX"); err != nil || res != nil {
+		t.Fatalf("want null reply, got %v, %v", res, err)
+	}
+	if res, err := rc.Do("SET", "missing", "2", "XX"); err != nil || res != nil {
+		t.Fatalf("want null reply, got %v, %v", res, err)
+	}
+	if _, err := rc.Do("SET", "a", "2", "PX", 0); err == nil {
+		t.Fatal("want error for invalid expire time")
+	}
+
+	if n, err := redis.Int64(rc.Do("INCRBY", "a", 41)); err != nil || n != 42 {
+		t.Fatalf("want 42, got %d, %v", n, err)
+	}
+	if n, err := redis.Int64(rc.Do("INCR", "counter")); err != nil || n != 1 {
+		t.Fatalf("want 1, got %d, %v", n, err)
+	}
+	if _, err := rc.Do("SET", "text", "abc"); err != nil {
+		t.Fatalf("cannot SET: %s", err)
+	}
+	if _, err := rc.Do("INCR", "text"); err == nil {
+		t.Fatal("want error incrementing text")
+	}
+
+	values, err := redis.Strings(rc.Do("MGET", "a", "missing", "counter"))
+	if err != nil {
+		t.Fatalf("cannot MGET: %s", err)
+	}
+	if want := []string{"42", "", "1"}; values[0] != want[0] || values[1] != want[1] || values[2] != want[2] {
+		t.Fatalf("want %q, got %q", want, values)
+	}
+
+	if n, err := redis.Int(rc.Do("DEL", "a", "missing", "counter")); err != nil || n != 2 {
+		t.Fatalf("want 2 deleted, got %d, %v", n, err)
+	}
+	if _, err := rc.Do("UNKNOWN"); err == nil {
+		t.Fatal("want error for unknown command")
+	}
+}
+
+func TestFakeServerScripts(t *testing.T) {
+	srv, rc := startFakeServer(t)
+
+	const src = `return redis.call("SET", KEYS[1], ARGV[1])`
+	script := redis.NewScript(1, src)
+	if _, err := script.Do(rc, "a", "1"); err == nil {
+		t.Fatal("want error for unsupported script")
+	}
+
+	srv.RegisterScript(src, func(call func(...string) interface{}, keys, args []string) interface{} {
+		return call("SET", keys[0], args[0])
+	})
+	// EVALSHA fails with NOSCRIPT and script falls back to EVAL
+	if res, err := redis.String(script.Do(rc, "a", "1")); err != nil || res != "OK" {
+		t.Fatalf("cannot run script: %q, %v", res, err)
+	}
+	if err := script.Load(rc); err != nil {
+		t.Fatalf("cannot load script: %s", err)
+	}
+	if v, err := redis.String(rc.Do("GET", "a")); err != nil || v != "1" {
+		t.Fatalf("want 1, got %q, %v", v, err)
+	}
+}
+
+func TestFakeServerCounterExpiration(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := StartFakeServer()
+	if err != nil {
+		t.Fatalf("cannot start fake server: %s", err)
+	}
+	defer srv.Close()
+	pool := srv.Pool()
+	defer pool.Close()
+	cache := NewRedisCache(pool).(surf.CounterCache)
+
+	if _, err := cache.Incr(ctx, "counter", 1, time.Minute); err != nil {
+		t.Fatalf("cannot increment: %s", err)
+	}
+	srv.Advance(30 * time.Second)
+	// expiration time is set only when counter is created
+	if _, err := cache.Incr(ctx, "counter", 1, time.Minute); err != nil {
+		t.Fatalf("cannot increment: %s", err)
+	}
+	srv.Advance(30 * time.Second)
+
+	var n int64
+	if err := cache.Get(ctx, "counter", &n); err != ErrMiss {
+		t.Fatalf("want counter expired, got %d, %v", n, err)
+	}
+}
@@ -0,0 +1,136 @@
+package rediscache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/gomodule/redigo/redis"
+)
+
+// NewRedisLocker returns surf.Locker implementation that is using given
+// redis pool. Each operation is a single script, so acquiring a lock and
+// generating its fencing token is atomic and only the owner can release or
+// extend a lock. Fencing token counters never expire.
+func NewRedisLocker(pool *redis.Pool) surf.Locker {
+	return &redisLocker{pool: pool}
+}
+
+type redisLocker struct {
+	pool *redis.Pool
+}
+
+// lockKeys returns key of the lock and of its fencing token counter. Both
+// keys share a hash tag, so that they are stored in the same slot of a
+// cluster.
+func lockKeys(name string) (string, string) {
+	key := "surf-lock:{" + name + "}"
+	return key, key + ":fence"
+}
+
+// acquireScriptSrc sets the lock if not set and returns a new fencing token.
+// It returns 0 if the lock is held.
+const acquireScriptSrc = `
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+local fence = redis.call("INCR", KEYS[2])
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return fence
+`
+
+var acquireScript = redis.NewScript(2, acquireScriptSrc)
+
+// releaseScriptSrc deletes the lock only if it is held by the owner of
+// given token. It returns 1 if the lock was deleted.
+const releaseScriptSrc = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`
+
+var releaseScript = redis.NewScript(1, releaseScriptSrc)
+
+// extendScriptSrc sets expiration time of the lock only if it is held by
+// the owner of given token. It returns 1 if the lock was extended.
+const extendScriptSrc = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`
+
+var extendScript = redis.NewScript(1, extendScriptSrc)
+
+func (l *redisLocker) Acquire(ctx context.Context, name string, ttl time.Duration) (*surf.Lock, error) {
+	token, err := lockToken()
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := l.pool.GetContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(ErrRedis, "cannot get connection: %s", err)
+	}
+	defer rc.Close()
+
+	key, fenceKey := lockKeys(name)
+	fence, err := redis.Int64(acquireScript.Do(rc, key, fenceKey, token, milliseconds(ttl)))
+	switch {
+	case err != nil:
+		return nil, errors.Wrap(ErrRedis, "cannot acquire lock: %s", err)
+	case fence == 0:
+		return nil, surf.ErrLocked
+	default:
+		return &surf.Lock{Name: name, Token: token, Fence: fence}, nil
+	}
+}
+
+func (l *redisLocker) Release(ctx context.Context, lock *surf.Lock) error {
+	rc, err := l.pool.GetContext(ctx)
+	if err != nil {
+		return errors.Wrap(ErrRedis, "cannot get connection: %s", err)
+	}
+	defer rc.Close()
+
+	key, _ := lockKeys(lock.Name)
+	switch n, err := redis.Int(releaseScript.Do(rc, key, lock.Token)); {
+	case err != nil:
+		return errors.Wrap(ErrRedis, "cannot release lock: %s", err)
+	case n == 0:
+		return surf.ErrLockLost
+	default:
+		return nil
+	}
+}
+
+func (l *redisLocker) Extend(ctx context.Context, lock *surf.Lock, ttl time.Duration) error {
+	rc, err := l.pool.GetContext(ctx)
+	if err != nil {
+		return errors.Wrap(ErrRedis, "cannot get connection: %s", err)
+	}
+	defer rc.Close()
+
+	key, _ := lockKeys(lock.Name)
+	switch n, err := redis.Int(extendScript.Do(rc, key, lock.Token, milliseconds(ttl))); {
+	case err != nil:
+		return errors.Wrap(ErrRedis, "cannot extend lock: %s", err)
+	case n == 0:
+		return surf.ErrLockLost
+	default:
+		return nil
+	}
+}
+
+// lockToken returns a random owner token.
+func lockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(surf.ErrInternal, "cannot read random data: %s", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,59 @@
+package rediscache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-surf/surf"
+)
+
+func TestRedisLocker(t *testing.T) {
+	pool := EnsureRedis(t)
+	defer pool.Close()
+
+	surf.RunLockerImplementationTest(t, NewRedisLocker(pool))
+}
+
+func TestRedisCacheLocker(t *testing.T) {
+	pool := EnsureRedis(t)
+	defer pool.Close()
+
+	surf.RunLockerImplementationTest(t, surf.NewCacheLocker(NewRedisCache(pool).(surf.CounterCache)))
+}
+
+func TestRedisLockerExpiration(t *testing.T) {
+	ctx := context.Background()
+
+	srv, err := StartFakeServer()
+	if err != nil {
+		t.Fatalf("cannot start fake server: %s", err)
+	}
+	defer srv.Close()
+	pool := srv.Pool()
+	defer pool.Close()
+	l := NewRedisLocker(pool)
+
+	lock, err := l.Acquire(ctx, "lock", time.Minute)
+	if err != nil {
+		t.Fatalf("cannot acquire: %s", err)
+	}
+	srv.Advance(time.Minute)
+
+	next, err := l.Acquire(ctx, "lock", time.Minute)
+	if err != nil {
+		t.Fatalf("cannot acquire expired lock: %s", err)
+	}
+	if next.Fence <= lock.Fence {
+		t.Fatalf("want fencing token greater than %d, got %d", lock.Fence, next.Fence)
+	}
+	if err := l.Extend(ctx, lock, time.Minute); !surf.ErrLockLost.Is(err) {
+		t.Fatalf("want ErrLockLost, got %+v", err)
+	}
+	if err := l.Release(ctx, lock); !surf.ErrLockLost.Is(err) {
+		t.Fatalf("want ErrLockLost, got %+v", err)
+	}
+	if err := l.Release(ctx, next); err != nil {
+		t.Fatalf("cannot release: %s", err)
+	}
+}
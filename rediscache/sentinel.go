@@ -0,0 +1,183 @@
+package rediscache
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/gomodule/redigo/redis"
+)
+
+// SentinelOpts defines options for the Sentinel managed redis pool.
+type SentinelOpts struct {
+	// MaxIdle is the maximum number of idle connections in the pool.
+	// Defaults to 3.
+	MaxIdle int
+
+	// IdleTimeout closes connections that remain idle longer. Defaults to
+	// 4 minutes.
+	IdleTimeout time.Duration
+
+	// Timeout is used for connecting, reading and writing, both to
+	// sentinels and to the master. Defaults to one second.
+	Timeout time.Duration
+
+	// Password is used to authenticate to the master.
+	Password string
+
+	// RoleCheckInterval defines how long a connection can stay idle before
+	// its role is verified again. After a failover, connections to the old
+	// master are discarded once they fail the check. Defaults to one
+	// second. Negative value verifies role every time a connection is
+	// borrowed.
+	RoleCheckInterval time.Duration
+}
+
+// NewSentinelPool returns redis pool connecting to the master of given
+// name, as discovered by asking given sentinels. Each new connection
+// resolves the master address again, so that after a failover new
+// connections are made to the promoted master. Returned pool can be used
+// with NewRedisCache and NewInvalidationBus.
+func NewSentinelPool(sentinelAddrs []string, masterName string, o *SentinelOpts) (*redis.Pool, error) {
+	if len(sentinelAddrs) == 0 {
+		return nil, errors.Wrap(surf.ErrValidation, "no sentinel")
+	}
+	if o == nil {
+		o = &SentinelOpts{}
+	}
+	maxIdle := o.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = 3
+	}
+	idleTimeout := o.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = 4 * time.Minute
+	}
+	timeout := o.Timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	roleCheck := o.RoleCheckInterval
+	if roleCheck == 0 {
+		roleCheck = time.Second
+	}
+
+	s := &sentinel{
+		addrs:      append([]string(nil), sentinelAddrs...),
+		masterName: masterName,
+		dialOpts: []redis.DialOption{
+			redis.DialConnectTimeout(timeout),
+			redis.DialReadTimeout(timeout),
+			redis.DialWriteTimeout(timeout),
+		},
+	}
+	masterOpts := s.dialOpts
+	if o.Password != "" {
+		masterOpts = append(masterOpts[:len(masterOpts):len(masterOpts)], redis.DialPassword(o.Password))
+	}
+
+	return &redis.Pool{
+		MaxIdle:     maxIdle,
+		IdleTimeout: idleTimeout,
+		Dial: func() (redis.Conn, error) {
+			addr, err := s.masterAddr()
+			if err != nil {
+				return nil, err
+			}
+			rc, err := redis.Dial("tcp", addr, masterOpts...)
+			if err != nil {
+				return nil, errors.Wrap(ErrRedis, "cannot connect to master %s: %s", addr, err)
+			}
+			if err := checkMasterRole(rc); err != nil {
+				rc.Close()
+				return nil, err
+			}
+			return rc, nil
+		},
+		TestOnBorrow: func(rc redis.Conn, idleSince time.Time) error {
+			if time.Since(idleSince) < roleCheck {
+				return nil
+			}
+			return checkMasterRole(rc)
+		},
+	}, nil
+}
+
+type sentinel struct {
+	mu         sync.Mutex
+	addrs      []string
+	masterName string
+	dialOpts   []redis.DialOption
+}
+
+// masterAddr returns address of the master, as reported by the first
+// sentinel that knows it. The sentinel that answered is moved to the front,
+// so that it is asked first next time.
+func (s *sentinel) masterAddr() (string, error) {
+	s.mu.Lock()
+	addrs := append([]string(nil), s.addrs...)
+	s.mu.Unlock()
+
+	var lastErr error
+	for _, addr := range addrs {
+		master, err := s.askSentinel(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		s.mu.Lock()
+		for i, a := range s.addrs {
+			if a == addr {
+				copy(s.addrs[1:i+1], s.addrs[:i])
+				s.addrs[0] = addr
+				break
+			}
+		}
+		s.mu.Unlock()
+		return master, nil
+	}
+	return "", errors.Wrap(ErrRedis, "cannot discover master %q: %s", s.masterName, lastErr)
+}
+
+func (s *sentinel) askSentinel(addr string) (string, error) {
+	rc, err := redis.Dial("tcp", addr, s.dialOpts...)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	res, err := redis.Strings(rc.Do("SENTINEL", "get-master-addr-by-name", s.masterName))
+	switch {
+	case err == redis.ErrNil:
+		return "", errors.Wrap(ErrRedis, "%s: unknown master", addr)
+	case err != nil:
+		return "", err
+	case len(res) != 2:
+		return "", errors.Wrap(ErrRedis, "%s: invalid master address: %q", addr, res)
+	default:
+		return net.JoinHostPort(res[0], res[1]), nil
+	}
+}
+
+// checkMasterRole returns an error if given connection is not made to a
+// master instance.
+func checkMasterRole(rc redis.Conn) error {
+	res, err := redis.Values(rc.Do("ROLE"))
+	if err != nil {
+		return errors.Wrap(ErrRedis, "cannot check role: %s", err)
+	}
+	if len(res) == 0 {
+		return errors.Wrap(ErrRedis, "empty role response")
+	}
+	role, err := redis.String(res[0], nil)
+	if err != nil {
+		return errors.Wrap(ErrRedis, "invalid role response: %s", err)
+	}
+	if role != "master" {
+		return errors.Wrap(ErrRedis, "not a master but %s", role)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package rediscache
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/gomodule/redigo/redis"
+)
+
+// stubSentinel is a sentinel together with the instances it monitors. Only
+// one of the instances is the master, others are replicas refusing writes.
+type stubSentinel struct {
+	t         *testing.T
+	sentinel  *stubServer
+	instances []*stubServer
+
+	mu     sync.Mutex
+	master int
+}
+
+func startStubSentinel(t *testing.T, instances int) *stubSentinel {
+	s := &stubSentinel{t: t}
+	for i := 0; i < instances; i++ {
+		i := i
+		store := newStubStore()
+		s.instances = append(s.instances, startStubServer(t, func(sc *stubConn, args []string) interface{} {
+			return s.handleInstance(i, store, args)
+		}))
+	}
+	s.sentinel = startStubServer(t, func(sc *stubConn, args []string) interface{} {
+		if len(args) != 3 || strings.ToUpper(args[0]) != "SENTINEL" || args[1] != "get-master-addr-by-name" {
+			return redis.Error("ERR unknown command")
+		}
+		if args[2] != "mymaster" {
+			return nil
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		host, port := splitAddr(t, s.instances[s.master].Addr())
+		return []interface{}{[]byte(host), []byte(strconv.Itoa(port))}
+	})
+	return s
+}
+
+func (s *stubSentinel) handleInstance(i int, store *stubStore, args []string) interface{} {
+	s.mu.Lock()
+	master := s.master
+	s.mu.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "ROLE":
+		if i == master {
+			return []interface{}{[]byte("master"), int64(0), []interface{}{}}
+		}
+		host, port := splitAddr(s.t, s.instances[master].Addr())
+		return []interface{}{[]byte("slave"), []byte(host), int64(port), []byte("connected"), int64(0)}
+	case "SET", "DEL":
+		if i != master {
+			return redis.Error("READONLY You can't write against a read only replica.")
+		}
+	}
+	return store.exec(args)
+}
+
+// failover promotes instance of given index to be the master.
+func (s *stubSentinel) failover(master int) {
+	s.mu.Lock()
+	s.master = master
+	s.mu.Unlock()
+}
+
+func TestSentinelCache(t *testing.T) {
+	s := startStubSentinel(t, 1)
+	pool, err := NewSentinelPool([]string{s.sentinel.Addr()}, "mymaster", nil)
+	if err != nil {
+		t.Fatalf("cannot create pool: %s", err)
+	}
+	defer pool.Close()
+
+	surf.RunCacheImplementationTest(t, NewRedisCache(pool))
+}
+
+func TestSentinelFailover(t *testing.T) {
+	ctx := context.Background()
+
+	s := startStubSentinel(t, 2)
+	pool, err := NewSentinelPool([]string{s.sentinel.Addr()}, "mymaster", &SentinelOpts{
+		RoleCheckInterval: -1,
+	})
+	if err != nil {
+		t.Fatalf("cannot create pool: %s", err)
+	}
+	defer pool.Close()
+	cache := NewRedisCache(pool)
+
+	if err := cache.Set(ctx, "before", "1", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+
+	s.failover(1)
+
+	// Idle connection to the old master must be discarded and a new one
+	// made to the promoted master.
+	if err := cache.Set(ctx, "after", "2", time.Minute); err != nil {
+		t.Fatalf("cannot set after failover: %s", err)
+	}
+	var val string
+	if err := cache.Get(ctx, "after", &val); err != nil || val != "2" {
+		t.Fatalf("want 2, got %q, %v", val, err)
+	}
+	if err := cache.Get(ctx, "before", &val); err != ErrMiss {
+		t.Fatalf("want value written before failover to be missing from new master, got %q, %v", val, err)
+	}
+}
+
+func TestSentinelUnavailable(t *testing.T) {
+	ctx := context.Background()
+
+	unavailable := startStubServer(t, nil)
+	unavailable.Close()
+	s := startStubSentinel(t, 1)
+
+	// Unavailable sentinel is skipped.
+	pool, err := NewSentinelPool([]string{unavailable.Addr(), s.sentinel.Addr()}, "mymaster", nil)
+	if err != nil {
+		t.Fatalf("cannot create pool: %s", err)
+	}
+	defer pool.Close()
+	if err := NewRedisCache(pool).Set(ctx, "a", "1", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+
+	// Sentinel addresses are required.
+	if _, err := NewSentinelPool(nil, "mymaster", nil); !surf.ErrValidation.Is(err) {
+		t.Fatalf("want ErrValidation, got %+v", err)
+	}
+
+	// Unknown master cannot be discovered.
+	pool, err = NewSentinelPool([]string{s.sentinel.Addr()}, "unknown", nil)
+	if err != nil {
+		t.Fatalf("cannot create pool: %s", err)
+	}
+	defer pool.Close()
+	if err := NewRedisCache(pool).Set(ctx, "a", "1", time.Minute); !ErrRedis.Is(err) {
+		t.Fatalf("want ErrRedis, got %+v", err)
+	}
+}
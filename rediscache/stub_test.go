@@ -0,0 +1,136 @@
+package rediscache
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// stubServer is a scripted stand-in for a redis server. Every command is
+// passed to the handler and its result is written back as a reply, using
+// the same types as FakeServer does.
+type stubServer struct {
+	ln     net.Listener
+	handle func(sc *stubConn, args []string) interface{}
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// stubConn holds state of a single client connection.
+type stubConn struct {
+	asking bool
+}
+
+func startStubServer(t *testing.T, handle func(sc *stubConn, args []string) interface{}) *stubServer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	s := &stubServer{
+		ln:     ln,
+		handle: handle,
+		conns:  make(map[net.Conn]struct{}),
+	}
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *stubServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server and closes all client connections.
+func (s *stubServer) Close() {
+	s.ln.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+func (s *stubServer) serve() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(c)
+	}
+}
+
+func (s *stubServer) serveConn(c net.Conn) {
+	defer func() {
+		c.Close()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}()
+
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+	var sc stubConn
+	for {
+		args, err := readFakeCommand(r)
+		if err != nil {
+			return
+		}
+		writeFakeReply(w, s.handle(&sc, args))
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// stubStore executes key value commands using the fake server
+// implementation.
+type stubStore struct {
+	fs *FakeServer
+}
+
+func newStubStore() *stubStore {
+	return &stubStore{
+		fs: &FakeServer{
+			items:   make(map[string]fakeItem),
+			scripts: fakeScripts,
+		},
+	}
+}
+
+func (s *stubStore) has(key string) bool {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	_, ok := s.fs.get(key, s.fs.now())
+	return ok
+}
+
+func (s *stubStore) exec(args []string) interface{} {
+	s.fs.mu.Lock()
+	defer s.fs.mu.Unlock()
+	return s.fs.exec(args)
+}
+
+// splitAddr returns host and port of given address.
+func splitAddr(t *testing.T, addr string) (string, int) {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("invalid address %q: %s", addr, err)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatalf("invalid port %q: %s", port, err)
+	}
+	return host, n
+}
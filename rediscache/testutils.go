@@ -8,10 +8,10 @@ import (
 	"github.com/gomodule/redigo/redis"
 )
 
-// EnsureRedis creates a redis pool. Only if a pool with a successful
-// connection can be created then the test is continued. If a connection is not
-// successful test is skipped.
-// Redis connection can be set via REDIS_URL environment variable.
+// EnsureRedis creates a redis pool. If REDIS_URL environment variable is
+// set, pool connects to that server and the test is skipped if a connection
+// cannot be made. Otherwise an in-process fake server is started for the
+// duration of the test, so that redis backed code is always exercised.
 // It is the clients responsibility to close the pool when no longer needed.
 func EnsureRedis(t *testing.T) *redis.Pool {
 	t.Helper()
@@ -19,7 +19,12 @@ func EnsureRedis(t *testing.T) *redis.Pool {
 	// https://www.iana.org/assignments/uri-schemes/prov/redis
 	redisURL := os.Getenv("REDIS_URL")
 	if redisURL == "" {
-		redisURL = "redis://localhost:6379"
+		srv, err := StartFakeServer()
+		if err != nil {
+			t.Fatalf("cannot start fake redis server: %s", err)
+		}
+		t.Cleanup(func() { srv.Close() })
+		return srv.Pool()
 	}
 
 	pool := &redis.Pool{
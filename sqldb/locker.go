@@ -0,0 +1,128 @@
+package sqldb
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+)
+
+// NewPostgresLocker returns surf.Locker implementation that is using
+// PostgreSQL session level advisory locks.
+//
+// Each held lock reserves a connection of given database, because advisory
+// lock belongs to the session that acquired it. Lock does not expire, ttl is
+// ignored. Instead, lock is released by the database when its connection
+// is lost, which is detected by Extend.
+//
+// Fencing tokens are transaction IDs, which are increasing across the
+// whole database cluster.
+func NewPostgresLocker(db *sql.DB) surf.Locker {
+	return &postgresLocker{
+		db:    db,
+		conns: make(map[string]*sql.Conn),
+	}
+}
+
+type postgresLocker struct {
+	db *sql.DB
+
+	mu    sync.Mutex
+	conns map[string]*sql.Conn
+}
+
+// advisoryLockID returns advisory lock identifier of given lock name.
+func advisoryLockID(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+func (l *postgresLocker) Acquire(ctx context.Context, name string, ttl time.Duration) (*surf.Lock, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, errors.Wrap(surf.ErrInternal, "cannot read random data: %s", err)
+	}
+	token := hex.EncodeToString(b)
+
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return nil, errors.Wrap(castPgErr(err), "cannot get connection")
+	}
+
+	var (
+		locked bool
+		fence  int64
+	)
+	err = conn.QueryRowContext(ctx, `
+		SELECT pg_try_advisory_lock($1), txid_current()
+	`, advisoryLockID(name)).Scan(&locked, &fence)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(castPgErr(err), "cannot acquire lock")
+	}
+	if !locked {
+		conn.Close()
+		return nil, surf.ErrLocked
+	}
+
+	l.mu.Lock()
+	l.conns[token] = conn
+	l.mu.Unlock()
+	return &surf.Lock{Name: name, Token: token, Fence: fence}, nil
+}
+
+func (l *postgresLocker) Release(ctx context.Context, lock *surf.Lock) error {
+	l.mu.Lock()
+	conn, ok := l.conns[lock.Token]
+	delete(l.conns, lock.Token)
+	l.mu.Unlock()
+	if !ok {
+		return surf.ErrLockLost
+	}
+	defer conn.Close()
+
+	var unlocked bool
+	err := conn.QueryRowContext(ctx, `
+		SELECT pg_advisory_unlock($1)
+	`, advisoryLockID(lock.Name)).Scan(&unlocked)
+	if err != nil {
+		// Lock is released when the session ends, so make sure the
+		// connection is not returned to the pool.
+		conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+		return errors.Wrap(castPgErr(err), "cannot release lock")
+	}
+	if !unlocked {
+		return surf.ErrLockLost
+	}
+	return nil
+}
+
+func (l *postgresLocker) Extend(ctx context.Context, lock *surf.Lock, ttl time.Duration) error {
+	l.mu.Lock()
+	conn, ok := l.conns[lock.Token]
+	l.mu.Unlock()
+	if !ok {
+		return surf.ErrLockLost
+	}
+
+	// Lock is held for as long as the session is alive.
+	if err := conn.PingContext(ctx); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		l.mu.Lock()
+		delete(l.conns, lock.Token)
+		l.mu.Unlock()
+		conn.Close()
+		return surf.ErrLockLost
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+package sqldb
+
+import (
+	"testing"
+
+	"github.com/go-surf/surf"
+)
+
+func TestPostgresLocker(t *testing.T) {
+	db, cleanup := EnsurePostgres(t, nil)
+	defer cleanup()
+
+	surf.RunLockerImplementationTest(t, NewPostgresLocker(db))
+}
@@ -0,0 +1,393 @@
+// Package surftest provides helpers for testing code that is using surf.
+package surftest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+)
+
+// Cache is a cache wrapper for tests. It records every call and can inject
+// errors, latency and misses into operations on keys matching a pattern.
+// If configured with a clock, values expire according to that clock instead
+// of real time.
+//
+// Batch operations are executed as a sequence of single key operations, so
+// that faults apply and calls are recorded for every key.
+//
+// Cache does not implement surf.CounterCache, so that wrapping a cache
+// without counters does not claim support for them. Use CounterCache to wrap
+// a cache with counters.
+//
+// Cache is safe for concurrent use.
+type Cache struct {
+	cache surf.CacheService
+	clock *Clock
+
+	mu     sync.Mutex
+	faults []*Fault
+	calls  []Call
+	// expireAt holds expiration time of keys written through the cache,
+	// if clock is used.
+	expireAt map[string]time.Time
+}
+
+// CacheOpts defines options for the test cache.
+type CacheOpts struct {
+	// Clock is used to expire values. If nil, values expire as decided
+	// by the wrapped cache.
+	Clock *Clock
+}
+
+// NewCache returns test cache wrapping given cache. If cache is nil, a new
+// local memory cache is used.
+func NewCache(cache surf.CacheService, o *CacheOpts) *Cache {
+	if cache == nil {
+		cache = surf.NewLocalMemCache()
+	}
+	if o == nil {
+		o = &CacheOpts{}
+	}
+	return &Cache{
+		cache:    cache,
+		clock:    o.Clock,
+		expireAt: make(map[string]time.Time),
+	}
+}
+
+// CounterCache is a test cache wrapping a surf.CounterCache. Its atomic
+// operations are recorded and faults apply to them as well.
+type CounterCache struct {
+	*Cache
+	counters surf.CounterCache
+}
+
+var _ surf.CounterCache = (*CounterCache)(nil)
+
+// NewCounterCache returns test cache wrapping given cache. If cache is nil,
+// a new local memory cache is used.
+func NewCounterCache(cache surf.CounterCache, o *CacheOpts) *CounterCache {
+	if cache == nil {
+		cache = surf.NewLocalMemCache()
+	}
+	return &CounterCache{
+		Cache:    NewCache(cache, o),
+		counters: cache,
+	}
+}
+
+// Fault describes a failure injected into cache operations.
+type Fault struct {
+	// Key is a pattern of keys the fault applies to. Star matches any
+	// sequence of characters. Empty pattern matches all keys.
+	Key string
+
+	// Ops are names of operations the fault applies to, for example
+	// "Get" or "SetNx". All operations if empty.
+	Ops []string
+
+	// Delay is waited before the operation. If the context is done
+	// first, its error is returned.
+	Delay time.Duration
+
+	// Err is returned instead of calling the wrapped cache.
+	Err error
+
+	// Miss makes Get return surf.ErrMiss instead of calling the wrapped
+	// cache. It is ignored by other operations.
+	Miss bool
+
+	// Times is the number of operations the fault applies to. Zero
+	// means no limit.
+	Times int
+}
+
+func (f *Fault) matches(op, key string) bool {
+	if len(f.Ops) > 0 {
+		var found bool
+		for _, name := range f.Ops {
+			if name == op {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return f.Key == "" || matchKey(f.Key, key)
+}
+
+// matchKey returns true if given key matches given pattern, in which star
+// matches any sequence of characters.
+func matchKey(pattern, key string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == '*' {
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if matchKey(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if key == "" || pattern[0] != key[0] {
+			return false
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return key == ""
+}
+
+// Inject adds given fault. When many faults match an operation, the one
+// injected first is used.
+func (c *Cache) Inject(f Fault) {
+	c.mu.Lock()
+	c.faults = append(c.faults, &f)
+	c.mu.Unlock()
+}
+
+// ClearFaults removes all injected faults.
+func (c *Cache) ClearFaults() {
+	c.mu.Lock()
+	c.faults = nil
+	c.mu.Unlock()
+}
+
+// Call describes a single operation done on the cache.
+type Call struct {
+	Op  string
+	Key string
+
+	// Value is the value written by Set, SetNx and CompareAndSwap or the
+	// delta of Incr.
+	Value interface{}
+
+	// Old is the value compared by CompareAndSwap.
+	Old interface{}
+
+	Exp time.Duration
+
+	// Err is the error returned by the operation.
+	Err error
+}
+
+// Calls returns recorded calls in the order they were completed. If any
+// operation names are given, only calls of these operations are returned.
+func (c *Cache) Calls(ops ...string) []Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	calls := make([]Call, 0, len(c.calls))
+	for _, call := range c.calls {
+		if len(ops) == 0 {
+			calls = append(calls, call)
+			continue
+		}
+		for _, op := range ops {
+			if call.Op == op {
+				calls = append(calls, call)
+				break
+			}
+		}
+	}
+	return calls
+}
+
+// ResetCalls removes all recorded calls.
+func (c *Cache) ResetCalls() {
+	c.mu.Lock()
+	c.calls = nil
+	c.mu.Unlock()
+}
+
+func (c *Cache) record(call Call) {
+	c.mu.Lock()
+	c.calls = append(c.calls, call)
+	c.mu.Unlock()
+}
+
+// fault returns fault that applies to given operation or nil.
+func (c *Cache) fault(op, key string) *Fault {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, f := range c.faults {
+		if !f.matches(op, key) {
+			continue
+		}
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				c.faults = append(c.faults[:i:i], c.faults[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+// before applies fault of given operation. If it returns true, the wrapped
+// cache must not be called and the returned error is the result.
+func (c *Cache) before(ctx context.Context, op, key string) (bool, error) {
+	f := c.fault(op, key)
+	if f != nil && f.Delay > 0 {
+		select {
+		case <-ctx.Done():
+			return true, ctx.Err()
+		case <-time.After(f.Delay):
+		}
+	}
+	switch {
+	case f == nil:
+	case f.Err != nil:
+		return true, f.Err
+	case f.Miss && op == "Get":
+		return true, surf.ErrMiss
+	}
+
+	if err := c.expire(ctx, key); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+// backendExp is the expiration time used with the wrapped cache when values
+// are expired using the clock.
+const backendExp = 24 * time.Hour
+
+// expire deletes value of given key from the wrapped cache if it expired
+// according to the clock.
+func (c *Cache) expire(ctx context.Context, key string) error {
+	if c.clock == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	expireAt, ok := c.expireAt[key]
+	expired := ok && !c.clock.Now().Before(expireAt)
+	if expired {
+		delete(c.expireAt, key)
+	}
+	c.mu.Unlock()
+
+	if !expired {
+		return nil
+	}
+	if err := c.cache.Del(ctx, key); err != nil && !surf.ErrMiss.Is(err) {
+		return errors.Wrap(err, "cannot delete expired value")
+	}
+	return nil
+}
+
+// written tracks expiration time of a value written with given
+// expiration. If keep is true, expiration time of a tracked value is not
+// changed.
+func (c *Cache) written(key string, exp time.Duration, keep bool) {
+	if c.clock == nil {
+		return
+	}
+	c.mu.Lock()
+	if _, ok := c.expireAt[key]; !ok || !keep {
+		c.expireAt[key] = c.clock.Now().Add(exp)
+	}
+	c.mu.Unlock()
+}
+
+func (c *Cache) backendExp(exp time.Duration) time.Duration {
+	if c.clock == nil {
+		return exp
+	}
+	return backendExp
+}
+
+// counterExp returns expiration passed to the wrapped cache when creating a
+// counter. Counter without expiration must not expire in the wrapped cache.
+func (c *Cache) counterExp(exp time.Duration) time.Duration {
+	if exp <= 0 {
+		return exp
+	}
+	return c.backendExp(exp)
+}
+
+func (c *Cache) Get(ctx context.Context, key string, dest interface{}) error {
+	skip, err := c.before(ctx, "Get", key)
+	if !skip {
+		err = c.cache.Get(ctx, key, dest)
+	}
+	c.record(Call{Op: "Get", Key: key, Err: err})
+	return err
+}
+
+func (c *Cache) Set(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	skip, err := c.before(ctx, "Set", key)
+	if !skip {
+		err = c.cache.Set(ctx, key, value, c.backendExp(exp))
+		if err == nil {
+			c.written(key, exp, false)
+		}
+	}
+	c.record(Call{Op: "Set", Key: key, Value: value, Exp: exp, Err: err})
+	return err
+}
+
+func (c *Cache) SetNx(ctx context.Context, key string, value interface{}, exp time.Duration) error {
+	skip, err := c.before(ctx, "SetNx", key)
+	if !skip {
+		err = c.cache.SetNx(ctx, key, value, c.backendExp(exp))
+		if err == nil {
+			c.written(key, exp, false)
+		}
+	}
+	c.record(Call{Op: "SetNx", Key: key, Value: value, Exp: exp, Err: err})
+	return err
+}
+
+func (c *Cache) Del(ctx context.Context, key string) error {
+	skip, err := c.before(ctx, "Del", key)
+	if !skip {
+		err = c.cache.Del(ctx, key)
+		if c.clock != nil {
+			c.mu.Lock()
+			delete(c.expireAt, key)
+			c.mu.Unlock()
+		}
+	}
+	c.record(Call{Op: "Del", Key: key, Err: err})
+	return err
+}
+
+func (c *CounterCache) Incr(ctx context.Context, key string, delta int64, exp time.Duration) (int64, error) {
+	var n int64
+	skip, err := c.before(ctx, "Incr", key)
+	if !skip {
+		n, err = c.counters.Incr(ctx, key, delta, c.counterExp(exp))
+		// Only a counter created by this call is tracked. Counter
+		// created without expiration never expires.
+		if err == nil && exp > 0 && n == delta {
+			c.written(key, exp, true)
+		}
+	}
+	c.record(Call{Op: "Incr", Key: key, Value: delta, Exp: exp, Err: err})
+	return n, err
+}
+
+func (c *CounterCache) CompareAndSwap(ctx context.Context, key string, old, value interface{}, exp time.Duration) error {
+	skip, err := c.before(ctx, "CompareAndSwap", key)
+	if !skip {
+		err = c.counters.CompareAndSwap(ctx, key, old, value, c.backendExp(exp))
+		if err == nil {
+			c.written(key, exp, false)
+		}
+	}
+	c.record(Call{Op: "CompareAndSwap", Key: key, Old: old, Value: value, Exp: exp, Err: err})
+	return err
+}
@@ -0,0 +1,312 @@
+package surftest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+)
+
+func TestCache(t *testing.T) {
+	clock := NewClock(time.Now())
+	surf.RunCacheConformanceTest(t, NewCache(nil, &CacheOpts{Clock: clock}), &surf.CacheCapabilities{
+		Advance: clock.Advance,
+	})
+}
+
+func TestCounterCache(t *testing.T) {
+	clock := NewClock(time.Now())
+	surf.RunCacheConformanceTest(t, NewCounterCache(nil, &CacheOpts{Clock: clock}), &surf.CacheCapabilities{
+		Counters: true,
+		Advance:  clock.Advance,
+	})
+}
+
+func TestCacheWithoutCounters(t *testing.T) {
+	var cache surf.CacheService = NewCache(surf.PrefixCache(surf.NewLocalMemCache(), "x"), nil)
+	if _, ok := cache.(surf.CounterCache); ok {
+		t.Fatal("want counters not supported")
+	}
+}
+
+func TestMatchKey(t *testing.T) {
+	cases := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"a", "a", true},
+		{"a", "ab", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "post:1", false},
+		{"*:lock", "user:1:lock", true},
+		{"*:lock", "user:1:lock:x", false},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"a**", "a", true},
+	}
+	for _, tc := range cases {
+		if got := matchKey(tc.pattern, tc.key); got != tc.want {
+			t.Errorf("%q matching %q: want %v", tc.pattern, tc.key, tc.want)
+		}
+	}
+}
+
+func TestCacheClockExpiration(t *testing.T) {
+	ctx := context.Background()
+	clock := NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	cache := NewCounterCache(nil, &CacheOpts{Clock: clock})
+
+	if err := cache.Set(ctx, "key", "value", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	var val string
+	clock.Advance(time.Minute - time.Nanosecond)
+	if err := cache.Get(ctx, "key", &val); err != nil || val != "value" {
+		t.Fatalf("want value, got %+v, %q", err, val)
+	}
+	clock.Advance(time.Nanosecond)
+	if err := cache.Get(ctx, "key", &val); err != surf.ErrMiss {
+		t.Fatalf("want ErrMiss, got %+v", err)
+	}
+
+	// expired value does not block SetNx and cannot be deleted
+	if err := cache.Set(ctx, "key", "value", time.Second); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	clock.Advance(time.Second)
+	if err := cache.Del(ctx, "key"); err != surf.ErrMiss {
+		t.Fatalf("want ErrMiss, got %+v", err)
+	}
+	if err := cache.Set(ctx, "key", "value", time.Second); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	clock.Advance(time.Second)
+	if err := cache.SetNx(ctx, "key", "new", time.Second); err != nil {
+		t.Fatalf("cannot set expired key: %s", err)
+	}
+
+	// counter keeps its expiration time
+	if _, err := cache.Incr(ctx, "counter", 1, time.Minute); err != nil {
+		t.Fatalf("cannot increment: %s", err)
+	}
+	clock.Advance(30 * time.Second)
+	if n, err := cache.Incr(ctx, "counter", 1, time.Minute); err != nil || n != 2 {
+		t.Fatalf("want 2, got %d, %+v", n, err)
+	}
+	clock.Advance(30 * time.Second)
+	if n, err := cache.Incr(ctx, "counter", 1, time.Minute); err != nil || n != 1 {
+		t.Fatalf("want counter expired, got %d, %+v", n, err)
+	}
+
+	// non-positive expiration makes value expire immediately
+	if err := cache.Set(ctx, "key", "value", 0); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	if err := cache.Get(ctx, "key", &val); err != surf.ErrMiss {
+		t.Fatalf("want ErrMiss, got %+v", err)
+	}
+}
+
+func TestCacheFaults(t *testing.T) {
+	ctx := context.Background()
+	cache := NewCache(nil, nil)
+	errBroken := errors.Wrap(surf.ErrInternal, "broken")
+
+	if err := cache.Set(ctx, "user:1", "bob", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+
+	cache.Inject(Fault{Key: "user:*", Ops: []string{"Get"}, Err: errBroken, Times: 2})
+	var val string
+	for i := 0; i < 2; i++ {
+		if err := cache.Get(ctx, "user:1", &val); err != errBroken {
+			t.Fatalf("%d: want injected error, got %+v", i, err)
+		}
+	}
+	if err := cache.Get(ctx, "user:1", &val); err != nil || val != "bob" {
+		t.Fatalf("want fault exhausted, got %+v, %q", err, val)
+	}
+	if err := cache.Set(ctx, "user:2", "alice", time.Minute); err != nil {
+		t.Fatalf("fault must not apply to other operations: %s", err)
+	}
+
+	cache.Inject(Fault{Key: "user:1", Miss: true})
+	if err := cache.Get(ctx, "user:1", &val); err != surf.ErrMiss {
+		t.Fatalf("want forced miss, got %+v", err)
+	}
+	if err := cache.Get(ctx, "user:2", &val); err != nil || val != "alice" {
+		t.Fatalf("want alice, got %+v, %q", err, val)
+	}
+	if err := cache.Del(ctx, "user:1"); err != nil {
+		t.Fatalf("miss must not apply to Del: %s", err)
+	}
+	cache.ClearFaults()
+
+	cache.Inject(Fault{Delay: 20 * time.Millisecond})
+	start := time.Now()
+	if err := cache.Get(ctx, "user:2", &val); err != nil {
+		t.Fatalf("cannot get: %s", err)
+	}
+	if took := time.Since(start); took < 20*time.Millisecond {
+		t.Fatalf("want delay, took %s", took)
+	}
+
+	cache.ClearFaults()
+	cache.Inject(Fault{Delay: time.Minute})
+	cancelled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := cache.Get(cancelled, "user:2", &val); err != context.DeadlineExceeded {
+		t.Fatalf("want deadline exceeded, got %+v", err)
+	}
+}
+
+func TestCacheCalls(t *testing.T) {
+	ctx := context.Background()
+	cache := NewCounterCache(nil, nil)
+
+	cache.Set(ctx, "a", 1, time.Minute)
+	var val int
+	cache.Get(ctx, "a", &val)
+	cache.Get(ctx, "b", &val)
+	cache.Incr(ctx, "a", 2, time.Minute)
+
+	calls := cache.Calls()
+	if len(calls) != 4 {
+		t.Fatalf("want 4 calls, got %+v", calls)
+	}
+	if c := calls[0]; c.Op != "Set" || c.Key != "a" || c.Value != 1 || c.Exp != time.Minute || c.Err != nil {
+		t.Fatalf("unexpected call: %+v", c)
+	}
+	if c := calls[3]; c.Op != "Incr" || c.Value != int64(2) {
+		t.Fatalf("unexpected call: %+v", c)
+	}
+
+	gets := cache.Calls("Get")
+	if len(gets) != 2 || gets[0].Err != nil || gets[1].Err != surf.ErrMiss {
+		t.Fatalf("unexpected Get calls: %+v", gets)
+	}
+
+	cache.ResetCalls()
+	if calls := cache.Calls(); len(calls) != 0 {
+		t.Fatalf("want no calls, got %+v", calls)
+	}
+}
+
+func TestCsrfCacheFailure(t *testing.T) {
+	cache := NewCache(nil, nil)
+	mw := surf.CsrfMiddleware(surf.NewUnboundCache(cache, "sid"), nil)
+	handler := mw(func(w http.ResponseWriter, r *http.Request) surf.Response {
+		return nil
+	})
+	serve := func() int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		if resp := handler.HandleHTTPRequest(w, r); resp != nil {
+			resp.ServeHTTP(w, r)
+		}
+		return w.Code
+	}
+
+	cache.Inject(Fault{Key: "*" + surf.CsrfKey, Ops: []string{"Get"}, Err: surf.ErrInternal, Times: 1})
+	if code := serve(); code != http.StatusForbidden {
+		t.Fatalf("want request rejected when token cannot be loaded, got %d", code)
+	}
+
+	// failing to store a new token does not fail the request
+	cache.Inject(Fault{Key: "*" + surf.CsrfKey, Ops: []string{"Set"}, Err: surf.ErrInternal, Times: 1})
+	if code := serve(); code != http.StatusOK {
+		t.Fatalf("want 200, got %d", code)
+	}
+	if calls := cache.Calls("Set"); len(calls) != 1 || calls[0].Err != surf.ErrInternal {
+		t.Fatalf("unexpected Set calls: %+v", calls)
+	}
+}
+
+func TestCsrfTokenExpiration(t *testing.T) {
+	clock := NewClock(time.Now())
+	cache := NewCache(nil, &CacheOpts{Clock: clock})
+	mw := surf.CsrfMiddlewareWithOpts(surf.NewUnboundCache(cache, "sid"), nil, &surf.CsrfOpts{
+		Lifetime: time.Hour,
+	})
+	var token string
+	handler := mw(func(w http.ResponseWriter, r *http.Request) surf.Response {
+		token = surf.CsrfToken(r.Context())
+		return nil
+	})
+	serve := func(method string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/", nil)
+		r.Header.Set("sid", "session")
+		r.Header.Set(surf.CsrfKey, token)
+		if resp := handler.HandleHTTPRequest(w, r); resp != nil {
+			resp.ServeHTTP(w, r)
+		}
+		return w.Code
+	}
+
+	if code := serve("GET"); code != http.StatusOK {
+		t.Fatalf("want 200, got %d", code)
+	}
+	clock.Advance(time.Hour - time.Second)
+	if code := serve("POST"); code != http.StatusOK {
+		t.Fatalf("want valid token accepted, got %d", code)
+	}
+	clock.Advance(time.Second)
+	if code := serve("POST"); code != http.StatusForbidden {
+		t.Fatalf("want expired token rejected, got %d", code)
+	}
+}
+
+func TestStampedeProtectLockContention(t *testing.T) {
+	ctx := context.Background()
+	cache := NewCache(nil, nil)
+	protected := surf.StampedeProtect(cache)
+
+	// Computation lock is held by another client for the first three
+	// attempts.
+	cache.Inject(Fault{Key: "*:stampedelock", Ops: []string{"SetNx"}, Err: surf.ErrConflict, Times: 3})
+
+	var val string
+	if err := protected.Get(ctx, "key", &val); err != surf.ErrMiss {
+		t.Fatalf("want miss once lock is acquired, got %+v", err)
+	}
+	if n := len(cache.Calls("SetNx")); n != 4 {
+		t.Fatalf("want 4 lock attempts, got %d", n)
+	}
+
+	// Waiting for the value stops when the context is done.
+	cache.Inject(Fault{Key: "*:stampedelock", Ops: []string{"SetNx"}, Err: surf.ErrConflict})
+	timeout, cancel := context.WithTimeout(ctx, 60*time.Millisecond)
+	defer cancel()
+	if err := protected.Get(timeout, "key", &val); err != context.DeadlineExceeded {
+		t.Fatalf("want deadline exceeded, got %+v", err)
+	}
+
+	// Lock is still held by another client, so waiting client gets the
+	// value once that client computes it.
+	cache.ResetCalls()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var val string
+		if err := protected.Get(ctx, "key", &val); err != nil || val != "computed" {
+			t.Errorf("want computed value, got %+v, %q", err, val)
+		}
+	}()
+	for len(cache.Calls("SetNx")) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := protected.Set(ctx, "key", "computed", time.Minute); err != nil {
+		t.Fatalf("cannot set: %s", err)
+	}
+	wg.Wait()
+}